@@ -0,0 +1,278 @@
+package auth
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/limoges/p2pnet"
+)
+
+// The authentication events recorded in the audit log.
+const (
+	AuditHandshakeStarted   = "handshake_started"
+	AuditHandshakeSucceeded = "handshake_succeeded"
+	AuditHandshakeDeclined  = "handshake_declined"
+	AuditDecryptionFailed   = "decryption_failed"
+	AuditSessionClosed      = "session_closed"
+)
+
+// The extension of the file holding the sequence number and hash of the
+// latest record, signed with the hostkey. It allows the detection of a
+// truncated or rewritten log by anyone without the hostkey.
+const auditHeadExtension = ".head"
+
+var (
+	ErrAuditLogTampered  = errors.New("The audit log has been tampered with")
+	ErrAuditLogTruncated = errors.New("The audit log has been truncated")
+)
+
+// AuditRecord is a single line of the audit log. Each record includes the
+// hash of the previous one, chaining the records together.
+type AuditRecord struct {
+	Sequence  uint64          `json:"seq"`
+	Time      string          `json:"time"`
+	Event     string          `json:"event"`
+	SessionId uint32          `json:"session_id"`
+	Identity  p2pnet.Identity `json:"identity,omitempty"`
+	Remote    p2pnet.Identity `json:"remote,omitempty"`
+	Detail    string          `json:"detail,omitempty"`
+	Previous  string          `json:"prev"`
+	Hash      string          `json:"hash"`
+}
+
+// AuditLog is an append-only, hash-chained log of JSON lines.
+type AuditLog struct {
+	path     string
+	file     *os.File
+	sequence uint64
+	previous string
+	key      *rsa.PrivateKey
+	clock    p2pnet.Clock
+	lock     sync.Mutex
+}
+
+// OpenAuditLog opens the log for appending. The head is signed with the
+// key. An existing log is verified first, so that records are never chained
+// to a tampered history.
+func OpenAuditLog(path string, key *rsa.PrivateKey, clock p2pnet.Clock) (*AuditLog, error) {
+
+	var audit *AuditLog
+	var last *AuditRecord
+	var err error
+
+	audit = &AuditLog{path: path, key: key, clock: clock}
+	audit.previous = genesisHash()
+
+	if _, err = os.Stat(path); err == nil {
+		if last, _, err = verifyAuditLog(path, &key.PublicKey); err != nil {
+			return nil, err
+		}
+		if last != nil {
+			audit.sequence = last.Sequence + 1
+			audit.previous = last.Hash
+		}
+	}
+
+	if audit.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+		return nil, err
+	}
+	return audit, nil
+}
+
+// Record appends an event to the log.
+func (l *AuditLog) Record(event string, sessionId uint32, identity, remote p2pnet.Identity, detail string) error {
+
+	var record AuditRecord
+	var line []byte
+	var err error
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	record = AuditRecord{
+		Sequence:  l.sequence,
+		Time:      l.clock.Now().UTC().Format(time.RFC3339Nano),
+		Event:     event,
+		SessionId: sessionId,
+		Identity:  identity,
+		Remote:    remote,
+		Detail:    detail,
+		Previous:  l.previous,
+	}
+	if record.Hash, err = hashRecord(record); err != nil {
+		return err
+	}
+
+	if line, err = json.Marshal(record); err != nil {
+		return err
+	}
+	if _, err = l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err = l.file.Sync(); err != nil {
+		return err
+	}
+
+	// The record is in the log, so the next one is chained to it even if the
+	// head is not updated. The head of the next record covers it again.
+	l.sequence = record.Sequence + 1
+	l.previous = record.Hash
+	return writeAuditHead(l.path, l.key, record)
+}
+
+func (l *AuditLog) Close() error {
+	return l.file.Close()
+}
+
+// VerifyAuditLog checks the hash chain of the log, and that its last record
+// matches the head file signed by the owner of the public key. It returns the
+// number of records verified.
+func VerifyAuditLog(path string, pub *rsa.PublicKey) (int, error) {
+
+	var count int
+	var err error
+
+	_, count, err = verifyAuditLog(path, pub)
+	return count, err
+}
+
+func verifyAuditLog(path string, pub *rsa.PublicKey) (*AuditRecord, int, error) {
+
+	var file *os.File
+	var scanner *bufio.Scanner
+	var record *AuditRecord
+	var previous string
+	var expected string
+	var count int
+	var err error
+
+	if file, err = os.Open(path); err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	previous = genesisHash()
+	scanner = bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 4096), 1024*1024)
+	for scanner.Scan() {
+		record = &AuditRecord{}
+		if err = json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return nil, count, fmt.Errorf("%v: record %v: %v", ErrAuditLogTampered, count, err)
+		}
+		if record.Sequence != uint64(count) || record.Previous != previous {
+			return nil, count, fmt.Errorf("%v: record %v is out of sequence", ErrAuditLogTampered, count)
+		}
+		if expected, err = hashRecord(*record); err != nil {
+			return nil, count, err
+		}
+		if expected != record.Hash {
+			return nil, count, fmt.Errorf("%v: record %v does not match its hash", ErrAuditLogTampered, count)
+		}
+		previous = record.Hash
+		count = count + 1
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, count, err
+	}
+
+	if err = checkAuditHead(path, pub, record); err != nil {
+		return nil, count, err
+	}
+	return record, count, nil
+}
+
+// The hash covers the previous record's hash and every field of the record
+// but its own hash.
+func hashRecord(record AuditRecord) (string, error) {
+
+	var data []byte
+	var sum [sha256.Size]byte
+	var err error
+
+	record.Hash = ""
+	if data, err = json.Marshal(record); err != nil {
+		return "", err
+	}
+	sum = sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func genesisHash() string {
+	return strings.Repeat("0", 2*sha256.Size)
+}
+
+// auditHeadContent is the part of the head covered by its signature.
+func auditHeadContent(sequence uint64, hash string) []byte {
+	return []byte(fmt.Sprintf("%v %v", sequence, hash))
+}
+
+// The head is replaced atomically so that it always describes a complete
+// record. Without the hostkey, the chain cannot be rewritten to match it.
+func writeAuditHead(path string, key *rsa.PrivateKey, record AuditRecord) error {
+
+	var digest [sha256.Size]byte
+	var signature []byte
+	var head string
+	var temporary string
+	var err error
+
+	digest = sha256.Sum256(auditHeadContent(record.Sequence, record.Hash))
+	if signature, err = rsa.SignPKCS1v15(nil, key, crypto.SHA256, digest[:]); err != nil {
+		return err
+	}
+
+	head = fmt.Sprintf("%v %v %v\n", record.Sequence, record.Hash, hex.EncodeToString(signature))
+	temporary = path + auditHeadExtension + ".tmp"
+	if err = ioutil.WriteFile(temporary, []byte(head), 0600); err != nil {
+		return err
+	}
+	return os.Rename(temporary, path+auditHeadExtension)
+}
+
+func checkAuditHead(path string, pub *rsa.PublicKey, last *AuditRecord) error {
+
+	var data []byte
+	var fields []string
+	var sequence uint64
+	var digest [sha256.Size]byte
+	var signature []byte
+	var err error
+
+	if data, err = ioutil.ReadFile(path + auditHeadExtension); err != nil {
+		if os.IsNotExist(err) && last == nil {
+			return nil
+		}
+		return ErrAuditLogTruncated
+	}
+
+	fields = strings.Fields(string(data))
+	if len(fields) != 3 {
+		return ErrAuditLogTampered
+	}
+	if sequence, err = strconv.ParseUint(fields[0], 10, 64); err != nil {
+		return ErrAuditLogTampered
+	}
+	if signature, err = hex.DecodeString(fields[2]); err != nil {
+		return ErrAuditLogTampered
+	}
+	digest = sha256.Sum256(auditHeadContent(sequence, fields[1]))
+	if err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature); err != nil {
+		return ErrAuditLogTampered
+	}
+	if last == nil || last.Sequence != sequence || last.Hash != fields[1] {
+		return ErrAuditLogTruncated
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/rsa"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/limoges/p2pnet"
+	"github.com/limoges/p2pnet/msg"
+)
+
+func readTestKey(t *testing.T, name string) *rsa.PrivateKey {
+
+	var priv *rsa.PrivateKey
+	var err error
+
+	if priv, err = ReadPEMPrivateKey(filepath.Join("..", "main", "keys", name)); err != nil {
+		t.Fatal(err)
+	}
+	return priv
+}
+
+func writeTestAuditLog(t *testing.T, path string, key *rsa.PrivateKey, count int) {
+
+	var audit *AuditLog
+	var err error
+
+	if audit, err = OpenAuditLog(path, key, p2pnet.SystemClock{}); err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+
+	for i := 0; i < count; i++ {
+		if err = audit.Record(AuditHandshakeStarted, uint32(i), "local", "remote", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readAuditEvents returns the events of the log, in order.
+func readAuditEvents(t *testing.T, path string) []string {
+
+	var file *os.File
+	var scanner *bufio.Scanner
+	var events []string
+	var err error
+
+	if file, err = os.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	scanner = bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record AuditRecord
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, record.Event)
+	}
+	return events
+}
+
+// rewriteAuditLog changes the detail of every record, and chains the records
+// again as someone able to write the log would.
+func rewriteAuditLog(t *testing.T, path string) AuditRecord {
+
+	var data []byte
+	var lines []string
+	var record AuditRecord
+	var line []byte
+	var err error
+
+	if data, err = os.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	record.Hash = genesisHash()
+	lines = strings.Split(strings.TrimSpace(string(data)), "\n")
+	for i := range lines {
+		previous := record.Hash
+		record = AuditRecord{}
+		if err = json.Unmarshal([]byte(lines[i]), &record); err != nil {
+			t.Fatal(err)
+		}
+		record.Detail = "rewritten"
+		record.Previous = previous
+		if record.Hash, err = hashRecord(record); err != nil {
+			t.Fatal(err)
+		}
+		if line, err = json.Marshal(record); err != nil {
+			t.Fatal(err)
+		}
+		lines[i] = string(line)
+	}
+
+	if err = os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestAuditLog(t *testing.T) {
+
+	var key, other *rsa.PrivateKey
+	var path string
+	var data []byte
+	var lines []string
+	var count int
+	var err error
+
+	key = readTestKey(t, "peer0.pem")
+	other = readTestKey(t, "peer1.pem")
+	path = filepath.Join(t.TempDir(), "audit.log")
+
+	writeTestAuditLog(t, path, key, 3)
+	writeTestAuditLog(t, path, key, 1)
+	if count, err = VerifyAuditLog(path, &key.PublicKey); err != nil || count != 4 {
+		t.Fatalf("verified %v records: %v", count, err)
+	}
+	if _, err = VerifyAuditLog(path, &other.PublicKey); err == nil {
+		t.Fatal("the head verified with another hostkey")
+	}
+
+	if data, err = os.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	lines = strings.SplitAfter(string(data), "\n")
+
+	t.Run("truncated", func(t *testing.T) {
+		os.WriteFile(path, []byte(strings.Join(lines[:3], "")), 0600)
+		if _, err := VerifyAuditLog(path, &key.PublicKey); err == nil {
+			t.Fatal("the truncation was not detected")
+		}
+	})
+
+	t.Run("edited", func(t *testing.T) {
+		os.WriteFile(path, []byte(strings.Replace(string(data), `"session_id":2`, `"session_id":7`, 1)), 0600)
+		if _, err := VerifyAuditLog(path, &key.PublicKey); err == nil {
+			t.Fatal("the edit was not detected")
+		}
+	})
+
+	t.Run("rechained", func(t *testing.T) {
+		os.WriteFile(path, data, 0600)
+		last := rewriteAuditLog(t, path)
+		if _, err := VerifyAuditLog(path, &key.PublicKey); err == nil {
+			t.Fatal("the rewritten log matched the old head")
+		}
+		// A head signed with another key is not accepted either.
+		if err := writeAuditHead(path, other, last); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := VerifyAuditLog(path, &key.PublicKey); err == nil {
+			t.Fatal("the rewritten log verified with a forged head")
+		}
+	})
+}
+
+// The module records the handshakes, the failures to decrypt and the
+// closing of its sessions.
+func TestAuditEvents(t *testing.T) {
+
+	var path string
+	var initiator, responder *Auth
+	var local *Session
+	var err error
+
+	path = filepath.Join(t.TempDir(), "audit.log")
+	initiator = newTestAuth(t, "peer0")
+	responder = newTestAuth(t, "peer1")
+	if initiator.Audit, err = OpenAuditLog(path, initiator.PrivateKey, initiator.clock); err != nil {
+		t.Fatal(err)
+	}
+
+	local, _ = handshake(t, initiator, initiator.DefaultIdentity(), responder, testHostkey(t, responder, responder.DefaultIdentity()))
+
+	// The garbage does not decrypt.
+	err = initiator.handleLayerDecrypt(nil, msg.AuthLayerDecrypt{
+		Layers:           1,
+		SessionIds:       []uint32{local.Id},
+		EncryptedPayload: make([]byte, 64),
+	})
+	if err == nil {
+		t.Fatal("decrypted garbage")
+	}
+
+	initiator.CloseSession(local.Id)
+	initiator.Audit.Close()
+
+	expected := []string{AuditHandshakeStarted, AuditHandshakeSucceeded, AuditDecryptionFailed, AuditSessionClosed}
+	if events := readAuditEvents(t, path); strings.Join(events, " ") != strings.Join(expected, " ") {
+		t.Fatalf("recorded %v instead of %v", events, expected)
+	}
+	if _, err = VerifyAuditLog(path, &initiator.PrivateKey.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A record whose head could not be written stays in the chain, and the next
+// record follows it.
+func TestAuditHeadFailure(t *testing.T) {
+
+	var key *rsa.PrivateKey
+	var path, temporary string
+	var audit *AuditLog
+	var count int
+	var err error
+
+	key = readTestKey(t, "peer0.pem")
+	path = filepath.Join(t.TempDir(), "audit.log")
+	if audit, err = OpenAuditLog(path, key, p2pnet.SystemClock{}); err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+
+	// The head cannot be replaced while a directory is in the way.
+	temporary = path + auditHeadExtension + ".tmp"
+	if err = os.Mkdir(temporary, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = audit.Record(AuditHandshakeStarted, 1, "", "", ""); err == nil {
+		t.Fatal("the head was written")
+	}
+	if err = os.Remove(temporary); err != nil {
+		t.Fatal(err)
+	}
+	if err = audit.Record(AuditHandshakeSucceeded, 1, "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if count, err = VerifyAuditLog(path, &key.PublicKey); err != nil || count != 2 {
+		t.Fatalf("verified %v records: %v", count, err)
+	}
+}
@@ -11,6 +11,9 @@ import (
 	"errors"
 	"hash"
 	"io"
+	"math/big"
+
+	"github.com/limoges/p2pnet"
 )
 
 const (
@@ -25,12 +28,12 @@ type Encryption struct {
 	PrivateKey *rsa.PrivateKey
 }
 
-func GenerateKey() (*rsa.PrivateKey, error) {
+func GenerateKey(random io.Reader) (*rsa.PrivateKey, error) {
 
 	var priv *rsa.PrivateKey
 	var err error
 
-	if priv, err = rsa.GenerateKey(rand.Reader, DefaultAsymmetricKeyLengthInBits); err != nil {
+	if priv, err = rsa.GenerateKey(random, DefaultAsymmetricKeyLengthInBits); err != nil {
 		return nil, err
 	}
 
@@ -51,6 +54,18 @@ func MarshalPublicKey(pub *rsa.PublicKey) ([]byte, error) {
 	return derBytes, err
 }
 
+// PublicKeyIdentity returns the identity of the hostkey of the public key.
+func PublicKeyIdentity(pub *rsa.PublicKey) (p2pnet.Identity, error) {
+
+	var derBytes []byte
+	var err error
+
+	if derBytes, err = MarshalPublicKey(pub); err != nil {
+		return "", err
+	}
+	return p2pnet.GetIdentity(derBytes), nil
+}
+
 func ParsePublicKey(derBytes []byte) (*rsa.PublicKey, error) {
 
 	var pub *rsa.PublicKey
@@ -71,14 +86,14 @@ func ParsePublicKey(derBytes []byte) (*rsa.PublicKey, error) {
 	return pub, nil
 }
 
-func GenerateNewSymmetricKey() ([]byte, error) {
+func GenerateNewSymmetricKey(random io.Reader) ([]byte, error) {
 
 	var key []byte
 	var err error
 
 	key = make([]byte, DefaultSymmetricKeyLengthInBytes)
 
-	if _, err = rand.Read(key); err != nil {
+	if _, err = io.ReadFull(random, key); err != nil {
 		return nil, err
 	}
 	return key, nil
@@ -103,7 +118,7 @@ func ComputeMAC(message, key []byte) []byte {
 	return mac.Sum(nil)
 }
 
-func EncryptAES(key, plaintext []byte) ([]byte, error) {
+func EncryptAES(random io.Reader, key, plaintext []byte) ([]byte, error) {
 
 	var block cipher.Block
 	var ciphertext []byte
@@ -119,7 +134,7 @@ func EncryptAES(key, plaintext []byte) ([]byte, error) {
 	ciphertext = make([]byte, aes.BlockSize+len(plaintext))
 
 	iv = ciphertext[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+	if _, err := io.ReadFull(random, iv); err != nil {
 		return nil, err
 	}
 
@@ -148,9 +163,50 @@ func DecryptAES(key, ciphertext []byte) ([]byte, error) {
 	return ciphertext, nil
 }
 
-func EncryptPKCS(pub *rsa.PublicKey, msg []byte) ([]byte, error) {
+func EncryptPKCS(random io.Reader, pub *rsa.PublicKey, msg []byte) ([]byte, error) {
+
+	return rsa.EncryptPKCS1v15(random, pub, msg)
+}
+
+// encryptPKCSWithReader implements the PKCS #1 v1.5 encryption scheme,
+// drawing the padding from the given reader. The standard library ignores any
+// source of randomness but the system's, which would make handshakes
+// impossible to reproduce. It is only used with seeded Sources.
+func encryptPKCSWithReader(random io.Reader, pub *rsa.PublicKey, msg []byte) ([]byte, error) {
+
+	var k int
+	var em []byte
+	var ps []byte
+	var m, c *big.Int
+	var encrypted []byte
+
+	k = pub.Size()
+	if len(msg) > k-11 {
+		return nil, rsa.ErrMessageTooLong
+	}
+
+	// EM = 0x00 || 0x02 || PS || 0x00 || M, where PS is non-zero.
+	em = make([]byte, k)
+	em[1] = 2
+	ps = em[2 : k-len(msg)-1]
+	if _, err := io.ReadFull(random, ps); err != nil {
+		return nil, err
+	}
+	for i := range ps {
+		for ps[i] == 0 {
+			if _, err := io.ReadFull(random, ps[i:i+1]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	copy(em[k-len(msg):], msg)
+
+	m = new(big.Int).SetBytes(em)
+	c = new(big.Int).Exp(m, big.NewInt(int64(pub.E)), pub.N)
 
-	return rsa.EncryptPKCS1v15(rand.Reader, pub, msg)
+	encrypted = make([]byte, k)
+	c.FillBytes(encrypted)
+	return encrypted, nil
 }
 
 func DecryptPKCS(priv *rsa.PrivateKey, ciphertext []byte) ([]byte, error) {
@@ -158,12 +214,12 @@ func DecryptPKCS(priv *rsa.PrivateKey, ciphertext []byte) ([]byte, error) {
 	return rsa.DecryptPKCS1v15(rand.Reader, priv, ciphertext)
 }
 
-func EncryptAESWithHMAC(plaintext, secret, hmac []byte) ([]byte, error) {
+func EncryptAESWithHMAC(random io.Reader, plaintext, secret, hmac []byte) ([]byte, error) {
 
 	var ciphertext, signature, encrypted []byte
 	var err error
 
-	if ciphertext, err = EncryptAES(secret, plaintext); err != nil {
+	if ciphertext, err = EncryptAES(random, secret, plaintext); err != nil {
 		return nil, err
 	}
 
@@ -186,6 +242,11 @@ func DecryptAESWithHMAC(encrypted, secret, hmac []byte) ([]byte, error) {
 	var ciphertext, signature []byte
 	var valid bool
 
+	// Payloads relayed from other peers may be of any length.
+	if len(encrypted) < 32+aes.BlockSize {
+		return nil, errors.New("Encrypted message is too short.")
+	}
+
 	signature = encrypted[:32]
 	ciphertext = make([]byte, len(encrypted[32:]))
 	copy(ciphertext, encrypted[32:])
@@ -49,6 +49,33 @@ func ReadPEMPrivateKey(filepath string) (*rsa.PrivateKey, error) {
 	return priv, nil
 }
 
+// Read the public key from a PEM-formatted file. It is either a public key
+// block, or the public part of a private key block.
+func ReadPEMPublicKey(filepath string) (*rsa.PublicKey, error) {
+
+	var data []byte
+	var block *pem.Block
+	var priv *rsa.PrivateKey
+	var err error
+
+	if data, err = ioutil.ReadFile(filepath); err != nil {
+		return nil, err
+	}
+
+	for block, data = pem.Decode(data); block != nil; block, data = pem.Decode(data) {
+		switch block.Type {
+		case "PUBLIC KEY":
+			return ParsePublicKey(block.Bytes)
+		case RSAPrivateKeyType:
+			if priv, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+				return nil, err
+			}
+			return &priv.PublicKey, nil
+		}
+	}
+	return nil, ErrNoBlockFound
+}
+
 func GetPublicKeyAsDER(pub *rsa.PublicKey) ([]byte, error) {
 	return x509.MarshalPKIXPublicKey(pub)
 }
@@ -0,0 +1,238 @@
+package auth
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/mlkem"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"github.com/limoges/p2pnet/msg"
+)
+
+const (
+	// HybridSymmetricKeyLengthInBytes is the length of the session keys
+	// derived by the hybrid handshake. Using AES-256 keeps a sufficient
+	// security margin against quantum adversaries.
+	HybridSymmetricKeyLengthInBytes = 32
+	// hybridKeyInfo binds the derived keys to their purpose.
+	hybridKeyInfo = "p2pnet hybrid session key"
+)
+
+var (
+	ErrHybridRequired = errors.New("The hybrid key exchange is required")
+	ErrNoHybridOffer  = errors.New("The session did not offer a hybrid key exchange")
+)
+
+// hybridOffer holds the ephemeral keys of an initiator waiting for the
+// response to its hybrid handshake.
+type hybridOffer struct {
+	x25519 *ecdh.PrivateKey
+	mlkem  *mlkem.DecapsulationKey768
+}
+
+func (s *Session) CreateHybridHandshake1(pub *rsa.PublicKey) (*msg.AuthSessionHS1, error) {
+
+	var handshake1 *msg.AuthHandshake1
+	var hybrid msg.AuthHandshake1Hybrid
+	var offer *hybridOffer
+	var payload []byte
+	var err error
+
+	if handshake1, err = s.buildHandshake1(pub); err != nil {
+		return nil, err
+	}
+
+	if offer, err = newHybridOffer(s.random); err != nil {
+		return nil, err
+	}
+
+	hybrid = msg.AuthHandshake1Hybrid{
+		Target:        handshake1.Target,
+		EncryptedKey:  handshake1.EncryptedKey,
+		EncryptedHMAC: handshake1.EncryptedHMAC,
+	}
+	copy(hybrid.X25519Key[:], offer.x25519.PublicKey().Bytes())
+	copy(hybrid.MLKEMKey[:], offer.mlkem.EncapsulationKey().Bytes())
+
+	if payload, err = buildPayload(hybrid); err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	s.hybrid = offer
+	s.lock.Unlock()
+
+	return &msg.AuthSessionHS1{
+		SessionId:        s.Id,
+		HandshakePayload: payload,
+	}, nil
+}
+
+// CreateHybridHandshake2 answers a hybrid offer. The session key, which
+// was transported with RSA, is replaced by a key derived from the RSA,
+// X25519 and ML-KEM-768 shared secrets.
+func (s *Session) CreateHybridHandshake2(pub *rsa.PublicKey, offer *msg.AuthHandshake1Hybrid) (*msg.AuthSessionHS2, error) {
+
+	var encryptedHMAC []byte
+	var ephemeral *ecdh.PrivateKey
+	var remote *ecdh.PublicKey
+	var encapsulationKey *mlkem.EncapsulationKey768
+	var classical, quantum, ciphertext []byte
+	var handshake2 msg.AuthHandshake2Hybrid
+	var payload []byte
+	var err error
+
+	if encryptedHMAC, err = s.encryptPKCS(pub, s.LocalHMAC); err != nil {
+		return nil, err
+	}
+
+	if ephemeral, err = newX25519Key(s.random); err != nil {
+		return nil, err
+	}
+	if remote, err = ecdh.X25519().NewPublicKey(offer.X25519Key[:]); err != nil {
+		return nil, err
+	}
+	if classical, err = ephemeral.ECDH(remote); err != nil {
+		return nil, err
+	}
+
+	if encapsulationKey, err = mlkem.NewEncapsulationKey768(offer.MLKEMKey[:]); err != nil {
+		return nil, err
+	}
+	quantum, ciphertext = encapsulationKey.Encapsulate()
+
+	handshake2 = msg.AuthHandshake2Hybrid{}
+	copy(handshake2.EncryptedHMAC[:], encryptedHMAC)
+	copy(handshake2.X25519Key[:], ephemeral.PublicKey().Bytes())
+	copy(handshake2.MLKEMCiphertext[:], ciphertext)
+
+	s.lock.Lock()
+	s.SharedKey, err = deriveHybridKey(s.SharedKey, classical, quantum,
+		offer.X25519Key[:], handshake2.X25519Key[:], ciphertext)
+	if err == nil {
+		s.CipherSuite = CipherSuiteHybrid
+	}
+	s.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if payload, err = buildPayload(handshake2); err != nil {
+		return nil, err
+	}
+
+	return &msg.AuthSessionHS2{
+		SessionId:        s.Id,
+		HandshakePayload: payload,
+	}, nil
+}
+
+// AcceptHybridHandshake2 completes the hybrid exchange on the initiator's
+// side and derives the session key.
+func (s *Session) AcceptHybridHandshake2(handshake2 *msg.AuthHandshake2Hybrid) error {
+
+	var offer *hybridOffer
+	var remote *ecdh.PublicKey
+	var classical, quantum []byte
+	var err error
+
+	s.lock.Lock()
+	offer = s.hybrid
+	s.lock.Unlock()
+
+	if offer == nil {
+		return ErrNoHybridOffer
+	}
+
+	if err = s.DecryptRemoteHMAC(s.LocalKey, handshake2.EncryptedHMAC[:]); err != nil {
+		return err
+	}
+
+	if remote, err = ecdh.X25519().NewPublicKey(handshake2.X25519Key[:]); err != nil {
+		return err
+	}
+	if classical, err = offer.x25519.ECDH(remote); err != nil {
+		return err
+	}
+	if quantum, err = offer.mlkem.Decapsulate(handshake2.MLKEMCiphertext[:]); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.SharedKey, err = deriveHybridKey(s.SharedKey, classical, quantum,
+		offer.x25519.PublicKey().Bytes(), handshake2.X25519Key[:],
+		handshake2.MLKEMCiphertext[:]); err != nil {
+		return err
+	}
+	s.CipherSuite = CipherSuiteHybrid
+	s.hybrid = nil
+	return nil
+}
+
+// declineHybrid forgets our hybrid offer once the peer answered without it.
+func (s *Session) declineHybrid() {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.hybrid = nil
+}
+
+// The X25519 and ML-KEM keys are derived from the session's source of
+// randomness. ML-KEM encapsulation always uses the system's randomness.
+func newHybridOffer(random io.Reader) (*hybridOffer, error) {
+
+	var offer *hybridOffer
+	var seed []byte
+	var err error
+
+	offer = &hybridOffer{}
+	if offer.x25519, err = newX25519Key(random); err != nil {
+		return nil, err
+	}
+
+	seed = make([]byte, mlkem.SeedSize)
+	if _, err = io.ReadFull(random, seed); err != nil {
+		return nil, err
+	}
+	if offer.mlkem, err = mlkem.NewDecapsulationKey768(seed); err != nil {
+		return nil, err
+	}
+	return offer, nil
+}
+
+func newX25519Key(random io.Reader) (*ecdh.PrivateKey, error) {
+
+	var key []byte
+
+	key = make([]byte, msg.X25519KeyLength)
+	if _, err := io.ReadFull(random, key); err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPrivateKey(key)
+}
+
+// deriveHybridKey combines the three shared secrets. The session stays
+// confidential as long as any one of them is not broken. The ephemeral
+// public values are used as salt to bind the key to the exchange.
+func deriveHybridKey(transported, classical, quantum, initiatorKey, responderKey, ciphertext []byte) ([]byte, error) {
+
+	var secret []byte
+	var transcript [sha256.Size]byte
+
+	secret = make([]byte, 0, len(transported)+len(classical)+len(quantum))
+	secret = append(secret, transported...)
+	secret = append(secret, classical...)
+	secret = append(secret, quantum...)
+
+	transcript = sha256.Sum256(append(append(append([]byte{},
+		initiatorKey...), responderKey...), ciphertext...))
+
+	return hkdf.Key(sha256.New, secret, transcript[:], hybridKeyInfo,
+		HybridSymmetricKeyLengthInBytes)
+}
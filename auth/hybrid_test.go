@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"testing"
+)
+
+// Each pair of key exchange settings agrees on a cipher suite, or the peer
+// requiring the hybrid exchange declines.
+func TestKeyExchangeNegotiation(t *testing.T) {
+
+	tests := []struct {
+		initiator, responder string
+		suite                uint16
+		// The error of the responder on the first handshake, and of the
+		// initiator on the second.
+		responderErr, initiatorErr error
+	}{
+		{KeyExchangeRSA, KeyExchangeRSA, CipherSuiteRSA, nil, nil},
+		{KeyExchangeRSA, KeyExchangeHybrid, CipherSuiteRSA, nil, nil},
+		{KeyExchangeRSA, KeyExchangeHybridOnly, 0, ErrHybridRequired, nil},
+		{KeyExchangeHybrid, KeyExchangeRSA, CipherSuiteRSA, nil, nil},
+		{KeyExchangeHybrid, KeyExchangeHybrid, CipherSuiteHybrid, nil, nil},
+		{KeyExchangeHybrid, KeyExchangeHybridOnly, CipherSuiteHybrid, nil, nil},
+		{KeyExchangeHybridOnly, KeyExchangeRSA, 0, nil, ErrHybridRequired},
+		{KeyExchangeHybridOnly, KeyExchangeHybrid, CipherSuiteHybrid, nil, nil},
+		{KeyExchangeHybridOnly, KeyExchangeHybridOnly, CipherSuiteHybrid, nil, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.initiator+"/"+test.responder, func(t *testing.T) {
+
+			initiator := newTestAuth(t, "peer0")
+			responder := newTestAuth(t, "peer1")
+			initiator.KeyExchange = test.initiator
+			responder.KeyExchange = test.responder
+
+			hs1, err := initiator.StartSession(testHostkey(t, responder, responder.DefaultIdentity()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			hs2, err := responder.IncomingHandshake1(testHostkey(t, initiator, initiator.DefaultIdentity()), hs1.HandshakePayload)
+			if err != test.responderErr {
+				t.Fatalf("expected %v from the responder, got %v", test.responderErr, err)
+			}
+			if err != nil {
+				return
+			}
+			err = initiator.IncomingHandshake2(hs1.SessionId, hs2.HandshakePayload)
+			if err != test.initiatorErr {
+				t.Fatalf("expected %v from the initiator, got %v", test.initiatorErr, err)
+			}
+			if _, present := initiator.Sessions[hs1.SessionId]; err != nil && present {
+				t.Fatal("the declined session was kept")
+			}
+			if err != nil {
+				return
+			}
+
+			local, remote := initiator.Sessions[hs1.SessionId], responder.Sessions[hs2.SessionId]
+			if local.CipherSuite != test.suite || remote.CipherSuite != test.suite {
+				t.Fatalf("the sessions use the suites %v and %v instead of %v", local.CipherSuite, remote.CipherSuite, test.suite)
+			}
+			exchange(t, local, remote)
+			exchange(t, remote, local)
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	"github.com/limoges/p2pnet"
+	"github.com/limoges/p2pnet/msg"
+)
+
+// SessionInfo is a snapshot of the state of a session.
+type SessionInfo struct {
+	Id             uint32
+	LocalIdentity  p2pnet.Identity
+	RemoteIdentity p2pnet.Identity
+	CipherSuite    uint16
+	Created        time.Time
+	LastUsed       time.Time
+	BytesEncrypted uint64
+	BytesDecrypted uint64
+}
+
+// ListSessions returns a snapshot of every session held by the module,
+// ordered by session id.
+func (a *Auth) ListSessions() []SessionInfo {
+
+	var sessions []*Session
+	var infos []SessionInfo
+
+	a.lock.Lock()
+	sessions = make([]*Session, 0, len(a.Sessions))
+	for _, session := range a.Sessions {
+		sessions = append(sessions, session)
+	}
+	a.lock.Unlock()
+
+	infos = make([]SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		infos = append(infos, session.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Id < infos[j].Id })
+	return infos
+}
+
+// SessionInfo returns a snapshot of the session, if it exists.
+func (a *Auth) SessionInfo(id uint32) (SessionInfo, bool) {
+
+	var session *Session
+	var ok bool
+
+	if session, ok = a.session(id); !ok {
+		return SessionInfo{}, false
+	}
+	return session.Info(), true
+}
+
+func (s *Session) Info() SessionInfo {
+
+	var info SessionInfo
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	info = SessionInfo{
+		Id:             s.Id,
+		CipherSuite:    s.CipherSuite,
+		Created:        s.Created,
+		LastUsed:       s.LastUsed,
+		BytesEncrypted: s.BytesEncrypted,
+		BytesDecrypted: s.BytesDecrypted,
+	}
+	info.LocalIdentity, _ = PublicKeyIdentity(&s.LocalKey.PublicKey)
+	if s.RemotePublicKey != nil {
+		info.RemoteIdentity, _ = PublicKeyIdentity(s.RemotePublicKey)
+	}
+	return info
+}
+
+// handleSessionList answers with the ids of the sessions. Only the lowest
+// ones are listed if they do not all fit in the response.
+func (a *Auth) handleSessionList(source net.Conn, m msg.AuthSessionList) error {
+
+	var infos []SessionInfo
+	var response msg.AuthSessionListResp
+
+	infos = a.ListSessions()
+	if len(infos) > msg.MaximumSessionListLength {
+		infos = infos[:msg.MaximumSessionListLength]
+	}
+	response = msg.AuthSessionListResp{}
+	response.Count = uint16(len(infos))
+	response.SessionIds = make([]uint32, len(infos))
+	for i, info := range infos {
+		response.SessionIds[i] = info.Id
+	}
+
+	return msg.Send(source, response)
+}
+
+func (a *Auth) handleSessionQuery(source net.Conn, m msg.AuthSessionQuery) error {
+
+	var info SessionInfo
+	var found bool
+	var response msg.AuthSessionInfo
+
+	response = msg.AuthSessionInfo{}
+	response.SessionId = m.SessionId
+
+	// An unknown session is reported with a zero cipher suite.
+	if info, found = a.SessionInfo(m.SessionId); found {
+		response.CipherSuite = info.CipherSuite
+		response.Created = uint64(info.Created.UnixNano())
+		response.LastUsed = uint64(info.LastUsed.UnixNano())
+		response.BytesEncrypted = info.BytesEncrypted
+		response.BytesDecrypted = info.BytesDecrypted
+		response.LocalIdentity, _ = info.LocalIdentity.Digest()
+		response.RemoteIdentity, _ = info.RemoteIdentity.Digest()
+	}
+
+	return msg.Send(source, response)
+}
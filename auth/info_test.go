@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/limoges/p2pnet"
+	"github.com/limoges/p2pnet/msg"
+)
+
+// request hands the message to the module, and returns its answer.
+func request(t *testing.T, a *Auth, m msg.Message) msg.Message {
+
+	var client, server net.Conn
+	var response msg.Message
+	var err error
+
+	client, server = net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go a.Handle(server, m)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if response, err = msg.Read(client); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+// The sessions are listed and described with the identities at both ends,
+// and the traffic they carried.
+func TestSessionInfo(t *testing.T) {
+
+	var created time.Time
+	var initiator, responder *Auth
+	var local, remote *Session
+	var list msg.AuthSessionListResp
+	var info msg.AuthSessionInfo
+	var valid bool
+
+	created = time.Unix(1700000000, 0)
+	initiator = newTestAuth(t, "peer0")
+	responder = newTestAuth(t, "peer1", "peer2")
+	initiator.clock = p2pnet.FixedClock{Time: created}
+
+	local, remote = handshake(t, initiator, initiator.DefaultIdentity(), responder, testHostkey(t, responder, responder.DefaultIdentity()))
+	handshake(t, initiator, initiator.DefaultIdentity(), responder, testHostkey(t, responder, responder.DefaultIdentity()))
+
+	initiator.clock = p2pnet.FixedClock{Time: created.Add(time.Minute)}
+	local.clock = initiator.clock
+	exchange(t, local, remote)
+
+	if list, valid = request(t, initiator, msg.AuthSessionList{}).(msg.AuthSessionListResp); !valid {
+		t.Fatal("expected AUTH_SESSION_LIST_RESP")
+	}
+	if list.Count != 2 || len(list.SessionIds) != 2 || list.SessionIds[0] >= list.SessionIds[1] {
+		t.Fatalf("listed %v sessions: %v", list.Count, list.SessionIds)
+	}
+
+	if info, valid = request(t, initiator, msg.AuthSessionQuery{SessionId: local.Id}).(msg.AuthSessionInfo); !valid {
+		t.Fatal("expected AUTH_SESSION_INFO")
+	}
+	if info.SessionId != local.Id || info.CipherSuite != CipherSuiteRSA {
+		t.Fatalf("unexpected session %v with suite %v", info.SessionId, info.CipherSuite)
+	}
+	if info.Created != uint64(created.UnixNano()) || info.LastUsed != uint64(created.Add(time.Minute).UnixNano()) {
+		t.Fatalf("the session was created at %v and last used at %v", info.Created, info.LastUsed)
+	}
+	if info.BytesEncrypted != 5 || info.BytesDecrypted != 0 {
+		t.Fatalf("%v bytes encrypted and %v decrypted", info.BytesEncrypted, info.BytesDecrypted)
+	}
+	if localIdentity, _ := initiator.DefaultIdentity().Digest(); info.LocalIdentity != localIdentity {
+		t.Fatal("the local identity is not the initiator's")
+	}
+	if remoteIdentity, _ := responder.DefaultIdentity().Digest(); info.RemoteIdentity != remoteIdentity {
+		t.Fatal("the remote identity is not the responder's")
+	}
+
+	// An unknown session has no cipher suite.
+	unknown := local.Id + 1
+	for unknown == list.SessionIds[0] || unknown == list.SessionIds[1] {
+		unknown++
+	}
+	if info = request(t, initiator, msg.AuthSessionQuery{SessionId: unknown}).(msg.AuthSessionInfo); info.CipherSuite != 0 {
+		t.Fatalf("an unknown session has the suite %v", info.CipherSuite)
+	}
+}
+
+// A list of more sessions than a response holds is cut to the lowest ids, so
+// that its count matches the ids it carries.
+func TestSessionListTooLong(t *testing.T) {
+
+	var initiator, responder *Auth
+	var local *Session
+	var list msg.AuthSessionListResp
+	var valid bool
+
+	initiator = newTestAuth(t, "peer0")
+	responder = newTestAuth(t, "peer1")
+	local, _ = handshake(t, initiator, initiator.DefaultIdentity(), responder, testHostkey(t, responder, responder.DefaultIdentity()))
+
+	initiator.lock.Lock()
+	for id := uint32(1); id <= msg.MaximumSessionListLength+10; id++ {
+		if _, present := initiator.Sessions[id]; !present {
+			initiator.Sessions[id] = &Session{Id: id, LocalKey: local.LocalKey}
+		}
+	}
+	initiator.lock.Unlock()
+
+	if list, valid = request(t, initiator, msg.AuthSessionList{}).(msg.AuthSessionListResp); !valid {
+		t.Fatal("expected AUTH_SESSION_LIST_RESP")
+	}
+	if list.Count != msg.MaximumSessionListLength || len(list.SessionIds) != msg.MaximumSessionListLength {
+		t.Fatalf("listed %v sessions with %v ids", list.Count, len(list.SessionIds))
+	}
+	if list.SessionIds[0] != 1 || list.SessionIds[len(list.SessionIds)-1] != msg.MaximumSessionListLength {
+		t.Fatalf("listed the sessions %v to %v", list.SessionIds[0], list.SessionIds[len(list.SessionIds)-1])
+	}
+}
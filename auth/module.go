@@ -5,8 +5,10 @@ import (
 	"crypto/rsa"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"sync"
 
 	"github.com/limoges/p2pnet"
 	"github.com/limoges/p2pnet/cfg"
@@ -25,41 +27,181 @@ const (
 	HostkeyToken = "HOSTKEY"
 	// The default location of the hostkey file.
 	DefaultHostkey = "hostkey.pem"
+	// The configuration token listing additional hostkey files, used to
+	// run several virtual peers from the same module.
+	HostkeysToken = "hostkeys"
+	// The configuration token selecting the key exchange.
+	KeyExchangeToken = "key_exchange"
+	// The default key exchange.
+	DefaultKeyExchange = KeyExchangeRSA
+	// The configuration token providing the path of the audit log.
+	AuditLogToken = "audit_log"
+	// The audit log is disabled by default.
+	DefaultAuditLog = ""
+)
+
+// The supported key exchanges.
+const (
+	// KeyExchangeRSA transports the session key with RSA. Hybrid offers
+	// are answered with RSA.
+	KeyExchangeRSA = "rsa"
+	// KeyExchangeHybrid offers the hybrid X25519 and ML-KEM-768 exchange,
+	// but falls back to RSA with peers which do not support it.
+	KeyExchangeHybrid = "hybrid"
+	// KeyExchangeHybridOnly declines any session without the hybrid
+	// exchange.
+	KeyExchangeHybridOnly = "hybrid-only"
 )
 
 var (
-	ErrNoBlockFound = errors.New("No block found in key file")
+	ErrNoBlockFound    = errors.New("No block found in key file")
+	ErrUnknownIdentity = errors.New("No hostkey is known for the identity")
 )
 
 // This module only communicates with the Onion module.
 type Auth struct {
+	// PrivateKey is the default identity, read from HOSTKEY.
 	PrivateKey *rsa.PrivateKey
-
-	Sessions   map[uint32]*Session
-	APIAddr    string
-	ListenAddr string
+	// Identities is the keyring of every local identity, including the
+	// default one.
+	Identities map[p2pnet.Identity]*rsa.PrivateKey
+
+	Sessions    map[uint32]*Session
+	APIAddr     string
+	ListenAddr  string
+	KeyExchange string
+	// Audit records authentication events. It is nil when disabled.
+	Audit *AuditLog
+
+	lock   sync.Mutex
+	random io.Reader
+	seeded bool
+	clock  p2pnet.Clock
 }
 
 func New(conf *cfg.Configurations) (*Auth, error) {
+	return NewWithSources(conf, p2pnet.DefaultSources())
+}
+
+// NewWithSources creates the module using the given randomness and clock
+// instead of the system ones.
+func NewWithSources(conf *cfg.Configurations, sources p2pnet.Sources) (*Auth, error) {
 
 	var auth *Auth
 	var priv *rsa.PrivateKey
 	var err error
 	var hostkeyPath string
+	var hostkeyPaths []string
+	var auditPath string
 
-	auth = &Auth{}
+	auth = newAuth(sources)
 	conf.Init(&hostkeyPath, "", HostkeyToken, DefaultHostkey)
+	conf.Init(&hostkeyPaths, ModuleToken, HostkeysToken, []string{})
 	conf.Init(&auth.APIAddr, ModuleToken, ApiAddrToken, DefaultApiAddr)
+	conf.Init(&auth.KeyExchange, ModuleToken, KeyExchangeToken, DefaultKeyExchange)
+	conf.Init(&auditPath, ModuleToken, AuditLogToken, DefaultAuditLog)
+
+	switch auth.KeyExchange {
+	case KeyExchangeRSA, KeyExchangeHybrid, KeyExchangeHybridOnly:
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown key exchange '%v'.", auth.KeyExchange))
+	}
 
 	if priv, err = ReadPEMPrivateKey(hostkeyPath); err != nil {
 		fmt.Printf("Could not read necessary keys from '%v'.\n", hostkeyPath)
 		return nil, err
 	}
 	auth.PrivateKey = priv
-	auth.Sessions = make(map[uint32]*Session)
+	if _, err = auth.AddIdentity(priv); err != nil {
+		return nil, err
+	}
+
+	for _, path := range hostkeyPaths {
+		if priv, err = ReadPEMPrivateKey(path); err != nil {
+			fmt.Printf("Could not read necessary keys from '%v'.\n", path)
+			return nil, err
+		}
+		if _, err = auth.AddIdentity(priv); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(auditPath) > 0 {
+		if auth.Audit, err = OpenAuditLog(auditPath, auth.PrivateKey, auth.clock); err != nil {
+			fmt.Printf("Could not open audit log '%v'.\n", auditPath)
+			return nil, err
+		}
+	}
 	return auth, nil
 }
 
+func newAuth(sources p2pnet.Sources) *Auth {
+
+	var auth *Auth
+
+	auth = &Auth{}
+	auth.Identities = make(map[p2pnet.Identity]*rsa.PrivateKey)
+	auth.Sessions = make(map[uint32]*Session)
+	auth.KeyExchange = DefaultKeyExchange
+	auth.random = sources.Random
+	auth.seeded = sources.Seeded
+	auth.clock = sources.Clock
+	return auth
+}
+
+// AddIdentity adds a private key to the keyring and returns the identity
+// under which sessions can be started with it.
+func (a *Auth) AddIdentity(priv *rsa.PrivateKey) (p2pnet.Identity, error) {
+
+	var identity p2pnet.Identity
+	var err error
+
+	if identity, err = PublicKeyIdentity(&priv.PublicKey); err != nil {
+		return "", err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.Identities[identity] = priv
+	return identity, nil
+}
+
+// DefaultIdentity returns the identity of the hostkey read from HOSTKEY.
+func (a *Auth) DefaultIdentity() p2pnet.Identity {
+
+	var identity p2pnet.Identity
+
+	identity, _ = PublicKeyIdentity(&a.PrivateKey.PublicKey)
+	return identity
+}
+
+func (a *Auth) identityKey(identity p2pnet.Identity) (*rsa.PrivateKey, error) {
+
+	var priv *rsa.PrivateKey
+	var ok bool
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if priv, ok = a.Identities[identity]; !ok {
+		return nil, ErrUnknownIdentity
+	}
+	return priv, nil
+}
+
+func (a *Auth) session(id uint32) (*Session, bool) {
+
+	var session *Session
+	var ok bool
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	session, ok = a.Sessions[id]
+	return session, ok
+}
+
 func (a *Auth) Name() string {
 	return ModuleToken
 }
@@ -82,6 +224,9 @@ func (a *Auth) Handle(source net.Conn, message msg.Message) error {
 	case msg.AuthSessionStart:
 		m := message.(msg.AuthSessionStart)
 		return a.handleSessionStart(source, m)
+	case msg.AuthSessionStartAs:
+		m := message.(msg.AuthSessionStartAs)
+		return a.handleSessionStartAs(source, m)
 	case msg.AuthSessionIncomingHS1:
 		m := message.(msg.AuthSessionIncomingHS1)
 		return a.handleSessionIncomingHS1(source, m)
@@ -97,6 +242,12 @@ func (a *Auth) Handle(source net.Conn, message msg.Message) error {
 	case msg.AuthLayerDecrypt:
 		m := message.(msg.AuthLayerDecrypt)
 		return a.handleLayerDecrypt(source, m)
+	case msg.AuthSessionList:
+		m := message.(msg.AuthSessionList)
+		return a.handleSessionList(source, m)
+	case msg.AuthSessionQuery:
+		m := message.(msg.AuthSessionQuery)
+		return a.handleSessionQuery(source, m)
 	default:
 		return a.handleUnknown(source, message)
 	}
@@ -114,6 +265,19 @@ func (a *Auth) handleSessionStart(source net.Conn, m msg.AuthSessionStart) error
 	return msg.Send(source, sessionHS1)
 }
 
+func (a *Auth) handleSessionStartAs(source net.Conn, m msg.AuthSessionStartAs) error {
+
+	var sessionHS1 *msg.AuthSessionHS1
+	var identity p2pnet.Identity
+	var err error
+
+	identity = p2pnet.IdentityFromDigest(m.Identity)
+	if sessionHS1, err = a.StartSessionAs(identity, m.Hostkey); err != nil {
+		return err
+	}
+	return msg.Send(source, sessionHS1)
+}
+
 func (a *Auth) handleSessionIncomingHS1(source net.Conn, m msg.AuthSessionIncomingHS1) error {
 
 	var sessionHS2 *msg.AuthSessionHS2
@@ -156,7 +320,7 @@ func (a *Auth) handleLayerEncrypt(source net.Conn, m msg.AuthLayerEncrypt) error
 	copy(payload, m.Payload)
 
 	for _, sessionId := range m.SessionIds {
-		if session, present = a.Sessions[sessionId]; !present {
+		if session, present = a.session(sessionId); !present {
 			return errors.New(fmt.Sprintf("Session %v does not exist.", sessionId))
 		}
 		if encrypted, err = session.Encrypt(payload); err != nil {
@@ -189,10 +353,11 @@ func (a *Auth) handleLayerDecrypt(source net.Conn, m msg.AuthLayerDecrypt) error
 	for i := len(m.SessionIds) - 1; i >= 0; i-- {
 		sessionId := m.SessionIds[i]
 
-		if session, present = a.Sessions[sessionId]; !present {
+		if session, present = a.session(sessionId); !present {
 			return errors.New(fmt.Sprintf("Session %v does not exist.", sessionId))
 		}
 		if decrypted, err = session.Decrypt(payload); err != nil {
+			a.audit(AuditDecryptionFailed, session, err)
 			return errors.New("Could not decrypt payload")
 		}
 		payload = make([]byte, len(decrypted))
@@ -214,13 +379,26 @@ func (a *Auth) handleUnknown(source net.Conn, m msg.Message) error {
 	return p2pnet.ErrModuleDoesNotHandle
 }
 
+// StartSession starts a session with the remote hostkey using the default
+// identity.
 func (a *Auth) StartSession(hostkey []byte) (*msg.AuthSessionHS1, error) {
+	return a.StartSessionAs(a.DefaultIdentity(), hostkey)
+}
+
+// StartSessionAs starts a session with the remote hostkey using the named
+// local identity.
+func (a *Auth) StartSessionAs(identity p2pnet.Identity, hostkey []byte) (*msg.AuthSessionHS1, error) {
 
+	var priv *rsa.PrivateKey
 	var pub *rsa.PublicKey
 	var err error
 	var session *Session
 	var handshake1 *msg.AuthSessionHS1
 
+	if priv, err = a.identityKey(identity); err != nil {
+		return nil, err
+	}
+
 	// First, check that the hostkey is a valid rsa.PublicKey
 	if pub, err = ParsePublicKey(hostkey); err != nil {
 		log.Println("Could not parse hostkey into public key format.")
@@ -228,25 +406,32 @@ func (a *Auth) StartSession(hostkey []byte) (*msg.AuthSessionHS1, error) {
 	}
 
 	// Start creating the session.
-	if session, err = NewSession(a); err != nil {
+	if session, err = NewSession(a, priv); err != nil {
 		log.Println("Could not create session.")
 		return nil, err
 	}
 
-	if handshake1, err = session.CreateHandshake1(pub); err != nil {
+	if a.KeyExchange == KeyExchangeRSA {
+		handshake1, err = session.CreateHandshake1(pub)
+	} else {
+		handshake1, err = session.CreateHybridHandshake1(pub)
+	}
+	if err != nil {
 		return nil, err
 	}
 
 	session.RemotePublicKey = pub
-	a.Sessions[session.Id] = session
+	a.storeSession(session)
+	a.audit(AuditHandshakeStarted, session, nil)
 	return handshake1, nil
 }
 
 func (a *Auth) IncomingHandshake1(hostkey []byte, payload []byte) (*msg.AuthSessionHS2, error) {
 
 	var pub *rsa.PublicKey
+	var priv *rsa.PrivateKey
 	var err error
-	var handshake1 *msg.AuthHandshake1
+	var handshake msg.Message
 	var session *Session
 	var handshake2 *msg.AuthSessionHS2
 
@@ -257,23 +442,75 @@ func (a *Auth) IncomingHandshake1(hostkey []byte, payload []byte) (*msg.AuthSess
 	}
 
 	// Parse the payload for the handshake message
-	if handshake1, err = unloadHandshake1(payload); err != nil {
+	if handshake, err = unloadHandshake(payload); err != nil {
 		log.Println("Could not parse handshake payload.")
+		a.auditIncoming(AuditHandshakeDeclined, "", pub, err)
 		return nil, err
 	}
 
-	if session, err = NewIncomingSession(a, handshake1.EncryptedKey[:], handshake1.EncryptedHMAC[:]); err != nil {
-		log.Println(err)
+	switch handshake1 := handshake.(type) {
+	case msg.AuthHandshake1:
+		target := p2pnet.IdentityFromDigest(handshake1.Target)
+		a.auditIncoming(AuditHandshakeStarted, target, pub, nil)
+
+		if a.KeyExchange == KeyExchangeHybridOnly {
+			a.auditIncoming(AuditHandshakeDeclined, target, pub, ErrHybridRequired)
+			return nil, ErrHybridRequired
+		}
+
+		// Route the handshake to the identity the initiator targeted.
+		if priv, err = a.identityKey(target); err != nil {
+			log.Println(err)
+			a.auditIncoming(AuditHandshakeDeclined, target, pub, err)
+			return nil, err
+		}
+
+		if session, err = NewIncomingSession(a, priv, handshake1.EncryptedKey[:], handshake1.EncryptedHMAC[:]); err != nil {
+			log.Println(err)
+			a.auditIncoming(AuditHandshakeDeclined, target, pub, err)
+			return nil, err
+		}
+
+		handshake2, err = session.CreateHandshake2(pub)
+
+	case msg.AuthHandshake1Hybrid:
+		target := p2pnet.IdentityFromDigest(handshake1.Target)
+		a.auditIncoming(AuditHandshakeStarted, target, pub, nil)
+
+		if priv, err = a.identityKey(target); err != nil {
+			log.Println(err)
+			a.auditIncoming(AuditHandshakeDeclined, target, pub, err)
+			return nil, err
+		}
+
+		if session, err = NewIncomingSession(a, priv, handshake1.EncryptedKey[:], handshake1.EncryptedHMAC[:]); err != nil {
+			log.Println(err)
+			a.auditIncoming(AuditHandshakeDeclined, target, pub, err)
+			return nil, err
+		}
+
+		// Without hybrid support, the RSA-transported key is used alone.
+		if a.KeyExchange == KeyExchangeRSA {
+			handshake2, err = session.CreateHandshake2(pub)
+		} else {
+			handshake2, err = session.CreateHybridHandshake2(pub, &handshake1)
+		}
+
+	default:
+		err = errors.New("Unexpected handshake payload")
+		a.auditIncoming(AuditHandshakeDeclined, "", pub, err)
 		return nil, err
 	}
 
-	if handshake2, err = session.CreateHandshake2(pub); err != nil {
+	session.RemotePublicKey = pub
+	if err != nil {
 		log.Println(err)
+		a.audit(AuditHandshakeDeclined, session, err)
 		return nil, err
 	}
 
-	session.RemotePublicKey = pub
-	a.Sessions[session.Id] = session
+	a.storeSession(session)
+	a.audit(AuditHandshakeSucceeded, session, nil)
 	return handshake2, nil
 }
 
@@ -282,25 +519,62 @@ func (a *Auth) IncomingHandshake2(id uint32, payload []byte) error {
 	var session *Session
 	var ok bool
 	var err error
-	var handshake2 *msg.AuthHandshake2
+	var handshake msg.Message
 
 	// Check if the session exists
-	if session, ok = a.Sessions[id]; !ok {
+	if session, ok = a.session(id); !ok {
 		return errors.New("Session does not exist")
 	}
 
 	// Validate the handshake payload
-	if handshake2, err = unloadHandshake2(payload); err != nil {
+	if handshake, err = unloadHandshake(payload); err != nil {
 		log.Println("Could not parse handshake payload.")
+		a.declineSession(session, err)
 		return err
 	}
 
-	if err = session.DecryptRemoteHMAC(a.PrivateKey, handshake2.EncryptedHMAC[:]); err != nil {
+	switch handshake2 := handshake.(type) {
+	case msg.AuthHandshake2:
+		// The remote peer declined our hybrid offer, if any.
+		if a.KeyExchange == KeyExchangeHybridOnly {
+			err = ErrHybridRequired
+			break
+		}
+		session.declineHybrid()
+		err = session.DecryptRemoteHMAC(session.LocalKey, handshake2.EncryptedHMAC[:])
+	case msg.AuthHandshake2Hybrid:
+		err = session.AcceptHybridHandshake2(&handshake2)
+	default:
+		err = errors.New("Unexpected handshake payload")
+	}
+
+	if err != nil {
+		a.declineSession(session, err)
 		return err
 	}
+	a.audit(AuditHandshakeSucceeded, session, nil)
 	return nil
 }
 
+// declineSession forgets the session whose handshake failed, so that it
+// cannot be used with the keys it was left with.
+func (a *Auth) declineSession(session *Session, cause error) {
+
+	a.lock.Lock()
+	delete(a.Sessions, session.Id)
+	a.lock.Unlock()
+
+	a.audit(AuditHandshakeDeclined, session, cause)
+}
+
+func (a *Auth) storeSession(session *Session) {
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.Sessions[session.Id] = session
+}
+
 func buildPayload(m msg.Message) ([]byte, error) {
 
 	var buf *bytes.Buffer
@@ -314,52 +588,69 @@ func buildPayload(m msg.Message) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func unloadHandshake1(payload []byte) (*msg.AuthHandshake1, error) {
+// unloadHandshake reads the handshake message sent through the payload.
+func unloadHandshake(payload []byte) (msg.Message, error) {
 
 	var reader *bytes.Reader
-	var message msg.Message
-	var handshake1 msg.AuthHandshake1
-	var err error
-	var ok bool
 
-	// First read the message sent through the payload.
 	reader = bytes.NewReader(payload)
+	return msg.Read(reader)
+}
 
-	if message, err = msg.Read(reader); err != nil {
-		return nil, err
-	}
+func (a *Auth) CloseSession(id uint32) {
+
+	var session *Session
+	var ok bool
 
-	// We expect a AuthHandshake1 message in the payload.
-	if handshake1, ok = message.(msg.AuthHandshake1); !ok {
-		return nil, errors.New("Unexpected handshake payload")
+	a.lock.Lock()
+	if session, ok = a.Sessions[id]; ok {
+		delete(a.Sessions, id)
 	}
+	a.lock.Unlock()
 
-	return &handshake1, nil
+	if ok {
+		a.audit(AuditSessionClosed, session, nil)
+	}
 }
 
-func unloadHandshake2(payload []byte) (*msg.AuthHandshake2, error) {
+// audit records an event about an existing session.
+func (a *Auth) audit(event string, session *Session, cause error) {
 
-	var reader *bytes.Reader
-	var message msg.Message
-	var handshake2 msg.AuthHandshake2
-	var err error
-	var ok bool
+	var local, remote p2pnet.Identity
 
-	// First read the message sent through the payload.
-	reader = bytes.NewReader(payload)
+	if a.Audit == nil {
+		return
+	}
 
-	if message, err = msg.Read(reader); err != nil {
-		return nil, err
+	local, _ = PublicKeyIdentity(&session.LocalKey.PublicKey)
+	if session.RemotePublicKey != nil {
+		remote, _ = PublicKeyIdentity(session.RemotePublicKey)
 	}
+	a.recordAudit(event, session.Id, local, remote, cause)
+}
 
-	// We expect a AuthHandshake1 message in the payload.
-	if handshake2, ok = message.(msg.AuthHandshake2); !ok {
-		return nil, errors.New("Unexpected handshake payload")
+// auditIncoming records an event about an incoming handshake for which no
+// session exists.
+func (a *Auth) auditIncoming(event string, target p2pnet.Identity, pub *rsa.PublicKey, cause error) {
+
+	var remote p2pnet.Identity
+
+	if a.Audit == nil {
+		return
 	}
 
-	return &handshake2, nil
+	remote, _ = PublicKeyIdentity(pub)
+	a.recordAudit(event, 0, target, remote, cause)
 }
 
-func (a *Auth) CloseSession(id uint32) {
-	log.Println("CloseSession not implemented")
+func (a *Auth) recordAudit(event string, id uint32, local, remote p2pnet.Identity, cause error) {
+
+	var detail string
+
+	if cause != nil {
+		detail = cause.Error()
+	}
+	if err := a.Audit.Record(event, id, local, remote, detail); err != nil {
+		log.Println(err)
+	}
 }
@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/limoges/p2pnet"
+	"github.com/limoges/p2pnet/cfg"
+)
+
+// testKeyPath returns the path of one of the hostkeys of the example peers.
+func testKeyPath(t *testing.T, name string) string {
+
+	var path string
+	var err error
+
+	if path, err = filepath.Abs(filepath.Join("..", "main", "keys", name+".pem")); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTestAuth creates a module with the first hostkey as HOSTKEY and the
+// others in its keyring.
+func newTestAuth(t *testing.T, names ...string) *Auth {
+
+	var paths []string
+	var path string
+	var conf *cfg.Configurations
+	var a *Auth
+	var err error
+
+	for _, name := range names[1:] {
+		paths = append(paths, testKeyPath(t, name))
+	}
+	path = filepath.Join(t.TempDir(), "auth.ini")
+	err = os.WriteFile(path, []byte(fmt.Sprintf("HOSTKEY = %v\n\n[ONION_AUTHENTICATION]\nhostkeys = %v\n",
+		testKeyPath(t, names[0]), strings.Join(paths, ", "))), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf, err = cfg.New(path); err != nil {
+		t.Fatal(err)
+	}
+	if a, err = New(conf); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// testHostkey returns the hostkey of the identity in the keyring.
+func testHostkey(t *testing.T, a *Auth, identity p2pnet.Identity) []byte {
+
+	var hostkey []byte
+	var err error
+
+	if hostkey, err = GetPublicKeyAsDER(&a.Identities[identity].PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	return hostkey
+}
+
+// handshake runs a handshake from the identity of the initiator to the
+// hostkey, and returns the sessions of both ends.
+func handshake(t *testing.T, initiator *Auth, identity p2pnet.Identity, responder *Auth, hostkey []byte) (*Session, *Session) {
+
+	hs1, err := initiator.StartSessionAs(identity, hostkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs2, err := responder.IncomingHandshake1(testHostkey(t, initiator, identity), hs1.HandshakePayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = initiator.IncomingHandshake2(hs1.SessionId, hs2.HandshakePayload); err != nil {
+		t.Fatal(err)
+	}
+	return initiator.Sessions[hs1.SessionId], responder.Sessions[hs2.SessionId]
+}
+
+// exchange checks that what one session encrypts, the other decrypts.
+func exchange(t *testing.T, from *Session, to *Session) {
+
+	var data []byte
+	var err error
+
+	if data, err = from.Encrypt([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err = to.Decrypt(data); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte("hello")) {
+		t.Fatalf("decrypted %q", data)
+	}
+}
+
+// One module holds the identities of several peers: it starts sessions as
+// any of them, and answers each handshake with the identity it targets.
+func TestKeyring(t *testing.T) {
+
+	var single, virtual *Auth
+
+	single = newTestAuth(t, "peer0")
+	virtual = newTestAuth(t, "peer1", "peer2", "peer3", "peer4")
+	if len(virtual.Identities) != 4 {
+		t.Fatalf("%v identities instead of 4", len(virtual.Identities))
+	}
+
+	for identity, priv := range virtual.Identities {
+
+		// Towards the virtual peer.
+		initiator, responder := handshake(t, single, single.DefaultIdentity(), virtual, testHostkey(t, virtual, identity))
+		if responder.LocalKey != priv {
+			t.Fatalf("the handshake for %v was answered by another identity", identity)
+		}
+		exchange(t, initiator, responder)
+
+		// From the virtual peer.
+		initiator, responder = handshake(t, virtual, identity, single, testHostkey(t, single, single.DefaultIdentity()))
+		if initiator.LocalKey != priv {
+			t.Fatalf("the session was started by another identity than %v", identity)
+		}
+		exchange(t, responder, initiator)
+	}
+}
+
+// A handshake for an identity the module does not hold is refused, and so is
+// a session started as one.
+func TestKeyringUnknownIdentity(t *testing.T) {
+
+	var single, virtual *Auth
+	var hostkey []byte
+	var err error
+
+	single = newTestAuth(t, "peer0")
+	virtual = newTestAuth(t, "peer1", "peer2")
+	hostkey = testHostkey(t, single, single.DefaultIdentity())
+
+	hs1, err := single.StartSession(hostkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = virtual.IncomingHandshake1(hostkey, hs1.HandshakePayload); err != ErrUnknownIdentity {
+		t.Fatalf("expected %v, got %v", ErrUnknownIdentity, err)
+	}
+	if _, err = virtual.StartSessionAs(single.DefaultIdentity(), hostkey); err != ErrUnknownIdentity {
+		t.Fatalf("expected %v, got %v", ErrUnknownIdentity, err)
+	}
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"time"
+
+	"github.com/limoges/p2pnet"
+	"github.com/limoges/p2pnet/msg"
+)
+
+// Transcript holds the wire format of every message exchanged during a
+// handshake, along with a record encrypted in each direction.
+type Transcript struct {
+	Handshake1      []byte
+	Handshake2      []byte
+	InitiatorRecord []byte
+	ResponderRecord []byte
+}
+
+// ReplayHandshake runs a complete handshake between two in-memory modules
+// whose randomness and clocks are derived from the seed. The same seed and
+// keys always produce the same transcript, byte for byte, which makes it
+// suitable for golden-file tests.
+func ReplayHandshake(seed int64, initiator, responder *rsa.PrivateKey, record []byte) (*Transcript, error) {
+
+	var initiatorAuth, responderAuth *Auth
+	var initiatorHostkey, responderHostkey []byte
+	var handshake1 *msg.AuthSessionHS1
+	var handshake2 *msg.AuthSessionHS2
+	var transcript *Transcript
+	var err error
+
+	epoch := time.Unix(0, 0).UTC()
+	initiatorAuth = newAuth(p2pnet.SeededSources(seed, epoch))
+	responderAuth = newAuth(p2pnet.SeededSources(seed+1, epoch))
+
+	if _, err = initiatorAuth.AddIdentity(initiator); err != nil {
+		return nil, err
+	}
+	initiatorAuth.PrivateKey = initiator
+
+	if _, err = responderAuth.AddIdentity(responder); err != nil {
+		return nil, err
+	}
+	responderAuth.PrivateKey = responder
+
+	if initiatorHostkey, err = GetPublicKeyAsDER(&initiator.PublicKey); err != nil {
+		return nil, err
+	}
+	if responderHostkey, err = GetPublicKeyAsDER(&responder.PublicKey); err != nil {
+		return nil, err
+	}
+
+	transcript = &Transcript{}
+
+	if handshake1, err = initiatorAuth.StartSession(responderHostkey); err != nil {
+		return nil, err
+	}
+	if transcript.Handshake1, err = buildPayload(handshake1); err != nil {
+		return nil, err
+	}
+
+	if handshake2, err = responderAuth.IncomingHandshake1(initiatorHostkey, handshake1.HandshakePayload); err != nil {
+		return nil, err
+	}
+	if transcript.Handshake2, err = buildPayload(handshake2); err != nil {
+		return nil, err
+	}
+
+	if err = initiatorAuth.IncomingHandshake2(handshake1.SessionId, handshake2.HandshakePayload); err != nil {
+		return nil, err
+	}
+
+	if transcript.InitiatorRecord, err = initiatorAuth.Sessions[handshake1.SessionId].Encrypt(record); err != nil {
+		return nil, err
+	}
+	if transcript.ResponderRecord, err = responderAuth.Sessions[handshake2.SessionId].Encrypt(record); err != nil {
+		return nil, err
+	}
+
+	return transcript, nil
+}
@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+// TestReplayHandshakeGolden checks that a seeded handshake is reproduced
+// byte for byte. Run with -update after a deliberate change of the wire
+// format.
+func TestReplayHandshakeGolden(t *testing.T) {
+
+	initiator, err := ReadPEMPrivateKey("../main/keys/peer0.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, err := ReadPEMPrivateKey("../main/keys/peer1.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transcript, err := ReplayHandshake(42, initiator, responder, []byte("golden record"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := formatTranscript(transcript)
+
+	golden := filepath.Join("testdata", "replay_handshake.golden")
+	if *update {
+		if err = os.MkdirAll("testdata", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("the transcript differs from %v:\n%s", golden, got)
+	}
+
+	// Another seed gives another transcript.
+	other, err := ReplayHandshake(43, initiator, responder, []byte("golden record"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(formatTranscript(other), want) {
+		t.Fatal("the transcript does not depend on the seed")
+	}
+}
+
+func formatTranscript(transcript *Transcript) []byte {
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "handshake1 %v\n", hex.EncodeToString(transcript.Handshake1))
+	fmt.Fprintf(&buf, "handshake2 %v\n", hex.EncodeToString(transcript.Handshake2))
+	fmt.Fprintf(&buf, "initiator  %v\n", hex.EncodeToString(transcript.InitiatorRecord))
+	fmt.Fprintf(&buf, "responder  %v\n", hex.EncodeToString(transcript.ResponderRecord))
+	return buf.Bytes()
+}
@@ -1,20 +1,48 @@
 package auth
 
 import (
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
-	"math/rand"
+	"io"
+	"sync"
 	"time"
 
+	"github.com/limoges/p2pnet"
 	"github.com/limoges/p2pnet/msg"
 )
 
+const (
+	// CipherSuiteRSA transports an AES-128 key with RSA.
+	CipherSuiteRSA uint16 = 1
+	// CipherSuiteHybrid derives an AES-256 key from RSA, X25519 and
+	// ML-KEM-768 shared secrets.
+	CipherSuiteHybrid uint16 = 2
+)
+
 type Session struct {
-	Id              uint32
+	Id uint32
+	// LocalKey is the private key of the local identity used by the session.
+	LocalKey        *rsa.PrivateKey
 	SharedKey       []byte
 	LocalHMAC       []byte
 	RemoteHMAC      []byte
 	RemotePublicKey *rsa.PublicKey
+	CipherSuite     uint16
+	Created         time.Time
+	LastUsed        time.Time
+	BytesEncrypted  uint64
+	BytesDecrypted  uint64
+
+	// lock protects the keys and the cipher suite, which the hybrid exchange
+	// replaces, the hybrid offer and the usage of the session.
+	lock   sync.Mutex
+	random io.Reader
+	seeded bool
+	clock  p2pnet.Clock
+	hybrid *hybridOffer
 }
 
 func (a *Auth) localUnusedSessionId() (uint32, error) {
@@ -28,32 +56,32 @@ func (a *Auth) localUnusedSessionId() (uint32, error) {
 	// it is suggested to use a 32 bits session ID which will have
 	// about odds of a collision in about 1 in 10 millions for 30 or
 	// simultaneous sessions.
-	// Therefore, using the time as a random number generator seed seems
-	// perfectly fine.
+	// The identifiers are drawn from the module's source of randomness so
+	// that they can be reproduced in tests.
 
-	seed := time.Now().UnixNano()
-	source := rand.NewSource(seed)
-	rng := rand.New(source)
+	a.lock.Lock()
+	defer a.lock.Unlock()
 
 	// We generate a random number and then try again until we can find
 	// a number that is not currently in use. Again, there shouldn't be too
 	// many collisions locally.
-	id = rng.Uint32()
-	count = 1
+	count = 0
 	for {
 		if count == MaximumSessionIdAttempts {
 			return 0, errors.New("Could not generate a new session id")
 		}
+		if err := binary.Read(a.random, binary.BigEndian, &id); err != nil {
+			return 0, err
+		}
 		if _, alreadyInUse = a.Sessions[id]; !alreadyInUse {
 			break
 		}
-		id = rng.Uint32()
 		count = count + 1
 	}
 	return id, nil
 }
 
-func NewIncomingSession(a *Auth, encryptedKey, encryptedHMAC []byte) (*Session, error) {
+func NewIncomingSession(a *Auth, priv *rsa.PrivateKey, encryptedKey, encryptedHMAC []byte) (*Session, error) {
 
 	var id uint32
 	var localHMAC []byte
@@ -62,15 +90,15 @@ func NewIncomingSession(a *Auth, encryptedKey, encryptedHMAC []byte) (*Session,
 	var sharedKey []byte
 	var err error
 
-	if sharedKey, err = DecryptPKCS(a.PrivateKey, encryptedKey); err != nil {
+	if sharedKey, err = DecryptPKCS(priv, encryptedKey); err != nil {
 		return nil, err
 	}
 
-	if remoteHMAC, err = DecryptPKCS(a.PrivateKey, encryptedHMAC); err != nil {
+	if remoteHMAC, err = DecryptPKCS(priv, encryptedHMAC); err != nil {
 		return nil, err
 	}
 
-	if localHMAC, err = GenerateNewSymmetricKey(); err != nil {
+	if localHMAC, err = GenerateNewSymmetricKey(a.random); err != nil {
 		return nil, err
 	}
 
@@ -79,14 +107,21 @@ func NewIncomingSession(a *Auth, encryptedKey, encryptedHMAC []byte) (*Session,
 	}
 
 	session = &Session{
-		Id:         id,
-		SharedKey:  sharedKey,
-		LocalHMAC:  localHMAC,
-		RemoteHMAC: remoteHMAC,
+		Id:          id,
+		LocalKey:    priv,
+		SharedKey:   sharedKey,
+		LocalHMAC:   localHMAC,
+		RemoteHMAC:  remoteHMAC,
+		CipherSuite: CipherSuiteRSA,
+		Created:     a.clock.Now(),
+		LastUsed:    a.clock.Now(),
+		random:      a.random,
+		seeded:      a.seeded,
+		clock:       a.clock,
 	}
 	return session, nil
 }
-func NewSession(a *Auth) (*Session, error) {
+func NewSession(a *Auth, priv *rsa.PrivateKey) (*Session, error) {
 
 	var id uint32
 	var sharedKey []byte
@@ -98,28 +133,41 @@ func NewSession(a *Auth) (*Session, error) {
 		return nil, err
 	}
 
-	if sharedKey, err = GenerateNewSymmetricKey(); err != nil {
+	if sharedKey, err = GenerateNewSymmetricKey(a.random); err != nil {
 		return nil, err
 	}
 
-	if localHMAC, err = GenerateNewSymmetricKey(); err != nil {
+	if localHMAC, err = GenerateNewSymmetricKey(a.random); err != nil {
 		return nil, err
 	}
 
 	session = &Session{
-		Id:        id,
-		SharedKey: sharedKey,
-		LocalHMAC: localHMAC,
+		Id:          id,
+		LocalKey:    priv,
+		SharedKey:   sharedKey,
+		LocalHMAC:   localHMAC,
+		CipherSuite: CipherSuiteRSA,
+		Created:     a.clock.Now(),
+		LastUsed:    a.clock.Now(),
+		random:      a.random,
+		seeded:      a.seeded,
+		clock:       a.clock,
 	}
 	return session, nil
 }
 func (s *Session) DecryptRemoteHMAC(priv *rsa.PrivateKey, encryptedHMAC []byte) error {
 
+	var remoteHMAC []byte
 	var err error
-	if s.RemoteHMAC, err = DecryptPKCS(priv, encryptedHMAC); err != nil {
+
+	if remoteHMAC, err = DecryptPKCS(priv, encryptedHMAC); err != nil {
 		return err
 	}
 
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.RemoteHMAC = remoteHMAC
 	return nil
 }
 
@@ -129,18 +177,54 @@ func (s *Session) Validate() error {
 
 func (s *Session) CreateHandshake1(pub *rsa.PublicKey) (*msg.AuthSessionHS1, error) {
 
+	var handshake1 *msg.AuthHandshake1
+	var payload []byte
+	var session1 msg.AuthSessionHS1
+	var err error
+
+	if handshake1, err = s.buildHandshake1(pub); err != nil {
+		return nil, err
+	}
+
+	if payload, err = buildPayload(handshake1); err != nil {
+		return nil, err
+	}
+
+	session1 = msg.AuthSessionHS1{
+		SessionId:        s.Id,
+		HandshakePayload: payload,
+	}
+
+	return &session1, nil
+}
+
+// encryptPKCS encrypts the key for the peer. Only seeded sessions draw the
+// padding from their own source, so that their handshakes can be reproduced.
+func (s *Session) encryptPKCS(pub *rsa.PublicKey, key []byte) ([]byte, error) {
+
+	if s.seeded {
+		return encryptPKCSWithReader(s.random, pub, key)
+	}
+	return EncryptPKCS(rand.Reader, pub, key)
+}
+
+func (s *Session) buildHandshake1(pub *rsa.PublicKey) (*msg.AuthHandshake1, error) {
+
+	var hostkey []byte
 	var encryptedKey []byte
 	var encryptedHMAC []byte
 	var handshake1 msg.AuthHandshake1
-	var payload []byte
-	var session1 msg.AuthSessionHS1
 	var err error
 
-	if encryptedKey, err = EncryptPKCS(pub, s.SharedKey); err != nil {
+	if hostkey, err = MarshalPublicKey(pub); err != nil {
+		return nil, err
+	}
+
+	if encryptedKey, err = s.encryptPKCS(pub, s.SharedKey); err != nil {
 		return nil, err
 	}
 
-	if encryptedHMAC, err = EncryptPKCS(pub, s.LocalHMAC); err != nil {
+	if encryptedHMAC, err = s.encryptPKCS(pub, s.LocalHMAC); err != nil {
 		return nil, err
 	}
 
@@ -153,19 +237,11 @@ func (s *Session) CreateHandshake1(pub *rsa.PublicKey) (*msg.AuthSessionHS1, err
 	}
 
 	handshake1 = msg.AuthHandshake1{}
+	handshake1.Target = sha256.Sum256(hostkey)
 	copy(handshake1.EncryptedKey[:], encryptedKey)
 	copy(handshake1.EncryptedHMAC[:], encryptedHMAC)
 
-	if payload, err = buildPayload(handshake1); err != nil {
-		return nil, err
-	}
-
-	session1 = msg.AuthSessionHS1{
-		SessionId:        s.Id,
-		HandshakePayload: payload,
-	}
-
-	return &session1, nil
+	return &handshake1, nil
 }
 
 func (s *Session) CreateHandshake2(pub *rsa.PublicKey) (*msg.AuthSessionHS2, error) {
@@ -176,7 +252,7 @@ func (s *Session) CreateHandshake2(pub *rsa.PublicKey) (*msg.AuthSessionHS2, err
 	var payload []byte
 	var session2 msg.AuthSessionHS2
 
-	if encryptedHMAC, err = EncryptPKCS(pub, s.LocalHMAC); err != nil {
+	if encryptedHMAC, err = s.encryptPKCS(pub, s.LocalHMAC); err != nil {
 		return nil, err
 	}
 
@@ -198,9 +274,45 @@ func (s *Session) CreateHandshake2(pub *rsa.PublicKey) (*msg.AuthSessionHS2, err
 }
 
 func (s *Session) Encrypt(plaintext []byte) ([]byte, error) {
-	return EncryptAESWithHMAC(plaintext, s.SharedKey, s.LocalHMAC)
+
+	var sharedKey, localHMAC []byte
+	var ciphertext []byte
+	var err error
+
+	s.lock.Lock()
+	sharedKey, localHMAC = s.SharedKey, s.LocalHMAC
+	s.lock.Unlock()
+
+	if ciphertext, err = EncryptAESWithHMAC(s.random, plaintext, sharedKey, localHMAC); err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.LastUsed = s.clock.Now()
+	s.BytesEncrypted += uint64(len(plaintext))
+	return ciphertext, nil
 }
 
 func (s *Session) Decrypt(ciphertext []byte) ([]byte, error) {
-	return DecryptAESWithHMAC(ciphertext, s.SharedKey, s.RemoteHMAC)
+
+	var sharedKey, remoteHMAC []byte
+	var plaintext []byte
+	var err error
+
+	s.lock.Lock()
+	sharedKey, remoteHMAC = s.SharedKey, s.RemoteHMAC
+	s.lock.Unlock()
+
+	if plaintext, err = DecryptAESWithHMAC(ciphertext, sharedKey, remoteHMAC); err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.LastUsed = s.clock.Now()
+	s.BytesDecrypted += uint64(len(plaintext))
+	return plaintext, nil
 }
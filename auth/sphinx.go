@@ -0,0 +1,601 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/limoges/p2pnet/msg"
+)
+
+// Sphinx packets carry a message over up to SphinxMaxHops hops without any
+// circuit being set up. Each hop derives its keys from the packet's ephemeral
+// key and its own static X25519 key, and blinds the ephemeral key before
+// passing the packet on. The header and the payload keep the same size at
+// every hop, so a hop learns neither its position in the path nor the length
+// of the path, and cannot link the packets it receives to those it sends.
+//
+// The payload is encrypted with LIONESS, a wide-block cipher built from
+// AES-256-CTR and HMAC-SHA256. Changing any bit of it garbles all of it at
+// the next hop, so that a hop cannot mark a payload for a later one to
+// recognise, and the destination notices.
+const (
+	SphinxMaxHops = 6
+	// A hop's route: a flag, and the address of the next hop or the id of
+	// a reply.
+	SphinxRouteLength = 1 + msg.IPLength + 2
+	SphinxMacLength   = sha256.Size
+	// The routing information holds a route and a tag for each hop.
+	SphinxRoutingLength = SphinxMaxHops * (SphinxRouteLength + SphinxMacLength)
+	SphinxHeaderLength  = msg.X25519KeyLength + SphinxRoutingLength + SphinxMacLength
+	SphinxPayloadLength = 1024
+	SphinxPacketLength  = SphinxHeaderLength + SphinxPayloadLength
+	// The largest message a packet carries.
+	SphinxMaxDataLength = SphinxPayloadLength - sphinxZeroLength - 2
+)
+
+const (
+	sphinxHopLength = SphinxRouteLength + SphinxMacLength
+	// The payload starts with zeroes, which the last hop checks.
+	sphinxZeroLength = 16
+	// LIONESS splits the payload after the length of an AES-256 key.
+	lionessLeftLength = 32
+	// The info strings separating the keys derived from a shared secret.
+	sphinxRoutingInfo = "p2pnet sphinx routing"
+	sphinxMacInfo     = "p2pnet sphinx mac"
+	sphinxPayloadInfo = "p2pnet sphinx payload"
+	sphinxBlindInfo   = "p2pnet sphinx blinding"
+	sphinxTagInfo     = "p2pnet sphinx tag"
+)
+
+// Route flags.
+const (
+	sphinxRelay   = 0
+	sphinxDeliver = 1
+	sphinxReply   = 2
+)
+
+var (
+	ErrSphinxPath      = errors.New("A Sphinx path needs 1 to 6 hops, of which only the last delivers")
+	ErrSphinxReply     = errors.New("Only the last hop of a reply block delivers a reply")
+	ErrSphinxTooLarge  = errors.New("The message is too large for a Sphinx packet")
+	ErrSphinxLength    = errors.New("The Sphinx packet has the wrong length")
+	ErrSphinxTampered  = errors.New("The Sphinx header has been tampered with")
+	ErrSphinxCorrupted = errors.New("The Sphinx payload has been tampered with")
+)
+
+// SphinxRoute tells a hop what to do with a packet: relay it to the onion
+// module at IPAddr and Port, or deliver its payload. A reply is delivered to
+// the creator of the reply block with the Id, who alone can read it.
+type SphinxRoute struct {
+	Deliver bool
+	Reply   bool
+	Id      [msg.ReplyIdLength]byte
+	IPAddr  [msg.IPLength]byte
+	Port    uint16
+}
+
+// SphinxHop is a hop of a Sphinx path: its static key, and where it sends the
+// packet.
+type SphinxHop struct {
+	Key   *ecdh.PublicKey
+	Route SphinxRoute
+}
+
+// SphinxResult is what a hop learns from a packet.
+type SphinxResult struct {
+	Route SphinxRoute
+	// Identifies the packet, so that the hop refuses it a second time.
+	Tag [sha256.Size]byte
+	// The packet for the next hop, or the message when the route delivers.
+	Packet []byte
+	Data   []byte
+	// The payload of a reply, which OpenSphinxReply reads.
+	Payload []byte
+}
+
+// SphinxReplyBlock lets whoever holds it send one packet back to its
+// creator, through hops only the creator knows, from the first hop on. The
+// reply is encrypted with the Key before the hops add their layers.
+type SphinxReplyBlock struct {
+	Header []byte
+	Key    [msg.ReplyKeyLength]byte
+}
+
+// SphinxReplySecret is what the creator of a reply block keeps to read the
+// reply.
+type SphinxReplySecret struct {
+	hops []lionessKey
+	key  lionessKey
+}
+
+// sphinxKeys are the keys a hop derives from its shared secret.
+type sphinxKeys struct {
+	routing []byte
+	mac     []byte
+	payload lionessKey
+}
+
+// lionessKey holds the keys of the four rounds of LIONESS.
+type lionessKey [4][]byte
+
+// NewSphinxPacket wraps the data for the hops, in order. The last hop must
+// deliver the data, and every other one relay it.
+func NewSphinxPacket(random io.Reader, hops []SphinxHop, data []byte) ([]byte, error) {
+
+	var header, payload []byte
+	var keys []sphinxKeys
+	var err error
+
+	if len(hops) > 0 && hops[len(hops)-1].Route.Reply {
+		return nil, ErrSphinxReply
+	}
+	if payload, err = newSphinxPayload(data); err != nil {
+		return nil, err
+	}
+	if header, keys, err = newSphinxHeader(random, hops); err != nil {
+		return nil, err
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		if err = lionessEncrypt(keys[i].payload, payload); err != nil {
+			return nil, err
+		}
+	}
+	return append(header, payload...), nil
+}
+
+// NewSphinxReplyBlock creates a reply block leading back to us through the
+// hops, in order. The last hop is us, and delivers the reply.
+func NewSphinxReplyBlock(random io.Reader, hops []SphinxHop) (*SphinxReplyBlock, *SphinxReplySecret, error) {
+
+	var block *SphinxReplyBlock
+	var secret *SphinxReplySecret
+	var keys []sphinxKeys
+	var err error
+
+	if len(hops) == 0 || !hops[len(hops)-1].Route.Reply {
+		return nil, nil, ErrSphinxReply
+	}
+
+	block = &SphinxReplyBlock{}
+	if block.Header, keys, err = newSphinxHeader(random, hops); err != nil {
+		return nil, nil, err
+	}
+	if _, err = io.ReadFull(random, block.Key[:]); err != nil {
+		return nil, nil, err
+	}
+
+	secret = &SphinxReplySecret{key: splitLionessKey(block.Key[:])}
+	for _, key := range keys {
+		secret.hops = append(secret.hops, key.payload)
+	}
+	return block, secret, nil
+}
+
+// NewSphinxReply wraps the data for the reply block.
+func NewSphinxReply(block *SphinxReplyBlock, data []byte) ([]byte, error) {
+
+	var payload []byte
+	var err error
+
+	if len(block.Header) != SphinxHeaderLength {
+		return nil, ErrSphinxLength
+	}
+	if payload, err = newSphinxPayload(data); err != nil {
+		return nil, err
+	}
+	if err = lionessEncrypt(splitLionessKey(block.Key[:]), payload); err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, block.Header...), payload...), nil
+}
+
+// OpenSphinxReply adds back the layers the hops removed from the payload of
+// the reply, and returns its message.
+func OpenSphinxReply(secret *SphinxReplySecret, payload []byte) ([]byte, error) {
+
+	var err error
+
+	if len(payload) != SphinxPayloadLength {
+		return nil, ErrSphinxLength
+	}
+	payload = append([]byte{}, payload...)
+	for i := len(secret.hops) - 1; i >= 0; i-- {
+		if err = lionessEncrypt(secret.hops[i], payload); err != nil {
+			return nil, err
+		}
+	}
+	if err = lionessDecrypt(secret.key, payload); err != nil {
+		return nil, err
+	}
+	return openSphinxPayload(payload)
+}
+
+// newSphinxHeader builds the header leading through the hops, and returns it
+// with the keys each hop will derive.
+func newSphinxHeader(random io.Reader, hops []SphinxHop) ([]byte, []sphinxKeys, error) {
+
+	var ephemeral *ecdh.PrivateKey
+	var alpha []byte
+	var secrets [][]byte
+	var keys []sphinxKeys
+	var filler, routing, padding, tag []byte
+	var err error
+
+	if len(hops) == 0 || len(hops) > SphinxMaxHops {
+		return nil, nil, ErrSphinxPath
+	}
+	for i, hop := range hops {
+		if hop.Route.Deliver != (i == len(hops)-1) {
+			return nil, nil, ErrSphinxPath
+		}
+	}
+
+	if ephemeral, err = newX25519Key(random); err != nil {
+		return nil, nil, err
+	}
+	alpha = ephemeral.PublicKey().Bytes()
+	if secrets, err = sphinxSecrets(ephemeral, hops); err != nil {
+		return nil, nil, err
+	}
+	keys = make([]sphinxKeys, len(secrets))
+	for i, secret := range secrets {
+		if keys[i], err = deriveSphinxKeys(secret); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// The filler is what the hops before the last shift into the routing
+	// information. The tags must cover it as the hops will see it.
+	for i := 1; i < len(hops); i++ {
+		filler = append(filler, make([]byte, sphinxHopLength)...)
+		xorBytes(filler, sphinxStream(keys[i-1].routing)[SphinxRoutingLength-(i-1)*sphinxHopLength:])
+	}
+
+	// The last hop finds its route followed by random padding, which hides
+	// the length of the path from it.
+	padding = make([]byte, SphinxRoutingLength-len(hops)*sphinxHopLength)
+	if _, err = io.ReadFull(random, padding); err != nil {
+		return nil, nil, err
+	}
+	routing = encodeSphinxRoute(hops[len(hops)-1].Route)
+	routing = append(routing, make([]byte, SphinxMacLength)...)
+	routing = append(routing, padding...)
+	xorBytes(routing, sphinxStream(keys[len(hops)-1].routing))
+	routing = append(routing, filler...)
+	tag = computeSphinxMac(keys[len(hops)-1].mac, routing)
+
+	for i := len(hops) - 2; i >= 0; i-- {
+		next := encodeSphinxRoute(hops[i].Route)
+		next = append(next, tag...)
+		next = append(next, routing[:SphinxRoutingLength-sphinxHopLength]...)
+		xorBytes(next, sphinxStream(keys[i].routing))
+		routing = next
+		tag = computeSphinxMac(keys[i].mac, routing)
+	}
+
+	return bytes.Join([][]byte{alpha, routing, tag}, nil), keys, nil
+}
+
+// newSphinxPayload returns the payload carrying the data, before any layer
+// is added.
+func newSphinxPayload(data []byte) ([]byte, error) {
+
+	var payload []byte
+
+	if len(data) > SphinxMaxDataLength {
+		return nil, ErrSphinxTooLarge
+	}
+	payload = make([]byte, SphinxPayloadLength)
+	binary.BigEndian.PutUint16(payload[sphinxZeroLength:], uint16(len(data)))
+	copy(payload[sphinxZeroLength+2:], data)
+	return payload, nil
+}
+
+// ProcessSphinxPacket removes the layer of the hop with the key from the
+// packet.
+func ProcessSphinxPacket(key *ecdh.PrivateKey, packet []byte) (*SphinxResult, error) {
+
+	var alpha, routing, tag, payload []byte
+	var point *ecdh.PublicKey
+	var secret []byte
+	var keys sphinxKeys
+	var shifted []byte
+	var blinding *ecdh.PrivateKey
+	var result *SphinxResult
+	var err error
+
+	if len(packet) != SphinxPacketLength {
+		return nil, ErrSphinxLength
+	}
+	alpha = packet[:msg.X25519KeyLength]
+	routing = packet[msg.X25519KeyLength : msg.X25519KeyLength+SphinxRoutingLength]
+	tag = packet[msg.X25519KeyLength+SphinxRoutingLength : SphinxHeaderLength]
+	payload = append([]byte{}, packet[SphinxHeaderLength:]...)
+
+	if point, err = ecdh.X25519().NewPublicKey(alpha); err != nil {
+		return nil, err
+	}
+	if secret, err = key.ECDH(point); err != nil {
+		return nil, err
+	}
+	if keys, err = deriveSphinxKeys(secret); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(tag, computeSphinxMac(keys.mac, routing)) {
+		return nil, ErrSphinxTampered
+	}
+
+	result = &SphinxResult{}
+	result.Tag = sha256.Sum256(append([]byte(sphinxTagInfo), secret...))
+	if err = lionessDecrypt(keys.payload, payload); err != nil {
+		return nil, err
+	}
+
+	shifted = append(append([]byte{}, routing...), make([]byte, sphinxHopLength)...)
+	xorBytes(shifted, sphinxStream(keys.routing))
+	if result.Route, err = decodeSphinxRoute(shifted[:SphinxRouteLength]); err != nil {
+		return nil, err
+	}
+
+	if result.Route.Reply {
+		result.Payload = payload
+		return result, nil
+	}
+	if result.Route.Deliver {
+		if result.Data, err = openSphinxPayload(payload); err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+
+	if blinding, err = sphinxBlinding(alpha, secret); err != nil {
+		return nil, err
+	}
+	if alpha, err = blinding.ECDH(point); err != nil {
+		return nil, err
+	}
+	result.Packet = bytes.Join([][]byte{
+		alpha,
+		shifted[sphinxHopLength:],
+		shifted[SphinxRouteLength:sphinxHopLength],
+		payload,
+	}, nil)
+	return result, nil
+}
+
+// sphinxSecrets computes the secret the packet's ephemeral key shares with
+// each hop, once blinded by the hops before it.
+func sphinxSecrets(ephemeral *ecdh.PrivateKey, hops []SphinxHop) ([][]byte, error) {
+
+	var alpha, secret []byte
+	var point *ecdh.PublicKey
+	var blinding *ecdh.PrivateKey
+	var blindings []*ecdh.PrivateKey
+	var secrets [][]byte
+	var err error
+
+	alpha = ephemeral.PublicKey().Bytes()
+	for _, hop := range hops {
+		if secret, err = ephemeral.ECDH(hop.Key); err != nil {
+			return nil, err
+		}
+		for _, blinding = range blindings {
+			if point, err = ecdh.X25519().NewPublicKey(secret); err != nil {
+				return nil, err
+			}
+			if secret, err = blinding.ECDH(point); err != nil {
+				return nil, err
+			}
+		}
+		secrets = append(secrets, secret)
+
+		if blinding, err = sphinxBlinding(alpha, secret); err != nil {
+			return nil, err
+		}
+		blindings = append(blindings, blinding)
+		if point, err = ecdh.X25519().NewPublicKey(alpha); err != nil {
+			return nil, err
+		}
+		if alpha, err = blinding.ECDH(point); err != nil {
+			return nil, err
+		}
+	}
+	return secrets, nil
+}
+
+// sphinxBlinding derives the factor a hop blinds the ephemeral key with.
+func sphinxBlinding(alpha, secret []byte) (*ecdh.PrivateKey, error) {
+
+	var blinding []byte
+	var err error
+
+	if blinding, err = hkdf.Key(sha256.New, secret, alpha, sphinxBlindInfo, msg.X25519KeyLength); err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPrivateKey(blinding)
+}
+
+func deriveSphinxKeys(secret []byte) (sphinxKeys, error) {
+
+	var keys sphinxKeys
+	var payload []byte
+	var err error
+
+	if keys.routing, err = hkdf.Key(sha256.New, secret, nil, sphinxRoutingInfo, 32); err != nil {
+		return keys, err
+	}
+	if keys.mac, err = hkdf.Key(sha256.New, secret, nil, sphinxMacInfo, 32); err != nil {
+		return keys, err
+	}
+	if payload, err = hkdf.Key(sha256.New, secret, nil, sphinxPayloadInfo, msg.ReplyKeyLength); err != nil {
+		return keys, err
+	}
+	keys.payload = splitLionessKey(payload)
+	return keys, nil
+}
+
+// splitLionessKey splits the key material into the keys of the rounds.
+func splitLionessKey(material []byte) lionessKey {
+
+	var key lionessKey
+
+	for i := range key {
+		key[i] = material[32*i : 32*(i+1)]
+	}
+	return key
+}
+
+// sphinxStream returns the key stream a hop shifts the routing information
+// with.
+func sphinxStream(key []byte) []byte {
+
+	var stream []byte
+
+	stream = make([]byte, SphinxRoutingLength+sphinxHopLength)
+	xorKeyStream(key, stream)
+	return stream
+}
+
+// xorKeyStream encrypts or decrypts the data in place with AES-256 in
+// counter mode. Every key is used for a single message, so the IV is zero.
+// LIONESS combines its keys with the payload to keep it so.
+func xorKeyStream(key, data []byte) error {
+
+	var block cipher.Block
+	var err error
+
+	if block, err = aes.NewCipher(key); err != nil {
+		return err
+	}
+	cipher.NewCTR(block, make([]byte, aes.BlockSize)).XORKeyStream(data, data)
+	return nil
+}
+
+// lionessEncrypt encrypts the payload in place.
+func lionessEncrypt(key lionessKey, payload []byte) error {
+
+	var left, right []byte
+
+	left, right = payload[:lionessLeftLength], payload[lionessLeftLength:]
+	if err := lionessStream(key[0], left, right); err != nil {
+		return err
+	}
+	lionessHash(key[1], right, left)
+	if err := lionessStream(key[2], left, right); err != nil {
+		return err
+	}
+	lionessHash(key[3], right, left)
+	return nil
+}
+
+// lionessDecrypt decrypts the payload in place.
+func lionessDecrypt(key lionessKey, payload []byte) error {
+
+	var left, right []byte
+
+	left, right = payload[:lionessLeftLength], payload[lionessLeftLength:]
+	lionessHash(key[3], right, left)
+	if err := lionessStream(key[2], left, right); err != nil {
+		return err
+	}
+	lionessHash(key[1], right, left)
+	return lionessStream(key[0], left, right)
+}
+
+// lionessStream encrypts the right part with the key combined with the left
+// part.
+func lionessStream(key, left, right []byte) error {
+
+	var combined []byte
+
+	combined = append([]byte{}, key...)
+	xorBytes(combined, left)
+	return xorKeyStream(combined, right)
+}
+
+// lionessHash combines the left part with the keyed hash of the right part.
+func lionessHash(key, right, left []byte) {
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(right)
+	xorBytes(left, mac.Sum(nil))
+}
+
+func xorBytes(data, stream []byte) {
+	for i := range data {
+		data[i] ^= stream[i]
+	}
+}
+
+func computeSphinxMac(key, routing []byte) []byte {
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(routing)
+	return mac.Sum(nil)
+}
+
+func encodeSphinxRoute(route SphinxRoute) []byte {
+
+	var encoded []byte
+
+	encoded = make([]byte, SphinxRouteLength)
+	if route.Reply {
+		encoded[0] = sphinxReply
+		copy(encoded[1:], route.Id[:])
+		return encoded
+	}
+	if route.Deliver {
+		encoded[0] = sphinxDeliver
+	}
+	copy(encoded[1:], route.IPAddr[:])
+	binary.BigEndian.PutUint16(encoded[1+msg.IPLength:], route.Port)
+	return encoded
+}
+
+func decodeSphinxRoute(encoded []byte) (SphinxRoute, error) {
+
+	var route SphinxRoute
+
+	switch encoded[0] {
+	case sphinxRelay:
+	case sphinxDeliver:
+		route.Deliver = true
+	case sphinxReply:
+		route.Deliver = true
+		route.Reply = true
+		copy(route.Id[:], encoded[1:])
+		return route, nil
+	default:
+		return route, ErrSphinxTampered
+	}
+	copy(route.IPAddr[:], encoded[1:])
+	route.Port = binary.BigEndian.Uint16(encoded[1+msg.IPLength:])
+	return route, nil
+}
+
+// openSphinxPayload checks the zeroes the payload starts with, which only
+// survive if no hop altered it, and returns the message.
+func openSphinxPayload(payload []byte) ([]byte, error) {
+
+	var length int
+
+	for _, b := range payload[:sphinxZeroLength] {
+		if b != 0 {
+			return nil, ErrSphinxCorrupted
+		}
+	}
+	length = int(binary.BigEndian.Uint16(payload[sphinxZeroLength:]))
+	if length > SphinxMaxDataLength {
+		return nil, ErrSphinxCorrupted
+	}
+	return payload[sphinxZeroLength+2 : sphinxZeroLength+2+length], nil
+}
@@ -0,0 +1,329 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"net"
+	"testing"
+)
+
+// testSphinxPath returns the keys of n hops, and the path through them. Each
+// hop relays to the address of the next one, and the last delivers.
+func testSphinxPath(t *testing.T, n int) ([]*ecdh.PrivateKey, []SphinxHop) {
+
+	var keys []*ecdh.PrivateKey
+	var hops []SphinxHop
+
+	for i := 0; i < n; i++ {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		hops = append(hops, SphinxHop{Key: key.PublicKey()})
+	}
+	for i := range hops {
+		if i == n-1 {
+			hops[i].Route.Deliver = true
+			continue
+		}
+		copy(hops[i].Route.IPAddr[:], net.IPv4(10, 0, 0, byte(i+2)).To16())
+		hops[i].Route.Port = uint16(7000 + i + 1)
+	}
+	return keys, hops
+}
+
+// Packets keep their length at every hop of paths of every length, and only
+// the last hop gets the data.
+func TestSphinxPacket(t *testing.T) {
+
+	for n := 1; n <= SphinxMaxHops; n++ {
+		for _, data := range [][]byte{{}, []byte("hello"), bytes.Repeat([]byte{7}, SphinxMaxDataLength)} {
+
+			keys, hops := testSphinxPath(t, n)
+			packet, err := NewSphinxPacket(rand.Reader, hops, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, key := range keys {
+				if len(packet) != SphinxPacketLength {
+					t.Fatalf("%v hops: the packet for hop %v is %v bytes", n, i, len(packet))
+				}
+				result, err := ProcessSphinxPacket(key, packet)
+				if err != nil {
+					t.Fatalf("%v hops: hop %v: %v", n, i, err)
+				}
+				if result.Route != hops[i].Route {
+					t.Fatalf("%v hops: hop %v was told %v", n, i, result.Route)
+				}
+				if i == n-1 {
+					if !bytes.Equal(result.Data, data) {
+						t.Fatalf("%v hops: the data was not delivered", n)
+					}
+					break
+				}
+				if result.Data != nil {
+					t.Fatalf("%v hops: hop %v saw the data", n, i)
+				}
+				// The packets a hop receives and sends share no bytes.
+				if bytes.Equal(packet[:SphinxHeaderLength], result.Packet[:SphinxHeaderLength]) ||
+					bytes.Equal(packet[SphinxHeaderLength:], result.Packet[SphinxHeaderLength:]) {
+					t.Fatalf("%v hops: hop %v passed on a part of the packet unchanged", n, i)
+				}
+				packet = result.Packet
+			}
+		}
+	}
+}
+
+func TestSphinxPacketInvalid(t *testing.T) {
+
+	var keys []*ecdh.PrivateKey
+	var hops []SphinxHop
+	var packet []byte
+	var err error
+
+	if _, err = NewSphinxPacket(rand.Reader, nil, nil); err != ErrSphinxPath {
+		t.Fatalf("expected %v for no hops, got %v", ErrSphinxPath, err)
+	}
+	_, hops = testSphinxPath(t, SphinxMaxHops+1)
+	if _, err = NewSphinxPacket(rand.Reader, hops, nil); err != ErrSphinxPath {
+		t.Fatalf("expected %v for too many hops, got %v", ErrSphinxPath, err)
+	}
+	_, hops = testSphinxPath(t, 3)
+	hops[1].Route.Deliver = true
+	if _, err = NewSphinxPacket(rand.Reader, hops, nil); err != ErrSphinxPath {
+		t.Fatalf("expected %v for a hop delivering early, got %v", ErrSphinxPath, err)
+	}
+	keys, hops = testSphinxPath(t, 3)
+	if _, err = NewSphinxPacket(rand.Reader, hops, make([]byte, SphinxMaxDataLength+1)); err != ErrSphinxTooLarge {
+		t.Fatalf("expected %v, got %v", ErrSphinxTooLarge, err)
+	}
+
+	if packet, err = NewSphinxPacket(rand.Reader, hops, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ProcessSphinxPacket(keys[0], packet[1:]); err != ErrSphinxLength {
+		t.Fatalf("expected %v, got %v", ErrSphinxLength, err)
+	}
+	if _, err = ProcessSphinxPacket(keys[1], packet); err != ErrSphinxTampered {
+		t.Fatalf("expected %v for the wrong hop, got %v", ErrSphinxTampered, err)
+	}
+}
+
+// A change to any part of a packet is noticed: to the header by the next hop,
+// to the payload by the destination.
+func TestSphinxTampering(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		hop    int
+		offset int
+		err    error
+		// The hop which notices.
+		notices int
+	}{
+		{"ephemeral key", 0, 0, ErrSphinxTampered, 0},
+		{"routing", 0, 40, ErrSphinxTampered, 0},
+		{"tag", 0, SphinxHeaderLength - 1, ErrSphinxTampered, 0},
+		{"routing after a hop", 1, 100, ErrSphinxTampered, 1},
+		{"payload zeroes", 0, SphinxHeaderLength, ErrSphinxCorrupted, 2},
+		{"payload data", 0, SphinxHeaderLength + 100, ErrSphinxCorrupted, 2},
+		{"payload end", 0, SphinxPacketLength - 1, ErrSphinxCorrupted, 2},
+		{"payload after a hop", 1, SphinxHeaderLength + 500, ErrSphinxCorrupted, 2},
+		{"payload at the last hop", 2, SphinxPacketLength - 1, ErrSphinxCorrupted, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			keys, hops := testSphinxPath(t, 3)
+			packet, err := NewSphinxPacket(rand.Reader, hops, []byte("hello"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, key := range keys {
+				if i == test.hop {
+					packet[test.offset] ^= 1
+				}
+				result, err := ProcessSphinxPacket(key, packet)
+				if i == test.notices {
+					if err != test.err {
+						t.Fatalf("expected %v at hop %v, got %v", test.err, i, err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("hop %v: %v", i, err)
+				}
+				packet = result.Packet
+			}
+			t.Fatal("nobody noticed")
+		})
+	}
+}
+
+// A hop gets the same tag for the same packet, so that it can refuse it a
+// second time, and different tags for different packets.
+func TestSphinxReplayTag(t *testing.T) {
+
+	var keys []*ecdh.PrivateKey
+	var hops []SphinxHop
+	var tags map[[32]byte]bool
+
+	keys, hops = testSphinxPath(t, 3)
+	tags = make(map[[32]byte]bool)
+
+	for count := 0; count < 2; count++ {
+		packet, err := NewSphinxPacket(rand.Reader, hops, []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, key := range keys {
+			result, err := ProcessSphinxPacket(key, packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			replayed, err := ProcessSphinxPacket(key, packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if replayed.Tag != result.Tag {
+				t.Fatalf("hop %v got another tag for the same packet", i)
+			}
+			if tags[result.Tag] {
+				t.Fatalf("hop %v got the tag of another packet", i)
+			}
+			tags[result.Tag] = true
+			packet = result.Packet
+		}
+	}
+}
+
+// testReplyBlock returns the keys of n hops, and a reply block through them
+// to the last one.
+func testReplyBlock(t *testing.T, n int) ([]*ecdh.PrivateKey, *SphinxReplyBlock, *SphinxReplySecret) {
+
+	keys, hops := testSphinxPath(t, n)
+	hops[n-1].Route = SphinxRoute{Deliver: true, Reply: true, Id: [16]byte{1, 2, 3}}
+	block, secret, err := NewSphinxReplyBlock(rand.Reader, hops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys, block, secret
+}
+
+// A reply goes back through the hops of its reply block, and only its
+// creator reads it.
+func TestSphinxReply(t *testing.T) {
+
+	for n := 1; n <= SphinxMaxHops; n++ {
+		for _, data := range [][]byte{{}, []byte("hello"), bytes.Repeat([]byte{7}, SphinxMaxDataLength)} {
+
+			keys, block, secret := testReplyBlock(t, n)
+			packet, err := NewSphinxReply(block, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var result *SphinxResult
+			for i, key := range keys {
+				if len(packet) != SphinxPacketLength {
+					t.Fatalf("%v hops: the packet for hop %v is %v bytes", n, i, len(packet))
+				}
+				if result, err = ProcessSphinxPacket(key, packet); err != nil {
+					t.Fatalf("%v hops: hop %v: %v", n, i, err)
+				}
+				if result.Route.Reply != (i == n-1) {
+					t.Fatalf("%v hops: hop %v was told %v", n, i, result.Route)
+				}
+				packet = result.Packet
+			}
+			if result.Route.Id != [16]byte{1, 2, 3} || result.Data != nil {
+				t.Fatalf("%v hops: the reply was delivered as %v", n, result.Route)
+			}
+
+			received, err := OpenSphinxReply(secret, result.Payload)
+			if err != nil {
+				t.Fatalf("%v hops: %v", n, err)
+			}
+			if !bytes.Equal(received, data) {
+				t.Fatalf("%v hops: the reply was not delivered", n)
+			}
+		}
+	}
+}
+
+func TestSphinxReplyInvalid(t *testing.T) {
+
+	var hops []SphinxHop
+	var err error
+
+	_, hops = testSphinxPath(t, 3)
+	if _, _, err = NewSphinxReplyBlock(rand.Reader, hops); err != ErrSphinxReply {
+		t.Fatalf("expected %v for a path delivering data, got %v", ErrSphinxReply, err)
+	}
+	hops[2].Route.Reply = true
+	if _, err = NewSphinxPacket(rand.Reader, hops, nil); err != ErrSphinxReply {
+		t.Fatalf("expected %v for data sent as a reply, got %v", ErrSphinxReply, err)
+	}
+
+	_, block, _ := testReplyBlock(t, 3)
+	if _, err = NewSphinxReply(block, make([]byte, SphinxMaxDataLength+1)); err != ErrSphinxTooLarge {
+		t.Fatalf("expected %v, got %v", ErrSphinxTooLarge, err)
+	}
+}
+
+// A change to the payload of a reply is noticed by the creator of the reply
+// block, and another reply block does not open it.
+func TestSphinxReplyTampering(t *testing.T) {
+
+	var payloads [][]byte
+
+	keys, block, secret := testReplyBlock(t, 3)
+	_, _, other := testReplyBlock(t, 3)
+	for _, offset := range []int{SphinxHeaderLength, SphinxHeaderLength + 100, SphinxPacketLength - 1} {
+
+		packet, err := NewSphinxReply(block, []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet[offset] ^= 1
+		for _, key := range keys {
+			result, err := ProcessSphinxPacket(key, packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			packet = result.Packet
+			if result.Route.Reply {
+				payloads = append(payloads, result.Payload)
+			}
+		}
+	}
+
+	for _, payload := range payloads {
+		if _, err := OpenSphinxReply(secret, payload); err != ErrSphinxCorrupted {
+			t.Fatalf("expected %v, got %v", ErrSphinxCorrupted, err)
+		}
+	}
+
+	packet, err := NewSphinxReply(block, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		result, err := ProcessSphinxPacket(key, packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Route.Reply {
+			if _, err = OpenSphinxReply(other, result.Payload); err != ErrSphinxCorrupted {
+				t.Fatalf("expected %v for another reply block, got %v", ErrSphinxCorrupted, err)
+			}
+		}
+		packet = result.Packet
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"reflect"
 	"strconv"
+	"strings"
 
 	"github.com/vaughan0/go-ini"
 )
@@ -61,6 +62,9 @@ func (c Configurations) Get(data interface{}, section string, key string) bool {
 			ok = false
 		}
 		*data = intValue
+	case *[]string:
+		// Lists are given as comma-separated values.
+		*data = splitList(value)
 	default:
 		panic(fmt.Sprintf("handling for %v not implemented", reflect.TypeOf(data)))
 	}
@@ -79,7 +83,35 @@ func (c Configurations) Init(data interface{}, section string, key string,
 		*data = defaultValue.(int)
 	case *string:
 		*data = defaultValue.(string)
+	case *[]string:
+		*data = defaultValue.([]string)
 	default:
 		panic(fmt.Sprintf("handling for %v not implemented", data))
 	}
 }
+
+// Section returns the key-values of the section. Sections holding a table
+// rather than known keys are read this way.
+func (c Configurations) Section(section string) map[string]string {
+
+	var values map[string]string
+
+	values = make(map[string]string)
+	for key, value := range c.file[section] {
+		values[key] = value
+	}
+	return values
+}
+
+func splitList(value string) []string {
+
+	var list []string
+
+	list = make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -25,6 +25,15 @@ type Module interface {
 	Handle(source net.Conn, message msg.Message) error
 }
 
+// ConnectionObserver is implemented by modules which keep track of the
+// clients connected to their API.
+type ConnectionObserver interface {
+	// Connected is called when a client connects to the module's API.
+	Connected(conn net.Conn)
+	// Disconnected is called once the client's connection is closed.
+	Disconnected(conn net.Conn)
+}
+
 func Run(m Module) error {
 
 	// We launch the listeners, if they are supported by the module.
@@ -36,7 +45,7 @@ func Run(m Module) error {
 			fmt.Printf("%v: Cannot bind on %v\n", m.Name(), apiAddr)
 			return err
 		} else {
-			go listen(m, listener)
+			go listen(m, listener, true)
 			defer listener.Close()
 		}
 	}
@@ -47,7 +56,7 @@ func Run(m Module) error {
 			fmt.Printf("%v: Cannot bind on %v\n", m.Name(), p2pAddr)
 			return err
 		} else {
-			go listen(m, listener)
+			go listen(m, listener, false)
 			defer listener.Close()
 		}
 	}
@@ -59,18 +68,40 @@ func Run(m Module) error {
 	return nil
 }
 
-func listen(m Module, ln net.Listener) {
+func listen(m Module, ln net.Listener, api bool) {
 
 	for {
 		conn, err := ln.Accept()
-		if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
 			fmt.Println(err)
 		} else {
-			go handle(m, conn)
+			go serve(m, conn, api)
 		}
 	}
 }
 
+func serve(m Module, conn net.Conn, api bool) {
+
+	var observer ConnectionObserver
+	var observed bool
+
+	defer conn.Close()
+
+	if observer, observed = m.(ConnectionObserver); observed && api {
+		observer.Connected(conn)
+		defer observer.Disconnected(conn)
+	}
+	handle(m, conn)
+}
+
+// Serve handles the messages received on a connection the module dialed
+// itself, until the connection is closed.
+func Serve(m Module, conn net.Conn) {
+	handle(m, conn)
+}
+
 func handle(m Module, conn net.Conn) {
 
 	// fmt.Printf("%v: New connexion from %v.\n", m.Name(), conn.RemoteAddr())
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"math"
 )
 
 const (
@@ -17,6 +18,11 @@ const (
 	AUTH_LAYER_DECRYPT        = 607
 	AUTH_LAYER_DECRYPT_RESP   = 608
 	AUTH_SESSION_CLOSE        = 609
+	AUTH_SESSION_START_AS     = 610
+	AUTH_SESSION_LIST         = 611
+	AUTH_SESSION_LIST_RESP    = 612
+	AUTH_SESSION_QUERY        = 613
+	AUTH_SESSION_INFO         = 614
 	// Reserved up to 649.
 
 )
@@ -37,6 +43,37 @@ func NewAuthSessionStart(data []byte) (AuthSessionStart, error) {
 	return m, nil
 }
 
+// AuthSessionStartAs starts a session like AuthSessionStart, but names the
+// local identity, the SHA256 checksum of the local hostkey, to use.
+type AuthSessionStartAs struct {
+	Identity [32]byte
+	Hostkey  []byte
+}
+
+func (m AuthSessionStartAs) TypeId() uint16 {
+	return AUTH_SESSION_START_AS
+}
+
+func NewAuthSessionStartAs(data []byte) (AuthSessionStartAs, error) {
+
+	var m AuthSessionStartAs
+	var reader *bytes.Reader
+	var err error
+
+	m = AuthSessionStartAs{}
+	reader = bytes.NewReader(data)
+
+	if _, err = io.ReadFull(reader, m.Identity[:]); err != nil {
+		return m, err
+	}
+
+	m.Hostkey = make([]byte, reader.Len())
+	if _, err = io.ReadFull(reader, m.Hostkey); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
 type AuthSessionHS1 struct {
 	SessionId        uint32
 	HandshakePayload []byte
@@ -335,3 +372,134 @@ func NewAuthSessionClose(data []byte) (AuthSessionClose, error) {
 	}
 	return m, nil
 }
+
+type AuthSessionList struct {
+	// This is empty.
+}
+
+func (m AuthSessionList) TypeId() uint16 {
+	return AUTH_SESSION_LIST
+}
+
+func NewAuthSessionList(data []byte) (AuthSessionList, error) {
+	return AuthSessionList{}, nil
+}
+
+// The most session ids an AUTH_SESSION_LIST_RESP carries, within the size of
+// a message.
+const MaximumSessionListLength = (math.MaxUint16 - HeaderLength - 4) / 4
+
+type AuthSessionListResp struct {
+	Count      uint16
+	Reserved   uint16
+	SessionIds []uint32
+}
+
+func (m AuthSessionListResp) TypeId() uint16 {
+	return AUTH_SESSION_LIST_RESP
+}
+
+func NewAuthSessionListResp(data []byte) (AuthSessionListResp, error) {
+
+	var m AuthSessionListResp
+	var reader *bytes.Reader
+	var err error
+
+	m = AuthSessionListResp{}
+	reader = bytes.NewReader(data)
+
+	if err = binary.Read(reader, binary.BigEndian, &m.Count); err != nil {
+		return m, err
+	}
+	if err = binary.Read(reader, binary.BigEndian, &m.Reserved); err != nil {
+		return m, err
+	}
+
+	m.SessionIds = make([]uint32, m.Count)
+	for i := 0; i < int(m.Count); i++ {
+		if err = binary.Read(reader, binary.BigEndian, &m.SessionIds[i]); err != nil {
+			return m, err
+		}
+	}
+	return m, nil
+}
+
+type AuthSessionQuery struct {
+	SessionId uint32
+}
+
+func (m AuthSessionQuery) TypeId() uint16 {
+	return AUTH_SESSION_QUERY
+}
+
+func NewAuthSessionQuery(data []byte) (AuthSessionQuery, error) {
+
+	var m AuthSessionQuery
+	var reader *bytes.Reader
+	var err error
+
+	m = AuthSessionQuery{}
+	reader = bytes.NewReader(data)
+
+	if err = binary.Read(reader, binary.BigEndian, &m.SessionId); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// AuthSessionInfo describes a session. Times are given in nanoseconds since
+// the Unix epoch. The CipherSuite is zero when the session does not exist.
+type AuthSessionInfo struct {
+	SessionId      uint32
+	CipherSuite    uint16
+	Reserved       uint16
+	Created        uint64
+	LastUsed       uint64
+	BytesEncrypted uint64
+	BytesDecrypted uint64
+	LocalIdentity  [32]byte
+	RemoteIdentity [32]byte
+}
+
+func (m AuthSessionInfo) TypeId() uint16 {
+	return AUTH_SESSION_INFO
+}
+
+func NewAuthSessionInfo(data []byte) (AuthSessionInfo, error) {
+
+	var m AuthSessionInfo
+	var reader *bytes.Reader
+	var err error
+
+	m = AuthSessionInfo{}
+	reader = bytes.NewReader(data)
+
+	if err = binary.Read(reader, binary.BigEndian, &m.SessionId); err != nil {
+		return m, err
+	}
+	if err = binary.Read(reader, binary.BigEndian, &m.CipherSuite); err != nil {
+		return m, err
+	}
+	if err = binary.Read(reader, binary.BigEndian, &m.Reserved); err != nil {
+		return m, err
+	}
+	if err = binary.Read(reader, binary.BigEndian, &m.Created); err != nil {
+		return m, err
+	}
+	if err = binary.Read(reader, binary.BigEndian, &m.LastUsed); err != nil {
+		return m, err
+	}
+	if err = binary.Read(reader, binary.BigEndian, &m.BytesEncrypted); err != nil {
+		return m, err
+	}
+	if err = binary.Read(reader, binary.BigEndian, &m.BytesDecrypted); err != nil {
+		return m, err
+	}
+	if _, err = io.ReadFull(reader, m.LocalIdentity[:]); err != nil {
+		return m, err
+	}
+	if _, err = io.ReadFull(reader, m.RemoteIdentity[:]); err != nil {
+		return m, err
+	}
+	return m, nil
+}
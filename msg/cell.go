@@ -0,0 +1,306 @@
+package msg
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sync"
+)
+
+// Onion P2P traffic is carried in cells of CellSize bytes, whatever the
+// message. A cell holds a command, the tunnel id, and a fragment of the
+// message, padded to the size of the cell. The whole cell is encrypted with
+// the link's cipher, so that an observer of the link only sees a stream of
+// identical looking cells.
+const (
+	CellSize         = 1024
+	CellHeaderLength = 8
+	// The number of messages a CellReader reassembles at once. A CellWriter
+	// never interleaves the cells of its messages, so it has at most one in
+	// progress.
+	MaximumPartialMessages = 8
+)
+
+// Cell commands.
+const (
+	CELL_PADDING = 0
+	CELL_CREATE  = 1
+	CELL_CREATED = 2
+	CELL_RELAY   = 3
+	CELL_DESTROY = 4
+	CELL_SPHINX  = 5
+)
+
+// Cell flags.
+const (
+	// The message continues in the next cell of the tunnel.
+	CellFlagMore = 1
+)
+
+var (
+	ErrNotACellMessage = errors.New("The message cannot be carried in cells")
+	ErrCellTooLarge    = errors.New("The message spread over cells is too large")
+	ErrTooManyPartials = errors.New("Too many messages spread over cells are in progress")
+)
+
+// Cell is a decrypted cell.
+type Cell struct {
+	Command  uint8
+	Flags    uint8
+	Length   uint16
+	TunnelId uint32
+	Payload  []byte
+}
+
+// CellCommand returns the cell command carrying messages of the given type.
+func CellCommand(messageType uint16) (uint8, bool) {
+
+	switch messageType {
+	case ONION_CREATE:
+		return CELL_CREATE, true
+	case ONION_CREATED:
+		return CELL_CREATED, true
+	case ONION_RELAY:
+		return CELL_RELAY, true
+	case ONION_DESTROY:
+		return CELL_DESTROY, true
+	case ONION_SPHINX:
+		return CELL_SPHINX, true
+	default:
+		return 0, false
+	}
+}
+
+// CellMessageType returns the type of the messages carried by the command.
+func CellMessageType(command uint8) (uint16, bool) {
+
+	switch command {
+	case CELL_CREATE:
+		return ONION_CREATE, true
+	case CELL_CREATED:
+		return ONION_CREATED, true
+	case CELL_RELAY:
+		return ONION_RELAY, true
+	case CELL_DESTROY:
+		return ONION_DESTROY, true
+	case CELL_SPHINX:
+		return ONION_SPHINX, true
+	default:
+		return 0, false
+	}
+}
+
+// CellWriter writes messages as cells encrypted with the link's cipher.
+type CellWriter struct {
+	writer  io.Writer
+	aead    cipher.AEAD
+	counter uint64
+	lock    sync.Mutex
+}
+
+func NewCellWriter(writer io.Writer, aead cipher.AEAD) *CellWriter {
+	return &CellWriter{writer: writer, aead: aead}
+}
+
+// WriteMessage splits the message over as many cells as needed. The cells of
+// a message are never interleaved with those of another message.
+func (w *CellWriter) WriteMessage(m Message) error {
+
+	var generic GenericMessage
+	var command uint8
+	var valid bool
+	var tunnelId uint32
+	var content []byte
+	var cell Cell
+	var err error
+
+	if command, valid = CellCommand(m.TypeId()); !valid {
+		return ErrNotACellMessage
+	}
+
+	if generic, err = ConvertToGeneric(m); err != nil {
+		return err
+	}
+
+	// Every cell message starts with its tunnel id.
+	if len(generic.Content) < 4 {
+		return ErrDataTooShort
+	}
+	tunnelId = binary.BigEndian.Uint32(generic.Content)
+	content = generic.Content[4:]
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for {
+		cell = Cell{
+			Command:  command,
+			TunnelId: tunnelId,
+		}
+		if len(content) > w.payloadLength() {
+			cell.Flags = CellFlagMore
+			cell.Payload = content[:w.payloadLength()]
+		} else {
+			cell.Payload = content
+		}
+		cell.Length = uint16(len(cell.Payload))
+		content = content[len(cell.Payload):]
+
+		if err = w.writeCell(cell); err != nil {
+			return err
+		}
+		if cell.Flags&CellFlagMore == 0 {
+			return nil
+		}
+	}
+}
+
+// WritePadding writes a cell which the other end of the link drops.
+func (w *CellWriter) WritePadding() error {
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.writeCell(Cell{Command: CELL_PADDING})
+}
+
+func (w *CellWriter) payloadLength() int {
+	return CellSize - w.aead.Overhead() - CellHeaderLength
+}
+
+func (w *CellWriter) writeCell(cell Cell) error {
+
+	var plaintext []byte
+	var sealed []byte
+
+	plaintext = make([]byte, CellSize-w.aead.Overhead())
+	plaintext[0] = cell.Command
+	plaintext[1] = cell.Flags
+	binary.BigEndian.PutUint16(plaintext[2:], cell.Length)
+	binary.BigEndian.PutUint32(plaintext[4:], cell.TunnelId)
+	copy(plaintext[CellHeaderLength:], cell.Payload)
+
+	sealed = w.aead.Seal(nil, cellNonce(w.aead, w.counter), plaintext, nil)
+	w.counter = w.counter + 1
+
+	_, err := w.writer.Write(sealed)
+	return err
+}
+
+// CellReader reads the messages written by a CellWriter.
+type CellReader struct {
+	reader  io.Reader
+	aead    cipher.AEAD
+	counter uint64
+	partial map[cellKey]*bytes.Buffer
+}
+
+// cellKey identifies a message spread over several cells.
+type cellKey struct {
+	command  uint8
+	tunnelId uint32
+}
+
+func NewCellReader(reader io.Reader, aead cipher.AEAD) *CellReader {
+	return &CellReader{
+		reader:  reader,
+		aead:    aead,
+		partial: make(map[cellKey]*bytes.Buffer),
+	}
+}
+
+// ReadMessage reads cells until a complete message has been received.
+// Padding cells are dropped.
+func (r *CellReader) ReadMessage() (Message, error) {
+
+	var cell Cell
+	var key cellKey
+	var buf *bytes.Buffer
+	var present bool
+	var messageType uint16
+	var valid bool
+	var content []byte
+	var err error
+
+	for {
+		if cell, err = r.readCell(); err != nil {
+			return nil, err
+		}
+		if cell.Command == CELL_PADDING {
+			continue
+		}
+		if messageType, valid = CellMessageType(cell.Command); !valid {
+			return nil, errors.New("Unknown cell command")
+		}
+
+		key = cellKey{cell.Command, cell.TunnelId}
+		if buf, present = r.partial[key]; !present {
+			if len(r.partial) >= MaximumPartialMessages {
+				return nil, ErrTooManyPartials
+			}
+			buf = new(bytes.Buffer)
+			binary.Write(buf, binary.BigEndian, cell.TunnelId)
+			r.partial[key] = buf
+		}
+		if buf.Len()+len(cell.Payload) > math.MaxUint16-HeaderLength {
+			delete(r.partial, key)
+			return nil, ErrCellTooLarge
+		}
+		buf.Write(cell.Payload)
+
+		if cell.Flags&CellFlagMore != 0 {
+			continue
+		}
+		delete(r.partial, key)
+
+		content = buf.Bytes()
+		return ConvertFromGeneric(GenericMessage{
+			Size:    uint16(len(content) + HeaderLength),
+			Type:    messageType,
+			Content: content,
+		})
+	}
+}
+
+func (r *CellReader) readCell() (Cell, error) {
+
+	var cell Cell
+	var sealed []byte
+	var plaintext []byte
+	var err error
+
+	sealed = make([]byte, CellSize)
+	if _, err = io.ReadFull(r.reader, sealed); err != nil {
+		return cell, err
+	}
+
+	if plaintext, err = r.aead.Open(nil, cellNonce(r.aead, r.counter), sealed, nil); err != nil {
+		return cell, err
+	}
+	r.counter = r.counter + 1
+
+	cell.Command = plaintext[0]
+	cell.Flags = plaintext[1]
+	cell.Length = binary.BigEndian.Uint16(plaintext[2:])
+	cell.TunnelId = binary.BigEndian.Uint32(plaintext[4:])
+	if int(cell.Length) > len(plaintext)-CellHeaderLength {
+		return cell, ErrDataTooShort
+	}
+	cell.Payload = plaintext[CellHeaderLength : CellHeaderLength+int(cell.Length)]
+
+	return cell, nil
+}
+
+// cellNonce derives the nonce of a cell from its position on the link, so
+// that cells can be neither replayed nor reordered.
+func cellNonce(aead cipher.AEAD, counter uint64) []byte {
+
+	var nonce []byte
+
+	nonce = make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	return nonce
+}
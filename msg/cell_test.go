@@ -0,0 +1,118 @@
+package msg
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"testing"
+)
+
+func testCipher(t *testing.T) cipher.AEAD {
+
+	var block cipher.Block
+	var aead cipher.AEAD
+	var err error
+
+	if block, err = aes.NewCipher(make([]byte, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if aead, err = cipher.NewGCM(block); err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+// Messages travel as encrypted cells of a fixed size. Large messages are
+// spread over several cells, and padding cells are dropped.
+func TestCells(t *testing.T) {
+
+	var buf *bytes.Buffer
+	var writer *CellWriter
+	var reader *CellReader
+	var large []byte
+	var message Message
+	var err error
+
+	buf = new(bytes.Buffer)
+	writer = NewCellWriter(buf, testCipher(t))
+	large = bytes.Repeat([]byte{7}, 5000)
+
+	if err = writer.WriteMessage(OnionDestroy{TunnelId: 9}); err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.WritePadding(); err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.WriteMessage(OnionRelay{TunnelId: 3, Payload: large}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 7*CellSize {
+		t.Fatalf("wrote %v bytes instead of 7 cells", buf.Len())
+	}
+	if bytes.Contains(buf.Bytes(), []byte{7, 7, 7, 7}) {
+		t.Fatal("the payload is visible on the link")
+	}
+	if err = writer.WriteMessage(OnionData{}); err != ErrNotACellMessage {
+		t.Fatalf("expected %v, got %v", ErrNotACellMessage, err)
+	}
+
+	reader = NewCellReader(buf, testCipher(t))
+	if message, err = reader.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if destroy, valid := message.(OnionDestroy); !valid || destroy.TunnelId != 9 {
+		t.Fatalf("read %#v", message)
+	}
+	if message, err = reader.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if relay, valid := message.(OnionRelay); !valid || relay.TunnelId != 3 || !bytes.Equal(relay.Payload, large) {
+		t.Fatal("the relayed payload was not reassembled")
+	}
+}
+
+// A cell altered on the link is rejected.
+func TestCellTampered(t *testing.T) {
+
+	var buf *bytes.Buffer
+	var data []byte
+
+	buf = new(bytes.Buffer)
+	if err := NewCellWriter(buf, testCipher(t)).WriteMessage(OnionDestroy{TunnelId: 9}); err != nil {
+		t.Fatal(err)
+	}
+	data = buf.Bytes()
+	data[CellSize/2] ^= 1
+
+	if _, err := NewCellReader(bytes.NewReader(data), testCipher(t)).ReadMessage(); err == nil {
+		t.Fatal("read a tampered cell")
+	}
+}
+
+// A reader only reassembles a few messages at once, whatever the other end
+// sends.
+func TestCellPartialLimit(t *testing.T) {
+
+	var buf *bytes.Buffer
+	var writer *CellWriter
+	var err error
+
+	buf = new(bytes.Buffer)
+	writer = NewCellWriter(buf, testCipher(t))
+	for i := 0; i <= MaximumPartialMessages; i++ {
+		cell := Cell{
+			Command:  CELL_RELAY,
+			Flags:    CellFlagMore,
+			TunnelId: uint32(i),
+			Payload:  []byte("partial"),
+		}
+		cell.Length = uint16(len(cell.Payload))
+		if err = writer.writeCell(cell); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err = NewCellReader(buf, testCipher(t)).ReadMessage(); err != ErrTooManyPartials {
+		t.Fatalf("expected %v, got %v", ErrTooManyPartials, err)
+	}
+}
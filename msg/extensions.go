@@ -10,9 +10,20 @@ const (
 	AUTH_HANDSHAKE2        = 701
 	AUTH_SESSION_CONFIRMED = 702
 	AUTH_SESSION_DECLINED  = 703
+	AUTH_HANDSHAKE1_HYBRID = 704
+	AUTH_HANDSHAKE2_HYBRID = 705
+)
+
+// Sizes of the key material exchanged by the hybrid handshake.
+const (
+	X25519KeyLength      = 32
+	MLKEM768KeyLength    = 1184
+	MLKEM768CipherLength = 1088
 )
 
 type AuthHandshake1 struct {
+	// Target is the identity of the hostkey the handshake is encrypted for.
+	Target        [32]byte
 	EncryptedKey  [512]byte
 	EncryptedHMAC [512]byte
 }
@@ -30,6 +41,9 @@ func NewAuthHandshake1(data []byte) (AuthHandshake1, error) {
 	m = AuthHandshake1{}
 	reader = bytes.NewReader(data)
 
+	if _, err = io.ReadFull(reader, m.Target[:]); err != nil {
+		return m, err
+	}
 	if _, err = io.ReadFull(reader, m.EncryptedKey[:]); err != nil {
 		return m, err
 	}
@@ -77,9 +91,84 @@ type AuthSessionDeclined struct {
 }
 
 func (m AuthSessionDeclined) TypeId() uint16 {
-	return AUTH_SESSION_CONFIRMED
+	return AUTH_SESSION_DECLINED
 }
 
 func NewAuthSessionDeclined(data []byte) (AuthSessionDeclined, error) {
 	return AuthSessionDeclined{}, nil
 }
+
+// AuthHandshake1Hybrid offers a hybrid key exchange combining X25519 with
+// ML-KEM-768. It also carries the fields of AuthHandshake1 so that a peer
+// which only supports RSA key transport can fall back to it.
+type AuthHandshake1Hybrid struct {
+	Target        [32]byte
+	EncryptedKey  [512]byte
+	EncryptedHMAC [512]byte
+	X25519Key     [X25519KeyLength]byte
+	MLKEMKey      [MLKEM768KeyLength]byte
+}
+
+func (m AuthHandshake1Hybrid) TypeId() uint16 {
+	return AUTH_HANDSHAKE1_HYBRID
+}
+
+func NewAuthHandshake1Hybrid(data []byte) (AuthHandshake1Hybrid, error) {
+
+	var m AuthHandshake1Hybrid
+	var reader *bytes.Reader
+	var err error
+
+	m = AuthHandshake1Hybrid{}
+	reader = bytes.NewReader(data)
+
+	if _, err = io.ReadFull(reader, m.Target[:]); err != nil {
+		return m, err
+	}
+	if _, err = io.ReadFull(reader, m.EncryptedKey[:]); err != nil {
+		return m, err
+	}
+	if _, err = io.ReadFull(reader, m.EncryptedHMAC[:]); err != nil {
+		return m, err
+	}
+	if _, err = io.ReadFull(reader, m.X25519Key[:]); err != nil {
+		return m, err
+	}
+	if _, err = io.ReadFull(reader, m.MLKEMKey[:]); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// AuthHandshake2Hybrid accepts the hybrid key exchange offered by
+// AuthHandshake1Hybrid.
+type AuthHandshake2Hybrid struct {
+	EncryptedHMAC   [512]byte
+	X25519Key       [X25519KeyLength]byte
+	MLKEMCiphertext [MLKEM768CipherLength]byte
+}
+
+func (m AuthHandshake2Hybrid) TypeId() uint16 {
+	return AUTH_HANDSHAKE2_HYBRID
+}
+
+func NewAuthHandshake2Hybrid(data []byte) (AuthHandshake2Hybrid, error) {
+
+	var m AuthHandshake2Hybrid
+	var reader *bytes.Reader
+	var err error
+
+	m = AuthHandshake2Hybrid{}
+	reader = bytes.NewReader(data)
+
+	if _, err = io.ReadFull(reader, m.EncryptedHMAC[:]); err != nil {
+		return m, err
+	}
+	if _, err = io.ReadFull(reader, m.X25519Key[:]); err != nil {
+		return m, err
+	}
+	if _, err = io.ReadFull(reader, m.MLKEMCiphertext[:]); err != nil {
+		return m, err
+	}
+	return m, nil
+}
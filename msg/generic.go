@@ -1,7 +1,6 @@
 package msg
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/binary"
 	"errors"
@@ -55,12 +54,34 @@ func Identifier(messageType uint16) string {
 		return "ONION_TUNNEL_INCOMING"
 	case ONION_TUNNEL_DESTROY:
 		return "ONION_TUNNEL_DESTROY"
+	case ONION_TUNNEL_SUBSCRIBE:
+		return "ONION_TUNNEL_SUBSCRIBE"
 	case ONION_TUNNEL_DATA:
 		return "ONION_TUNNEL_DATA"
 	case ONION_ERROR:
 		return "ONION_ERROR"
 	case ONION_COVER:
 		return "ONION_COVER"
+	case ONION_STREAM_OPEN:
+		return "ONION_STREAM_OPEN"
+	case ONION_STREAM_READY:
+		return "ONION_STREAM_READY"
+	case ONION_STREAM_INCOMING:
+		return "ONION_STREAM_INCOMING"
+	case ONION_STREAM_DATA:
+		return "ONION_STREAM_DATA"
+	case ONION_STREAM_CLOSE:
+		return "ONION_STREAM_CLOSE"
+	case ONION_TUNNEL_REPLYABLE:
+		return "ONION_TUNNEL_REPLYABLE"
+	case ONION_TUNNEL_REPLY:
+		return "ONION_TUNNEL_REPLY"
+	case ONION_SPHINX_SEND:
+		return "ONION_SPHINX_SEND"
+	case ONION_SPHINX_RECEIVED:
+		return "ONION_SPHINX_RECEIVED"
+	case ONION_SPHINX_SUBSCRIBE:
+		return "ONION_SPHINX_SUBSCRIBE"
 	case AUTH_SESSION_START:
 		return "AUTH_SESSION_START"
 	case AUTH_SESSION_HS1:
@@ -81,6 +102,16 @@ func Identifier(messageType uint16) string {
 		return "AUTH_LAYER_DECRYPT_RESP"
 	case AUTH_SESSION_CLOSE:
 		return "AUTH_SESSION_CLOSE"
+	case AUTH_SESSION_START_AS:
+		return "AUTH_SESSION_START_AS"
+	case AUTH_SESSION_LIST:
+		return "AUTH_SESSION_LIST"
+	case AUTH_SESSION_LIST_RESP:
+		return "AUTH_SESSION_LIST_RESP"
+	case AUTH_SESSION_QUERY:
+		return "AUTH_SESSION_QUERY"
+	case AUTH_SESSION_INFO:
+		return "AUTH_SESSION_INFO"
 	case AUTH_HANDSHAKE1:
 		return "AUTH_HANDSHAKE1"
 	case AUTH_HANDSHAKE2:
@@ -89,6 +120,64 @@ func Identifier(messageType uint16) string {
 		return "AUTH_SESSION_CONFIRMED"
 	case AUTH_SESSION_DECLINED:
 		return "AUTH_SESSION_DECLINED"
+	case AUTH_HANDSHAKE1_HYBRID:
+		return "AUTH_HANDSHAKE1_HYBRID"
+	case AUTH_HANDSHAKE2_HYBRID:
+		return "AUTH_HANDSHAKE2_HYBRID"
+	case ONION_CREATE:
+		return "ONION_CREATE"
+	case ONION_CREATED:
+		return "ONION_CREATED"
+	case ONION_RELAY:
+		return "ONION_RELAY"
+	case ONION_DESTROY:
+		return "ONION_DESTROY"
+	case ONION_EXTEND:
+		return "ONION_EXTEND"
+	case ONION_EXTENDED:
+		return "ONION_EXTENDED"
+	case ONION_DATA:
+		return "ONION_DATA"
+	case ONION_BEGIN:
+		return "ONION_BEGIN"
+	case ONION_PADDING:
+		return "ONION_PADDING"
+	case ONION_SENDME:
+		return "ONION_SENDME"
+	case ONION_KEEPALIVE:
+		return "ONION_KEEPALIVE"
+	case ONION_OPEN:
+		return "ONION_OPEN"
+	case ONION_SEGMENT:
+		return "ONION_SEGMENT"
+	case ONION_CLOSE:
+		return "ONION_CLOSE"
+	case ONION_ESTABLISH_INTRO:
+		return "ONION_ESTABLISH_INTRO"
+	case ONION_INTRO_ESTABLISHED:
+		return "ONION_INTRO_ESTABLISHED"
+	case ONION_INTRODUCE:
+		return "ONION_INTRODUCE"
+	case ONION_INTRODUCE_ACK:
+		return "ONION_INTRODUCE_ACK"
+	case ONION_INTRODUCED:
+		return "ONION_INTRODUCED"
+	case ONION_INTRODUCTION:
+		return "ONION_INTRODUCTION"
+	case ONION_ESTABLISH_RENDEZVOUS:
+		return "ONION_ESTABLISH_RENDEZVOUS"
+	case ONION_RENDEZVOUS_ESTABLISHED:
+		return "ONION_RENDEZVOUS_ESTABLISHED"
+	case ONION_RENDEZVOUS:
+		return "ONION_RENDEZVOUS"
+	case ONION_RENDEZVOUS_JOINED:
+		return "ONION_RENDEZVOUS_JOINED"
+	case ONION_SEALED:
+		return "ONION_SEALED"
+	case ONION_REPLYABLE_DATA:
+		return "ONION_REPLYABLE_DATA"
+	case ONION_SPHINX:
+		return "ONION_SPHINX"
 	default:
 		return "UNKNOWN_MESSAGE"
 	}
@@ -114,7 +203,7 @@ func WriteGenericMessage(writer io.Writer, message GenericMessage) error {
 	return nil
 }
 
-func ReadGenericMessage(reader *bufio.Reader) (GenericMessage, error) {
+func ReadGenericMessage(reader io.Reader) (GenericMessage, error) {
 
 	m := GenericMessage{}
 
@@ -128,6 +217,10 @@ func ReadGenericMessage(reader *bufio.Reader) (GenericMessage, error) {
 		return m, err
 	}
 
+	if m.Size < HeaderLength {
+		return m, ErrDataTooShort
+	}
+
 	// Calculate the length left to read.
 	mustRead := m.Size - HeaderLength
 	buf := make([]byte, mustRead)
@@ -177,36 +270,38 @@ func ConvertFromGeneric(generic GenericMessage) (Message, error) {
 	var err error
 
 	switch generic.Type {
-	// case GOSSIP_ANNOUNCE:
-	// 	m = &GossipAnnounce{}
-	// case GOSSIP_NOTIFY:
-	// 	m = &GossipNotify{}
-	// case GOSSIP_NOTIFICATION:
-	// 	m = &GossipNotification{}
-	// case GOSSIP_VALIDATION:
-	// 	m = &GossipValidation{}
+	case GOSSIP_ANNOUNCE:
+		m, err = NewGossipAnnounce(generic.Content)
+	case GOSSIP_NOTIFY:
+		m, err = NewGossipNotify(generic.Content)
+	case GOSSIP_NOTIFICATION:
+		m, err = NewGossipNotification(generic.Content)
+	case GOSSIP_VALIDATION:
+		m, err = NewGossipValidation(generic.Content)
 	// case NSE_QUERY:
 	// 	m = &NSEQuery{}
 	// case NSE_ESTIMATE:
 	// 	m = &NSEEstimate{}
-	// case RPS_QUERY:
-	// 	m = &RPSQuery{}
-	// case RPS_PEER:
-	// 	m = &RPSPeer{}
+	case RPS_QUERY:
+		m, err = NewRPSQuery(generic.Content)
+	case RPS_PEER:
+		m, err = NewRPSPeer(generic.Content)
 	case ONION_TUNNEL_BUILD:
 		m, err = NewOnionTunnelBuild(generic.Content)
 	case ONION_TUNNEL_READY:
 		m, err = NewOnionTunnelReady(generic.Content)
-	// case ONION_TUNNEL_INCOMING:
-	// 	m = &OnionTunnelIncoming{}
-	// case ONION_TUNNEL_DESTROY:
-	// 	m = &OnionTunnelDestroy{}
-	// case ONION_TUNNEL_DATA:
-	// 	m = &OnionTunnelData{}
-	// case ONION_ERROR:
-	// 	m = &OnionError{}
-	// case ONION_COVER:
-	//	m = &OnionCover{}
+	case ONION_TUNNEL_INCOMING:
+		m, err = NewOnionTunnelIncoming(generic.Content)
+	case ONION_TUNNEL_DESTROY:
+		m, err = NewOnionTunnelDestroy(generic.Content)
+	case ONION_TUNNEL_SUBSCRIBE:
+		m, err = NewOnionTunnelSubscribe(generic.Content)
+	case ONION_TUNNEL_DATA:
+		m, err = NewOnionTunnelData(generic.Content)
+	case ONION_ERROR:
+		m, err = NewOnionError(generic.Content)
+	case ONION_COVER:
+		m, err = NewOnionCover(generic.Content)
 	case AUTH_SESSION_START:
 		m, err = NewAuthSessionStart(generic.Content)
 	case AUTH_SESSION_HS1:
@@ -227,6 +322,16 @@ func ConvertFromGeneric(generic GenericMessage) (Message, error) {
 		m, err = NewAuthLayerDecryptResp(generic.Content)
 	case AUTH_SESSION_CLOSE:
 		m, err = NewAuthSessionClose(generic.Content)
+	case AUTH_SESSION_START_AS:
+		m, err = NewAuthSessionStartAs(generic.Content)
+	case AUTH_SESSION_LIST:
+		m, err = NewAuthSessionList(generic.Content)
+	case AUTH_SESSION_LIST_RESP:
+		m, err = NewAuthSessionListResp(generic.Content)
+	case AUTH_SESSION_QUERY:
+		m, err = NewAuthSessionQuery(generic.Content)
+	case AUTH_SESSION_INFO:
+		m, err = NewAuthSessionInfo(generic.Content)
 	case AUTH_HANDSHAKE1:
 		m, err = NewAuthHandshake1(generic.Content)
 	case AUTH_HANDSHAKE2:
@@ -235,9 +340,86 @@ func ConvertFromGeneric(generic GenericMessage) (Message, error) {
 		m, err = NewAuthSessionConfirmed(generic.Content)
 	case AUTH_SESSION_DECLINED:
 		m, err = NewAuthSessionDeclined(generic.Content)
+	case AUTH_HANDSHAKE1_HYBRID:
+		m, err = NewAuthHandshake1Hybrid(generic.Content)
+	case AUTH_HANDSHAKE2_HYBRID:
+		m, err = NewAuthHandshake2Hybrid(generic.Content)
+	case ONION_CREATE:
+		m, err = NewOnionCreate(generic.Content)
+	case ONION_CREATED:
+		m, err = NewOnionCreated(generic.Content)
+	case ONION_RELAY:
+		m, err = NewOnionRelay(generic.Content)
+	case ONION_DESTROY:
+		m, err = NewOnionDestroy(generic.Content)
+	case ONION_EXTEND:
+		m, err = NewOnionExtend(generic.Content)
+	case ONION_EXTENDED:
+		m, err = NewOnionExtended(generic.Content)
+	case ONION_DATA:
+		m, err = NewOnionData(generic.Content)
+	case ONION_BEGIN:
+		m, err = NewOnionBegin(generic.Content)
+	case ONION_PADDING:
+		m, err = NewOnionPadding(generic.Content)
+	case ONION_SENDME:
+		m, err = NewOnionSendme(generic.Content)
+	case ONION_KEEPALIVE:
+		m, err = NewOnionKeepalive(generic.Content)
+	case ONION_STREAM_OPEN:
+		m, err = NewOnionStreamOpen(generic.Content)
+	case ONION_STREAM_READY:
+		m, err = NewOnionStreamReady(generic.Content)
+	case ONION_STREAM_INCOMING:
+		m, err = NewOnionStreamIncoming(generic.Content)
+	case ONION_STREAM_DATA:
+		m, err = NewOnionStreamData(generic.Content)
+	case ONION_STREAM_CLOSE:
+		m, err = NewOnionStreamClose(generic.Content)
+	case ONION_TUNNEL_REPLYABLE:
+		m, err = NewOnionTunnelReplyable(generic.Content)
+	case ONION_TUNNEL_REPLY:
+		m, err = NewOnionTunnelReply(generic.Content)
+	case ONION_SPHINX_SEND:
+		m, err = NewOnionSphinxSend(generic.Content)
+	case ONION_SPHINX_RECEIVED:
+		m, err = NewOnionSphinxReceived(generic.Content)
+	case ONION_SPHINX_SUBSCRIBE:
+		m, err = NewOnionSphinxSubscribe(generic.Content)
+	case ONION_OPEN:
+		m, err = NewOnionOpen(generic.Content)
+	case ONION_SEGMENT:
+		m, err = NewOnionSegment(generic.Content)
+	case ONION_CLOSE:
+		m, err = NewOnionClose(generic.Content)
+	case ONION_ESTABLISH_INTRO:
+		m, err = NewOnionEstablishIntro(generic.Content)
+	case ONION_INTRO_ESTABLISHED:
+		m, err = NewOnionIntroEstablished(generic.Content)
+	case ONION_INTRODUCE:
+		m, err = NewOnionIntroduce(generic.Content)
+	case ONION_INTRODUCE_ACK:
+		m, err = NewOnionIntroduceAck(generic.Content)
+	case ONION_INTRODUCED:
+		m, err = NewOnionIntroduced(generic.Content)
+	case ONION_INTRODUCTION:
+		m, err = NewOnionIntroduction(generic.Content)
+	case ONION_ESTABLISH_RENDEZVOUS:
+		m, err = NewOnionEstablishRendezvous(generic.Content)
+	case ONION_RENDEZVOUS_ESTABLISHED:
+		m, err = NewOnionRendezvousEstablished(generic.Content)
+	case ONION_RENDEZVOUS:
+		m, err = NewOnionRendezvous(generic.Content)
+	case ONION_RENDEZVOUS_JOINED:
+		m, err = NewOnionRendezvousJoined(generic.Content)
+	case ONION_SEALED:
+		m, err = NewOnionSealed(generic.Content)
+	case ONION_REPLYABLE_DATA:
+		m, err = NewOnionReplyableData(generic.Content)
+	case ONION_SPHINX:
+		m, err = NewOnionSphinx(generic.Content)
 	default:
-		fmt.Printf("Type cannot be converted from generic: %v\n", generic.Type)
-		panic("Need to implement in msg/messages.go")
+		err = ErrUnknownType
 	}
 	if err != nil {
 		fmt.Println(err)
@@ -120,7 +120,7 @@ type GossipValidation struct {
 }
 
 func (m GossipValidation) Valid() bool {
-	return true
+	return m.Reserved&0x1 == 0x1
 }
 
 func (m *GossipValidation) SetValid(valid bool) {
@@ -0,0 +1,422 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// The length of the cookie identifying a rendezvous.
+const RendezvousCookieLength = 20
+
+// Messages sent through tunnels to reach hidden services.
+const (
+	ONION_ESTABLISH_INTRO        = 724
+	ONION_INTRO_ESTABLISHED      = 725
+	ONION_INTRODUCE              = 726
+	ONION_INTRODUCE_ACK          = 727
+	ONION_INTRODUCED             = 728
+	ONION_INTRODUCTION           = 729
+	ONION_ESTABLISH_RENDEZVOUS   = 730
+	ONION_RENDEZVOUS_ESTABLISHED = 731
+	ONION_RENDEZVOUS             = 732
+	ONION_RENDEZVOUS_JOINED      = 733
+	ONION_SEALED                 = 734
+)
+
+// The gossip data type of hidden service descriptors.
+const ONION_DESCRIPTOR = 735
+
+// The status of OnionIntroduceAck.
+const (
+	// The introduction was relayed to the service.
+	IntroduceRelayed = 0
+	// The introduction point does not know the service.
+	IntroduceUnknown = 1
+)
+
+var (
+	ErrTooManyIntroductionPoints = errors.New("A descriptor lists at most 255 introduction points")
+)
+
+// OnionEstablishIntro asks the last hop of a tunnel to relay the
+// introductions to the hidden service with the Hostkey. Signature is the
+// service's signature of the hostkey of the last hop.
+type OnionEstablishIntro struct {
+	HostkeyLength uint16
+	Hostkey       []byte
+	Signature     []byte
+}
+
+func (m OnionEstablishIntro) TypeId() uint16 {
+	return ONION_ESTABLISH_INTRO
+}
+
+func NewOnionEstablishIntro(data []byte) (OnionEstablishIntro, error) {
+
+	var m OnionEstablishIntro
+	var reader *bytes.Reader
+	var err error
+
+	m = OnionEstablishIntro{}
+	reader = bytes.NewReader(data)
+
+	if err = binary.Read(reader, binary.BigEndian, &m.HostkeyLength); err != nil {
+		return m, err
+	}
+
+	m.Hostkey = make([]byte, m.HostkeyLength)
+	if _, err = io.ReadFull(reader, m.Hostkey); err != nil {
+		return m, err
+	}
+
+	m.Signature = make([]byte, reader.Len())
+	if _, err = io.ReadFull(reader, m.Signature); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// OnionIntroEstablished answers OnionEstablishIntro.
+type OnionIntroEstablished struct {
+}
+
+func (m OnionIntroEstablished) TypeId() uint16 {
+	return ONION_INTRO_ESTABLISHED
+}
+
+func NewOnionIntroEstablished(data []byte) (OnionIntroEstablished, error) {
+	return OnionIntroEstablished{}, nil
+}
+
+// OnionIntroduce asks an introduction point to relay the Payload to the
+// hidden service with the identity. Payload holds an OnionIntroduction
+// encrypted for the service.
+type OnionIntroduce struct {
+	Identity [32]byte
+	Payload  []byte
+}
+
+func (m OnionIntroduce) TypeId() uint16 {
+	return ONION_INTRODUCE
+}
+
+func NewOnionIntroduce(data []byte) (OnionIntroduce, error) {
+
+	var m OnionIntroduce
+	var reader *bytes.Reader
+	var err error
+
+	m = OnionIntroduce{}
+	reader = bytes.NewReader(data)
+
+	if _, err = io.ReadFull(reader, m.Identity[:]); err != nil {
+		return m, err
+	}
+
+	m.Payload = make([]byte, reader.Len())
+	if _, err = io.ReadFull(reader, m.Payload); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// OnionIntroduceAck answers OnionIntroduce.
+type OnionIntroduceAck struct {
+	Status uint16
+}
+
+func (m OnionIntroduceAck) TypeId() uint16 {
+	return ONION_INTRODUCE_ACK
+}
+
+func NewOnionIntroduceAck(data []byte) (OnionIntroduceAck, error) {
+
+	var m OnionIntroduceAck
+	var err error
+
+	m = OnionIntroduceAck{}
+	if err = binary.Read(bytes.NewReader(data), binary.BigEndian, &m.Status); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// OnionIntroduced carries the Payload of an OnionIntroduce from the
+// introduction point to the hidden service.
+type OnionIntroduced struct {
+	Payload []byte
+}
+
+func (m OnionIntroduced) TypeId() uint16 {
+	return ONION_INTRODUCED
+}
+
+func NewOnionIntroduced(data []byte) (OnionIntroduced, error) {
+
+	var m OnionIntroduced
+
+	m = OnionIntroduced{}
+	m.Payload = make([]byte, len(data))
+	copy(m.Payload, data)
+	return m, nil
+}
+
+// OnionIntroduction tells a hidden service where a client waits for it: the
+// rendezvous point at IPAddr and Port with the Hostkey, and the Cookie the
+// client gave it. Key is the client's half of the end-to-end key exchange.
+type OnionIntroduction struct {
+	Cookie   [RendezvousCookieLength]byte
+	Key      [X25519KeyLength]byte
+	Port     uint16
+	Reserved uint16
+	IPAddr   [IPLength]byte
+	Hostkey  []byte
+}
+
+func (m OnionIntroduction) TypeId() uint16 {
+	return ONION_INTRODUCTION
+}
+
+func NewOnionIntroduction(data []byte) (OnionIntroduction, error) {
+
+	var m OnionIntroduction
+	var reader *bytes.Reader
+	var err error
+
+	m = OnionIntroduction{}
+	reader = bytes.NewReader(data)
+
+	if _, err = io.ReadFull(reader, m.Cookie[:]); err != nil {
+		return m, err
+	}
+	if _, err = io.ReadFull(reader, m.Key[:]); err != nil {
+		return m, err
+	}
+	if err = binary.Read(reader, binary.BigEndian, &m.Port); err != nil {
+		return m, err
+	}
+	if err = binary.Read(reader, binary.BigEndian, &m.Reserved); err != nil {
+		return m, err
+	}
+	if _, err = io.ReadFull(reader, m.IPAddr[:]); err != nil {
+		return m, err
+	}
+
+	m.Hostkey = make([]byte, reader.Len())
+	if _, err = io.ReadFull(reader, m.Hostkey); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// OnionEstablishRendezvous asks the last hop of a tunnel to join it to the
+// tunnel which brings the same Cookie.
+type OnionEstablishRendezvous struct {
+	Cookie [RendezvousCookieLength]byte
+}
+
+func (m OnionEstablishRendezvous) TypeId() uint16 {
+	return ONION_ESTABLISH_RENDEZVOUS
+}
+
+func NewOnionEstablishRendezvous(data []byte) (OnionEstablishRendezvous, error) {
+
+	var m OnionEstablishRendezvous
+	var err error
+
+	m = OnionEstablishRendezvous{}
+	if _, err = io.ReadFull(bytes.NewReader(data), m.Cookie[:]); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// OnionRendezvousEstablished answers OnionEstablishRendezvous.
+type OnionRendezvousEstablished struct {
+}
+
+func (m OnionRendezvousEstablished) TypeId() uint16 {
+	return ONION_RENDEZVOUS_ESTABLISHED
+}
+
+func NewOnionRendezvousEstablished(data []byte) (OnionRendezvousEstablished, error) {
+	return OnionRendezvousEstablished{}, nil
+}
+
+// OnionRendezvous is sent by a hidden service to the rendezvous point named
+// in an introduction. Key is the service's half of the end-to-end key
+// exchange.
+type OnionRendezvous struct {
+	Cookie [RendezvousCookieLength]byte
+	Key    [X25519KeyLength]byte
+}
+
+func (m OnionRendezvous) TypeId() uint16 {
+	return ONION_RENDEZVOUS
+}
+
+func NewOnionRendezvous(data []byte) (OnionRendezvous, error) {
+
+	var m OnionRendezvous
+	var reader *bytes.Reader
+	var err error
+
+	m = OnionRendezvous{}
+	reader = bytes.NewReader(data)
+
+	if _, err = io.ReadFull(reader, m.Cookie[:]); err != nil {
+		return m, err
+	}
+	if _, err = io.ReadFull(reader, m.Key[:]); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// OnionRendezvousJoined tells the client that the service joined its tunnel,
+// with the service's half of the key exchange.
+type OnionRendezvousJoined struct {
+	Key [X25519KeyLength]byte
+}
+
+func (m OnionRendezvousJoined) TypeId() uint16 {
+	return ONION_RENDEZVOUS_JOINED
+}
+
+func NewOnionRendezvousJoined(data []byte) (OnionRendezvousJoined, error) {
+
+	var m OnionRendezvousJoined
+	var err error
+
+	m = OnionRendezvousJoined{}
+	if _, err = io.ReadFull(bytes.NewReader(data), m.Key[:]); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// OnionSealed carries a message between a client and a hidden service,
+// encrypted with their end-to-end key. The rendezvous point relays it from
+// one tunnel to the other.
+type OnionSealed struct {
+	Payload []byte
+}
+
+func (m OnionSealed) TypeId() uint16 {
+	return ONION_SEALED
+}
+
+func NewOnionSealed(data []byte) (OnionSealed, error) {
+
+	var m OnionSealed
+
+	m = OnionSealed{}
+	m.Payload = make([]byte, len(data))
+	copy(m.Payload, data)
+	return m, nil
+}
+
+// IntroductionPoint is a peer relaying the introductions to a hidden
+// service.
+type IntroductionPoint struct {
+	Port    uint16
+	IPAddr  [IPLength]byte
+	Hostkey []byte
+}
+
+// HiddenDescriptor tells clients how to reach the hidden service with the
+// Hostkey until Expires, in seconds since the epoch. It is spread through
+// gossip, signed by the service.
+type HiddenDescriptor struct {
+	Expires   uint64
+	Hostkey   []byte
+	Points    []IntroductionPoint
+	Signature []byte
+}
+
+// SignedContent returns the encoding of the descriptor without its
+// signature.
+func (d HiddenDescriptor) SignedContent() ([]byte, error) {
+
+	var buf *bytes.Buffer
+
+	if len(d.Points) > 255 {
+		return nil, ErrTooManyIntroductionPoints
+	}
+
+	buf = new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, d.Expires)
+	binary.Write(buf, binary.BigEndian, uint16(len(d.Hostkey)))
+	buf.Write(d.Hostkey)
+	buf.WriteByte(uint8(len(d.Points)))
+	for _, point := range d.Points {
+		binary.Write(buf, binary.BigEndian, point.Port)
+		buf.Write(point.IPAddr[:])
+		binary.Write(buf, binary.BigEndian, uint16(len(point.Hostkey)))
+		buf.Write(point.Hostkey)
+	}
+	return buf.Bytes(), nil
+}
+
+// Bytes returns the encoding of the descriptor.
+func (d HiddenDescriptor) Bytes() ([]byte, error) {
+
+	var content []byte
+	var err error
+
+	if content, err = d.SignedContent(); err != nil {
+		return nil, err
+	}
+	return append(content, d.Signature...), nil
+}
+
+func NewHiddenDescriptor(data []byte) (HiddenDescriptor, error) {
+
+	var d HiddenDescriptor
+	var reader *bytes.Reader
+	var length uint16
+	var count uint8
+	var err error
+
+	d = HiddenDescriptor{}
+	reader = bytes.NewReader(data)
+
+	if err = binary.Read(reader, binary.BigEndian, &d.Expires); err != nil {
+		return d, err
+	}
+	if err = binary.Read(reader, binary.BigEndian, &length); err != nil {
+		return d, err
+	}
+	d.Hostkey = make([]byte, length)
+	if _, err = io.ReadFull(reader, d.Hostkey); err != nil {
+		return d, err
+	}
+
+	if err = binary.Read(reader, binary.BigEndian, &count); err != nil {
+		return d, err
+	}
+	d.Points = make([]IntroductionPoint, count)
+	for i := range d.Points {
+		if err = binary.Read(reader, binary.BigEndian, &d.Points[i].Port); err != nil {
+			return d, err
+		}
+		if _, err = io.ReadFull(reader, d.Points[i].IPAddr[:]); err != nil {
+			return d, err
+		}
+		if err = binary.Read(reader, binary.BigEndian, &length); err != nil {
+			return d, err
+		}
+		d.Points[i].Hostkey = make([]byte, length)
+		if _, err = io.ReadFull(reader, d.Points[i].Hostkey); err != nil {
+			return d, err
+		}
+	}
+
+	d.Signature = make([]byte, reader.Len())
+	if _, err = io.ReadFull(reader, d.Signature); err != nil {
+		return d, err
+	}
+	return d, nil
+}
@@ -1,7 +1,6 @@
 package msg
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
 	"io"
@@ -14,7 +13,9 @@ const (
 )
 
 var (
-	ErrDataTooShort = errors.New("unmarshal: data is shorter than expected")
+	ErrDataTooShort   = errors.New("unmarshal: data is shorter than expected")
+	ErrUnknownType    = errors.New("unmarshal: the message type is unknown")
+	ErrUnexpectedType = errors.New("unmarshal: the message type is not expected here")
 )
 
 type Message interface {
@@ -50,22 +51,36 @@ func Receive(conn net.Conn) (Message, error) {
 // Read a message from the reader.
 func Read(reader io.Reader) (Message, error) {
 
-	var buf *bufio.Reader
 	var generic GenericMessage
 	var err error
 
-	// Create a buffered reader because calls to read are blocking.
-	// If we have an ill-formed message, we could be stuck trying to
-	// wait for bytes that will never arrive.
-	buf = bufio.NewReader(reader)
-
-	if generic, err = ReadGenericMessage(buf); err != nil {
+	// The reader is used as is: buffering it here would swallow the bytes
+	// of the following messages on connections which carry several.
+	if generic, err = ReadGenericMessage(reader); err != nil {
 		return nil, err
 	} else {
 		return ConvertFromGeneric(generic)
 	}
 }
 
+// ReadExpected reads a message of one of the types from the reader. A message
+// of any other type is rejected before its content is decoded.
+func ReadExpected(reader io.Reader, types ...uint16) (Message, error) {
+
+	var generic GenericMessage
+	var err error
+
+	if generic, err = ReadGenericMessage(reader); err != nil {
+		return nil, err
+	}
+	for _, expected := range types {
+		if generic.Type == expected {
+			return ConvertFromGeneric(generic)
+		}
+	}
+	return nil, ErrUnexpectedType
+}
+
 func Send(conn net.Conn, message Message) error {
 
 	fmt.Printf("%20v: SND %25v to   %20v\n",
@@ -0,0 +1,42 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestReadUnknownType(t *testing.T) {
+
+	var buf *bytes.Buffer
+
+	buf = new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint16(HeaderLength+2))
+	binary.Write(buf, binary.BigEndian, uint16(0xffff))
+	buf.Write([]byte{1, 2})
+
+	if _, err := Read(buf); err != ErrUnknownType {
+		t.Fatalf("expected ErrUnknownType, got %v", err)
+	}
+}
+
+func TestReadExpected(t *testing.T) {
+
+	var buf *bytes.Buffer
+	var message Message
+	var err error
+
+	buf = new(bytes.Buffer)
+	if err = Write(buf, OnionTunnelReply{ReplyId: 7, Data: []byte("reply")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadExpected(bytes.NewReader(buf.Bytes()), ONION_TUNNEL_REPLYABLE, ONION_DATA); err != ErrUnexpectedType {
+		t.Fatalf("expected ErrUnexpectedType, got %v", err)
+	}
+	if message, err = ReadExpected(bytes.NewReader(buf.Bytes()), ONION_TUNNEL_REPLY); err != nil {
+		t.Fatal(err)
+	}
+	if reply, valid := message.(OnionTunnelReply); !valid || reply.ReplyId != 7 || string(reply.Data) != "reply" {
+		t.Fatalf("unexpected message %#v", message)
+	}
+}
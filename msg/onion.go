@@ -17,6 +17,8 @@ const (
 	// Reserved up to 599.
 )
 
+const ONION_TUNNEL_SUBSCRIBE = 577
+
 type OnionTunnelBuild struct {
 	Reserved   uint16
 	Port       uint16
@@ -92,22 +94,157 @@ type OnionTunnelIncoming struct {
 	SourceHostKeyInDER []byte
 }
 
+func (m OnionTunnelIncoming) TypeId() uint16 {
+	return ONION_TUNNEL_INCOMING
+}
+
+func NewOnionTunnelIncoming(data []byte) (OnionTunnelIncoming, error) {
+
+	m := OnionTunnelIncoming{}
+	reader := bytes.NewReader(data)
+
+	// TunnelID field
+	if err := binary.Read(reader, binary.BigEndian, &m.TunnelID); err != nil {
+		return m, err
+	}
+
+	// Source Hostkey
+	m.SourceHostKeyInDER = make([]byte, reader.Len())
+	if _, err := io.ReadFull(reader, m.SourceHostKeyInDER); err != nil {
+		return m, err
+	}
+
+	return m, nil
+}
+
+// OnionTunnelSubscribe asks the module to hand the client the data and the
+// streams of an incoming tunnel, which it owns from then on.
+type OnionTunnelSubscribe struct {
+	TunnelID uint32
+}
+
+func (m OnionTunnelSubscribe) TypeId() uint16 {
+	return ONION_TUNNEL_SUBSCRIBE
+}
+
+func NewOnionTunnelSubscribe(data []byte) (OnionTunnelSubscribe, error) {
+
+	m := OnionTunnelSubscribe{}
+	reader := bytes.NewReader(data)
+
+	// TunnelID field
+	if err := binary.Read(reader, binary.BigEndian, &m.TunnelID); err != nil {
+		return m, err
+	}
+
+	return m, nil
+}
+
 type OnionTunnelDestroy struct {
 	TunnelID uint32
 }
 
+func (m OnionTunnelDestroy) TypeId() uint16 {
+	return ONION_TUNNEL_DESTROY
+}
+
+func NewOnionTunnelDestroy(data []byte) (OnionTunnelDestroy, error) {
+
+	m := OnionTunnelDestroy{}
+	reader := bytes.NewReader(data)
+
+	// TunnelID field
+	if err := binary.Read(reader, binary.BigEndian, &m.TunnelID); err != nil {
+		return m, err
+	}
+
+	return m, nil
+}
+
 type OnionTunnelData struct {
 	TunnelID uint32
 	Data     []byte
 }
 
+func (m OnionTunnelData) TypeId() uint16 {
+	return ONION_TUNNEL_DATA
+}
+
+func NewOnionTunnelData(data []byte) (OnionTunnelData, error) {
+
+	m := OnionTunnelData{}
+	reader := bytes.NewReader(data)
+
+	// TunnelID field
+	if err := binary.Read(reader, binary.BigEndian, &m.TunnelID); err != nil {
+		return m, err
+	}
+
+	// Data field
+	m.Data = make([]byte, reader.Len())
+	if _, err := io.ReadFull(reader, m.Data); err != nil {
+		return m, err
+	}
+
+	return m, nil
+}
+
 type OnionError struct {
 	RequestType uint16
-	reserved    uint16
+	Reserved    uint16
 	TunnelID    uint32
 }
 
+func (m OnionError) TypeId() uint16 {
+	return ONION_ERROR
+}
+
+func NewOnionError(data []byte) (OnionError, error) {
+
+	m := OnionError{}
+	reader := bytes.NewReader(data)
+
+	// Request Type field
+	if err := binary.Read(reader, binary.BigEndian, &m.RequestType); err != nil {
+		return m, err
+	}
+
+	// Reserved field
+	if err := binary.Read(reader, binary.BigEndian, &m.Reserved); err != nil {
+		return m, err
+	}
+
+	// TunnelID field
+	if err := binary.Read(reader, binary.BigEndian, &m.TunnelID); err != nil {
+		return m, err
+	}
+
+	return m, nil
+}
+
 type OnionCover struct {
 	CoverSize uint16
-	reserved  uint16
+	Reserved  uint16
+}
+
+func (m OnionCover) TypeId() uint16 {
+	return ONION_COVER
+}
+
+func NewOnionCover(data []byte) (OnionCover, error) {
+
+	m := OnionCover{}
+	reader := bytes.NewReader(data)
+
+	// Cover Size field
+	if err := binary.Read(reader, binary.BigEndian, &m.CoverSize); err != nil {
+		return m, err
+	}
+
+	// Reserved field
+	if err := binary.Read(reader, binary.BigEndian, &m.Reserved); err != nil {
+		return m, err
+	}
+
+	return m, nil
 }
@@ -0,0 +1,315 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// The length of the token identifying a tunnel across rounds.
+const TunnelTokenLength = 16
+
+// Messages exchanged between onion modules over their P2P listener.
+const (
+	ONION_CREATE  = 710
+	ONION_CREATED = 711
+	ONION_RELAY   = 712
+	ONION_DESTROY = 717
+)
+
+// Messages sent through a tunnel to its last hop, and their answers.
+const (
+	ONION_EXTEND   = 713
+	ONION_EXTENDED = 714
+	ONION_DATA     = 715
+	ONION_BEGIN    = 716
+	ONION_PADDING  = 718
+	ONION_SENDME   = 719
+	// ONION_OPEN, ONION_SEGMENT and ONION_CLOSE take 720 to 722.
+	ONION_KEEPALIVE = 723
+)
+
+// OnionCreate establishes a session with the next hop of a tunnel. Payload
+// holds the AuthSessionIncomingHS1 of the initiator. The sender uses
+// TunnelId for the tunnel on this link from then on.
+type OnionCreate struct {
+	TunnelId uint32
+	Payload  []byte
+}
+
+func (m OnionCreate) TypeId() uint16 {
+	return ONION_CREATE
+}
+
+func NewOnionCreate(data []byte) (OnionCreate, error) {
+
+	var m OnionCreate
+	var reader *bytes.Reader
+	var err error
+
+	m = OnionCreate{}
+	reader = bytes.NewReader(data)
+
+	if err = binary.Read(reader, binary.BigEndian, &m.TunnelId); err != nil {
+		return m, err
+	}
+
+	m.Payload = make([]byte, reader.Len())
+	if _, err = io.ReadFull(reader, m.Payload); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// OnionCreated answers OnionCreate. Payload holds the handshake the Auth
+// module of the hop produced.
+type OnionCreated struct {
+	TunnelId uint32
+	Payload  []byte
+}
+
+func (m OnionCreated) TypeId() uint16 {
+	return ONION_CREATED
+}
+
+func NewOnionCreated(data []byte) (OnionCreated, error) {
+
+	var m OnionCreated
+	var reader *bytes.Reader
+	var err error
+
+	m = OnionCreated{}
+	reader = bytes.NewReader(data)
+
+	if err = binary.Read(reader, binary.BigEndian, &m.TunnelId); err != nil {
+		return m, err
+	}
+
+	m.Payload = make([]byte, reader.Len())
+	if _, err = io.ReadFull(reader, m.Payload); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// OnionRelay carries layered traffic of a tunnel between two neighbouring
+// hops. Each hop removes or adds its own layer before passing it on.
+type OnionRelay struct {
+	TunnelId uint32
+	Payload  []byte
+}
+
+func (m OnionRelay) TypeId() uint16 {
+	return ONION_RELAY
+}
+
+func NewOnionRelay(data []byte) (OnionRelay, error) {
+
+	var m OnionRelay
+	var reader *bytes.Reader
+	var err error
+
+	m = OnionRelay{}
+	reader = bytes.NewReader(data)
+
+	if err = binary.Read(reader, binary.BigEndian, &m.TunnelId); err != nil {
+		return m, err
+	}
+
+	m.Payload = make([]byte, reader.Len())
+	if _, err = io.ReadFull(reader, m.Payload); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// OnionDestroy tears down a tunnel. Each hop forgets the tunnel and passes
+// the message on to its other neighbour.
+type OnionDestroy struct {
+	TunnelId uint32
+	Reason   uint16
+}
+
+// Why a tunnel is torn down.
+const (
+	// One of the ends of the tunnel asked for it.
+	DestroyRequested = 0
+	// A hop or a link of the tunnel failed.
+	DestroyFailed = 1
+)
+
+func (m OnionDestroy) TypeId() uint16 {
+	return ONION_DESTROY
+}
+
+func NewOnionDestroy(data []byte) (OnionDestroy, error) {
+
+	var m OnionDestroy
+	var err error
+
+	m = OnionDestroy{}
+	reader := bytes.NewReader(data)
+	if err = binary.Read(reader, binary.BigEndian, &m.TunnelId); err != nil {
+		return m, err
+	}
+	if err = binary.Read(reader, binary.BigEndian, &m.Reason); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// OnionExtend asks the last hop of a tunnel to extend it to the peer at
+// IPAddr and Port. Payload holds the AuthSessionIncomingHS1 for that peer.
+type OnionExtend struct {
+	Port     uint16
+	Reserved uint16
+	IPAddr   [IPLength]byte
+	Payload  []byte
+}
+
+func (m OnionExtend) TypeId() uint16 {
+	return ONION_EXTEND
+}
+
+func NewOnionExtend(data []byte) (OnionExtend, error) {
+
+	var m OnionExtend
+	var reader *bytes.Reader
+	var err error
+
+	m = OnionExtend{}
+	reader = bytes.NewReader(data)
+
+	if err = binary.Read(reader, binary.BigEndian, &m.Port); err != nil {
+		return m, err
+	}
+	if err = binary.Read(reader, binary.BigEndian, &m.Reserved); err != nil {
+		return m, err
+	}
+	if _, err = io.ReadFull(reader, m.IPAddr[:]); err != nil {
+		return m, err
+	}
+
+	m.Payload = make([]byte, reader.Len())
+	if _, err = io.ReadFull(reader, m.Payload); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// OnionExtended answers OnionExtend with the handshake of the new hop.
+type OnionExtended struct {
+	Payload []byte
+}
+
+func (m OnionExtended) TypeId() uint16 {
+	return ONION_EXTENDED
+}
+
+func NewOnionExtended(data []byte) (OnionExtended, error) {
+
+	var m OnionExtended
+
+	m = OnionExtended{}
+	m.Payload = make([]byte, len(data))
+	copy(m.Payload, data)
+	return m, nil
+}
+
+// OnionData carries the data of ONION_TUNNEL_DATA between the ends of a
+// tunnel.
+type OnionData struct {
+	Data []byte
+}
+
+func (m OnionData) TypeId() uint16 {
+	return ONION_DATA
+}
+
+func NewOnionData(data []byte) (OnionData, error) {
+
+	var m OnionData
+
+	m = OnionData{}
+	m.Data = make([]byte, len(data))
+	copy(m.Data, data)
+	return m, nil
+}
+
+// OnionBegin tells the last hop of a tunnel that the tunnel is complete and
+// ends there. A tunnel rebuilt for a new round carries the Token of the
+// tunnel it replaces, so that the last hop keeps it under the same id.
+type OnionBegin struct {
+	Token [TunnelTokenLength]byte
+}
+
+func (m OnionBegin) TypeId() uint16 {
+	return ONION_BEGIN
+}
+
+func NewOnionBegin(data []byte) (OnionBegin, error) {
+
+	var m OnionBegin
+	var err error
+
+	m = OnionBegin{}
+	if _, err = io.ReadFull(bytes.NewReader(data), m.Token[:]); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// OnionPadding carries cover traffic. It has the size of an OnionData
+// carrying as much data, and is dropped by the last hop.
+type OnionPadding struct {
+	Data []byte
+}
+
+func (m OnionPadding) TypeId() uint16 {
+	return ONION_PADDING
+}
+
+func NewOnionPadding(data []byte) (OnionPadding, error) {
+
+	var m OnionPadding
+
+	m = OnionPadding{}
+	m.Data = make([]byte, len(data))
+	copy(m.Data, data)
+	return m, nil
+}
+
+// OnionSendme tells the other end of a tunnel that it may send more data. A
+// StreamId of zero acknowledges the data of the whole tunnel.
+type OnionSendme struct {
+	StreamId uint16
+}
+
+func (m OnionSendme) TypeId() uint16 {
+	return ONION_SENDME
+}
+
+func NewOnionSendme(data []byte) (OnionSendme, error) {
+
+	var m OnionSendme
+	var err error
+
+	m = OnionSendme{}
+	if err = binary.Read(bytes.NewReader(data), binary.BigEndian, &m.StreamId); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// OnionKeepalive shows that the tunnel still works. The initiator sends it
+// periodically, and the other end sends it back.
+type OnionKeepalive struct {
+}
+
+func (m OnionKeepalive) TypeId() uint16 {
+	return ONION_KEEPALIVE
+}
+
+func NewOnionKeepalive(data []byte) (OnionKeepalive, error) {
+	return OnionKeepalive{}, nil
+}
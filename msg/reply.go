@@ -0,0 +1,144 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// The length of the id of a reply block.
+const ReplyIdLength = 16
+
+// The length of the key a reply is encrypted with.
+const ReplyKeyLength = 128
+
+// Onion API messages for the data answered with reply blocks.
+const (
+	ONION_TUNNEL_REPLYABLE = 572
+	ONION_TUNNEL_REPLY     = 573
+)
+
+// OnionReplyableData is sent through tunnels for reply blocks.
+const ONION_REPLYABLE_DATA = 738
+
+// OnionTunnelReplyable is ONION_TUNNEL_DATA with a reply block attached.
+// Sent by a client, the module creates the reply block, and the reply to it
+// comes back as ONION_TUNNEL_REPLY with the same ReplyId. Sent by the module,
+// ReplyId names the reply block in the client's ONION_TUNNEL_REPLY.
+type OnionTunnelReplyable struct {
+	TunnelID uint32
+	ReplyId  uint32
+	Data     []byte
+}
+
+func (m OnionTunnelReplyable) TypeId() uint16 {
+	return ONION_TUNNEL_REPLYABLE
+}
+
+func NewOnionTunnelReplyable(data []byte) (OnionTunnelReplyable, error) {
+
+	var m OnionTunnelReplyable
+	var reader *bytes.Reader
+	var err error
+
+	m = OnionTunnelReplyable{}
+	reader = bytes.NewReader(data)
+
+	if err = binary.Read(reader, binary.BigEndian, &m.TunnelID); err != nil {
+		return m, err
+	}
+	if err = binary.Read(reader, binary.BigEndian, &m.ReplyId); err != nil {
+		return m, err
+	}
+
+	m.Data = make([]byte, reader.Len())
+	if _, err = io.ReadFull(reader, m.Data); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// OnionTunnelReply answers data through the reply block with the ReplyId.
+// The module sends it to the client which asked for the reply block.
+type OnionTunnelReply struct {
+	ReplyId uint32
+	Data    []byte
+}
+
+func (m OnionTunnelReply) TypeId() uint16 {
+	return ONION_TUNNEL_REPLY
+}
+
+func NewOnionTunnelReply(data []byte) (OnionTunnelReply, error) {
+
+	var m OnionTunnelReply
+	var reader *bytes.Reader
+	var err error
+
+	m = OnionTunnelReply{}
+	reader = bytes.NewReader(data)
+
+	if err = binary.Read(reader, binary.BigEndian, &m.ReplyId); err != nil {
+		return m, err
+	}
+
+	m.Data = make([]byte, reader.Len())
+	if _, err = io.ReadFull(reader, m.Data); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// OnionReplyableData is OnionData with a reply block: a reply encrypted with
+// the Key and sent with the Sphinx Header to the peer at IPAddr and Port goes
+// back to the sender, through hops only the sender knows.
+type OnionReplyableData struct {
+	Port         uint16
+	Reserved     uint16
+	IPAddr       [IPLength]byte
+	Key          [ReplyKeyLength]byte
+	HeaderLength uint16
+	Header       []byte
+	Data         []byte
+}
+
+func (m OnionReplyableData) TypeId() uint16 {
+	return ONION_REPLYABLE_DATA
+}
+
+func NewOnionReplyableData(data []byte) (OnionReplyableData, error) {
+
+	var m OnionReplyableData
+	var reader *bytes.Reader
+	var err error
+
+	m = OnionReplyableData{}
+	reader = bytes.NewReader(data)
+
+	if err = binary.Read(reader, binary.BigEndian, &m.Port); err != nil {
+		return m, err
+	}
+	if err = binary.Read(reader, binary.BigEndian, &m.Reserved); err != nil {
+		return m, err
+	}
+	if _, err = io.ReadFull(reader, m.IPAddr[:]); err != nil {
+		return m, err
+	}
+	if _, err = io.ReadFull(reader, m.Key[:]); err != nil {
+		return m, err
+	}
+	if err = binary.Read(reader, binary.BigEndian, &m.HeaderLength); err != nil {
+		return m, err
+	}
+
+	m.Header = make([]byte, m.HeaderLength)
+	if _, err = io.ReadFull(reader, m.Header); err != nil {
+		return m, err
+	}
+
+	m.Data = make([]byte, reader.Len())
+	if _, err = io.ReadFull(reader, m.Data); err != nil {
+		return m, err
+	}
+	return m, nil
+}
@@ -42,7 +42,7 @@ func NewRPSPeer(data []byte) (RPSPeer, error) {
 	var reader *bytes.Reader
 
 	m = RPSPeer{}
-	reader = new(bytes.Reader)
+	reader = bytes.NewReader(data)
 
 	if err = binary.Read(reader, binary.BigEndian, &m.Port); err != nil {
 		return m, err
@@ -0,0 +1,193 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// Onion API messages for the messages sent as Sphinx packets.
+const (
+	ONION_SPHINX_SEND      = 574
+	ONION_SPHINX_RECEIVED  = 575
+	ONION_SPHINX_SUBSCRIBE = 576
+)
+
+// Sphinx packets travel on links, outside of any tunnel.
+const ONION_SPHINX = 741
+
+// The gossip data type of the keys Sphinx packets are built for.
+const ONION_SPHINX_KEY = 742
+
+// OnionSphinxSend asks the module to send the Data as a Sphinx packet to the
+// peer at IPAddr and Port with the Hostkey.
+type OnionSphinxSend struct {
+	Port          uint16
+	Reserved      uint16
+	IPAddr        [IPLength]byte
+	HostkeyLength uint16
+	Hostkey       []byte
+	Data          []byte
+}
+
+func (m OnionSphinxSend) TypeId() uint16 {
+	return ONION_SPHINX_SEND
+}
+
+func NewOnionSphinxSend(data []byte) (OnionSphinxSend, error) {
+
+	var m OnionSphinxSend
+	var reader *bytes.Reader
+	var err error
+
+	m = OnionSphinxSend{}
+	reader = bytes.NewReader(data)
+
+	if err = binary.Read(reader, binary.BigEndian, &m.Port); err != nil {
+		return m, err
+	}
+	if err = binary.Read(reader, binary.BigEndian, &m.Reserved); err != nil {
+		return m, err
+	}
+	if _, err = io.ReadFull(reader, m.IPAddr[:]); err != nil {
+		return m, err
+	}
+	if err = binary.Read(reader, binary.BigEndian, &m.HostkeyLength); err != nil {
+		return m, err
+	}
+
+	m.Hostkey = make([]byte, m.HostkeyLength)
+	if _, err = io.ReadFull(reader, m.Hostkey); err != nil {
+		return m, err
+	}
+
+	m.Data = make([]byte, reader.Len())
+	if _, err = io.ReadFull(reader, m.Data); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// OnionSphinxReceived hands the API clients the Data of a Sphinx packet
+// delivered to us. Nothing tells who sent it.
+type OnionSphinxReceived struct {
+	Data []byte
+}
+
+func (m OnionSphinxReceived) TypeId() uint16 {
+	return ONION_SPHINX_RECEIVED
+}
+
+func NewOnionSphinxReceived(data []byte) (OnionSphinxReceived, error) {
+
+	var m OnionSphinxReceived
+
+	m = OnionSphinxReceived{}
+	m.Data = make([]byte, len(data))
+	copy(m.Data, data)
+	return m, nil
+}
+
+// OnionSphinxSubscribe asks the module to hand the client the Sphinx packets
+// delivered to us as ONION_SPHINX_RECEIVED.
+type OnionSphinxSubscribe struct {
+	// This is empty.
+}
+
+func (m OnionSphinxSubscribe) TypeId() uint16 {
+	return ONION_SPHINX_SUBSCRIBE
+}
+
+func NewOnionSphinxSubscribe(data []byte) (OnionSphinxSubscribe, error) {
+	return OnionSphinxSubscribe{}, nil
+}
+
+// OnionSphinx carries a Sphinx packet to the next hop. Every cell message
+// names a tunnel, but the packet belongs to none: TunnelId is always zero.
+type OnionSphinx struct {
+	TunnelId uint32
+	Packet   []byte
+}
+
+func (m OnionSphinx) TypeId() uint16 {
+	return ONION_SPHINX
+}
+
+func NewOnionSphinx(data []byte) (OnionSphinx, error) {
+
+	var m OnionSphinx
+	var reader *bytes.Reader
+	var err error
+
+	m = OnionSphinx{}
+	reader = bytes.NewReader(data)
+
+	if err = binary.Read(reader, binary.BigEndian, &m.TunnelId); err != nil {
+		return m, err
+	}
+
+	m.Packet = make([]byte, reader.Len())
+	if _, err = io.ReadFull(reader, m.Packet); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// SphinxKey announces the X25519 key the peer with the Hostkey processes
+// Sphinx packets with, until Expires, in seconds since the epoch. It is
+// spread through gossip, signed by the peer.
+type SphinxKey struct {
+	Expires   uint64
+	Key       [X25519KeyLength]byte
+	Hostkey   []byte
+	Signature []byte
+}
+
+// SignedContent returns the encoding of the key without its signature.
+func (k SphinxKey) SignedContent() []byte {
+
+	var buf *bytes.Buffer
+
+	buf = new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, k.Expires)
+	buf.Write(k.Key[:])
+	binary.Write(buf, binary.BigEndian, uint16(len(k.Hostkey)))
+	buf.Write(k.Hostkey)
+	return buf.Bytes()
+}
+
+// Bytes returns the encoding of the key.
+func (k SphinxKey) Bytes() []byte {
+	return append(k.SignedContent(), k.Signature...)
+}
+
+func NewSphinxKey(data []byte) (SphinxKey, error) {
+
+	var k SphinxKey
+	var reader *bytes.Reader
+	var length uint16
+	var err error
+
+	k = SphinxKey{}
+	reader = bytes.NewReader(data)
+
+	if err = binary.Read(reader, binary.BigEndian, &k.Expires); err != nil {
+		return k, err
+	}
+	if _, err = io.ReadFull(reader, k.Key[:]); err != nil {
+		return k, err
+	}
+	if err = binary.Read(reader, binary.BigEndian, &length); err != nil {
+		return k, err
+	}
+	k.Hostkey = make([]byte, length)
+	if _, err = io.ReadFull(reader, k.Hostkey); err != nil {
+		return k, err
+	}
+
+	k.Signature = make([]byte, reader.Len())
+	if _, err = io.ReadFull(reader, k.Signature); err != nil {
+		return k, err
+	}
+	return k, nil
+}
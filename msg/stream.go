@@ -0,0 +1,249 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// Onion API messages for the streams multiplexed inside a tunnel.
+const (
+	ONION_STREAM_OPEN     = 567
+	ONION_STREAM_READY    = 568
+	ONION_STREAM_INCOMING = 569
+	ONION_STREAM_DATA     = 570
+	ONION_STREAM_CLOSE    = 571
+)
+
+// Messages sent through a tunnel between its ends for its streams.
+const (
+	ONION_OPEN    = 720
+	ONION_SEGMENT = 721
+	ONION_CLOSE   = 722
+)
+
+// OnionStreamOpen asks the module to open a new stream in the tunnel, to the
+// named service of the other end. An empty name is the default service.
+type OnionStreamOpen struct {
+	TunnelID uint32
+	Service  []byte
+}
+
+func (m OnionStreamOpen) TypeId() uint16 {
+	return ONION_STREAM_OPEN
+}
+
+func NewOnionStreamOpen(data []byte) (OnionStreamOpen, error) {
+
+	m := OnionStreamOpen{}
+	reader := bytes.NewReader(data)
+
+	// TunnelID field
+	if err := binary.Read(reader, binary.BigEndian, &m.TunnelID); err != nil {
+		return m, err
+	}
+
+	// Service field
+	m.Service = make([]byte, reader.Len())
+	if _, err := io.ReadFull(reader, m.Service); err != nil {
+		return m, err
+	}
+
+	return m, nil
+}
+
+// OnionStreamReady answers OnionStreamOpen with the id of the new stream.
+type OnionStreamReady struct {
+	TunnelID uint32
+	StreamID uint16
+	Reserved uint16
+}
+
+func (m OnionStreamReady) TypeId() uint16 {
+	return ONION_STREAM_READY
+}
+
+func NewOnionStreamReady(data []byte) (OnionStreamReady, error) {
+
+	m := OnionStreamReady{}
+	err := readStreamHeader(bytes.NewReader(data), &m.TunnelID, &m.StreamID, &m.Reserved)
+	return m, err
+}
+
+// OnionStreamIncoming tells the clients of a tunnel that the other end opened
+// a stream in it.
+type OnionStreamIncoming struct {
+	TunnelID uint32
+	StreamID uint16
+	Reserved uint16
+	Service  []byte
+}
+
+func (m OnionStreamIncoming) TypeId() uint16 {
+	return ONION_STREAM_INCOMING
+}
+
+func NewOnionStreamIncoming(data []byte) (OnionStreamIncoming, error) {
+
+	m := OnionStreamIncoming{}
+	reader := bytes.NewReader(data)
+
+	if err := readStreamHeader(reader, &m.TunnelID, &m.StreamID, &m.Reserved); err != nil {
+		return m, err
+	}
+
+	// Service field
+	m.Service = make([]byte, reader.Len())
+	if _, err := io.ReadFull(reader, m.Service); err != nil {
+		return m, err
+	}
+
+	return m, nil
+}
+
+// OnionStreamData carries the data of a stream, in both directions.
+type OnionStreamData struct {
+	TunnelID uint32
+	StreamID uint16
+	Reserved uint16
+	Data     []byte
+}
+
+func (m OnionStreamData) TypeId() uint16 {
+	return ONION_STREAM_DATA
+}
+
+func NewOnionStreamData(data []byte) (OnionStreamData, error) {
+
+	m := OnionStreamData{}
+	reader := bytes.NewReader(data)
+
+	if err := readStreamHeader(reader, &m.TunnelID, &m.StreamID, &m.Reserved); err != nil {
+		return m, err
+	}
+
+	// Data field
+	m.Data = make([]byte, reader.Len())
+	if _, err := io.ReadFull(reader, m.Data); err != nil {
+		return m, err
+	}
+
+	return m, nil
+}
+
+// OnionStreamClose closes a stream. The module sends it to the clients of the
+// stream when the other end closed it.
+type OnionStreamClose struct {
+	TunnelID uint32
+	StreamID uint16
+	Reserved uint16
+}
+
+func (m OnionStreamClose) TypeId() uint16 {
+	return ONION_STREAM_CLOSE
+}
+
+func NewOnionStreamClose(data []byte) (OnionStreamClose, error) {
+
+	m := OnionStreamClose{}
+	err := readStreamHeader(bytes.NewReader(data), &m.TunnelID, &m.StreamID, &m.Reserved)
+	return m, err
+}
+
+func readStreamHeader(reader io.Reader, tunnelId *uint32, streamId *uint16, reserved *uint16) error {
+
+	// TunnelID field
+	if err := binary.Read(reader, binary.BigEndian, tunnelId); err != nil {
+		return err
+	}
+
+	// StreamID field
+	if err := binary.Read(reader, binary.BigEndian, streamId); err != nil {
+		return err
+	}
+
+	// Reserved field
+	return binary.Read(reader, binary.BigEndian, reserved)
+}
+
+// OnionOpen opens a stream at the other end of the tunnel, to the named
+// service.
+type OnionOpen struct {
+	StreamId uint16
+	Service  []byte
+}
+
+func (m OnionOpen) TypeId() uint16 {
+	return ONION_OPEN
+}
+
+func NewOnionOpen(data []byte) (OnionOpen, error) {
+
+	var m OnionOpen
+	var reader *bytes.Reader
+	var err error
+
+	m = OnionOpen{}
+	reader = bytes.NewReader(data)
+
+	if err = binary.Read(reader, binary.BigEndian, &m.StreamId); err != nil {
+		return m, err
+	}
+
+	m.Service = make([]byte, reader.Len())
+	if _, err = io.ReadFull(reader, m.Service); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// OnionSegment carries the data of a stream through the tunnel.
+type OnionSegment struct {
+	StreamId uint16
+	Data     []byte
+}
+
+func (m OnionSegment) TypeId() uint16 {
+	return ONION_SEGMENT
+}
+
+func NewOnionSegment(data []byte) (OnionSegment, error) {
+
+	var m OnionSegment
+	var reader *bytes.Reader
+	var err error
+
+	m = OnionSegment{}
+	reader = bytes.NewReader(data)
+
+	if err = binary.Read(reader, binary.BigEndian, &m.StreamId); err != nil {
+		return m, err
+	}
+
+	m.Data = make([]byte, reader.Len())
+	if _, err = io.ReadFull(reader, m.Data); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// OnionClose closes a stream at the other end of the tunnel.
+type OnionClose struct {
+	StreamId uint16
+}
+
+func (m OnionClose) TypeId() uint16 {
+	return ONION_CLOSE
+}
+
+func NewOnionClose(data []byte) (OnionClose, error) {
+
+	var m OnionClose
+	var err error
+
+	m = OnionClose{}
+	if err = binary.Read(bytes.NewReader(data), binary.BigEndian, &m.StreamId); err != nil {
+		return m, err
+	}
+	return m, nil
+}
@@ -16,6 +16,8 @@ type NSE struct {
 	HistoryLength int
 	Period        int
 	APIAddr       string
+
+	clock p2pnet.Clock
 }
 
 const (
@@ -29,10 +31,17 @@ const (
 )
 
 func New(conf *cfg.Configurations) (*NSE, error) {
+	return NewWithSources(conf, p2pnet.DefaultSources())
+}
+
+// NewWithSources creates the module using the given clock instead of the
+// system one.
+func NewWithSources(conf *cfg.Configurations, sources p2pnet.Sources) (*NSE, error) {
 
 	var module *NSE
 
 	module = &NSE{}
+	module.clock = sources.Clock
 	conf.Init(&module.APIAddr, ModuleToken, ApiAddrToken, DefaultApiAddr)
 	conf.Init(&module.HistoryLength, ModuleToken, HistoryLengthToken, DefaultHistoryLength)
 	conf.Init(&module.Period, ModuleToken, PeriodToken, DefaultPeriod)
@@ -54,7 +63,7 @@ func (m *NSE) Run() error {
 
 	m.Calculate()
 
-	c = time.Tick(time.Duration(m.Period) * time.Second)
+	c = m.clock.Tick(time.Duration(m.Period) * time.Second)
 
 	for {
 		select {
@@ -84,7 +93,7 @@ func (m *NSE) Reply(conn net.Conn) error {
 		Deviation: uint32(m.EstimatedDeviation),
 	}
 
-	return msg.WriteMessage(conn, reply)
+	return msg.Send(conn, reply)
 }
 
 func (m *NSE) Calculate() {
@@ -0,0 +1,141 @@
+package onion
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/limoges/p2pnet"
+	"github.com/limoges/p2pnet/msg"
+)
+
+// The largest amount of cover data sent in a single message.
+const MaximumCoverChunk = 4096
+
+func (o *Onion) handleCover(source net.Conn, m *msg.OnionCover) error {
+	return o.SendCover(int(m.CoverSize))
+}
+
+// SendCover sends size bytes of random data to a random peer. The data
+// travels through a tunnel as ONION_DATA, within the windows of the tunnel
+// like the data of ONION_TUNNEL_DATA, and is dropped by the peer at its end.
+func (o *Onion) SendCover(size int) error {
+
+	var tunnel *Tunnel
+	var data []byte
+	var chunk int
+	var err error
+
+	if tunnel, err = o.currentCoverTunnel(); err != nil {
+		return err
+	}
+
+	for size > 0 {
+		chunk = size
+		if chunk > MaximumCoverChunk {
+			chunk = MaximumCoverChunk
+		}
+
+		data = make([]byte, chunk)
+		if _, err = io.ReadFull(lockedRandom{o}, data); err != nil {
+			return err
+		}
+
+		if err = tunnel.SendData(data); err != nil {
+			o.DestroyTunnel(tunnel)
+			return err
+		}
+		size = size - chunk
+	}
+	return nil
+}
+
+// currentCoverTunnel returns the tunnel cover traffic is sent through,
+// building a new one to a random peer when needed. The tunnel is opened with
+// ONION_PADDING instead of ONION_BEGIN, so that the peer drops its data. The
+// cover tunnel is never visible to API clients.
+func (o *Onion) currentCoverTunnel() (*Tunnel, error) {
+
+	var tunnel *Tunnel
+	var peers []p2pnet.Peer
+	var destination p2pnet.Peer
+	var err error
+
+	o.lock.Lock()
+	tunnel = o.coverTunnel
+	o.lock.Unlock()
+
+	if tunnel != nil && o.hasCircuit(tunnel.origin) {
+		return tunnel, nil
+	}
+
+	if peers, err = o.samplePeers(1); err != nil {
+		return nil, err
+	}
+	destination = peers[0]
+
+	tunnel, err = o.buildTunnel(0, peerHostport(destination), destination.Hostkey, msg.OnionPadding{})
+	if err != nil {
+		return nil, err
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.coverTunnel = tunnel
+	return tunnel, nil
+}
+
+// beginCover makes the circuit ending here a cover tunnel. Its data is
+// acknowledged like any other, but no client owns the tunnel and the data is
+// dropped.
+func (o *Onion) beginCover(circuit *Circuit) error {
+
+	var tunnel *Tunnel
+	var err error
+
+	if circuit.tunnel != nil {
+		return nil
+	}
+	if tunnel, err = NewTunnel(o); err != nil {
+		return err
+	}
+	tunnel.circuit = circuit
+	circuit.tunnel = tunnel
+	return nil
+}
+
+// runCover keeps the data leaving the node at CoverSize bytes every
+// CoverInterval. The data API clients sent during the interval takes the
+// place of cover traffic, and cover traffic makes up the rest.
+func (o *Onion) runCover() {
+
+	var ticks <-chan time.Time
+	var size int
+
+	ticks = o.clock.Tick(time.Duration(o.CoverInterval) * time.Millisecond)
+	for range ticks {
+		o.lock.Lock()
+		size = o.CoverSize - o.dataSent
+		o.dataSent = 0
+		o.lock.Unlock()
+
+		if size <= 0 {
+			continue
+		}
+		if err := o.SendCover(size); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// markDataSent records that size bytes of real traffic left the node, which
+// replace as much cover traffic in the current interval.
+func (o *Onion) markDataSent(size int) {
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.dataSent = o.dataSent + size
+}
@@ -0,0 +1,62 @@
+package onion
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/limoges/p2pnet/msg"
+)
+
+// decryptedBytes sums the traffic the peers removed a layer from.
+func decryptedBytes(peers []*testPeer) uint64 {
+
+	var total uint64
+
+	for _, peer := range peers {
+		for _, session := range peer.Auth.ListSessions() {
+			total = total + session.BytesDecrypted
+		}
+	}
+	return total
+}
+
+// Cover traffic travels through a tunnel, and is never handed to the API
+// clients at its end.
+func TestCover(t *testing.T) {
+
+	var peers []*testPeer
+	var clients []net.Conn
+	var err error
+
+	peers = startNetwork(t, 5, "")
+	for _, peer := range peers[1:] {
+		clients = append(clients, dialAPI(t, peer))
+	}
+	if err = msg.Send(dialAPI(t, peers[0]), msg.OnionCover{CoverSize: 10000}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every hop removes its layer from the whole cover.
+	waitFor(t, "the cover traffic", func() bool {
+		return decryptedBytes(peers[1:]) >= 3*10000
+	})
+	for _, client := range clients {
+		client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if m, err := msg.Read(client); err == nil {
+			t.Fatalf("a client received %v", msg.Identifier(m.TypeId()))
+		}
+	}
+}
+
+// Without any traffic from the clients, cover traffic is sent at the
+// configured interval.
+func TestCoverInterval(t *testing.T) {
+
+	var peers []*testPeer
+
+	peers = startNetwork(t, 5, "cover_interval = 50\ncover_size = 1000")
+	waitFor(t, "the background cover traffic", func() bool {
+		return decryptedBytes(peers) >= 5*3*1000
+	})
+}
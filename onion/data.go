@@ -0,0 +1,272 @@
+package onion
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/limoges/p2pnet/msg"
+)
+
+var (
+	ErrNotOwner = errors.New("The tunnel is owned by other API connections")
+)
+
+// beginTunnel gives the tunnel ending here an id and lets all our API clients
+// know about it. A tunnel rebuilt for a new round takes over the id and the
+// clients of the tunnel it replaces instead.
+func (o *Onion) beginTunnel(circuit *Circuit, m *msg.OnionBegin) error {
+
+	var tunnel *Tunnel
+	var err error
+
+	if circuit.tunnel != nil {
+		return errors.New("The tunnel has already begun")
+	}
+
+	if tunnel, err = NewTunnel(o); err != nil {
+		return err
+	}
+	tunnel.circuit = circuit
+	tunnel.token = m.Token
+	circuit.tunnel = tunnel
+
+	if o.continueTunnel(tunnel) {
+		return nil
+	}
+
+	o.notifyIncoming(tunnel, o.adoptTunnel(tunnel), circuit.hostkey)
+	return nil
+}
+
+// adoptTunnel stores a tunnel other peers brought to us. The clients own it
+// once they subscribe to it. It returns the clients to notify.
+func (o *Onion) adoptTunnel(tunnel *Tunnel) []net.Conn {
+
+	var clients []net.Conn
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for client := range o.clients {
+		clients = append(clients, client)
+	}
+	tunnel.incoming = true
+	o.Tunnels[tunnel.Id] = tunnel
+	return clients
+}
+
+// notifyIncoming sends ONION_TUNNEL_INCOMING to the clients, with the hostkey
+// of the initiator if it is known.
+func (o *Onion) notifyIncoming(tunnel *Tunnel, clients []net.Conn, hostkey []byte) {
+
+	o.notify(clients, msg.OnionTunnelIncoming{
+		TunnelID:           tunnel.Id,
+		SourceHostKeyInDER: hostkey,
+	}, nil)
+}
+
+// receiveData handles data arriving at the end of a tunnel initiated by
+// another peer.
+func (o *Onion) receiveData(circuit *Circuit, m *msg.OnionData) error {
+
+	if circuit.tunnel == nil {
+		return errors.New("Data received before the tunnel has begun")
+	}
+	return o.acceptData(circuit.tunnel, m.Data)
+}
+
+// deliver queues data received through the tunnel for the API clients owning
+// it. done is called once they have all been handed the data.
+func (o *Onion) deliver(tunnel *Tunnel, data []byte, done func()) error {
+
+	o.handOver(tunnel, func() {
+		o.notify(o.owners(tunnel), msg.OnionTunnelData{
+			TunnelID: tunnel.Id,
+			Data:     data,
+		}, done)
+	})
+	return nil
+}
+
+// handOver calls delivery, unless no client has subscribed to the incoming
+// tunnel yet. The delivery is then held back for the first one which does.
+// Since the data is only acknowledged once delivered, the windows of the
+// tunnel bound what is held back.
+func (o *Onion) handOver(tunnel *Tunnel, delivery func()) {
+
+	o.lock.Lock()
+	if tunnel.flushing || (tunnel.incoming && len(tunnel.owners) == 0) {
+		tunnel.held = append(tunnel.held, delivery)
+		o.lock.Unlock()
+		return
+	}
+	o.lock.Unlock()
+
+	delivery()
+}
+
+// owners returns the API clients owning the tunnel.
+func (o *Onion) owners(tunnel *Tunnel) []net.Conn {
+
+	var clients []net.Conn
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for client := range tunnel.owners {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// notifyError sends ONION_ERROR to the API clients owning the tunnel.
+// The clients of a replaced tunnel have moved on to its replacement and are
+// not told about it.
+func (o *Onion) notifyError(tunnel *Tunnel, requestType uint16) {
+
+	var clients []net.Conn
+
+	o.lock.Lock()
+	if !tunnel.retired {
+		for client := range tunnel.owners {
+			clients = append(clients, client)
+		}
+	}
+	o.lock.Unlock()
+
+	o.notify(clients, msg.OnionError{
+		RequestType: requestType,
+		TunnelID:    tunnel.Id,
+	}, nil)
+}
+
+// Connected registers the API client.
+func (o *Onion) Connected(client net.Conn) {
+	o.storeClient(client)
+}
+
+// Disconnected forgets the API client, and tears down the tunnels it was the
+// last owner of.
+func (o *Onion) Disconnected(client net.Conn) {
+
+	var orphans []*Tunnel
+
+	o.lock.Lock()
+	if queue, present := o.clients[client]; present {
+		queue.close()
+		delete(o.clients, client)
+	}
+	delete(o.sphinxClients, client)
+	for _, tunnel := range o.Tunnels {
+		if !tunnel.owners[client] {
+			continue
+		}
+		delete(tunnel.owners, client)
+		for _, stream := range tunnel.streams {
+			delete(stream.clients, client)
+		}
+		if len(tunnel.owners) == 0 {
+			orphans = append(orphans, tunnel)
+		}
+	}
+	o.lock.Unlock()
+
+	for _, tunnel := range orphans {
+		if err := o.DestroyTunnel(tunnel); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// addOwner records that the API client owns the tunnel.
+func (o *Onion) addOwner(tunnel *Tunnel, client net.Conn) {
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	tunnel.owners[client] = true
+}
+
+// owned finds the tunnel, as long as the API client owns it.
+func (o *Onion) owned(id uint32, client net.Conn) (*Tunnel, error) {
+
+	var tunnel *Tunnel
+	var present bool
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if tunnel, present = o.Tunnels[id]; !present {
+		return nil, errors.New(fmt.Sprintf("Tunnel %v does not exist.", id))
+	}
+	if !tunnel.owners[client] {
+		return nil, ErrNotOwner
+	}
+	return tunnel, nil
+}
+
+// handleTunnelSubscribe makes the client an owner of the incoming tunnel.
+// The first client to subscribe is handed what the tunnel delivered so far.
+func (o *Onion) handleTunnelSubscribe(source net.Conn, m *msg.OnionTunnelSubscribe) error {
+
+	var tunnel *Tunnel
+	var present bool
+	var first bool
+
+	o.lock.Lock()
+	if tunnel, present = o.Tunnels[m.TunnelID]; !present {
+		o.lock.Unlock()
+		return errors.New(fmt.Sprintf("Tunnel %v does not exist.", m.TunnelID))
+	}
+	if !tunnel.incoming && !tunnel.owners[source] {
+		o.lock.Unlock()
+		return ErrNotOwner
+	}
+	if first = tunnel.incoming && len(tunnel.owners) == 0; first {
+		tunnel.flushing = true
+	}
+	tunnel.owners[source] = true
+	o.lock.Unlock()
+
+	if first {
+		o.flushHeld(tunnel)
+	}
+	return nil
+}
+
+// flushHeld hands over the deliveries held back for the tunnel, in order.
+// Those held back meanwhile follow.
+func (o *Onion) flushHeld(tunnel *Tunnel) {
+
+	var held []func()
+
+	for {
+		o.lock.Lock()
+		held = tunnel.held
+		tunnel.held = nil
+		if len(held) == 0 {
+			tunnel.flushing = false
+		}
+		o.lock.Unlock()
+
+		if len(held) == 0 {
+			return
+		}
+		for _, delivery := range held {
+			delivery()
+		}
+	}
+}
+
+// storeClient remembers an API connection to deliver tunnel data to, through
+// a queue of its own.
+func (o *Onion) storeClient(client net.Conn) {
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if _, present := o.clients[client]; !present {
+		o.clients[client] = newClientQueue(client)
+	}
+}
@@ -0,0 +1,91 @@
+package onion
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/limoges/p2pnet/msg"
+)
+
+// Data sent by a client travels to the clients of the destination, and
+// their answers come back to the initiator.
+func TestTunnelData(t *testing.T) {
+
+	var peers []*testPeer
+	var data msg.OnionTunnelData
+	var err error
+
+	peers = startNetwork(t, 5, "")
+	source := dialAPI(t, peers[0])
+	destination := dialAPI(t, peers[4])
+	connected(t, peers[4], 1)
+
+	sourceId, destinationId := openTestTunnel(t, source, peers, destination)
+	if err = msg.Send(source, msg.OnionTunnelData{TunnelID: sourceId, Data: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	if data = expectMessage[msg.OnionTunnelData](t, destination); string(data.Data) != "hello" || data.TunnelID != destinationId {
+		t.Fatalf("the destination received %#v", data)
+	}
+
+	if err = msg.Send(destination, msg.OnionTunnelData{TunnelID: destinationId, Data: []byte("world")}); err != nil {
+		t.Fatal(err)
+	}
+	if data = expectMessage[msg.OnionTunnelData](t, source); string(data.Data) != "world" || data.TunnelID != sourceId {
+		t.Fatalf("the initiator received %#v", data)
+	}
+}
+
+// Every client connected to the destination is told about the tunnel and
+// who built it, but only those which subscribe to it receive its data. The
+// data sent before anyone subscribed is held back for the first to do so.
+func TestTunnelIncoming(t *testing.T) {
+
+	var peers []*testPeer
+	var incoming msg.OnionTunnelIncoming
+	var data msg.OnionTunnelData
+	var err error
+
+	peers = startNetwork(t, 5, "")
+	source := dialAPI(t, peers[0])
+	subscriber, bystander := dialAPI(t, peers[4]), dialAPI(t, peers[4])
+	connected(t, peers[4], 2)
+
+	sourceId, _ := openTestTunnel(t, source, peers)
+	for _, client := range []net.Conn{subscriber, bystander} {
+		incoming = expectMessage[msg.OnionTunnelIncoming](t, client)
+		if !bytes.Equal(incoming.SourceHostKeyInDER, peers[0].Onion.Hostkey) {
+			t.Fatal("the tunnel is not attributed to its initiator")
+		}
+	}
+
+	if err = msg.Send(source, msg.OnionTunnelData{TunnelID: sourceId, Data: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the data to be held back", func() bool {
+		tunnel, _ := peers[4].Onion.tunnel(incoming.TunnelID)
+		peers[4].Onion.lock.Lock()
+		defer peers[4].Onion.lock.Unlock()
+		return len(tunnel.held) == 1
+	})
+
+	if err = msg.Send(subscriber, msg.OnionTunnelSubscribe{TunnelID: incoming.TunnelID}); err != nil {
+		t.Fatal(err)
+	}
+	if data = expectMessage[msg.OnionTunnelData](t, subscriber); string(data.Data) != "hello" || data.TunnelID != incoming.TunnelID {
+		t.Fatalf("the subscriber received %#v", data)
+	}
+	if err = msg.Send(source, msg.OnionTunnelData{TunnelID: sourceId, Data: []byte("world")}); err != nil {
+		t.Fatal(err)
+	}
+	if data = expectMessage[msg.OnionTunnelData](t, subscriber); string(data.Data) != "world" {
+		t.Fatalf("the subscriber received %q", data.Data)
+	}
+
+	bystander.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if m, err := msg.Read(bystander); err == nil {
+		t.Fatalf("the client which did not subscribe received %v", msg.Identifier(m.TypeId()))
+	}
+}
@@ -0,0 +1,207 @@
+package onion
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/limoges/p2pnet"
+	"github.com/limoges/p2pnet/msg"
+)
+
+// handleTunnelDestroy releases the client's ownership of the tunnel. The
+// tunnel is torn down once no client owns it anymore.
+func (o *Onion) handleTunnelDestroy(source net.Conn, m *msg.OnionTunnelDestroy) error {
+
+	var tunnel *Tunnel
+	var err error
+
+	if tunnel, err = o.owned(m.TunnelID, source); err != nil {
+		return err
+	}
+
+	if !o.release(tunnel, source) {
+		return nil
+	}
+	return o.DestroyTunnel(tunnel)
+}
+
+// DestroyTunnel tears down the tunnel along every hop and forgets it.
+func (o *Onion) DestroyTunnel(tunnel *Tunnel) error {
+
+	var circuit *Circuit
+	var err error
+
+	if tunnel.circuit != nil {
+		circuit = tunnel.circuit
+		if o.hasCircuit(circuit) {
+			err = circuit.Previous.Send(msg.OnionDestroy{TunnelId: circuit.PreviousId})
+		}
+	} else if tunnel.origin != nil {
+		circuit = tunnel.origin
+		if len(tunnel.Hops) > 0 && o.hasCircuit(circuit) {
+			err = circuit.Next.Send(msg.OnionDestroy{TunnelId: circuit.NextId})
+		}
+	}
+
+	if circuit != nil {
+		o.removeCircuit(circuit)
+	}
+	o.removeTunnel(tunnel)
+	return err
+}
+
+// handleDestroy forgets the circuit and passes the destruction on to the
+// circuit's other neighbour.
+func (o *Onion) handleDestroy(source *Link, m *msg.OnionDestroy) error {
+
+	var circuit *Circuit
+	var err error
+
+	if circuit, err = o.circuit(source, m.TunnelId); err != nil {
+		return err
+	}
+	o.removeCircuit(circuit)
+
+	// A tunnel being extended stops waiting for the answer.
+	if circuit.Previous == nil {
+		o.respond(circuitKey{source, m.TunnelId}, *m)
+	}
+
+	if circuit.isForward(source, m.TunnelId) {
+		if circuit.Next != nil {
+			err = circuit.Next.Send(msg.OnionDestroy{TunnelId: circuit.NextId, Reason: m.Reason})
+		}
+	} else if circuit.Previous != nil {
+		err = circuit.Previous.Send(msg.OnionDestroy{TunnelId: circuit.PreviousId, Reason: m.Reason})
+	}
+
+	// A tunnel torn down by a failure may be rebuilt, otherwise the clients
+	// are told it is gone.
+	if circuit.tunnel != nil && m.Reason == msg.DestroyFailed {
+		o.tunnelLost(circuit.tunnel)
+	} else if circuit.tunnel != nil {
+		o.notifyError(circuit.tunnel, msg.ONION_TUNNEL_DESTROY)
+		o.removeTunnel(circuit.tunnel)
+	}
+	return err
+}
+
+// abortCircuit tears down a circuit which cannot relay anymore, in both
+// directions.
+func (o *Onion) abortCircuit(circuit *Circuit) {
+
+	o.removeCircuit(circuit)
+
+	if circuit.Next != nil {
+		circuit.Next.Send(msg.OnionDestroy{TunnelId: circuit.NextId, Reason: msg.DestroyFailed})
+	}
+	if circuit.Previous != nil {
+		circuit.Previous.Send(msg.OnionDestroy{TunnelId: circuit.PreviousId, Reason: msg.DestroyFailed})
+	}
+	if circuit.tunnel != nil {
+		o.notifyError(circuit.tunnel, msg.ONION_TUNNEL_DESTROY)
+		o.removeTunnel(circuit.tunnel)
+	}
+}
+
+// hasCircuit reports whether the circuit is still known.
+func (o *Onion) hasCircuit(circuit *Circuit) bool {
+
+	var key circuitKey
+
+	key = circuitKey{circuit.Next, circuit.NextId}
+	if circuit.Next == nil {
+		key = circuitKey{circuit.Previous, circuit.PreviousId}
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	return o.circuits[key] == circuit
+}
+
+// release removes the client's ownership of the tunnel. It reports whether
+// the client was the last owner.
+func (o *Onion) release(tunnel *Tunnel, client net.Conn) bool {
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	delete(tunnel.owners, client)
+	return len(tunnel.owners) == 0
+}
+
+// removeCircuit forgets the circuit and closes the session it used. The
+// circuit it was joined to at a rendezvous is torn down as well.
+func (o *Onion) removeCircuit(circuit *Circuit) {
+
+	var joined *Circuit
+
+	o.lock.Lock()
+	if circuit.Previous != nil {
+		delete(o.circuits, circuitKey{circuit.Previous, circuit.PreviousId})
+	}
+	if circuit.Next != nil {
+		delete(o.circuits, circuitKey{circuit.Next, circuit.NextId})
+	}
+	joined = o.forgetRendezvous(circuit)
+	o.lock.Unlock()
+
+	if joined != nil {
+		joined.Previous.Send(msg.OnionDestroy{TunnelId: joined.PreviousId})
+		o.removeCircuit(joined)
+	}
+
+	// The circuit of a tunnel we initiated has no session of its own.
+	if circuit.Previous != nil {
+		o.closeSession(circuit.SessionId)
+	}
+}
+
+// removeTunnel forgets the tunnel, the sessions with its hops and the hops
+// no other tunnel goes through.
+func (o *Onion) removeTunnel(tunnel *Tunnel) {
+
+	var identity p2pnet.Identity
+	var used map[p2pnet.Identity]bool
+
+	for _, hop := range tunnel.Hops {
+		o.closeSession(hop.SessionId)
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	tunnel.closed = true
+	o.windows.Broadcast()
+
+	// A replaced tunnel has given its id to its replacement.
+	if o.Tunnels[tunnel.Id] == tunnel {
+		delete(o.Tunnels, tunnel.Id)
+	}
+
+	used = make(map[p2pnet.Identity]bool)
+	for _, other := range o.Tunnels {
+		for _, hop := range other.Hops {
+			used[p2pnet.GetIdentity(hop.Hostkey)] = true
+		}
+	}
+	for _, hop := range tunnel.Hops {
+		if identity = p2pnet.GetIdentity(hop.Hostkey); !used[identity] {
+			delete(o.Peers, identity)
+		}
+	}
+}
+
+// closeSession asks the Auth module to close the session and forgets it.
+func (o *Onion) closeSession(id uint32) {
+
+	if err := forwardTo(o.AuthAddr, msg.AuthSessionClose{SessionId: id}); err != nil {
+		fmt.Println(err)
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	delete(o.Sessions, id)
+}
@@ -0,0 +1,78 @@
+package onion
+
+import (
+	"testing"
+
+	"github.com/limoges/p2pnet/msg"
+)
+
+// state counts what the peer keeps about tunnels.
+func state(peer *testPeer) int {
+
+	peer.Onion.lock.Lock()
+	defer peer.Onion.lock.Unlock()
+
+	return len(peer.Onion.Tunnels) + len(peer.Onion.circuits) + len(peer.Onion.Sessions) + len(peer.Auth.ListSessions())
+}
+
+// Destroying a tunnel removes its circuits, sessions and peers along every
+// hop.
+func TestDestroy(t *testing.T) {
+
+	var peers []*testPeer
+	var err error
+
+	peers = startNetwork(t, 5, "")
+	source := dialAPI(t, peers[0])
+	destination := dialAPI(t, peers[4])
+	connected(t, peers[4], 1)
+
+	sourceId, _ := openTestTunnel(t, source, peers, destination)
+	if err = msg.Send(source, msg.OnionTunnelDestroy{TunnelID: sourceId}); err != nil {
+		t.Fatal(err)
+	}
+	for _, peer := range peers {
+		waitFor(t, "the tunnel to be torn down at "+peer.Onion.ListenAddr, func() bool {
+			return state(peer) == 0
+		})
+	}
+
+	peers[0].Onion.lock.Lock()
+	defer peers[0].Onion.lock.Unlock()
+	if len(peers[0].Onion.Peers) != 0 {
+		t.Fatalf("the initiator still knows %v peers", len(peers[0].Onion.Peers))
+	}
+}
+
+// The tunnel stays up while a client still owns it.
+func TestDestroyShared(t *testing.T) {
+
+	var peers []*testPeer
+	var err error
+
+	peers = startNetwork(t, 5, "")
+	source := dialAPI(t, peers[0])
+	first, second := dialAPI(t, peers[4]), dialAPI(t, peers[4])
+	connected(t, peers[4], 2)
+
+	sourceId, destinationId := openTestTunnel(t, source, peers, first, second)
+	if err = msg.Send(first, msg.OnionTunnelDestroy{TunnelID: destinationId}); err != nil {
+		t.Fatal(err)
+	}
+	if err = msg.Send(source, msg.OnionTunnelData{TunnelID: sourceId, Data: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	if data := expectMessage[msg.OnionTunnelData](t, second); string(data.Data) != "hello" {
+		t.Fatalf("the destination received %q", data.Data)
+	}
+
+	if err = msg.Send(second, msg.OnionTunnelDestroy{TunnelID: destinationId}); err != nil {
+		t.Fatal(err)
+	}
+	if failure := expectMessage[msg.OnionError](t, source); failure.RequestType != msg.ONION_TUNNEL_DESTROY {
+		t.Fatalf("the initiator was told %#v", failure)
+	}
+	waitFor(t, "the tunnel to be torn down", func() bool {
+		return state(peers[0]) == 0 && state(peers[4]) == 0
+	})
+}
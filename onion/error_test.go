@@ -0,0 +1,90 @@
+package onion
+
+import (
+	"testing"
+
+	"github.com/limoges/p2pnet/msg"
+)
+
+// Requests which cannot be carried out are answered with ONION_ERROR.
+func TestErrorResponses(t *testing.T) {
+
+	var peers []*testPeer
+	var response msg.Message
+	var failure msg.OnionError
+	var valid bool
+	var err error
+
+	peers = startNetwork(t, 5, "")
+	client := dialAPI(t, peers[0])
+
+	// Nothing listens at the destination.
+	unreachable := buildMsg(peers[4])
+	unreachable.Port = 1
+	if response, err = msg.SendReceive(client, unreachable); err != nil {
+		t.Fatal(err)
+	}
+	if failure, valid = response.(msg.OnionError); !valid || failure.RequestType != msg.ONION_TUNNEL_BUILD {
+		t.Fatalf("expected an error about the build, got %#v", response)
+	}
+
+	if response, err = msg.SendReceive(client, msg.OnionTunnelData{TunnelID: 42}); err != nil {
+		t.Fatal(err)
+	}
+	if failure, valid = response.(msg.OnionError); !valid || failure.RequestType != msg.ONION_TUNNEL_DATA || failure.TunnelID != 42 {
+		t.Fatalf("expected an error about the data, got %#v", response)
+	}
+}
+
+// anyCircuit returns one of the circuits of the module.
+func anyCircuit(o *Onion) *Circuit {
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for _, circuit := range o.circuits {
+		return circuit
+	}
+	return nil
+}
+
+// When a hop drops the tunnel, the clients at both ends are told it is gone
+// and every peer forgets it. Without keepalives, the destination does not wait
+// for the timeout to give up on the tunnel.
+func TestErrorTornDown(t *testing.T) {
+
+	var peers []*testPeer
+	var tunnel *Tunnel
+	var failure msg.OnionError
+
+	peers = startNetwork(t, 5, "keepalive_interval = 0")
+	source := dialAPI(t, peers[0])
+	destination := dialAPI(t, peers[4])
+	connected(t, peers[4], 1)
+
+	sourceId, destinationId := openTestTunnel(t, source, peers, destination)
+	peers[0].Onion.lock.Lock()
+	tunnel = peers[0].Onion.Tunnels[sourceId]
+	peers[0].Onion.lock.Unlock()
+
+	// The middle hop loses the tunnel.
+	for _, peer := range peers {
+		if peer.Onion.ListenAddr == tunnel.Hops[1].Hostport {
+			peer.Onion.abortCircuit(anyCircuit(peer.Onion))
+		}
+	}
+
+	if failure = expectMessage[msg.OnionError](t, source); failure.RequestType != msg.ONION_TUNNEL_DESTROY || failure.TunnelID != sourceId {
+		t.Fatalf("the initiator was told %#v", failure)
+	}
+	if failure = expectMessage[msg.OnionError](t, destination); failure.RequestType != msg.ONION_TUNNEL_DESTROY || failure.TunnelID != destinationId {
+		t.Fatalf("the destination was told %#v", failure)
+	}
+	for _, peer := range peers {
+		waitFor(t, "the circuits to be removed at "+peer.Onion.ListenAddr, func() bool {
+			peer.Onion.lock.Lock()
+			defer peer.Onion.lock.Unlock()
+			return len(peer.Onion.circuits) == 0
+		})
+	}
+}
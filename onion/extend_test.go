@@ -0,0 +1,59 @@
+package onion
+
+import (
+	"testing"
+
+	"github.com/limoges/p2pnet/msg"
+)
+
+// links lists the peers the module dialed.
+func links(o *Onion) map[string]bool {
+
+	var hostports map[string]bool
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	hostports = make(map[string]bool)
+	for hostport := range o.links {
+		hostports[hostport] = true
+	}
+	return hostports
+}
+
+// The initiator only connects to the first hop. Every other hop is reached
+// by the one before it.
+func TestExtend(t *testing.T) {
+
+	var peers []*testPeer
+	var ready *msg.OnionTunnelReady
+	var tunnel *Tunnel
+	var byHostport map[string]*testPeer
+	var err error
+
+	peers = startNetwork(t, 5, "")
+	source, destination := peers[0], peers[4]
+	if ready, err = source.Onion.BuildTunnel(2, destination.Onion.ListenAddr, destination.Onion.Hostkey); err != nil {
+		t.Fatal(err)
+	}
+	tunnel = source.Onion.Tunnels[ready.TunnelId]
+	if len(tunnel.Hops) != 3 {
+		t.Fatalf("the tunnel has %v hops instead of 3", len(tunnel.Hops))
+	}
+
+	byHostport = make(map[string]*testPeer)
+	for _, peer := range peers {
+		byHostport[peer.Onion.ListenAddr] = peer
+	}
+
+	dialer := source
+	for _, hop := range tunnel.Hops {
+		if dialed := links(dialer.Onion); len(dialed) != 1 || !dialed[hop.Hostport] {
+			t.Fatalf("%v dialed %v instead of %v", dialer.Onion.ListenAddr, dialed, hop.Hostport)
+		}
+		dialer = byHostport[hop.Hostport]
+	}
+	if dialed := links(destination.Onion); len(dialed) != 0 {
+		t.Fatalf("the destination dialed %v", dialed)
+	}
+}
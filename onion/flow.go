@@ -0,0 +1,234 @@
+package onion
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/limoges/p2pnet/msg"
+)
+
+// The ends of a tunnel limit the data in flight with windows, counted in
+// ONION_DATA messages. Each end may send as many messages as its window
+// allows, and the other end opens the window again with ONION_SENDME once it
+// has received an increment's worth. The whole tunnel has a window, and so
+// does each of its streams.
+const (
+	CircuitWindowStart     = 1000
+	CircuitWindowIncrement = 100
+	StreamWindowStart      = 500
+	StreamWindowIncrement  = 50
+)
+
+// The stream carrying the data of ONION_TUNNEL_DATA.
+const DataStreamId = 1
+
+var (
+	ErrWindowExceeded = errors.New("The other end sent more data than its window allows")
+	ErrTunnelClosed   = errors.New("The tunnel has been closed")
+	ErrUnknownStream  = errors.New("The stream does not exist")
+)
+
+type window struct {
+	start     int
+	increment int
+	// The messages we may still send.
+	packaged int
+	// The messages the other end may still send.
+	delivered int
+	// The messages handed over since the other end was last acknowledged.
+	handed int
+}
+
+func newWindow(start, increment int) window {
+	return window{
+		start:     start,
+		increment: increment,
+		packaged:  start,
+		delivered: start,
+	}
+}
+
+func (w *window) open() bool {
+	return w.packaged > 0
+}
+
+func (w *window) sent() {
+	w.packaged = w.packaged - 1
+}
+
+// acknowledged opens the window again for an increment's worth of messages.
+func (w *window) acknowledged() error {
+
+	if w.packaged+w.increment > w.start {
+		return errors.New("Unexpected ONION_SENDME")
+	}
+	w.packaged = w.packaged + w.increment
+	return nil
+}
+
+func (w *window) received() error {
+
+	if w.delivered == 0 {
+		return ErrWindowExceeded
+	}
+	w.delivered = w.delivered - 1
+	return nil
+}
+
+// acknowledge records that a message has been handed over. It reports
+// whether the other end should be sent ONION_SENDME, and opens its window if
+// so.
+func (w *window) acknowledge() bool {
+
+	w.handed = w.handed + 1
+	if w.handed < w.increment {
+		return false
+	}
+	w.handed = w.handed - w.increment
+	w.delivered = w.delivered + w.increment
+	return true
+}
+
+// SendData sends the data through the tunnel once the windows allow it. The
+// API client sending it is held back until then.
+func (t *Tunnel) SendData(data []byte) error {
+	return t.sendWindowed(DataStreamId, msg.OnionData{Data: data})
+}
+
+// sendWindowed sends a message of the stream through the tunnel once the
+// windows of the tunnel and of the stream allow it. Data sent to a tunnel
+// replaced in a new round goes through its replacement.
+func (t *Tunnel) sendWindowed(streamId uint16, message msg.Message) error {
+
+	var o *Onion
+	var next *Tunnel
+	var stream *window
+	var present bool
+
+	o = t.onion
+	o.lock.Lock()
+	for {
+		if t.retired {
+			if next, present = o.Tunnels[t.Id]; present {
+				t = next
+				continue
+			}
+		}
+		if t.closed || t.retired {
+			o.lock.Unlock()
+			return ErrTunnelClosed
+		}
+		if stream = t.window(streamId); stream == nil {
+			o.lock.Unlock()
+			return ErrUnknownStream
+		}
+		if t.circuitWindow.open() && stream.open() {
+			break
+		}
+		o.windows.Wait()
+	}
+	t.circuitWindow.sent()
+	stream.sent()
+	o.lock.Unlock()
+
+	return t.Send(message)
+}
+
+// window returns the window of the stream, if it is open. The lock must be
+// held.
+func (t *Tunnel) window(streamId uint16) *window {
+
+	if streamId == DataStreamId {
+		return &t.streamWindow
+	}
+	if stream, present := t.streams[streamId]; present {
+		return &stream.window
+	}
+	return nil
+}
+
+// acceptData hands the data received through the tunnel to its clients, and
+// acknowledges it to the other end.
+func (o *Onion) acceptData(tunnel *Tunnel, data []byte) error {
+	return o.acceptWindowed(tunnel, DataStreamId, func(done func()) error {
+		return o.deliver(tunnel, data, done)
+	})
+}
+
+// acceptWindowed accounts for a message of the stream received through the
+// tunnel before handing it over with deliver, which calls done once the
+// clients have it. The other end is sent ONION_SENDME when its windows need
+// opening. Since the stream is only acknowledged once the clients have its
+// data, a slow client holds back the other end of the tunnel and nothing
+// else.
+func (o *Onion) acceptWindowed(tunnel *Tunnel, streamId uint16, deliver func(done func()) error) error {
+
+	var stream *window
+	var acknowledgeCircuit bool
+	var err error
+
+	o.lock.Lock()
+	if stream = tunnel.window(streamId); stream == nil {
+		err = ErrUnknownStream
+	} else if err = tunnel.circuitWindow.received(); err == nil {
+		err = stream.received()
+	}
+	acknowledgeCircuit = err == nil && tunnel.circuitWindow.acknowledge()
+	o.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if acknowledgeCircuit {
+		if err = tunnel.Send(msg.OnionSendme{StreamId: 0}); err != nil {
+			return err
+		}
+	}
+
+	return deliver(func() {
+		if err := o.acknowledgeStream(tunnel, streamId); err != nil {
+			fmt.Println(err)
+		}
+	})
+}
+
+// acknowledgeStream sends ONION_SENDME for the stream if its window needs
+// opening. The stream may have been closed in the meantime.
+func (o *Onion) acknowledgeStream(tunnel *Tunnel, streamId uint16) error {
+
+	var stream *window
+	var acknowledge bool
+
+	o.lock.Lock()
+	if stream = tunnel.window(streamId); stream != nil {
+		acknowledge = stream.acknowledge()
+	}
+	o.lock.Unlock()
+
+	if acknowledge {
+		return tunnel.Send(msg.OnionSendme{StreamId: streamId})
+	}
+	return nil
+}
+
+// receiveSendme opens the window the other end of the tunnel acknowledged.
+func (o *Onion) receiveSendme(tunnel *Tunnel, m *msg.OnionSendme) error {
+
+	var stream *window
+	var err error
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if m.StreamId == 0 {
+		err = tunnel.circuitWindow.acknowledged()
+	} else if stream = tunnel.window(m.StreamId); stream != nil {
+		err = stream.acknowledged()
+	} else {
+		// The stream may have been closed since.
+		return nil
+	}
+	o.windows.Broadcast()
+	return err
+}
@@ -0,0 +1,242 @@
+package onion
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/limoges/p2pnet/msg"
+)
+
+// numbered returns size bytes starting with the number.
+func numbered(i int, size int) []byte {
+
+	var data []byte
+
+	data = make([]byte, size)
+	binary.BigEndian.PutUint32(data, uint32(i))
+	return data
+}
+
+// sendNumbered sends count numbered messages through the tunnel, in the
+// background.
+func sendNumbered(conn net.Conn, tunnelId uint32, count int, size int) <-chan error {
+
+	var sent chan error
+
+	sent = make(chan error, 1)
+	go func() {
+		for i := 0; i < count; i++ {
+			if err := msg.Send(conn, msg.OnionTunnelData{TunnelID: tunnelId, Data: numbered(i, size)}); err != nil {
+				sent <- err
+				return
+			}
+		}
+		sent <- nil
+	}()
+	return sent
+}
+
+// receiveNumbered checks that the count numbered messages arrive in order.
+func receiveNumbered(t *testing.T, conn net.Conn, count int, size int) {
+	if err := readNumbered(conn, count, size); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readNumbered(conn net.Conn, count int, size int) error {
+
+	var message msg.Message
+	var data msg.OnionTunnelData
+	var valid bool
+	var err error
+
+	for i := 0; i < count; i++ {
+		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		if message, err = msg.Read(conn); err != nil {
+			return err
+		}
+		if data, valid = message.(msg.OnionTunnelData); !valid {
+			return fmt.Errorf("expected OnionTunnelData, got %v", message)
+		}
+		if !bytes.Equal(data.Data, numbered(i, size)) {
+			return fmt.Errorf("message %v is out of order", i)
+		}
+	}
+	return nil
+}
+
+// testWindows returns the windows of the tunnel: the messages we may still
+// send on the tunnel and on its data stream.
+func testWindows(t *testing.T, o *Onion, tunnelId uint32) (int, int) {
+
+	var tunnel *Tunnel
+	var present bool
+
+	if tunnel, present = o.tunnel(tunnelId); !present {
+		t.Fatalf("tunnel %v does not exist", tunnelId)
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	return tunnel.circuitWindow.packaged, tunnel.streamWindow.packaged
+}
+
+// The data of a tunnel through several relays arrives whole and in order,
+// across many windows, and the windows are open again afterwards.
+func TestWindowThroughput(t *testing.T) {
+
+	const count = 3 * CircuitWindowStart
+	const size = 1024
+
+	var peers []*testPeer
+	var source, destination net.Conn
+	var tunnelId uint32
+	var sent <-chan error
+	var start time.Time
+	var elapsed time.Duration
+	var circuit, stream int
+
+	peers = startNetwork(t, 5, "")
+	source = dialAPI(t, peers[0])
+	destination = dialAPI(t, peers[4])
+	time.Sleep(50 * time.Millisecond)
+
+	tunnelId, _ = openTestTunnel(t, source, peers, destination)
+
+	start = time.Now()
+	sent = sendNumbered(source, tunnelId, count, size)
+	receiveNumbered(t, destination, count, size)
+	elapsed = time.Since(start)
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("%v messages of %v bytes in %v: %.1f kB/s", count, size, elapsed,
+		float64(count*size)/1000/elapsed.Seconds())
+
+	// The destination acknowledges all but the last increment.
+	time.Sleep(200 * time.Millisecond)
+	circuit, stream = testWindows(t, peers[0].Onion, tunnelId)
+	if circuit <= CircuitWindowStart-CircuitWindowIncrement || stream <= StreamWindowStart-StreamWindowIncrement {
+		t.Fatalf("the windows were not opened again: circuit %v, stream %v", circuit, stream)
+	}
+}
+
+// A closed window holds the data of the clients back until a SENDME opens
+// it, and data beyond the window of the receiving end is refused.
+func TestWindowBackpressure(t *testing.T) {
+
+	var peers []*testPeer
+	var source, destination net.Conn
+	var tunnelId uint32
+	var tunnel *Tunnel
+	var err error
+
+	peers = startNetwork(t, 5, "")
+	source = dialAPI(t, peers[0])
+	destination = dialAPI(t, peers[4])
+	connected(t, peers[4], 1)
+
+	tunnelId, _ = openTestTunnel(t, source, peers, destination)
+	o := peers[0].Onion
+	tunnel, _ = o.tunnel(tunnelId)
+
+	o.lock.Lock()
+	tunnel.streamWindow.packaged = 0
+	o.lock.Unlock()
+	if err = msg.Send(source, msg.OnionTunnelData{TunnelID: tunnelId, Data: numbered(0, 16)}); err != nil {
+		t.Fatal(err)
+	}
+	destination.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if m, err := msg.Read(destination); err == nil {
+		t.Fatalf("the destination received %v through a closed window", msg.Identifier(m.TypeId()))
+	}
+	if err = o.receiveSendme(tunnel, &msg.OnionSendme{StreamId: DataStreamId}); err != nil {
+		t.Fatal(err)
+	}
+	receiveNumbered(t, destination, 1, 16)
+
+	o.lock.Lock()
+	tunnel.circuitWindow.delivered = 0
+	o.lock.Unlock()
+	if err = o.acceptData(tunnel, []byte("refused")); err != ErrWindowExceeded {
+		t.Fatalf("expected %v, got %v", ErrWindowExceeded, err)
+	}
+}
+
+// A client which does not read holds back the tunnel it reads from, and
+// nothing else: the data waiting for it is bounded by the stream window, and
+// the link the tunnel comes through keeps being read.
+func TestSlowClientMemoryLimit(t *testing.T) {
+
+	// Enough data to fill the socket buffers of the slow client.
+	const count = StreamWindowStart + 3*StreamWindowIncrement
+	const size = 48000
+
+	var peers []*testPeer
+	var source, slow, fast net.Conn
+	var tunnelId, incomingId uint32
+	var sent <-chan error
+	var queue *clientQueue
+	var deadline time.Time
+	var stream int
+
+	peers = startNetwork(t, 5, "")
+	source = dialAPI(t, peers[0])
+	slow = dialAPI(t, peers[4])
+	fast = dialAPI(t, peers[4])
+	time.Sleep(50 * time.Millisecond)
+
+	tunnelId, incomingId = openTestTunnel(t, source, peers, slow, fast)
+	sent = sendNumbered(source, tunnelId, count, size)
+
+	// The source runs out of window, since the slow client holds back the
+	// acknowledgements.
+	deadline = time.Now().Add(60 * time.Second)
+	for {
+		if _, stream = testWindows(t, peers[0].Onion, tunnelId); stream == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the source was not held back: stream window %v", stream)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	peers[4].Onion.lock.Lock()
+	for conn, q := range peers[4].Onion.clients {
+		if conn.RemoteAddr().String() == slow.LocalAddr().String() {
+			queue = q
+		}
+	}
+	peers[4].Onion.lock.Unlock()
+	if queue == nil {
+		t.Fatal("the slow client has no queue")
+	}
+	if queue.pending() > StreamWindowStart {
+		t.Fatalf("%v messages are waiting for the slow client", queue.pending())
+	}
+
+	// The other end of the tunnel still hears from us: data sent back
+	// through it needs its acknowledgements, which come through the link
+	// the slow client's data came from.
+	go sendNumbered(fast, incomingId, count, 16)
+	receiveNumbered(t, source, count, 16)
+
+	// Once the slow client reads, everything arrives. The window is only
+	// opened again once both clients have the data.
+	received := make(chan error, 1)
+	go func() {
+		received <- readNumbered(fast, count, size)
+	}()
+	receiveNumbered(t, slow, count, size)
+	if err := <-received; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+}
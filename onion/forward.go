@@ -0,0 +1,88 @@
+package onion
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/limoges/p2pnet"
+)
+
+// Forward carries the connections made to a local address to a service of
+// another peer, like ssh -L.
+type Forward struct {
+	// The peer offering the service.
+	Identity p2pnet.Identity
+	// The name of the service in the peer's service table. An empty name is
+	// its default service.
+	Service string
+}
+
+// parseForwards reads the forwards from their configuration table. Each
+// local address maps to the pseudo-hostname of the peer and the name of the
+// service, separated by a comma.
+func parseForwards(table map[string]string) (map[string]Forward, error) {
+
+	var forwards map[string]Forward
+	var fields []string
+	var identity p2pnet.Identity
+	var err error
+
+	forwards = make(map[string]Forward)
+	for local, value := range table {
+		if fields = strings.Split(value, ","); len(fields) != 2 {
+			return nil, errors.New(fmt.Sprintf("Invalid forward '%v = %v'.", local, value))
+		}
+		if identity, err = p2pnet.IdentityFromHostname(strings.TrimSpace(fields[0])); err != nil {
+			return nil, err
+		}
+		forwards[strings.TrimSpace(local)] = Forward{
+			Identity: identity,
+			Service:  strings.TrimSpace(fields[1]),
+		}
+	}
+	return forwards, nil
+}
+
+// listenForward carries the connections accepted on the listener to the
+// service of the forward.
+func (f *frontend) listenForward(ln net.Listener, forward Forward) {
+
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			fmt.Println(err)
+		} else {
+			go f.serveForward(conn, forward)
+		}
+	}
+}
+
+func (f *frontend) serveForward(conn net.Conn, forward Forward) {
+
+	var stream net.Conn
+	var err error
+
+	if stream, err = f.open(forward.Identity, forward.Service); err != nil {
+		fmt.Println(err)
+		conn.Close()
+		return
+	}
+	splice(conn, stream)
+}
+
+// serviceAddr returns the address of the named service. The default service
+// is at ServiceAddr.
+func (f *frontend) serviceAddr(service string) (string, bool) {
+
+	var addr string
+
+	if service == "" {
+		return f.onion.ServiceAddr, f.onion.ServiceAddr != ""
+	}
+	addr = f.onion.Services[service]
+	return addr, addr != ""
+}
@@ -0,0 +1,166 @@
+package onion
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/limoges/p2pnet"
+	"github.com/limoges/p2pnet/auth"
+)
+
+// testPeerHostkey returns the hostkey of the i-th peer of a test network,
+// before it is started.
+func testPeerHostkey(t *testing.T, i int) []byte {
+
+	var hostkey []byte
+
+	priv, err := auth.ReadPEMPrivateKey(filepath.Join("..", "main", "keys", fmt.Sprintf("peer%v.pem", i%5)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hostkey, err = auth.GetPublicKeyAsDER(&priv.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	return hostkey
+}
+
+// testHostname returns the pseudo-hostname of the i-th peer of a test
+// network.
+func testHostname(t *testing.T, i int) string {
+
+	var hostname string
+	var err error
+
+	if hostname, err = p2pnet.GetIdentity(testPeerHostkey(t, i)).Hostname(); err != nil {
+		t.Fatal(err)
+	}
+	return hostname
+}
+
+// upperServer runs a service answering the first five bytes it receives in
+// upper case and closing the connection, and returns its address.
+func upperServer(t *testing.T) string {
+
+	var listener net.Listener
+	var err error
+
+	if listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 5)
+				if _, err := io.ReadFull(conn, buf); err == nil {
+					conn.Write(bytes.ToUpper(buf))
+				}
+				conn.Close()
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// dialForward connects to the local address of a forward.
+func dialForward(t *testing.T, local string) net.Conn {
+
+	var conn net.Conn
+	var err error
+
+	if conn, err = net.Dial("tcp", local); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	return conn
+}
+
+// Connections to the local addresses of the forwards reach the named services
+// of the peer, each of which is spliced with its own stream. Streams for a
+// service the peer does not offer are closed.
+func TestForwards(t *testing.T) {
+
+	var echo, upper, hostname string
+	var echoLocal, upperLocal, missingLocal string
+	var peers []*testPeer
+	var conn net.Conn
+	var buf []byte
+	var err error
+
+	echo, upper = echoServer(t), upperServer(t)
+	hostname = testHostname(t, 4)
+	echoLocal, upperLocal, missingLocal = port(), port(), port()
+	peers = startNetworkEach(t, 5, func(i int) string {
+		switch i {
+		case 0:
+			return fmt.Sprintf("\n[ONION_FORWARDS]\n%v = %v, echo\n%v = %v, upper\n%v = %v, missing\n",
+				echoLocal, hostname, upperLocal, hostname, missingLocal, hostname)
+		case 4:
+			return fmt.Sprintf("\n[ONION_SERVICES]\necho = %v\nupper = %v\n", echo, upper)
+		}
+		return ""
+	})
+	if forward := peers[0].Onion.Forwards[echoLocal]; len(peers[0].Onion.Forwards) != 3 || forward.Service != "echo" {
+		t.Fatalf("the forwards were parsed as %v", peers[0].Onion.Forwards)
+	}
+
+	peers[0].Onion.storeKnownPeer(peers[4].peer())
+	conn = dialForward(t, echoLocal)
+	buf = make([]byte, 5)
+	for _, data := range []string{"hello", "again"} {
+		if _, err = conn.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != data {
+			t.Fatalf("the echo service answered %q, %v", buf, err)
+		}
+
+		// The upper service closes its connection after answering.
+		upperConn := dialForward(t, upperLocal)
+		if _, err = upperConn.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.ReadFull(upperConn, buf); err != nil || string(buf) != string(bytes.ToUpper([]byte(data))) {
+			t.Fatalf("the upper service answered %q, %v", buf, err)
+		}
+		if _, err = upperConn.Read(buf); err != io.EOF {
+			t.Fatalf("expected the upper service to close the connection, got %v", err)
+		}
+	}
+
+	if _, err = dialForward(t, missingLocal).Read(buf); err != io.EOF {
+		t.Fatalf("expected the stream to a missing service to be closed, got %v", err)
+	}
+}
+
+// A forward names a peer and a service.
+func TestParseForwards(t *testing.T) {
+
+	var forwards map[string]Forward
+	var hostname string
+	var err error
+
+	hostname = testHostname(t, 0)
+	if forwards, err = parseForwards(map[string]string{"127.0.0.1:2222": hostname + ", ssh"}); err != nil {
+		t.Fatal(err)
+	}
+	if forward := forwards["127.0.0.1:2222"]; forward.Service != "ssh" || forward.Identity != p2pnet.GetIdentity(testPeerHostkey(t, 0)) {
+		t.Fatalf("the forward was parsed as %v", forwards)
+	}
+	for _, value := range []string{hostname, "unknown.onion, ssh", hostname + ", ssh, http"} {
+		if _, err = parseForwards(map[string]string{"127.0.0.1:2222": value}); err == nil {
+			t.Fatalf("'%v' was accepted", value)
+		}
+	}
+}
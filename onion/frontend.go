@@ -0,0 +1,180 @@
+package onion
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/limoges/p2pnet"
+	"github.com/limoges/p2pnet/msg"
+	"github.com/limoges/p2pnet/sdk"
+)
+
+// frontend carries TCP connections over streams of tunnels. It uses our own
+// onion API like any other application would.
+type frontend struct {
+	onion  *Onion
+	client *sdk.Client
+
+	// The tunnels built to the peers.
+	tunnels map[p2pnet.Identity]uint32
+	lock    sync.Mutex
+}
+
+// frontendEnabled reports whether any of the frontend's features is
+// configured.
+func (o *Onion) frontendEnabled() bool {
+	return o.SocksAddr != "" || o.ServiceAddr != "" || len(o.Forwards) > 0 || len(o.Services) > 0
+}
+
+// runFrontend starts the SOCKS listener, the local forwards and the
+// forwarding to the local services, as configured.
+func (o *Onion) runFrontend() error {
+
+	var f *frontend
+	var listener net.Listener
+	var err error
+
+	f = &frontend{
+		onion:   o,
+		tunnels: make(map[p2pnet.Identity]uint32),
+	}
+
+	// Without a service, the tunnels other peers build to us are left to
+	// the other API clients.
+	if o.ServiceAddr != "" || len(o.Services) > 0 {
+		f.client, err = sdk.Dial(o.APIAddr)
+	} else {
+		f.client, err = sdk.DialOutgoing(o.APIAddr)
+	}
+	if err != nil {
+		return err
+	}
+
+	if o.SocksAddr != "" {
+		fmt.Printf("%20v: %v: Listening SOCKS\n", o.Name(), o.SocksAddr)
+		if listener, err = net.Listen("tcp", o.SocksAddr); err != nil {
+			fmt.Printf("%v: Cannot bind on %v\n", o.Name(), o.SocksAddr)
+			f.client.Close()
+			return err
+		}
+		go f.listenSocks(listener)
+	}
+	for local, forward := range o.Forwards {
+		fmt.Printf("%20v: %v: Forwarding to %v of %v\n", o.Name(), local, forward.Service, forward.Identity)
+		if listener, err = net.Listen("tcp", local); err != nil {
+			fmt.Printf("%v: Cannot bind on %v\n", o.Name(), local)
+			return err
+		}
+		go f.listenForward(listener, forward)
+	}
+	if o.ServiceAddr != "" || len(o.Services) > 0 {
+		go f.serveIncoming()
+	}
+	return nil
+}
+
+// open opens a stream to the service of the peer, building a tunnel to the
+// peer first if we have none. Hidden services are reached through a
+// rendezvous, other peers through the address the RPS module gave for them.
+func (f *frontend) open(identity p2pnet.Identity, service string) (*sdk.Stream, error) {
+
+	var tunnelId, existing uint32
+	var present bool
+	var peer p2pnet.Peer
+	var descriptor msg.HiddenDescriptor
+	var stream *sdk.Stream
+	var err error
+
+	f.lock.Lock()
+	tunnelId, present = f.tunnels[identity]
+	f.lock.Unlock()
+
+	if present {
+		if stream, err = f.client.OpenService(tunnelId, service); err == nil {
+			return stream, nil
+		}
+		// The tunnel has been torn down since.
+		f.lock.Lock()
+		if f.tunnels[identity] == tunnelId {
+			delete(f.tunnels, identity)
+		}
+		f.lock.Unlock()
+	}
+
+	if descriptor, err = f.onion.descriptor(identity); err == nil {
+		tunnelId, err = f.client.BuildHidden(descriptor.Hostkey)
+	} else if peer, err = f.onion.knownPeer(identity); err == nil {
+		tunnelId, err = f.client.Build(peerHostport(peer), peer.Hostkey)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Another connection may have built a tunnel to the peer in the meantime.
+	f.lock.Lock()
+	if existing, present = f.tunnels[identity]; !present {
+		f.tunnels[identity] = tunnelId
+	}
+	f.lock.Unlock()
+	if present {
+		f.client.Destroy(tunnelId)
+		tunnelId = existing
+	}
+
+	return f.client.OpenService(tunnelId, service)
+}
+
+// serveIncoming forwards the streams other peers open to us to the local
+// services they are for. Streams for unknown services are closed.
+func (f *frontend) serveIncoming() {
+
+	for {
+		stream, err := f.client.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if addr, known := f.serviceAddr(stream.Service()); known {
+			go f.forward(stream, addr)
+		} else {
+			fmt.Printf("Unknown service '%v'\n", stream.Service())
+			stream.Close()
+		}
+	}
+}
+
+// forward splices the stream onto a connection to the address.
+func (f *frontend) forward(stream *sdk.Stream, addr string) {
+
+	var conn net.Conn
+	var err error
+
+	if conn, err = net.Dial("tcp", addr); err != nil {
+		fmt.Println(err)
+		stream.Close()
+		return
+	}
+	splice(stream, conn)
+}
+
+// splice copies between the connections until either of them closes, and
+// closes both then.
+func splice(a, b net.Conn) {
+
+	var once sync.Once
+	var closeBoth func()
+
+	closeBoth = func() {
+		a.Close()
+		b.Close()
+	}
+
+	go func() {
+		io.Copy(a, b)
+		once.Do(closeBoth)
+	}()
+	io.Copy(b, a)
+	once.Do(closeBoth)
+}
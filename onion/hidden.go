@@ -0,0 +1,815 @@
+package onion
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/limoges/p2pnet"
+	"github.com/limoges/p2pnet/auth"
+	"github.com/limoges/p2pnet/msg"
+)
+
+const (
+	// How long a descriptor of ours may be used.
+	DescriptorLifetime = time.Hour
+	// How often we replace the failed introduction points and publish a
+	// new descriptor.
+	DescriptorRefresh = 10 * time.Minute
+	// How long we wait before trying again when publishing failed.
+	DescriptorRetry = 5 * time.Second
+)
+
+// Distinguishes the keys derived at a rendezvous from any other use of the
+// shared secret.
+var rendezvousKeyInfo = "p2pnet rendezvous"
+
+var (
+	ErrUnknownService       = errors.New("No descriptor is known for the hidden service")
+	ErrExpiredDescriptor    = errors.New("The descriptor of the hidden service has expired")
+	ErrNoIntroductionPoints = errors.New("No introduction point relayed the introduction")
+	ErrNotSealed            = errors.New("Only sealed messages come through a rendezvous")
+)
+
+// rendezvous is the end-to-end layer between a client and a hidden service
+// whose tunnels are joined at a rendezvous point. The rendezvous point relays
+// the sealed messages without being able to read or alter them.
+type rendezvous struct {
+	// Whether we are the service, which answers the tunnel like its
+	// destination would.
+	service bool
+	// The AES and HMAC keys of each direction.
+	send    []byte
+	receive []byte
+}
+
+// runGossip subscribes to the descriptors of hidden services and to the
+// Sphinx keys, and keeps those the gossip module hands us until the
+// connection closes.
+func (o *Onion) runGossip() {
+
+	var conn net.Conn
+	var err error
+
+	if conn, err = net.Dial("tcp", o.GossipAddr); err != nil {
+		fmt.Printf("%v: Cannot reach gossip on %v\n", o.Name(), o.GossipAddr)
+		return
+	}
+	defer conn.Close()
+
+	for _, dataType := range []uint16{msg.ONION_DESCRIPTOR, msg.ONION_SPHINX_KEY} {
+		if err = msg.Send(conn, msg.GossipNotify{DataType: dataType}); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	p2pnet.Serve(o, conn)
+}
+
+// handleNotification keeps the descriptor or Sphinx key spread through
+// gossip, and tells the gossip module whether it is worth spreading further.
+func (o *Onion) handleNotification(source net.Conn, m *msg.GossipNotification) error {
+
+	var validation msg.GossipValidation
+	var err error
+
+	switch m.DataType {
+	case msg.ONION_DESCRIPTOR:
+		err = o.storeDescriptor(m.Data)
+	case msg.ONION_SPHINX_KEY:
+		err = o.storeSphinxKey(m.Data)
+	default:
+		err = errors.New("Unexpected gossip data type")
+	}
+
+	validation = msg.GossipValidation{MessageId: m.HeaderId}
+	validation.SetValid(err == nil)
+	if sendErr := msg.Send(source, validation); sendErr != nil {
+		fmt.Println(sendErr)
+	}
+	return err
+}
+
+// storeDescriptor keeps the descriptor if it is signed by its service and
+// newer than the one we know.
+func (o *Onion) storeDescriptor(data []byte) error {
+
+	var descriptor msg.HiddenDescriptor
+	var content []byte
+	var identity p2pnet.Identity
+	var err error
+
+	if descriptor, err = msg.NewHiddenDescriptor(data); err != nil {
+		return err
+	}
+	if content, err = descriptor.SignedContent(); err != nil {
+		return err
+	}
+	if err = verify(descriptor.Hostkey, content, descriptor.Signature); err != nil {
+		return err
+	}
+	if time.Unix(int64(descriptor.Expires), 0).Before(o.clock.Now()) {
+		return ErrExpiredDescriptor
+	}
+
+	identity = p2pnet.GetIdentity(descriptor.Hostkey)
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if known, present := o.descriptors[identity]; !present || known.Expires < descriptor.Expires {
+		o.descriptors[identity] = descriptor
+	}
+	return nil
+}
+
+// descriptor returns the descriptor of the hidden service, unless it has
+// expired.
+func (o *Onion) descriptor(identity p2pnet.Identity) (msg.HiddenDescriptor, error) {
+
+	var descriptor msg.HiddenDescriptor
+	var present bool
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if descriptor, present = o.descriptors[identity]; !present {
+		return descriptor, ErrUnknownService
+	}
+	if time.Unix(int64(descriptor.Expires), 0).Before(o.clock.Now()) {
+		delete(o.descriptors, identity)
+		return descriptor, ErrExpiredDescriptor
+	}
+	return descriptor, nil
+}
+
+// runHiddenService keeps IntroductionPoints introduction points for us, and
+// publishes our descriptor every DescriptorRefresh.
+func (o *Onion) runHiddenService() {
+
+	var wait time.Duration
+
+	for {
+		wait = DescriptorRefresh
+		if err := o.refreshIntroductions(); err != nil {
+			fmt.Printf("Could not publish our descriptor: %v\n", err)
+			wait = DescriptorRetry
+		}
+		<-o.clock.After(wait)
+	}
+}
+
+// refreshIntroductions replaces the introduction points whose tunnels are
+// gone, and publishes a new descriptor.
+func (o *Onion) refreshIntroductions() error {
+
+	var excluded [][]byte
+	var missing int
+	var peers []p2pnet.Peer
+	var err error
+
+	o.lock.Lock()
+	for tunnel, point := range o.introTunnels {
+		if tunnel.closed {
+			delete(o.introTunnels, tunnel)
+			continue
+		}
+		excluded = append(excluded, point.Hostkey)
+	}
+	missing = o.IntroductionPoints - len(o.introTunnels)
+	o.lock.Unlock()
+
+	if missing > 0 {
+		if peers, err = o.samplePeers(missing, excluded...); err != nil {
+			return err
+		}
+	}
+	for _, peer := range peers {
+		if err = o.establishIntroduction(peer); err != nil {
+			fmt.Printf("Could not establish an introduction point: %v\n", err)
+		}
+	}
+	return o.publishDescriptor()
+}
+
+// establishIntroduction builds a tunnel to the peer and makes it relay the
+// introductions to us.
+func (o *Onion) establishIntroduction(peer p2pnet.Peer) error {
+
+	var establish msg.OnionEstablishIntro
+	var point msg.IntroductionPoint
+	var tunnel *Tunnel
+	var response msg.Message
+	var valid bool
+	var err error
+
+	establish = msg.OnionEstablishIntro{
+		HostkeyLength: uint16(len(o.Hostkey)),
+		Hostkey:       o.Hostkey,
+	}
+	if establish.Signature, err = o.sign(peer.Hostkey); err != nil {
+		return err
+	}
+
+	point = msg.IntroductionPoint{Hostkey: peer.Hostkey}
+	if point.IPAddr, point.Port, err = splitHostport(peerHostport(peer)); err != nil {
+		return err
+	}
+
+	if tunnel, err = o.buildTunnel(0, peerHostport(peer), peer.Hostkey, nil); err != nil {
+		return err
+	}
+
+	response, err = o.request(tunnel, establish)
+	if _, valid = response.(msg.OnionIntroEstablished); err == nil && !valid {
+		err = errors.New("Invalid response expected OnionIntroEstablished")
+	}
+	if err != nil {
+		o.DestroyTunnel(tunnel)
+		return err
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.introTunnels[tunnel] = point
+	return nil
+}
+
+// publishDescriptor signs a descriptor listing our introduction points and
+// announces it through gossip.
+func (o *Onion) publishDescriptor() error {
+
+	var descriptor msg.HiddenDescriptor
+	var content, data []byte
+	var err error
+
+	descriptor = msg.HiddenDescriptor{
+		Expires: uint64(o.clock.Now().Add(DescriptorLifetime).Unix()),
+		Hostkey: o.Hostkey,
+	}
+
+	o.lock.Lock()
+	for _, point := range o.introTunnels {
+		descriptor.Points = append(descriptor.Points, point)
+	}
+	o.lock.Unlock()
+
+	if len(descriptor.Points) == 0 {
+		return ErrNoIntroductionPoints
+	}
+
+	if content, err = descriptor.SignedContent(); err != nil {
+		return err
+	}
+	if descriptor.Signature, err = o.sign(content); err != nil {
+		return err
+	}
+	if data, err = descriptor.Bytes(); err != nil {
+		return err
+	}
+
+	// Our own clients may reach us as well.
+	if err = o.storeDescriptor(data); err != nil {
+		return err
+	}
+
+	return forwardTo(o.GossipAddr, msg.GossipAnnounce{
+		DataType: msg.ONION_DESCRIPTOR,
+		Data:     data,
+	})
+}
+
+// establishIntro makes the circuit ending here relay the introductions to
+// the hidden service, once the service proved it owns its hostkey.
+func (o *Onion) establishIntro(circuit *Circuit, m *msg.OnionEstablishIntro) error {
+
+	if err := verify(m.Hostkey, o.Hostkey, m.Signature); err != nil {
+		return err
+	}
+
+	o.lock.Lock()
+	o.introductions[p2pnet.GetIdentity(m.Hostkey)] = circuit
+	o.lock.Unlock()
+
+	return o.sendBackward(circuit, msg.OnionIntroEstablished{})
+}
+
+// introduce relays the introduction of a client to the hidden service.
+func (o *Onion) introduce(circuit *Circuit, m *msg.OnionIntroduce) error {
+
+	var service *Circuit
+	var present bool
+	var err error
+
+	o.lock.Lock()
+	service, present = o.introductions[p2pnet.IdentityFromDigest(m.Identity)]
+	o.lock.Unlock()
+
+	if !present {
+		return o.sendBackward(circuit, msg.OnionIntroduceAck{Status: msg.IntroduceUnknown})
+	}
+	if err = o.sendBackward(service, msg.OnionIntroduced{Payload: m.Payload}); err != nil {
+		return err
+	}
+	return o.sendBackward(circuit, msg.OnionIntroduceAck{Status: msg.IntroduceRelayed})
+}
+
+// establishRendezvous makes the circuit ending here wait for the hidden
+// service bringing the cookie.
+func (o *Onion) establishRendezvous(circuit *Circuit, m *msg.OnionEstablishRendezvous) error {
+
+	o.lock.Lock()
+	if _, used := o.rendezvous[m.Cookie]; used {
+		o.lock.Unlock()
+		return errors.New("The rendezvous cookie is already in use")
+	}
+	o.rendezvous[m.Cookie] = circuit
+	o.lock.Unlock()
+
+	return o.sendBackward(circuit, msg.OnionRendezvousEstablished{})
+}
+
+// meet joins the circuit of the hidden service to the circuit of the client
+// waiting with the same cookie.
+func (o *Onion) meet(circuit *Circuit, m *msg.OnionRendezvous) error {
+
+	var client *Circuit
+	var present bool
+
+	o.lock.Lock()
+	if client, present = o.rendezvous[m.Cookie]; present {
+		delete(o.rendezvous, m.Cookie)
+		client.joined = circuit
+		circuit.joined = client
+	}
+	o.lock.Unlock()
+
+	if !present {
+		return errors.New("No client waits with the rendezvous cookie")
+	}
+	return o.sendBackward(client, msg.OnionRendezvousJoined{Key: m.Key})
+}
+
+// relaySealed passes a message from one side of a rendezvous to the other.
+func (o *Onion) relaySealed(circuit *Circuit, m *msg.OnionSealed) error {
+
+	var joined *Circuit
+
+	o.lock.Lock()
+	joined = circuit.joined
+	o.lock.Unlock()
+
+	if joined == nil {
+		return errors.New("Sealed message received before the rendezvous")
+	}
+	return o.sendBackward(joined, *m)
+}
+
+// forgetRendezvous forgets the introductions and the rendezvous the circuit
+// took part in, and returns the circuit it was joined to. The lock must be
+// held.
+func (o *Onion) forgetRendezvous(circuit *Circuit) *Circuit {
+
+	var joined *Circuit
+
+	for identity, introduction := range o.introductions {
+		if introduction == circuit {
+			delete(o.introductions, identity)
+		}
+	}
+	for cookie, waiting := range o.rendezvous {
+		if waiting == circuit {
+			delete(o.rendezvous, cookie)
+		}
+	}
+
+	if joined = circuit.joined; joined != nil {
+		joined.joined = nil
+		circuit.joined = nil
+	}
+	return joined
+}
+
+// BuildHiddenTunnel builds a tunnel to the hidden service with the hostkey.
+// The service is introduced to a rendezvous point we picked, where it joins
+// the tunnel with one of its own.
+func (o *Onion) BuildHiddenTunnel(hostkey []byte) (*msg.OnionTunnelReady, error) {
+
+	var descriptor msg.HiddenDescriptor
+	var peers []p2pnet.Peer
+	var point p2pnet.Peer
+	var tunnel *Tunnel
+	var introduction msg.OnionIntroduction
+	var key circuitKey
+	var joined chan msg.Message
+	var err error
+
+	if descriptor, err = o.descriptor(p2pnet.GetIdentity(hostkey)); err != nil {
+		return nil, err
+	}
+
+	if peers, err = o.samplePeers(1, hostkey); err != nil {
+		return nil, err
+	}
+	point = peers[0]
+
+	if tunnel, err = o.buildTunnel(0, peerHostport(point), point.Hostkey, nil); err != nil {
+		return nil, err
+	}
+	if introduction, err = o.awaitRendezvous(tunnel); err != nil {
+		o.DestroyTunnel(tunnel)
+		return nil, err
+	}
+	introduction.Hostkey = point.Hostkey
+	if introduction.IPAddr, introduction.Port, err = splitHostport(peerHostport(point)); err != nil {
+		o.DestroyTunnel(tunnel)
+		return nil, err
+	}
+
+	// The service answers at the rendezvous point rather than through the
+	// introduction point.
+	key = circuitKey{tunnel.link, tunnel.Hops[0].TunnelId}
+	joined = o.await(key)
+
+	if err = o.introduceTo(descriptor, introduction); err != nil {
+		o.cancel(key)
+		o.DestroyTunnel(tunnel)
+		return nil, err
+	}
+	if _, err = o.wait(key, joined); err != nil {
+		o.DestroyTunnel(tunnel)
+		return nil, err
+	}
+
+	o.storeTunnel(tunnel)
+	return &msg.OnionTunnelReady{TunnelId: tunnel.Id, DstHostkey: hostkey}, nil
+}
+
+// awaitRendezvous makes the last hop of the tunnel wait for the service with
+// a fresh cookie. It returns the introduction telling the service about it.
+func (o *Onion) awaitRendezvous(tunnel *Tunnel) (msg.OnionIntroduction, error) {
+
+	var introduction msg.OnionIntroduction
+	var private *ecdh.PrivateKey
+	var response msg.Message
+	var valid bool
+	var err error
+
+	if _, err = io.ReadFull(lockedRandom{o}, introduction.Cookie[:]); err != nil {
+		return introduction, err
+	}
+	if private, err = ecdh.X25519().GenerateKey(lockedRandom{o}); err != nil {
+		return introduction, err
+	}
+	copy(introduction.Key[:], private.PublicKey().Bytes())
+
+	o.lock.Lock()
+	tunnel.joining = private
+	tunnel.cookie = introduction.Cookie
+	o.lock.Unlock()
+
+	response, err = o.request(tunnel, msg.OnionEstablishRendezvous{Cookie: introduction.Cookie})
+	if err != nil {
+		return introduction, err
+	}
+	if _, valid = response.(msg.OnionRendezvousEstablished); !valid {
+		return introduction, errors.New("Invalid response expected OnionRendezvousEstablished")
+	}
+	return introduction, nil
+}
+
+// introduceTo hands the introduction, encrypted for the service, to the
+// first of its introduction points which relays it.
+func (o *Onion) introduceTo(descriptor msg.HiddenDescriptor, introduction msg.OnionIntroduction) error {
+
+	var introduce msg.OnionIntroduce
+	var err error
+
+	if introduce.Identity, err = p2pnet.GetIdentity(descriptor.Hostkey).Digest(); err != nil {
+		return err
+	}
+	if introduce.Payload, err = o.sealIntroduction(descriptor.Hostkey, introduction); err != nil {
+		return err
+	}
+
+	for _, point := range descriptor.Points {
+		if err = o.introduceAt(point, introduce); err == nil {
+			return nil
+		}
+		fmt.Printf("Introduction through %v failed: %v\n", p2pnet.GetIdentity(point.Hostkey), err)
+	}
+	return ErrNoIntroductionPoints
+}
+
+// introduceAt sends the introduction through a tunnel to the introduction
+// point, which is torn down once it answered.
+func (o *Onion) introduceAt(point msg.IntroductionPoint, introduce msg.OnionIntroduce) error {
+
+	var hostport string
+	var tunnel *Tunnel
+	var response msg.Message
+	var ack msg.OnionIntroduceAck
+	var valid bool
+	var err error
+
+	hostport = net.JoinHostPort(net.IP(point.IPAddr[:]).String(), strconv.Itoa(int(point.Port)))
+	if tunnel, err = o.buildTunnel(0, hostport, point.Hostkey, nil); err != nil {
+		return err
+	}
+	defer o.DestroyTunnel(tunnel)
+
+	if response, err = o.request(tunnel, introduce); err != nil {
+		return err
+	}
+	if ack, valid = response.(msg.OnionIntroduceAck); !valid {
+		return errors.New("Invalid response expected OnionIntroduceAck")
+	}
+	if ack.Status != msg.IntroduceRelayed {
+		return ErrUnknownService
+	}
+	return nil
+}
+
+// joinTunnel completes the rendezvous of a tunnel we built to reach a hidden
+// service. The messages that follow are sealed with the keys agreed with the
+// service.
+func (o *Onion) joinTunnel(tunnel *Tunnel, m *msg.OnionRendezvousJoined) error {
+
+	var private *ecdh.PrivateKey
+	var cookie [msg.RendezvousCookieLength]byte
+	var joined *rendezvous
+	var err error
+
+	o.lock.Lock()
+	private, cookie = tunnel.joining, tunnel.cookie
+	tunnel.joining = nil
+	o.lock.Unlock()
+
+	if private == nil {
+		return errors.New("Unexpected OnionRendezvousJoined")
+	}
+	if joined, err = newRendezvous(private, m.Key[:], cookie, false); err != nil {
+		return err
+	}
+	tunnel.joined.Store(joined)
+
+	return o.respond(circuitKey{tunnel.link, tunnel.Hops[0].TunnelId}, *m)
+}
+
+// receiveIntroduction handles an introduction relayed by one of our
+// introduction points. Building the tunnel to the rendezvous point waits for
+// answers from links, possibly from the one whose goroutine brought us here.
+func (o *Onion) receiveIntroduction(tunnel *Tunnel, m *msg.OnionIntroduced) error {
+
+	var present bool
+
+	o.lock.Lock()
+	_, present = o.introTunnels[tunnel]
+	o.lock.Unlock()
+
+	if !present {
+		return errors.New("Introduction received outside of an introduction point")
+	}
+
+	go func() {
+		if err := o.acceptIntroduction(m.Payload); err != nil {
+			fmt.Printf("Could not meet the client: %v\n", err)
+		}
+	}()
+	return nil
+}
+
+// acceptIntroduction builds a tunnel to the rendezvous point named by the
+// client and joins it to the client's tunnel there. The tunnel is then
+// handed to our API clients like a tunnel ending here, without the client's
+// hostkey.
+func (o *Onion) acceptIntroduction(payload []byte) error {
+
+	var introduction msg.OnionIntroduction
+	var private *ecdh.PrivateKey
+	var joined *rendezvous
+	var hostport string
+	var tunnel *Tunnel
+	var meeting msg.OnionRendezvous
+	var clients []net.Conn
+	var err error
+
+	if introduction, err = o.openIntroduction(payload); err != nil {
+		return err
+	}
+
+	if private, err = ecdh.X25519().GenerateKey(lockedRandom{o}); err != nil {
+		return err
+	}
+	if joined, err = newRendezvous(private, introduction.Key[:], introduction.Cookie, true); err != nil {
+		return err
+	}
+
+	hostport = net.JoinHostPort(net.IP(introduction.IPAddr[:]).String(), strconv.Itoa(int(introduction.Port)))
+	if tunnel, err = o.buildTunnel(0, hostport, introduction.Hostkey, nil); err != nil {
+		return err
+	}
+
+	meeting = msg.OnionRendezvous{Cookie: introduction.Cookie}
+	copy(meeting.Key[:], private.PublicKey().Bytes())
+
+	// The client may send as soon as it learns about the rendezvous, so the
+	// tunnel must be ready for its messages beforehand.
+	tunnel.joined.Store(joined)
+	clients = o.adoptTunnel(tunnel)
+
+	if err = tunnel.sendPlain(meeting); err != nil {
+		o.DestroyTunnel(tunnel)
+		return err
+	}
+	o.notifyIncoming(tunnel, clients, nil)
+	return nil
+}
+
+// sealIntroduction encrypts the introduction for the hidden service with the
+// hostkey. Only the service can read where the client waits for it.
+func (o *Onion) sealIntroduction(hostkey []byte, introduction msg.OnionIntroduction) ([]byte, error) {
+
+	var buf *bytes.Buffer
+	var pub *rsa.PublicKey
+	var secret, hmac, keys, body []byte
+	var err error
+
+	buf = new(bytes.Buffer)
+	if err = msg.Write(buf, introduction); err != nil {
+		return nil, err
+	}
+
+	if pub, err = auth.ParsePublicKey(hostkey); err != nil {
+		return nil, err
+	}
+	if secret, err = auth.GenerateNewSymmetricKey(lockedRandom{o}); err != nil {
+		return nil, err
+	}
+	if hmac, err = auth.GenerateNewSymmetricKey(lockedRandom{o}); err != nil {
+		return nil, err
+	}
+
+	// The introductions are never reproduced, so the keys are always
+	// encrypted with the secure source.
+	if keys, err = auth.EncryptPKCS(rand.Reader, pub, append(secret, hmac...)); err != nil {
+		return nil, err
+	}
+	if body, err = auth.EncryptAESWithHMAC(lockedRandom{o}, buf.Bytes(), secret, hmac); err != nil {
+		return nil, err
+	}
+	return append(keys, body...), nil
+}
+
+// openIntroduction decrypts an introduction sealed for us.
+func (o *Onion) openIntroduction(payload []byte) (msg.OnionIntroduction, error) {
+
+	var introduction msg.OnionIntroduction
+	var size int
+	var keys, plaintext []byte
+	var message msg.Message
+	var valid bool
+	var err error
+
+	size = o.privateKey.Size()
+	if len(payload) < size {
+		return introduction, errors.New("The introduction is too short")
+	}
+
+	if keys, err = auth.DecryptPKCS(o.privateKey, payload[:size]); err != nil {
+		return introduction, err
+	}
+	if len(keys) != 2*auth.DefaultSymmetricKeyLengthInBytes {
+		return introduction, errors.New("Invalid introduction keys")
+	}
+
+	plaintext, err = auth.DecryptAESWithHMAC(payload[size:],
+		keys[:auth.DefaultSymmetricKeyLengthInBytes], keys[auth.DefaultSymmetricKeyLengthInBytes:])
+	if err != nil {
+		return introduction, err
+	}
+
+	if message, err = msg.ReadExpected(bytes.NewReader(plaintext), msg.ONION_INTRODUCTION); err != nil {
+		return introduction, err
+	}
+	if introduction, valid = message.(msg.OnionIntroduction); !valid {
+		return introduction, errors.New("Invalid introduction expected OnionIntroduction")
+	}
+	return introduction, nil
+}
+
+// newRendezvous derives the keys of both directions from our half of the key
+// exchange, the other end's half and the cookie of the rendezvous.
+func newRendezvous(private *ecdh.PrivateKey, remote []byte, cookie [msg.RendezvousCookieLength]byte, service bool) (*rendezvous, error) {
+
+	var pub *ecdh.PublicKey
+	var shared, keys, toService, toClient []byte
+	var length int
+	var err error
+
+	if pub, err = ecdh.X25519().NewPublicKey(remote); err != nil {
+		return nil, err
+	}
+	if shared, err = private.ECDH(pub); err != nil {
+		return nil, err
+	}
+
+	length = 2 * auth.DefaultSymmetricKeyLengthInBytes
+	if keys, err = hkdf.Key(sha256.New, shared, cookie[:], rendezvousKeyInfo, 2*length); err != nil {
+		return nil, err
+	}
+	toService, toClient = keys[:length], keys[length:]
+
+	if service {
+		return &rendezvous{service: true, send: toClient, receive: toService}, nil
+	}
+	return &rendezvous{send: toService, receive: toClient}, nil
+}
+
+// seal encrypts the message for the other end of the rendezvous.
+func (r *rendezvous) seal(random io.Reader, message msg.Message) (msg.OnionSealed, error) {
+
+	var buf *bytes.Buffer
+	var sealed msg.OnionSealed
+	var err error
+
+	buf = new(bytes.Buffer)
+	if err = msg.Write(buf, message); err != nil {
+		return sealed, err
+	}
+
+	sealed.Payload, err = auth.EncryptAESWithHMAC(random, buf.Bytes(),
+		r.send[:auth.DefaultSymmetricKeyLengthInBytes], r.send[auth.DefaultSymmetricKeyLengthInBytes:])
+	return sealed, err
+}
+
+// open decrypts a message sealed by the other end of the rendezvous.
+func (r *rendezvous) open(message msg.Message) (msg.Message, error) {
+
+	var sealed msg.OnionSealed
+	var plaintext []byte
+	var valid bool
+	var err error
+
+	if sealed, valid = message.(msg.OnionSealed); !valid {
+		return nil, ErrNotSealed
+	}
+
+	plaintext, err = auth.DecryptAESWithHMAC(sealed.Payload,
+		r.receive[:auth.DefaultSymmetricKeyLengthInBytes], r.receive[auth.DefaultSymmetricKeyLengthInBytes:])
+	if err != nil {
+		return nil, err
+	}
+	return msg.ReadExpected(bytes.NewReader(plaintext), backwardMessages...)
+}
+
+// request sends the message through a tunnel we initiated and waits for its
+// last hop's answer.
+func (o *Onion) request(tunnel *Tunnel, message msg.Message) (msg.Message, error) {
+
+	var key circuitKey
+	var responses chan msg.Message
+
+	key = circuitKey{tunnel.link, tunnel.Hops[0].TunnelId}
+	responses = o.await(key)
+
+	if err := tunnel.Send(message); err != nil {
+		o.cancel(key)
+		return nil, err
+	}
+	return o.wait(key, responses)
+}
+
+// sign signs the content with our hostkey.
+func (o *Onion) sign(content []byte) ([]byte, error) {
+
+	var digest [sha256.Size]byte
+
+	digest = sha256.Sum256(content)
+	return rsa.SignPKCS1v15(nil, o.privateKey, crypto.SHA256, digest[:])
+}
+
+// verify checks that the content was signed by the owner of the hostkey.
+func verify(hostkey, content, signature []byte) error {
+
+	var pub *rsa.PublicKey
+	var digest [sha256.Size]byte
+	var err error
+
+	if pub, err = auth.ParsePublicKey(hostkey); err != nil {
+		return err
+	}
+	digest = sha256.Sum256(content)
+	return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature)
+}
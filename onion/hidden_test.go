@@ -0,0 +1,175 @@
+package onion
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/limoges/p2pnet"
+	"github.com/limoges/p2pnet/msg"
+)
+
+// fakeGossip hands every announcement to all the subscribed connections.
+// Those which subscribe later receive the earlier announcements too, as they
+// would in a network running for a while.
+type fakeGossip struct {
+	addr          string
+	lock          sync.Mutex
+	subscribers   []net.Conn
+	announcements []msg.GossipAnnounce
+}
+
+func (g *fakeGossip) Name() string {
+	return "FAKEGOSSIP"
+}
+
+func (g *fakeGossip) Addresses() (string, string) {
+	return g.addr, ""
+}
+
+func (g *fakeGossip) Run() error {
+	select {}
+}
+
+func (g *fakeGossip) Handle(conn net.Conn, m msg.Message) error {
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	switch m := m.(type) {
+	case msg.GossipNotify:
+		g.subscribers = append(g.subscribers, conn)
+		for _, announce := range g.announcements {
+			if announce.DataType == m.DataType {
+				msg.Send(conn, msg.GossipNotification{DataType: announce.DataType, Data: announce.Data})
+			}
+		}
+	case msg.GossipAnnounce:
+		g.announcements = append(g.announcements, m)
+		for _, subscriber := range g.subscribers {
+			msg.Send(subscriber, msg.GossipNotification{DataType: m.DataType, Data: m.Data})
+		}
+	}
+	return nil
+}
+
+// startGossip runs a fake gossip module, and returns the configuration
+// pointing the peers to it.
+func startGossip(t *testing.T) string {
+
+	var gossip *fakeGossip
+
+	gossip = &fakeGossip{addr: port()}
+	go p2pnet.Run(gossip)
+	waitFor(t, "the gossip module to listen", func() bool {
+		conn, err := net.Dial("tcp", gossip.addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	})
+	return "\n[GOSSIP]\napi_address = " + gossip.addr + "\n"
+}
+
+// A client reaches a hidden service through one of the introduction points
+// of its descriptor and a rendezvous, without either end learning the
+// other's address.
+func TestHiddenService(t *testing.T) {
+
+	var gossip string
+	var peers []*testPeer
+	var service *Onion
+	var identity p2pnet.Identity
+	var descriptor msg.HiddenDescriptor
+	var response msg.Message
+	var ready msg.OnionTunnelReady
+	var incoming msg.OnionTunnelIncoming
+	var data msg.OnionTunnelData
+	var failure msg.OnionError
+	var raw []byte
+	var valid bool
+	var err error
+
+	gossip = startGossip(t)
+	peers = startNetworkEach(t, 5, func(i int) string {
+		if i == 4 {
+			return "hidden_service = 1\nintroduction_points = 2\n" + gossip
+		}
+		return gossip
+	})
+	service = peers[4].Onion
+	identity = p2pnet.GetIdentity(service.Hostkey)
+	hidden := dialAPI(t, peers[4])
+	connected(t, peers[4], 1)
+
+	waitFor(t, "the descriptor to spread", func() bool {
+		descriptor, err = peers[0].Onion.descriptor(identity)
+		return err == nil
+	})
+	if len(descriptor.Points) != 2 {
+		t.Fatalf("the descriptor has %v introduction points", len(descriptor.Points))
+	}
+	if raw, err = descriptor.Bytes(); err != nil {
+		t.Fatal(err)
+	}
+	raw[3] ^= 1
+	if err = peers[1].Onion.storeDescriptor(raw); err == nil {
+		t.Fatal("a tampered descriptor was accepted")
+	}
+
+	client := dialAPI(t, peers[0])
+	response, err = msg.SendReceive(client, &msg.OnionTunnelBuild{IPAddr: net.IPv6unspecified, DstHostkey: service.Hostkey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ready, valid = response.(msg.OnionTunnelReady); !valid {
+		t.Fatalf("expected OnionTunnelReady, got %v", response)
+	}
+	if incoming = expectMessage[msg.OnionTunnelIncoming](t, hidden); len(incoming.SourceHostKeyInDER) != 0 {
+		t.Fatal("the hidden service learned the hostkey of the client")
+	}
+	if err = msg.Send(hidden, msg.OnionTunnelSubscribe{TunnelID: incoming.TunnelID}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = msg.Send(client, msg.OnionTunnelData{TunnelID: ready.TunnelId, Data: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	if data = expectMessage[msg.OnionTunnelData](t, hidden); string(data.Data) != "hello" {
+		t.Fatalf("the hidden service received %q", data.Data)
+	}
+	if err = msg.Send(hidden, msg.OnionTunnelData{TunnelID: incoming.TunnelID, Data: []byte("back")}); err != nil {
+		t.Fatal(err)
+	}
+	if data = expectMessage[msg.OnionTunnelData](t, client); string(data.Data) != "back" {
+		t.Fatalf("the client received %q", data.Data)
+	}
+
+	// The keepalives go through the rendezvous and the service answers them.
+	o := peers[0].Onion
+	tunnel, _ := o.tunnel(ready.TunnelId)
+	o.lock.Lock()
+	heard := tunnel.heard
+	o.lock.Unlock()
+	o.keepalive(time.Now())
+	waitFor(t, "the service to answer the keepalive", func() bool {
+		o.lock.Lock()
+		defer o.lock.Unlock()
+		return tunnel.heard.After(heard)
+	})
+
+	if err = msg.Send(client, msg.OnionTunnelDestroy{TunnelID: ready.TunnelId}); err != nil {
+		t.Fatal(err)
+	}
+	if failure = expectMessage[msg.OnionError](t, hidden); failure.TunnelID != incoming.TunnelID || failure.RequestType != msg.ONION_TUNNEL_DESTROY {
+		t.Fatalf("the hidden service was told %#v", failure)
+	}
+	for _, peer := range peers {
+		waitFor(t, "the rendezvous to be closed at "+peer.Onion.ListenAddr, func() bool {
+			peer.Onion.lock.Lock()
+			defer peer.Onion.lock.Unlock()
+			return len(peer.Onion.rendezvous) == 0
+		})
+	}
+}
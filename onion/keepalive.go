@@ -0,0 +1,222 @@
+package onion
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/limoges/p2pnet/msg"
+)
+
+// TunnelState tells whether a tunnel is known to work.
+type TunnelState int
+
+const (
+	// Traffic went through the tunnel recently.
+	TunnelAlive TunnelState = iota
+	// Nothing went through the tunnel for KeepaliveTimeout. A tunnel we
+	// initiated is being rebuilt or torn down. A tunnel ending here waits for
+	// its initiator to rebuild it.
+	TunnelDead
+)
+
+// runKeepalive checks our links and tunnels every KeepaliveInterval.
+func (o *Onion) runKeepalive() {
+
+	var ticks <-chan time.Time
+
+	ticks = o.clock.Tick(time.Duration(o.KeepaliveInterval) * time.Second)
+	for now := range ticks {
+		o.keepalive(now)
+	}
+}
+
+// keepalive sends a heartbeat on each link and a keepalive through each
+// tunnel we initiated. The links and the tunnels we have not heard from for
+// KeepaliveTimeout have failed.
+func (o *Onion) keepalive(now time.Time) {
+
+	var timeout time.Duration
+	var links []*Link
+	var tunnels []*Tunnel
+
+	timeout = time.Duration(o.KeepaliveTimeout) * time.Second
+
+	o.lock.Lock()
+	for link := range o.served {
+		links = append(links, link)
+	}
+	for _, tunnel := range o.Tunnels {
+		tunnels = append(tunnels, tunnel)
+	}
+	o.lock.Unlock()
+
+	// Closing a link ends serveLink, which tears down its circuits.
+	for _, link := range links {
+		if now.Sub(link.lastHeard()) > timeout {
+			fmt.Printf("The link to %v timed out\n", link.RemoteAddr())
+			link.Close()
+		} else if err := link.Heartbeat(); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	for _, tunnel := range tunnels {
+		o.checkTunnel(tunnel, now, timeout)
+	}
+}
+
+// checkTunnel keeps the tunnel alive, or handles its failure. The other end
+// of a tunnel gives its initiator twice the timeout to rebuild it before
+// giving up on it.
+func (o *Onion) checkTunnel(tunnel *Tunnel, now time.Time, timeout time.Duration) {
+
+	var silent time.Duration
+
+	o.lock.Lock()
+	silent = now.Sub(tunnel.heard)
+	if !tunnel.initiated() && silent > timeout {
+		tunnel.State = TunnelDead
+	}
+	o.lock.Unlock()
+
+	switch {
+	case tunnel.initiated() && silent > timeout:
+		o.tunnelFailed(tunnel)
+	case tunnel.initiated():
+		if err := tunnel.Send(msg.OnionKeepalive{}); err != nil {
+			fmt.Println(err)
+		}
+	case silent > 2*timeout:
+		o.notifyError(tunnel, msg.ONION_TUNNEL_DESTROY)
+		if err := o.DestroyTunnel(tunnel); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// receiveKeepalive answers the keepalive of the initiator of a tunnel ending
+// here.
+func (o *Onion) receiveKeepalive(tunnel *Tunnel) error {
+
+	if tunnel.initiated() {
+		return nil
+	}
+	return tunnel.Send(msg.OnionKeepalive{})
+}
+
+// heard records that traffic came through the tunnel. A tunnel we initiated
+// never comes back from the dead, it is replaced instead.
+func (o *Onion) heard(tunnel *Tunnel) {
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	tunnel.heard = o.clock.Now()
+	if !tunnel.initiated() {
+		tunnel.State = TunnelAlive
+	}
+}
+
+// tunnelFailed handles a tunnel we initiated which stopped working. It is
+// rebuilt over fresh hops when KeepaliveRebuild is set, and torn down
+// otherwise. Its clients are told if it cannot be rebuilt.
+func (o *Onion) tunnelFailed(tunnel *Tunnel) {
+
+	var failed, cover, pinned bool
+
+	o.lock.Lock()
+	failed = tunnel.State == TunnelAlive && !tunnel.retired && !tunnel.closed
+	tunnel.State = TunnelDead
+	if cover = tunnel == o.coverTunnel; cover {
+		o.coverTunnel = nil
+	}
+	pinned = o.pinned(tunnel)
+	o.lock.Unlock()
+
+	if !failed {
+		return
+	}
+	fmt.Printf("Tunnel %v failed\n", tunnel.Id)
+
+	if o.KeepaliveRebuild == 0 || cover || pinned {
+		if !cover {
+			o.notifyError(tunnel, msg.ONION_TUNNEL_DESTROY)
+		}
+		if err := o.DestroyTunnel(tunnel); err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	// Building waits for answers from links, possibly from the one whose
+	// goroutine brought us here.
+	go func() {
+		err := o.replaceTunnel(tunnel)
+		if err == nil {
+			return
+		}
+		fmt.Printf("Could not rebuild tunnel %v: %v\n", tunnel.Id, err)
+		o.notifyError(tunnel, msg.ONION_TUNNEL_DESTROY)
+		if err = o.DestroyTunnel(tunnel); err != nil {
+			fmt.Println(err)
+		}
+	}()
+}
+
+// linkClosed tears down the circuits going through the link. Their
+// neighbours on the other side are told of the failure.
+func (o *Onion) linkClosed(link *Link) {
+
+	var circuits map[*Circuit]bool
+
+	circuits = make(map[*Circuit]bool)
+
+	o.lock.Lock()
+	delete(o.served, link)
+	for key, circuit := range o.circuits {
+		if key.link == link {
+			circuits[circuit] = true
+		}
+	}
+	o.lock.Unlock()
+
+	for circuit := range circuits {
+		o.removeCircuit(circuit)
+		if circuit.Next != nil && circuit.Next != link {
+			circuit.Next.Send(msg.OnionDestroy{TunnelId: circuit.NextId, Reason: msg.DestroyFailed})
+		}
+		if circuit.Previous != nil && circuit.Previous != link {
+			circuit.Previous.Send(msg.OnionDestroy{TunnelId: circuit.PreviousId, Reason: msg.DestroyFailed})
+		}
+		if circuit.tunnel != nil {
+			o.tunnelLost(circuit.tunnel)
+		}
+	}
+}
+
+// tunnelLost handles a tunnel whose circuit has been torn down by a failure.
+// A tunnel ending here waits for its initiator to rebuild it, as long as
+// keepalives eventually give up on it.
+func (o *Onion) tunnelLost(tunnel *Tunnel) {
+
+	if tunnel.initiated() {
+		o.tunnelFailed(tunnel)
+	} else if o.KeepaliveInterval > 0 {
+		o.lock.Lock()
+		tunnel.State = TunnelDead
+		o.lock.Unlock()
+	} else {
+		o.notifyError(tunnel, msg.ONION_TUNNEL_DESTROY)
+		o.removeTunnel(tunnel)
+	}
+}
+
+// pinned reports whether the tunnel leads to a rendezvous or an introduction
+// point, which cannot be rebuilt to the same peer. The lock must be held.
+func (o *Onion) pinned(tunnel *Tunnel) bool {
+
+	if _, present := o.introTunnels[tunnel]; present {
+		return true
+	}
+	return tunnel.joined.Load() != nil
+}
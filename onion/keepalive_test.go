@@ -0,0 +1,86 @@
+package onion
+
+import (
+	"testing"
+	"time"
+
+	"github.com/limoges/p2pnet/msg"
+)
+
+// tunnelState returns the state of the tunnel.
+func tunnelState(o *Onion, tunnel *Tunnel) TunnelState {
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	return tunnel.State
+}
+
+// The keepalives keep an idle tunnel alive.
+func TestKeepaliveIdle(t *testing.T) {
+
+	var peers []*testPeer
+	var tunnel *Tunnel
+
+	peers = startNetwork(t, 5, "keepalive_interval = 1\nkeepalive_timeout = 2")
+	source := dialAPI(t, peers[0])
+	tunnelId, _ := openTestTunnel(t, source, peers)
+
+	time.Sleep(3500 * time.Millisecond)
+	tunnel, _ = peers[0].Onion.tunnel(tunnelId)
+	if tunnel == nil || tunnelState(peers[0].Onion, tunnel) != TunnelAlive {
+		t.Fatal("the idle tunnel died")
+	}
+}
+
+// A tunnel which stays silent past the timeout has failed, and its clients
+// are told it is gone.
+func TestKeepaliveTimeout(t *testing.T) {
+
+	var peers []*testPeer
+	var failure msg.OnionError
+
+	peers = startNetwork(t, 5, "keepalive_interval = 0\nkeepalive_timeout = 2")
+	source := dialAPI(t, peers[0])
+	tunnelId, _ := openTestTunnel(t, source, peers)
+
+	peers[0].Onion.keepalive(time.Now().Add(10 * time.Second))
+	if failure = expectMessage[msg.OnionError](t, source); failure.TunnelID != tunnelId || failure.RequestType != msg.ONION_TUNNEL_DESTROY {
+		t.Fatalf("the client was told %#v", failure)
+	}
+	waitFor(t, "the tunnel to be removed", func() bool {
+		_, present := peers[0].Onion.tunnel(tunnelId)
+		return !present
+	})
+}
+
+// With keepalive_rebuild set, a tunnel whose link fails is rebuilt and keeps
+// its ids at both ends.
+func TestKeepaliveRebuild(t *testing.T) {
+
+	var peers []*testPeer
+	var previous *Tunnel
+	var data msg.OnionTunnelData
+	var err error
+
+	peers = startNetwork(t, 5, "keepalive_interval = 1\nkeepalive_timeout = 2\nkeepalive_rebuild = 1")
+	source := dialAPI(t, peers[0])
+	destination := dialAPI(t, peers[4])
+	connected(t, peers[4], 1)
+	sourceId, destinationId := openTestTunnel(t, source, peers, destination)
+
+	o := peers[0].Onion
+	previous, _ = o.tunnel(sourceId)
+	previous.link.Close()
+	waitFor(t, "the tunnel to be rebuilt", func() bool {
+		current, _ := o.tunnel(sourceId)
+		return current != previous
+	})
+
+	if err = msg.Send(source, msg.OnionTunnelData{TunnelID: sourceId, Data: []byte("again")}); err != nil {
+		t.Fatal(err)
+	}
+	if data = expectMessage[msg.OnionTunnelData](t, destination); string(data.Data) != "again" || data.TunnelID != destinationId {
+		t.Fatalf("the destination received %q on %v instead of %v", data.Data, data.TunnelID, destinationId)
+	}
+}
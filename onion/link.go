@@ -0,0 +1,281 @@
+package onion
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/limoges/p2pnet"
+	"github.com/limoges/p2pnet/msg"
+)
+
+// The info string binding the link keys to their use.
+const linkKeyInfo = "p2pnet onion link"
+
+var (
+	ErrLinkHandshake = errors.New("The link handshake failed")
+)
+
+// Link is a connection between two onion modules, carrying cells. Each end
+// picks an ephemeral X25519 key when the link is opened, and the two derive a
+// key for each direction from the shared secret.
+//
+// Links are not authenticated: they hide the cells from observers of the
+// network, while the hops of a tunnel are authenticated by their sessions with
+// the Auth module.
+type Link struct {
+	conn   net.Conn
+	reader *msg.CellReader
+	writer *msg.CellWriter
+
+	// When anything was last received on the link, in nanoseconds.
+	heard atomic.Int64
+	clock p2pnet.Clock
+}
+
+// linkActivity records when the link receives anything, heartbeats
+// included.
+type linkActivity struct {
+	link *Link
+}
+
+func (a linkActivity) Read(p []byte) (int, error) {
+
+	n, err := a.link.conn.Read(p)
+	if n > 0 {
+		a.link.heard.Store(a.link.clock.Now().UnixNano())
+	}
+	return n, err
+}
+
+// dialLink opens a link to the onion module at hostport.
+func (o *Onion) dialLink(hostport string) (*Link, error) {
+
+	var conn net.Conn
+	var link *Link
+	var start time.Time
+	var err error
+
+	start = o.clock.Now()
+	if conn, err = net.Dial("tcp", hostport); err != nil {
+		return nil, err
+	}
+	if link, err = o.openLink(conn, true); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Opening the link takes two round trips.
+	o.recordLatency(hostport, o.clock.Now().Sub(start)/2)
+	return link, nil
+}
+
+// openLink runs the key exchange on the connection. The dialer sends its
+// public key first.
+func (o *Onion) openLink(conn net.Conn, dialer bool) (*Link, error) {
+
+	var private *ecdh.PrivateKey
+	var remote *ecdh.PublicKey
+	var local, received []byte
+	var secret, salt, keys []byte
+	var sendKey, receiveKey []byte
+	var sendCipher, receiveCipher cipher.AEAD
+	var link *Link
+	var err error
+
+	o.lock.Lock()
+	private, err = newLinkKey(o.random)
+	o.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	local = private.PublicKey().Bytes()
+	received = make([]byte, len(local))
+
+	if dialer {
+		if _, err = conn.Write(local); err != nil {
+			return nil, err
+		}
+	}
+	if _, err = io.ReadFull(conn, received); err != nil {
+		return nil, err
+	}
+	if !dialer {
+		if _, err = conn.Write(local); err != nil {
+			return nil, err
+		}
+	}
+
+	if remote, err = ecdh.X25519().NewPublicKey(received); err != nil {
+		return nil, ErrLinkHandshake
+	}
+	if secret, err = private.ECDH(remote); err != nil {
+		return nil, ErrLinkHandshake
+	}
+
+	// The dialer's key comes first, so that both ends agree on the salt and
+	// on which half of the keys protects which direction.
+	if dialer {
+		salt = append(append(salt, local...), received...)
+	} else {
+		salt = append(append(salt, received...), local...)
+	}
+	if keys, err = hkdf.Key(sha256.New, secret, salt, linkKeyInfo, 64); err != nil {
+		return nil, err
+	}
+
+	if dialer {
+		sendKey, receiveKey = keys[:32], keys[32:]
+	} else {
+		sendKey, receiveKey = keys[32:], keys[:32]
+	}
+	if sendCipher, err = newLinkCipher(sendKey); err != nil {
+		return nil, err
+	}
+	if receiveCipher, err = newLinkCipher(receiveKey); err != nil {
+		return nil, err
+	}
+
+	link = &Link{
+		conn:   conn,
+		writer: msg.NewCellWriter(conn, sendCipher),
+		clock:  o.clock,
+	}
+	link.reader = msg.NewCellReader(linkActivity{link}, receiveCipher)
+	link.heard.Store(o.clock.Now().UnixNano())
+	return link, nil
+}
+
+// Send writes the message to the link as cells.
+func (l *Link) Send(message msg.Message) error {
+	return l.writer.WriteMessage(message)
+}
+
+// Receive reads the next message from the link.
+func (l *Link) Receive() (msg.Message, error) {
+	return l.reader.ReadMessage()
+}
+
+// Heartbeat sends a padding cell, which shows the other end that the link
+// still works.
+func (l *Link) Heartbeat() error {
+	return l.writer.WritePadding()
+}
+
+func (l *Link) lastHeard() time.Time {
+	return time.Unix(0, l.heard.Load())
+}
+
+func (l *Link) RemoteAddr() net.Addr {
+	return l.conn.RemoteAddr()
+}
+
+func (l *Link) Close() error {
+	return l.conn.Close()
+}
+
+// listenLinks accepts the links other onion modules open to us.
+func (o *Onion) listenLinks(ln net.Listener) {
+
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			fmt.Println(err)
+		} else {
+			go o.acceptLink(conn)
+		}
+	}
+}
+
+func (o *Onion) acceptLink(conn net.Conn) {
+
+	var link *Link
+	var err error
+
+	if link, err = o.openLink(conn, false); err != nil {
+		fmt.Println(err)
+		conn.Close()
+		return
+	}
+	o.serveLink(link)
+	link.Close()
+}
+
+// serveLink handles the messages received on the link until it is closed.
+// The circuits going through the link are torn down then.
+func (o *Onion) serveLink(link *Link) {
+
+	o.lock.Lock()
+	o.served[link] = true
+	o.lock.Unlock()
+	defer o.linkClosed(link)
+
+	for {
+		message, err := link.Receive()
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				fmt.Println(err)
+			}
+			return
+		}
+		if err = o.handleLink(link, message); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// handleLink handles the messages other onion modules send on links.
+func (o *Onion) handleLink(link *Link, message msg.Message) error {
+
+	switch message.(type) {
+	case msg.OnionCreate:
+		m := message.(msg.OnionCreate)
+		return o.handleCreate(link, &m)
+	case msg.OnionCreated:
+		m := message.(msg.OnionCreated)
+		return o.handleCreated(link, &m)
+	case msg.OnionRelay:
+		m := message.(msg.OnionRelay)
+		return o.handleRelay(link, &m)
+	case msg.OnionDestroy:
+		m := message.(msg.OnionDestroy)
+		return o.handleDestroy(link, &m)
+	case msg.OnionSphinx:
+		m := message.(msg.OnionSphinx)
+		return o.handleSphinx(link, &m)
+	default:
+		return o.handleUnknown(nil, message)
+	}
+}
+
+func newLinkKey(random io.Reader) (*ecdh.PrivateKey, error) {
+
+	var key []byte
+
+	key = make([]byte, msg.X25519KeyLength)
+	if _, err := io.ReadFull(random, key); err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPrivateKey(key)
+}
+
+func newLinkCipher(key []byte) (cipher.AEAD, error) {
+
+	var block cipher.Block
+	var err error
+
+	if block, err = aes.NewCipher(key); err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
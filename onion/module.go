@@ -2,9 +2,13 @@ package onion
 
 import (
 	"crypto/rsa"
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/limoges/p2pnet"
 	"github.com/limoges/p2pnet/auth"
@@ -36,6 +40,86 @@ const (
 	HostkeyToken = "HOSTKEY"
 	// The default hostkey configuration.
 	DefaultHostkey = "hostkey.pem"
+	// The token identifying the RPS module's configurations.
+	RPSModuleToken = "RPS"
+	// The token identifying the RPS module's api address.
+	RPSApiAddrToken = "api_address"
+	// The default RPS api address.
+	DefaultRPSApiAddr = "127.0.0.1:7022"
+	// The token identifying the gossip module's configurations.
+	GossipModuleToken = "GOSSIP"
+	// The token identifying the gossip module's api address.
+	GossipApiAddrToken = "api_address"
+	// The default gossip api address.
+	DefaultGossipApiAddr = "127.0.0.1:6001"
+	// The token identifying the cover traffic interval, in milliseconds.
+	CoverIntervalToken = "cover_interval"
+	// The default cover traffic interval. No background cover traffic is
+	// sent when it is zero.
+	DefaultCoverInterval = 0
+	// The token identifying the amount of cover traffic sent per interval.
+	CoverSizeToken = "cover_size"
+	// The default amount of cover traffic sent per interval, in bytes.
+	DefaultCoverSize = 1024
+	// The token identifying the duration of a round, in seconds.
+	RoundDurationToken = "round_duration"
+	// The default duration of a round. Tunnels are never rebuilt when it is
+	// zero.
+	DefaultRoundDuration = 0
+	// The token identifying the identities never used as hops, as a
+	// comma-separated list.
+	ExcludeToken = "exclude"
+	// The token identifying whether the hops of a tunnel must be in distinct
+	// networks.
+	DistinctSubnetsToken = "distinct_subnets"
+	// The default distinct networks configuration.
+	DefaultDistinctSubnets = 1
+	// The token identifying how hops are weighted: "latency", "uptime", or
+	// nothing.
+	PathWeightToken = "path_weight"
+	// The default hop weighting configuration.
+	DefaultPathWeight = WeightNone
+	// The token identifying the interval between keepalives, in seconds.
+	KeepaliveIntervalToken = "keepalive_interval"
+	// The default keepalive interval. Links and tunnels are not monitored
+	// when it is zero.
+	DefaultKeepaliveInterval = 10
+	// The token identifying the time after which a silent link or tunnel has
+	// failed, in seconds.
+	KeepaliveTimeoutToken = "keepalive_timeout"
+	// The default keepalive timeout.
+	DefaultKeepaliveTimeout = 30
+	// The token identifying whether failed tunnels are rebuilt rather than
+	// reported to the clients.
+	KeepaliveRebuildToken = "keepalive_rebuild"
+	// The default failed tunnel rebuilding configuration.
+	DefaultKeepaliveRebuild = 0
+	// The token identifying the SOCKS5 listen address.
+	SocksAddrToken = "socks_address"
+	// The default SOCKS5 listen address. No SOCKS5 proxy is run when it is
+	// empty.
+	DefaultSocksAddr = ""
+	// The token identifying the address of the local service the streams of
+	// incoming tunnels are forwarded to.
+	ServiceAddrToken = "service_address"
+	// The default service address. Incoming streams are left to the API
+	// clients when it is empty.
+	DefaultServiceAddr = ""
+	// The token identifying the section mapping local addresses to the
+	// services of other peers.
+	ForwardsToken = "ONION_FORWARDS"
+	// The token identifying the section mapping the names of our services to
+	// their addresses.
+	ServicesToken = "ONION_SERVICES"
+	// The token identifying whether we are reachable as a hidden service.
+	HiddenServiceToken = "hidden_service"
+	// The default hidden service configuration.
+	DefaultHiddenService = 0
+	// The token identifying the number of introduction points of our hidden
+	// service.
+	IntroductionPointsToken = "introduction_points"
+	// The default number of introduction points.
+	DefaultIntroductionPoints = 3
 )
 
 type Onion struct {
@@ -46,27 +130,131 @@ type Onion struct {
 	ListenAddr string
 	APIAddr    string
 	AuthAddr   string
+	RPSAddr    string
+	GossipAddr string
+
+	SocksAddr   string
+	ServiceAddr string
+	Forwards    map[string]Forward
+	Services    map[string]string
+
+	HiddenService      int
+	IntroductionPoints int
+
+	CoverInterval int
+	CoverSize     int
+	RoundDuration int
+
+	KeepaliveInterval int
+	KeepaliveTimeout  int
+	KeepaliveRebuild  int
+
+	ExcludedPeers   []string
+	DistinctSubnets int
+	PathWeight      string
+	Selector        PathSelector
+	// The other identities our Auth module holds, which are us as well.
+	keyring []p2pnet.Identity
 
 	Peers    map[p2pnet.Identity]string
 	Sessions map[uint32]p2pnet.Identity
 	Tunnels  map[uint32]*Tunnel
+
+	circuits  map[circuitKey]*Circuit
+	pending   map[circuitKey]chan msg.Message
+	links     map[string]*Link
+	served    map[*Link]bool
+	latencies map[string]time.Duration
+	firstSeen map[p2pnet.Identity]time.Time
+	clients   map[net.Conn]*clientQueue
+	requestId uint16
+
+	// The peers the RPS module named, to find them by their identity.
+	knownPeers map[p2pnet.Identity]p2pnet.Peer
+
+	coverTunnel *Tunnel
+	// The bytes API clients sent during the current cover interval.
+	dataSent int
+
+	// Signs the descriptors of our hidden service.
+	privateKey *rsa.PrivateKey
+	// The descriptors of hidden services spread through gossip.
+	descriptors map[p2pnet.Identity]msg.HiddenDescriptor
+	// The circuits ending here which relay introductions to hidden services,
+	// and those waiting at a rendezvous.
+	introductions map[p2pnet.Identity]*Circuit
+	rendezvous    map[[msg.RendezvousCookieLength]byte]*Circuit
+	// The tunnels to the introduction points of our hidden service.
+	introTunnels map[*Tunnel]msg.IntroductionPoint
+	// The reply blocks we created, by the id their reply comes back with.
+	replyBlocks map[[msg.ReplyIdLength]byte]*replyBlock
+	// The reply blocks our clients may answer, by the id they know them by,
+	// and when each reply block was received, by the hash of its header, to
+	// refuse it a second time.
+	receivedReplies map[uint32]*receivedReply
+	seenReplies     map[[sha256.Size]byte]time.Time
+	replyCount      uint32
+
+	// Our keys processing the Sphinx packets relayed through us, the newest
+	// last, and the Sphinx keys of other peers spread through gossip.
+	sphinxEpochs []*sphinxEpoch
+	sphinxKeys   map[p2pnet.Identity]msg.SphinxKey
+	// The API clients the Sphinx packets delivered to us go to.
+	sphinxClients map[net.Conn]bool
+
+	lock sync.Mutex
+	// Signalled when the flow control windows of a tunnel change.
+	windows *sync.Cond
+	random  io.Reader
+	clock   p2pnet.Clock
 }
 
 func New(conf *cfg.Configurations) (*Onion, error) {
+	return NewWithSources(conf, p2pnet.DefaultSources())
+}
+
+// NewWithSources creates the module using the given randomness and clock
+// instead of the system ones.
+func NewWithSources(conf *cfg.Configurations, sources p2pnet.Sources) (*Onion, error) {
 
 	var mod *Onion
 	var priv *rsa.PrivateKey
 	var hostkey []byte
 	var err error
 	var hostkeyPath string
+	var keyringPaths []string
 
 	mod = &Onion{}
+	mod.windows = sync.NewCond(&mod.lock)
+	mod.random = sources.Random
+	mod.clock = sources.Clock
 	conf.Init(&mod.MinimalHopCount, ModuleToken, MinHopToken, DefaultMinHop)
 	conf.Init(&mod.HopCount, ModuleToken, HopCountToken, DefaultHopCount)
 	conf.Init(&mod.ListenAddr, ModuleToken, ListenAddrToken, DefaultListenAddr)
 	conf.Init(&mod.APIAddr, ModuleToken, ApiAddrToken, DefaultApiAddr)
 	conf.Init(&mod.AuthAddr, auth.ModuleToken, auth.ApiAddrToken, auth.DefaultApiAddr)
+	conf.Init(&mod.RPSAddr, RPSModuleToken, RPSApiAddrToken, DefaultRPSApiAddr)
+	conf.Init(&mod.GossipAddr, GossipModuleToken, GossipApiAddrToken, DefaultGossipApiAddr)
+	conf.Init(&mod.CoverInterval, ModuleToken, CoverIntervalToken, DefaultCoverInterval)
+	conf.Init(&mod.CoverSize, ModuleToken, CoverSizeToken, DefaultCoverSize)
+	conf.Init(&mod.RoundDuration, ModuleToken, RoundDurationToken, DefaultRoundDuration)
+	conf.Init(&mod.ExcludedPeers, ModuleToken, ExcludeToken, []string{})
+	conf.Init(&mod.DistinctSubnets, ModuleToken, DistinctSubnetsToken, DefaultDistinctSubnets)
+	conf.Init(&mod.PathWeight, ModuleToken, PathWeightToken, DefaultPathWeight)
+	conf.Init(&mod.KeepaliveInterval, ModuleToken, KeepaliveIntervalToken, DefaultKeepaliveInterval)
+	conf.Init(&mod.KeepaliveTimeout, ModuleToken, KeepaliveTimeoutToken, DefaultKeepaliveTimeout)
+	conf.Init(&mod.KeepaliveRebuild, ModuleToken, KeepaliveRebuildToken, DefaultKeepaliveRebuild)
+	conf.Init(&mod.SocksAddr, ModuleToken, SocksAddrToken, DefaultSocksAddr)
+	conf.Init(&mod.ServiceAddr, ModuleToken, ServiceAddrToken, DefaultServiceAddr)
+	conf.Init(&mod.HiddenService, ModuleToken, HiddenServiceToken, DefaultHiddenService)
+	conf.Init(&mod.IntroductionPoints, ModuleToken, IntroductionPointsToken, DefaultIntroductionPoints)
 	conf.Init(&hostkeyPath, "", HostkeyToken, DefaultHostkey)
+	conf.Init(&keyringPaths, auth.ModuleToken, auth.HostkeysToken, []string{})
+
+	mod.Services = conf.Section(ServicesToken)
+	if mod.Forwards, err = parseForwards(conf.Section(ForwardsToken)); err != nil {
+		return nil, err
+	}
 
 	if priv, err = auth.ReadPEMPrivateKey(hostkeyPath); err != nil {
 		return nil, err
@@ -77,8 +265,42 @@ func New(conf *cfg.Configurations) (*Onion, error) {
 	}
 
 	mod.Hostkey = hostkey
+	mod.privateKey = priv
+
+	for _, path := range keyringPaths {
+		if priv, err = auth.ReadPEMPrivateKey(path); err != nil {
+			return nil, err
+		}
+		if hostkey, err = auth.GetPublicKeyAsDER(&priv.PublicKey); err != nil {
+			return nil, err
+		}
+		mod.keyring = append(mod.keyring, p2pnet.GetIdentity(hostkey))
+	}
+
 	mod.Peers = make(map[p2pnet.Identity]string)
 	mod.Sessions = make(map[uint32]p2pnet.Identity)
+	mod.Tunnels = make(map[uint32]*Tunnel)
+	mod.circuits = make(map[circuitKey]*Circuit)
+	mod.pending = make(map[circuitKey]chan msg.Message)
+	mod.links = make(map[string]*Link)
+	mod.served = make(map[*Link]bool)
+	mod.latencies = make(map[string]time.Duration)
+	mod.firstSeen = make(map[p2pnet.Identity]time.Time)
+	mod.knownPeers = make(map[p2pnet.Identity]p2pnet.Peer)
+	mod.clients = make(map[net.Conn]*clientQueue)
+	mod.descriptors = make(map[p2pnet.Identity]msg.HiddenDescriptor)
+	mod.introductions = make(map[p2pnet.Identity]*Circuit)
+	mod.rendezvous = make(map[[msg.RendezvousCookieLength]byte]*Circuit)
+	mod.introTunnels = make(map[*Tunnel]msg.IntroductionPoint)
+	mod.replyBlocks = make(map[[msg.ReplyIdLength]byte]*replyBlock)
+	mod.receivedReplies = make(map[uint32]*receivedReply)
+	mod.seenReplies = make(map[[sha256.Size]byte]time.Time)
+	mod.sphinxKeys = make(map[p2pnet.Identity]msg.SphinxKey)
+	mod.sphinxClients = make(map[net.Conn]bool)
+	if _, err = mod.rotateSphinxKey(); err != nil {
+		return nil, err
+	}
+	mod.Selector = mod.newPathSelector()
 	return mod, nil
 }
 
@@ -86,11 +308,44 @@ func (o *Onion) Name() string {
 	return ModuleToken
 }
 
+// Addresses only returns the API address. The onion module listens on
+// ListenAddr itself, since its peers speak in cells rather than messages.
 func (o *Onion) Addresses() (APIAddr, P2PAddr string) {
-	return o.APIAddr, o.ListenAddr
+	return o.APIAddr, ""
 }
 
 func (o *Onion) Run() error {
+
+	var listener net.Listener
+	var err error
+
+	fmt.Printf("%20v: %v: Listening P2P\n", o.Name(), o.ListenAddr)
+	if listener, err = net.Listen("tcp", o.ListenAddr); err != nil {
+		fmt.Printf("%v: Cannot bind on %v\n", o.Name(), o.ListenAddr)
+		return err
+	}
+	defer listener.Close()
+	go o.listenLinks(listener)
+
+	if o.RoundDuration > 0 {
+		go o.runRounds()
+	}
+	if o.KeepaliveInterval > 0 {
+		go o.runKeepalive()
+	}
+	go o.runGossip()
+	if o.HiddenService != 0 {
+		go o.runHiddenService()
+	}
+	go o.runSphinx()
+	if o.frontendEnabled() {
+		if err = o.runFrontend(); err != nil {
+			return err
+		}
+	}
+	if o.CoverInterval > 0 {
+		o.runCover()
+	}
 	select {}
 }
 
@@ -99,19 +354,67 @@ func (o *Onion) Handle(source net.Conn, message msg.Message) error {
 	switch message.(type) {
 	case msg.OnionTunnelBuild:
 		m := message.(msg.OnionTunnelBuild)
-		return o.handleTunnelBuild(source, &m)
-	case msg.AuthSessionIncomingHS1:
-		m := message.(msg.AuthSessionIncomingHS1)
-		return o.handleIncomingHS1(source, &m)
-	case msg.AuthHandshake2:
-		m := message.(msg.AuthHandshake2)
-		return o.handleHandshake2(source, &m)
+		return o.reportError(source, message, 0, o.handleTunnelBuild(source, &m))
+	case msg.OnionTunnelData:
+		m := message.(msg.OnionTunnelData)
+		return o.reportError(source, message, m.TunnelID, o.handleTunnelData(source, &m))
+	case msg.OnionTunnelDestroy:
+		m := message.(msg.OnionTunnelDestroy)
+		return o.reportError(source, message, m.TunnelID, o.handleTunnelDestroy(source, &m))
+	case msg.OnionTunnelSubscribe:
+		m := message.(msg.OnionTunnelSubscribe)
+		return o.reportError(source, message, m.TunnelID, o.handleTunnelSubscribe(source, &m))
+	case msg.OnionCover:
+		m := message.(msg.OnionCover)
+		return o.reportError(source, message, 0, o.handleCover(source, &m))
+	case msg.OnionStreamOpen:
+		m := message.(msg.OnionStreamOpen)
+		return o.reportError(source, message, m.TunnelID, o.handleStreamOpen(source, &m))
+	case msg.OnionStreamData:
+		m := message.(msg.OnionStreamData)
+		return o.reportError(source, message, m.TunnelID, o.handleStreamData(source, &m))
+	case msg.OnionStreamClose:
+		m := message.(msg.OnionStreamClose)
+		return o.reportError(source, message, m.TunnelID, o.handleStreamClose(source, &m))
+	case msg.OnionTunnelReplyable:
+		m := message.(msg.OnionTunnelReplyable)
+		return o.reportError(source, message, m.TunnelID, o.handleTunnelReplyable(source, &m))
+	case msg.OnionTunnelReply:
+		m := message.(msg.OnionTunnelReply)
+		return o.reportError(source, message, m.ReplyId, o.handleTunnelReply(source, &m))
+	case msg.OnionSphinxSend:
+		m := message.(msg.OnionSphinxSend)
+		return o.reportError(source, message, 0, o.handleSphinxSend(source, &m))
+	case msg.OnionSphinxSubscribe:
+		return o.reportError(source, message, 0, o.handleSphinxSubscribe(source))
+	case msg.GossipNotification:
+		m := message.(msg.GossipNotification)
+		return o.handleNotification(source, &m)
 	default:
 		return p2pnet.ErrModuleDoesNotHandle
 	}
 	return nil
 }
 
+// reportError answers a failed API request with ONION_ERROR.
+func (o *Onion) reportError(source net.Conn, request msg.Message, tunnelId uint32, err error) error {
+
+	if err == nil {
+		return nil
+	}
+
+	response := msg.OnionError{
+		RequestType: request.TypeId(),
+		TunnelID:    tunnelId,
+	}
+	if sendErr := msg.Send(source, response); sendErr != nil {
+		fmt.Println(sendErr)
+	}
+	return err
+}
+
+// handleTunnelBuild builds a tunnel to the peer at the address. Without an
+// address, the peer is a hidden service reached through a rendezvous.
 func (o *Onion) handleTunnelBuild(source net.Conn, m *msg.OnionTunnelBuild) error {
 
 	var port int
@@ -119,6 +422,8 @@ func (o *Onion) handleTunnelBuild(source net.Conn, m *msg.OnionTunnelBuild) erro
 	var hostport string
 	var hostkey []byte
 	var tunnelReady *msg.OnionTunnelReady
+	var tunnel *Tunnel
+	var present bool
 	var err error
 
 	port = int(m.Port)
@@ -126,42 +431,30 @@ func (o *Onion) handleTunnelBuild(source net.Conn, m *msg.OnionTunnelBuild) erro
 	hostport = net.JoinHostPort(host.String(), strconv.Itoa(port))
 	hostkey = m.DstHostkey
 
-	if tunnelReady, err = o.BuildTunnel(0, hostport, hostkey); err != nil {
+	if port == 0 && host.IsUnspecified() {
+		tunnelReady, err = o.BuildHiddenTunnel(hostkey)
+	} else {
+		tunnelReady, err = o.BuildTunnel(0, hostport, hostkey)
+	}
+	if err != nil {
 		return err
 	}
+	if tunnel, present = o.tunnel(tunnelReady.TunnelId); present {
+		o.addOwner(tunnel, source)
+	}
 	return msg.Send(source, tunnelReady)
 }
 
-func (o *Onion) handleIncomingHS1(source net.Conn, m *msg.AuthSessionIncomingHS1) error {
+func (o *Onion) handleTunnelData(source net.Conn, m *msg.OnionTunnelData) error {
 
-	var response *msg.AuthSessionHS2
-	var sessionId uint32
-	var payload []byte
+	var tunnel *Tunnel
 	var err error
 
-	if response, err = o.requestHandshake2(m); err != nil {
-		return err
-	}
-
-	// Save the session Id and source
-	sessionId = response.SessionId
-	o.storeSession(sessionId, m.Hostkey)
-	o.storeIdentity(source.RemoteAddr().String(), m.Hostkey)
-
-	// Extract the payload.
-	payload = response.HandshakePayload
-
-	// Forward the payload to the source.
-	if _, err = source.Write(payload); err != nil {
+	if tunnel, err = o.owned(m.TunnelID, source); err != nil {
 		return err
 	}
-
-	return nil
-}
-
-func (o *Onion) handleHandshake2(source net.Conn, m msg.Message) error {
-
-	return forwardTo(o.AuthAddr, m)
+	o.markDataSent(len(m.Data))
+	return tunnel.SendData(m.Data)
 }
 
 func (o *Onion) handleUnknown(source net.Conn, m msg.Message) error {
@@ -0,0 +1,273 @@
+package onion
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/limoges/p2pnet"
+	"github.com/limoges/p2pnet/auth"
+	"github.com/limoges/p2pnet/cfg"
+	"github.com/limoges/p2pnet/msg"
+)
+
+// The tests run a network of peers within the test process, on the loopback
+// interface. Each peer runs an Onion and an Auth module, and they all learn
+// about each other from a fake RPS module.
+
+// fakeRPS answers RPS queries with a random peer of the network.
+type fakeRPS struct {
+	addr  string
+	lock  sync.Mutex
+	peers []p2pnet.Peer
+}
+
+func (r *fakeRPS) Name() string {
+	return "FAKERPS"
+}
+
+func (r *fakeRPS) Addresses() (string, string) {
+	return r.addr, ""
+}
+
+func (r *fakeRPS) Run() error {
+	select {}
+}
+
+func (r *fakeRPS) Handle(conn net.Conn, m msg.Message) error {
+
+	var peer p2pnet.Peer
+	var response msg.RPSPeer
+
+	r.lock.Lock()
+	peer = r.peers[rand.Intn(len(r.peers))]
+	r.lock.Unlock()
+
+	response = msg.RPSPeer{Port: peer.Port, Hostkey: peer.Hostkey}
+	copy(response.IPAddr[:], net.IP(peer.IPAddr).To16())
+	return msg.Send(conn, response)
+}
+
+type testPeer struct {
+	Auth  *auth.Auth
+	Onion *Onion
+}
+
+// The ports handed out by port. They are taken below the ephemeral range, so
+// that the connections the peers make cannot take them before they listen.
+var (
+	portsLock sync.Mutex
+	ports     = make(map[int]bool)
+)
+
+// port returns a loopback address nothing listens on.
+func port() string {
+
+	var listener net.Listener
+	var number int
+	var err error
+
+	portsLock.Lock()
+	defer portsLock.Unlock()
+
+	for {
+		if number = 20000 + rand.Intn(12000); ports[number] {
+			continue
+		}
+		ports[number] = true
+		if listener, err = net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(number))); err == nil {
+			listener.Close()
+			return listener.Addr().String()
+		}
+	}
+}
+
+// startNetwork starts n peers, with the extra configuration in the
+// ONION_FORWARDING section of each.
+func startNetwork(t *testing.T, n int, extra string) []*testPeer {
+	return startNetworkEach(t, n, func(int) string { return extra })
+}
+
+// startNetworkEach starts n peers, with the extra configuration of each in
+// its ONION_FORWARDING section.
+func startNetworkEach(t *testing.T, n int, each func(int) string) []*testPeer {
+
+	var dir string
+	var rps *fakeRPS
+	var peers []*testPeer
+
+	dir = t.TempDir()
+	rps = &fakeRPS{addr: port()}
+	for i := 0; i < n; i++ {
+		hostkey, err := filepath.Abs(filepath.Join("..", "main", "keys", fmt.Sprintf("peer%v.pem", i%5)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ini := fmt.Sprintf(`HOSTKEY = %v
+
+[RPS]
+api_address = %v
+
+[ONION_FORWARDING]
+listen_address = %v
+api_address = %v
+min_hop_count = 1
+distinct_subnets = 0
+hop_count = 2
+%v
+
+[ONION_AUTHENTICATION]
+api_address = %v
+`, hostkey, rps.addr, port(), port(), each(i), port())
+
+		path := filepath.Join(dir, fmt.Sprintf("peer%v.ini", i))
+		if err = os.WriteFile(path, []byte(ini), 0600); err != nil {
+			t.Fatal(err)
+		}
+		conf, err := cfg.New(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := auth.New(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o, err := New(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go p2pnet.Run(a)
+		go p2pnet.Run(o)
+
+		peers = append(peers, &testPeer{a, o})
+		rps.peers = append(rps.peers, peers[i].peer())
+	}
+	go p2pnet.Run(rps)
+	time.Sleep(200 * time.Millisecond)
+	return peers
+}
+
+// peer returns the address of the peer, as the RPS module gives it.
+func (p *testPeer) peer() p2pnet.Peer {
+
+	var host, portString string
+	var portNumber int
+
+	host, portString, _ = net.SplitHostPort(p.Onion.ListenAddr)
+	portNumber, _ = strconv.Atoi(portString)
+	return p2pnet.Peer{
+		Port:    uint16(portNumber),
+		IPAddr:  net.ParseIP(host),
+		Hostkey: p.Onion.Hostkey,
+	}
+}
+
+// buildMsg asks for a tunnel to the peer.
+func buildMsg(peer *testPeer) *msg.OnionTunnelBuild {
+
+	var host, portString string
+	var portNumber int
+
+	host, portString, _ = net.SplitHostPort(peer.Onion.ListenAddr)
+	portNumber, _ = strconv.Atoi(portString)
+	return &msg.OnionTunnelBuild{
+		Port:       uint16(portNumber),
+		IPAddr:     net.ParseIP(host).To16(),
+		DstHostkey: peer.Onion.Hostkey,
+	}
+}
+
+// dialAPI connects to the API of the peer's Onion module.
+func dialAPI(t *testing.T, peer *testPeer) net.Conn {
+
+	var conn net.Conn
+	var err error
+
+	if conn, err = net.Dial("tcp", peer.Onion.APIAddr); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// waitFor polls the condition until it holds, or fails the test.
+func waitFor(t *testing.T, what string, condition func() bool) {
+
+	var deadline time.Time
+
+	deadline = time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// openTestTunnel builds a tunnel from the client of the first peer to the
+// last peer, whose clients are told about it and subscribe to it. It returns
+// the id of the tunnel at the first peer, and at the last.
+func openTestTunnel(t *testing.T, source net.Conn, peers []*testPeer, destinations ...net.Conn) (uint32, uint32) {
+
+	var response msg.Message
+	var ready msg.OnionTunnelReady
+	var incoming msg.OnionTunnelIncoming
+	var valid bool
+	var err error
+
+	if response, err = msg.SendReceive(source, buildMsg(peers[len(peers)-1])); err != nil {
+		t.Fatal(err)
+	}
+	if ready, valid = response.(msg.OnionTunnelReady); !valid {
+		t.Fatalf("expected OnionTunnelReady, got %v", response)
+	}
+	for _, destination := range destinations {
+		incoming = expectMessage[msg.OnionTunnelIncoming](t, destination)
+		if err = msg.Send(destination, msg.OnionTunnelSubscribe{TunnelID: incoming.TunnelID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(destinations) > 0 {
+		o := peers[len(peers)-1].Onion
+		waitFor(t, "the destinations to subscribe", func() bool {
+			tunnel, present := o.tunnel(incoming.TunnelID)
+			o.lock.Lock()
+			defer o.lock.Unlock()
+			return present && len(tunnel.owners) == len(destinations)
+		})
+	}
+	return ready.TunnelId, incoming.TunnelID
+}
+
+// expectMessage reads a message of type M from the connection.
+func expectMessage[M msg.Message](t *testing.T, conn net.Conn) M {
+
+	var message msg.Message
+	var m M
+	var valid bool
+	var err error
+
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	if message, err = msg.Read(conn); err != nil {
+		t.Fatal(err)
+	}
+	if m, valid = message.(M); !valid {
+		t.Fatalf("expected %T, got %v", m, message)
+	}
+	return m
+}
+
+// connected waits until the module knows about the count clients.
+func connected(t *testing.T, peer *testPeer, count int) {
+	waitFor(t, "the clients to connect", func() bool {
+		peer.Onion.lock.Lock()
+		defer peer.Onion.lock.Unlock()
+		return len(peer.Onion.clients) == count
+	})
+}
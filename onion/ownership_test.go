@@ -0,0 +1,80 @@
+package onion
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/limoges/p2pnet/msg"
+)
+
+// Only the API connections owning a tunnel may use it, and a client which
+// gives the tunnel up receives nothing more from it.
+func TestOwnership(t *testing.T) {
+
+	var peers []*testPeer
+	var response msg.Message
+	var failure msg.OnionError
+	var data msg.OnionTunnelData
+	var valid bool
+	var err error
+
+	peers = startNetwork(t, 5, "")
+	source, other := dialAPI(t, peers[0]), dialAPI(t, peers[0])
+	kept, released := dialAPI(t, peers[4]), dialAPI(t, peers[4])
+	connected(t, peers[4], 2)
+
+	sourceId, destinationId := openTestTunnel(t, source, peers, kept, released)
+	if response, err = msg.SendReceive(other, msg.OnionTunnelData{TunnelID: sourceId, Data: []byte("refused")}); err != nil {
+		t.Fatal(err)
+	}
+	if failure, valid = response.(msg.OnionError); !valid || failure.RequestType != msg.ONION_TUNNEL_DATA {
+		t.Fatalf("expected an error about the data, got %#v", response)
+	}
+
+	if err = msg.Send(released, msg.OnionTunnelDestroy{TunnelID: destinationId}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the client to give the tunnel up", func() bool {
+		tunnel, _ := peers[4].Onion.tunnel(destinationId)
+		peers[4].Onion.lock.Lock()
+		defer peers[4].Onion.lock.Unlock()
+		return len(tunnel.owners) == 1
+	})
+	if err = msg.Send(source, msg.OnionTunnelData{TunnelID: sourceId, Data: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	if data = expectMessage[msg.OnionTunnelData](t, kept); string(data.Data) != "hello" {
+		t.Fatalf("the destination received %q", data.Data)
+	}
+	released.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if m, err := msg.Read(released); err == nil {
+		t.Fatalf("the released client received %v", msg.Identifier(m.TypeId()))
+	}
+}
+
+// Closing the connection of the last owner tears the tunnel down along every
+// hop, and the clients at the other end are told it is gone.
+func TestOrphanedTunnel(t *testing.T) {
+
+	var peers []*testPeer
+	var source net.Conn
+	var failure msg.OnionError
+
+	peers = startNetwork(t, 5, "")
+	source = dialAPI(t, peers[0])
+	destination := dialAPI(t, peers[4])
+	connected(t, peers[4], 1)
+
+	_, destinationId := openTestTunnel(t, source, peers, destination)
+	source.Close()
+
+	for _, peer := range peers {
+		waitFor(t, "the tunnel to be torn down at "+peer.Onion.ListenAddr, func() bool {
+			return state(peer) == 0
+		})
+	}
+	if failure = expectMessage[msg.OnionError](t, destination); failure.RequestType != msg.ONION_TUNNEL_DESTROY || failure.TunnelID != destinationId {
+		t.Fatalf("the destination was told %#v", failure)
+	}
+}
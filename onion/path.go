@@ -0,0 +1,253 @@
+package onion
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/limoges/p2pnet"
+)
+
+// The ways intermediate hops can be weighted.
+const (
+	// Every hop is equally likely.
+	WeightNone = ""
+	// Hops with a lower link latency are more likely.
+	WeightLatency = "latency"
+	// Hops we have known for longer are more likely.
+	WeightUptime = "uptime"
+)
+
+// The number of candidates sampled from the RPS module for each hop, so that
+// the path selector has a choice.
+const PathCandidatesPerHop = 4
+
+// The latency assumed for peers we have no link with yet.
+const UnmeasuredLatency = 100 * time.Millisecond
+
+// PathSelector picks the intermediate hops of a tunnel.
+type PathSelector interface {
+	// SelectPath returns count intermediate hops for a tunnel to the
+	// destination, chosen among the candidates.
+	SelectPath(candidates []p2pnet.Peer, count int, destination p2pnet.Peer) ([]p2pnet.Peer, error)
+}
+
+// DiversePathSelector picks hops at random, such that no two hops of a
+// tunnel, the destination included, share a /16 IPv4 or /48 IPv6 network.
+// We are never part of our own tunnels, and neither are the excluded peers.
+type DiversePathSelector struct {
+	Self     p2pnet.Identity
+	Excluded map[p2pnet.Identity]bool
+	// Whether hops must be in distinct networks. Networks running on a
+	// single host need to turn it off.
+	DistinctSubnets bool
+	// Weight gives the relative chance of a peer being picked. Peers with no
+	// positive weight are never picked. All peers are equally likely when
+	// Weight is nil.
+	Weight func(peer p2pnet.Peer) float64
+
+	random io.Reader
+}
+
+func NewDiversePathSelector(hostkey []byte, random io.Reader) *DiversePathSelector {
+	return &DiversePathSelector{
+		Self:            p2pnet.GetIdentity(hostkey),
+		Excluded:        make(map[p2pnet.Identity]bool),
+		DistinctSubnets: true,
+		random:          random,
+	}
+}
+
+func (s *DiversePathSelector) SelectPath(candidates []p2pnet.Peer, count int, destination p2pnet.Peer) ([]p2pnet.Peer, error) {
+
+	var path []p2pnet.Peer
+	var eligible []p2pnet.Peer
+	var weights []float64
+	var seen map[p2pnet.Identity]bool
+	var subnets map[string]bool
+	var identity p2pnet.Identity
+	var chosen int
+	var err error
+
+	seen = make(map[p2pnet.Identity]bool)
+	seen[s.Self] = true
+	seen[p2pnet.GetIdentity(destination.Hostkey)] = true
+
+	subnets = make(map[string]bool)
+	subnets[subnet(destination.IPAddr)] = true
+
+	path = make([]p2pnet.Peer, 0, count)
+	for len(path) < count {
+		eligible = eligible[:0]
+		weights = weights[:0]
+		for _, peer := range candidates {
+			identity = p2pnet.GetIdentity(peer.Hostkey)
+			if seen[identity] || s.Excluded[identity] {
+				continue
+			}
+			if s.DistinctSubnets && subnets[subnet(peer.IPAddr)] {
+				continue
+			}
+			weight := 1.0
+			if s.Weight != nil {
+				weight = s.Weight(peer)
+			}
+			if weight <= 0 {
+				continue
+			}
+			eligible = append(eligible, peer)
+			weights = append(weights, weight)
+		}
+		if len(eligible) == 0 {
+			return nil, ErrNotEnoughPeers
+		}
+
+		if chosen, err = s.pick(weights); err != nil {
+			return nil, err
+		}
+		path = append(path, eligible[chosen])
+		seen[p2pnet.GetIdentity(eligible[chosen].Hostkey)] = true
+		subnets[subnet(eligible[chosen].IPAddr)] = true
+	}
+	return path, nil
+}
+
+// pick returns the index of a weight, chosen with a probability proportional
+// to the weight.
+func (s *DiversePathSelector) pick(weights []float64) (int, error) {
+
+	var value uint64
+	var total, target float64
+
+	for _, weight := range weights {
+		total = total + weight
+	}
+
+	if err := binary.Read(s.random, binary.BigEndian, &value); err != nil {
+		return 0, err
+	}
+	// 53 random bits give a uniform float64 in [0, 1).
+	target = float64(value>>11) / (1 << 53) * total
+
+	for i, weight := range weights {
+		if target < weight {
+			return i, nil
+		}
+		target = target - weight
+	}
+	return len(weights) - 1, nil
+}
+
+// subnet returns the /16 network of an IPv4 address or the /48 network of an
+// IPv6 address.
+func subnet(address []byte) string {
+
+	var ip net.IP
+
+	ip = net.IP(address)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(16, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// newPathSelector configures the default path selector.
+func (o *Onion) newPathSelector() *DiversePathSelector {
+
+	var selector *DiversePathSelector
+
+	selector = NewDiversePathSelector(o.Hostkey, lockedRandom{o})
+	selector.DistinctSubnets = o.DistinctSubnets != 0
+	for _, identity := range o.ExcludedPeers {
+		selector.Excluded[p2pnet.Identity(identity)] = true
+	}
+	for _, identity := range o.keyring {
+		selector.Excluded[identity] = true
+	}
+
+	switch o.PathWeight {
+	case WeightLatency:
+		selector.Weight = o.latencyWeight
+	case WeightUptime:
+		selector.Weight = o.uptimeWeight
+	}
+	return selector
+}
+
+// selectPath picks the intermediate hops of a tunnel to the destination.
+func (o *Onion) selectPath(count int, hostport string, hostkey []byte) ([]p2pnet.Peer, error) {
+
+	var candidates []p2pnet.Peer
+	var destination p2pnet.Peer
+	var ipAddr [16]byte
+	var err error
+
+	if ipAddr, destination.Port, err = splitHostport(hostport); err != nil {
+		return nil, err
+	}
+	destination.IPAddr = ipAddr[:]
+	destination.Hostkey = hostkey
+
+	if candidates, err = o.sampleCandidates(count * PathCandidatesPerHop); err != nil {
+		return nil, err
+	}
+	return o.Selector.SelectPath(candidates, count, destination)
+}
+
+// latencyWeight favours the peers we reach faster.
+func (o *Onion) latencyWeight(peer p2pnet.Peer) float64 {
+
+	var latency time.Duration
+	var present bool
+
+	o.lock.Lock()
+	latency, present = o.latencies[peerHostport(peer)]
+	o.lock.Unlock()
+
+	if !present {
+		latency = UnmeasuredLatency
+	}
+	if latency < time.Millisecond {
+		latency = time.Millisecond
+	}
+	return 1 / latency.Seconds()
+}
+
+// uptimeWeight favours the peers we have known for longer.
+func (o *Onion) uptimeWeight(peer p2pnet.Peer) float64 {
+
+	var firstSeen time.Time
+	var present bool
+
+	o.lock.Lock()
+	firstSeen, present = o.firstSeen[p2pnet.GetIdentity(peer.Hostkey)]
+	o.lock.Unlock()
+
+	if !present {
+		return 1
+	}
+	return 1 + o.clock.Now().Sub(firstSeen).Seconds()
+}
+
+// lockedRandom reads from the module's randomness under its lock.
+type lockedRandom struct {
+	o *Onion
+}
+
+func (r lockedRandom) Read(p []byte) (int, error) {
+
+	r.o.lock.Lock()
+	defer r.o.lock.Unlock()
+
+	return r.o.random.Read(p)
+}
+
+// recordLatency remembers how long opening a link to the peer took.
+func (o *Onion) recordLatency(hostport string, latency time.Duration) {
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.latencies[hostport] = latency
+}
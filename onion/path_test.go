@@ -0,0 +1,309 @@
+package onion
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/limoges/p2pnet"
+	"github.com/limoges/p2pnet/cfg"
+)
+
+// syntheticPeer makes a peer whose hostkey is its name, which is enough for the
+// path selector.
+func syntheticPeer(name, ip string) p2pnet.Peer {
+	return p2pnet.Peer{
+		Port:    4000,
+		IPAddr:  net.ParseIP(ip).To16(),
+		Hostkey: []byte(name),
+	}
+}
+
+func TestDiversePathSelector(t *testing.T) {
+
+	var destination = syntheticPeer("destination", "10.1.0.1")
+	var destination6 = syntheticPeer("destination", "2001:db8:1:2::1")
+
+	var tests = []struct {
+		name        string
+		candidates  []p2pnet.Peer
+		count       int
+		destination p2pnet.Peer
+		excluded    []string
+		sameSubnets bool
+		// The hops the path may be made of.
+		allowed []string
+		err     error
+	}{
+		{
+			name: "distinct /16",
+			candidates: []p2pnet.Peer{
+				syntheticPeer("a", "10.1.200.1"), syntheticPeer("b", "10.2.0.1"),
+				syntheticPeer("c", "10.2.7.7"), syntheticPeer("d", "10.3.0.1"),
+			},
+			count:       2,
+			destination: destination,
+			allowed:     []string{"b", "c", "d"},
+		},
+		{
+			name: "/16 of the destination",
+			candidates: []p2pnet.Peer{
+				syntheticPeer("a", "10.1.0.2"), syntheticPeer("b", "10.1.255.255"),
+			},
+			count:       1,
+			destination: destination,
+			err:         ErrNotEnoughPeers,
+		},
+		{
+			name: "/16 of another hop",
+			candidates: []p2pnet.Peer{
+				syntheticPeer("a", "10.2.0.1"), syntheticPeer("b", "10.2.1.1"),
+			},
+			count:       2,
+			destination: destination,
+			err:         ErrNotEnoughPeers,
+		},
+		{
+			name: "distinct /48",
+			candidates: []p2pnet.Peer{
+				syntheticPeer("a", "2001:db8:1:ffff::1"), syntheticPeer("b", "2001:db8:2::1"),
+				syntheticPeer("c", "2001:db8:2:1::1"), syntheticPeer("d", "2001:db8:3::1"),
+			},
+			count:       2,
+			destination: destination6,
+			allowed:     []string{"b", "c", "d"},
+		},
+		{
+			name: "/48 of another hop",
+			candidates: []p2pnet.Peer{
+				syntheticPeer("a", "2001:db8:2::1"), syntheticPeer("b", "2001:db8:2:9::1"),
+			},
+			count:       2,
+			destination: destination6,
+			err:         ErrNotEnoughPeers,
+		},
+		{
+			name: "shared subnets",
+			candidates: []p2pnet.Peer{
+				syntheticPeer("a", "10.1.0.2"), syntheticPeer("b", "10.1.0.3"),
+			},
+			count:       2,
+			destination: destination,
+			sameSubnets: true,
+			allowed:     []string{"a", "b"},
+		},
+		{
+			name: "self and destination",
+			candidates: []p2pnet.Peer{
+				syntheticPeer("self", "10.2.0.1"), syntheticPeer("destination", "10.3.0.1"),
+				syntheticPeer("a", "10.4.0.1"),
+			},
+			count:       1,
+			destination: destination,
+			allowed:     []string{"a"},
+		},
+		{
+			name: "excluded",
+			candidates: []p2pnet.Peer{
+				syntheticPeer("a", "10.2.0.1"), syntheticPeer("b", "10.3.0.1"),
+				syntheticPeer("c", "10.4.0.1"),
+			},
+			count:       2,
+			destination: destination,
+			excluded:    []string{"b"},
+			allowed:     []string{"a", "c"},
+		},
+		{
+			name: "not enough peers",
+			candidates: []p2pnet.Peer{
+				syntheticPeer("self", "10.2.0.1"), syntheticPeer("a", "10.3.0.1"),
+				syntheticPeer("b", "10.4.0.1"),
+			},
+			count:       3,
+			destination: destination,
+			excluded:    []string{"b"},
+			err:         ErrNotEnoughPeers,
+		},
+		{
+			name:        "no candidates",
+			count:       1,
+			destination: destination,
+			err:         ErrNotEnoughPeers,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var selector *DiversePathSelector
+			var allowed map[string]bool
+			var path []p2pnet.Peer
+			var err error
+
+			selector = NewDiversePathSelector([]byte("self"), rand.New(rand.NewSource(1)))
+			selector.DistinctSubnets = !test.sameSubnets
+			for _, name := range test.excluded {
+				selector.Excluded[p2pnet.GetIdentity([]byte(name))] = true
+			}
+			allowed = make(map[string]bool)
+			for _, name := range test.allowed {
+				allowed[name] = true
+			}
+
+			// The selection is random: repeat it to try many paths.
+			for i := 0; i < 50; i++ {
+				path, err = selector.SelectPath(test.candidates, test.count, test.destination)
+				if err != test.err {
+					t.Fatalf("expected %v, got %v", test.err, err)
+				}
+				if err != nil {
+					return
+				}
+				if len(path) != test.count {
+					t.Fatalf("expected %v hops, got %v", test.count, len(path))
+				}
+				checkPath(t, path, test.destination, allowed, !test.sameSubnets)
+			}
+		})
+	}
+}
+
+// checkPath checks that the hops are allowed, distinct and, if required, in
+// distinct subnets, the destination's included.
+func checkPath(t *testing.T, path []p2pnet.Peer, destination p2pnet.Peer, allowed map[string]bool, distinct bool) {
+
+	var hops map[string]bool
+	var subnets map[string]bool
+
+	hops = make(map[string]bool)
+	subnets = map[string]bool{subnet(destination.IPAddr): true}
+	for _, hop := range path {
+		if !allowed[string(hop.Hostkey)] {
+			t.Fatalf("%s may not be a hop", hop.Hostkey)
+		}
+		if hops[string(hop.Hostkey)] {
+			t.Fatalf("%s is used twice", hop.Hostkey)
+		}
+		hops[string(hop.Hostkey)] = true
+		if distinct && subnets[subnet(hop.IPAddr)] {
+			t.Fatalf("%s shares the subnet %v", hop.Hostkey, subnet(hop.IPAddr))
+		}
+		subnets[subnet(hop.IPAddr)] = true
+	}
+}
+
+func TestDiversePathSelectorWeight(t *testing.T) {
+
+	var candidates []p2pnet.Peer
+	var destination p2pnet.Peer
+	var weights map[string]float64
+	var picked map[string]int
+	var first []string
+	var path []p2pnet.Peer
+	var err error
+
+	candidates = []p2pnet.Peer{
+		syntheticPeer("heavy", "10.2.0.1"), syntheticPeer("light", "10.3.0.1"),
+		syntheticPeer("zero", "10.4.0.1"), syntheticPeer("negative", "10.5.0.1"),
+	}
+	destination = syntheticPeer("destination", "10.1.0.1")
+	weights = map[string]float64{"heavy": 9, "light": 1, "zero": 0, "negative": -1}
+
+	selectMany := func() []string {
+
+		var selector *DiversePathSelector
+		var names []string
+
+		selector = NewDiversePathSelector([]byte("self"), rand.New(rand.NewSource(7)))
+		selector.Weight = func(peer p2pnet.Peer) float64 {
+			return weights[string(peer.Hostkey)]
+		}
+		picked = make(map[string]int)
+		for i := 0; i < 1000; i++ {
+			if path, err = selector.SelectPath(candidates, 1, destination); err != nil {
+				t.Fatal(err)
+			}
+			picked[string(path[0].Hostkey)]++
+			names = append(names, string(path[0].Hostkey))
+		}
+		return names
+	}
+
+	first = selectMany()
+	if picked["zero"] != 0 || picked["negative"] != 0 {
+		t.Fatalf("peers without a positive weight were picked: %v", picked)
+	}
+	// heavy is expected 900 times out of 1000.
+	if picked["heavy"] < 850 || picked["heavy"] > 950 {
+		t.Fatalf("the weights were not followed: %v", picked)
+	}
+
+	// The same seed picks the same hops.
+	for i, name := range selectMany() {
+		if first[i] != name {
+			t.Fatalf("selection %v differs with the same seed: %v, %v", i, first[i], name)
+		}
+	}
+
+	// Only the peers with a positive weight can make up a path.
+	selector := NewDiversePathSelector([]byte("self"), rand.New(rand.NewSource(7)))
+	selector.Weight = func(peer p2pnet.Peer) float64 {
+		return weights[string(peer.Hostkey)]
+	}
+	if _, err = selector.SelectPath(candidates, 3, destination); err != ErrNotEnoughPeers {
+		t.Fatalf("expected %v, got %v", ErrNotEnoughPeers, err)
+	}
+}
+
+// The other identities of our Auth module are never picked as hops.
+func TestPathSelectorKeyring(t *testing.T) {
+
+	var keys [5]string
+	var path string
+	var conf *cfg.Configurations
+	var o *Onion
+	var candidates, hops []p2pnet.Peer
+	var err error
+
+	for i := range keys {
+		if keys[i], err = filepath.Abs(filepath.Join("..", "main", "keys", fmt.Sprintf("peer%v.pem", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path = filepath.Join(t.TempDir(), "peer.ini")
+	ini := fmt.Sprintf("HOSTKEY = %v\n\n[ONION_AUTHENTICATION]\nhostkeys = %v, %v\n", keys[0], keys[1], keys[2])
+	if err = os.WriteFile(path, []byte(ini), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if conf, err = cfg.New(path); err != nil {
+		t.Fatal(err)
+	}
+	if o, err = New(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		candidates = append(candidates, p2pnet.Peer{
+			Port:    4000,
+			IPAddr:  net.ParseIP(fmt.Sprintf("10.%v.0.1", i)).To16(),
+			Hostkey: testPeerHostkey(t, i),
+		})
+	}
+	destination := p2pnet.Peer{Port: 4000, IPAddr: net.ParseIP("10.9.0.1").To16(), Hostkey: testPeerHostkey(t, 4)}
+
+	for i := 0; i < 20; i++ {
+		if hops, err = o.Selector.SelectPath(candidates, 1, destination); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(hops[0].Hostkey, candidates[3].Hostkey) {
+			t.Fatalf("picked the hop %v", hops[0].IPAddr)
+		}
+	}
+	if _, err = o.Selector.SelectPath(candidates, 2, destination); err != ErrNotEnoughPeers {
+		t.Fatalf("expected %v, got %v", ErrNotEnoughPeers, err)
+	}
+}
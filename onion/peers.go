@@ -0,0 +1,160 @@
+package onion
+
+import (
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/limoges/p2pnet"
+	"github.com/limoges/p2pnet/msg"
+)
+
+// The number of RPS queries made for each hop before giving up on finding
+// enough distinct peers.
+const MaximumPeerQueriesPerHop = 10
+
+// The number of peers the RPS module told us about which are remembered, to
+// find them by their identity.
+const MaximumKnownPeers = 4096
+
+var (
+	ErrNotEnoughPeers = errors.New("Not enough distinct peers to build the tunnel")
+	ErrUnknownPeer    = errors.New("The peer is unknown: the RPS module never named it, and it publishes no hidden service descriptor")
+)
+
+// samplePeers queries the RPS module for count distinct random peers. Our
+// own hostkey and the excluded hostkeys are never returned.
+func (o *Onion) samplePeers(count int, excluded ...[]byte) ([]p2pnet.Peer, error) {
+
+	var peers []p2pnet.Peer
+	var peer p2pnet.Peer
+	var identity p2pnet.Identity
+	var seen map[p2pnet.Identity]bool
+	var err error
+
+	seen = make(map[p2pnet.Identity]bool)
+	seen[p2pnet.GetIdentity(o.Hostkey)] = true
+	for _, hostkey := range excluded {
+		seen[p2pnet.GetIdentity(hostkey)] = true
+	}
+
+	peers = make([]p2pnet.Peer, 0, count)
+	for attempts := 0; len(peers) < count; attempts++ {
+		if attempts == count*MaximumPeerQueriesPerHop {
+			return nil, ErrNotEnoughPeers
+		}
+
+		if peer, err = o.queryRandomPeer(); err != nil {
+			return nil, err
+		}
+
+		identity = p2pnet.GetIdentity(peer.Hostkey)
+		if seen[identity] {
+			continue
+		}
+		seen[identity] = true
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
+
+// sampleCandidates queries the RPS module for up to count distinct peers to
+// choose hops from. Fewer peers are returned when the RPS module does not know
+// enough of them.
+func (o *Onion) sampleCandidates(count int) ([]p2pnet.Peer, error) {
+
+	var peers []p2pnet.Peer
+	var peer p2pnet.Peer
+	var identity p2pnet.Identity
+	var seen map[p2pnet.Identity]bool
+	var err error
+
+	seen = make(map[p2pnet.Identity]bool)
+	peers = make([]p2pnet.Peer, 0, count)
+	for attempts := 0; len(peers) < count && attempts < count*MaximumPeerQueriesPerHop; attempts++ {
+		if peer, err = o.queryRandomPeer(); err != nil {
+			return nil, err
+		}
+
+		identity = p2pnet.GetIdentity(peer.Hostkey)
+		o.storeFirstSeen(identity)
+		if seen[identity] {
+			continue
+		}
+		seen[identity] = true
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
+
+// storeFirstSeen remembers when the RPS module first told us about the peer.
+func (o *Onion) storeFirstSeen(identity p2pnet.Identity) {
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if _, present := o.firstSeen[identity]; !present {
+		o.firstSeen[identity] = o.clock.Now()
+	}
+}
+
+func (o *Onion) queryRandomPeer() (p2pnet.Peer, error) {
+
+	var response msg.Message
+	var rpsPeer msg.RPSPeer
+	var valid bool
+	var peer p2pnet.Peer
+	var err error
+
+	if response, err = requestFrom(o.RPSAddr, msg.RPSQuery{}); err != nil {
+		return peer, err
+	}
+
+	if rpsPeer, valid = response.(msg.RPSPeer); !valid {
+		return peer, errors.New("Invalid response to RPS Query")
+	}
+
+	peer = p2pnet.Peer{
+		Port:    rpsPeer.Port,
+		IPAddr:  rpsPeer.IPAddr[:],
+		Hostkey: rpsPeer.Hostkey,
+	}
+	o.storeKnownPeer(peer)
+	return peer, nil
+}
+
+// storeKnownPeer remembers the address of the peer the RPS module named. Any
+// other peer is forgotten to make room once MaximumKnownPeers are known.
+func (o *Onion) storeKnownPeer(peer p2pnet.Peer) {
+
+	var identity p2pnet.Identity
+
+	identity = p2pnet.GetIdentity(peer.Hostkey)
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if _, present := o.knownPeers[identity]; !present && len(o.knownPeers) >= MaximumKnownPeers {
+		for other := range o.knownPeers {
+			delete(o.knownPeers, other)
+			break
+		}
+	}
+	o.knownPeers[identity] = peer
+}
+
+// knownPeer returns the address the RPS module last gave for the peer.
+func (o *Onion) knownPeer(identity p2pnet.Identity) (p2pnet.Peer, error) {
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if peer, present := o.knownPeers[identity]; present {
+		return peer, nil
+	}
+	return p2pnet.Peer{}, ErrUnknownPeer
+}
+
+func peerHostport(peer p2pnet.Peer) string {
+	return net.JoinHostPort(net.IP(peer.IPAddr).String(), strconv.Itoa(int(peer.Port)))
+}
@@ -0,0 +1,127 @@
+package onion
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/limoges/p2pnet/msg"
+)
+
+// The messages waiting to be written to an API client. The windows of the
+// tunnels keep a client which reads slowly well below it; the messages which
+// do not fit are dropped, so that the links they came from are never held
+// back.
+const ClientQueueLength = 4 * StreamWindowStart
+
+// clientQueue writes the messages for an API client from a goroutine of its
+// own, so that a slow client only holds back the tunnels it reads from.
+type clientQueue struct {
+	conn     net.Conn
+	messages chan queuedMessage
+	closed   bool
+	lock     sync.Mutex
+}
+
+// queuedMessage is a message for an API client, and what to do once it has
+// been written or dropped.
+type queuedMessage struct {
+	message msg.Message
+	done    func()
+}
+
+func newClientQueue(conn net.Conn) *clientQueue {
+
+	var queue *clientQueue
+
+	queue = &clientQueue{
+		conn:     conn,
+		messages: make(chan queuedMessage, ClientQueueLength),
+	}
+	go queue.run()
+	return queue
+}
+
+func (q *clientQueue) run() {
+
+	for queued := range q.messages {
+		if err := msg.Send(q.conn, queued.message); err != nil {
+			fmt.Printf("Could not deliver to %v: %v\n", q.conn.RemoteAddr(), err)
+		}
+		if queued.done != nil {
+			queued.done()
+		}
+	}
+}
+
+// push queues the message without waiting. done is called right away if the
+// message is dropped.
+func (q *clientQueue) push(message msg.Message, done func()) {
+
+	var queued bool
+
+	q.lock.Lock()
+	if !q.closed {
+		select {
+		case q.messages <- queuedMessage{message, done}:
+			queued = true
+		default:
+			fmt.Printf("Dropped %v for %v: too many messages are waiting\n",
+				msg.Identifier(message.TypeId()), q.conn.RemoteAddr())
+		}
+	}
+	q.lock.Unlock()
+
+	if !queued && done != nil {
+		done()
+	}
+}
+
+// close stops the queue once the messages already in it are written.
+func (q *clientQueue) close() {
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if !q.closed {
+		q.closed = true
+		close(q.messages)
+	}
+}
+
+// pending returns the number of messages waiting to be written.
+func (q *clientQueue) pending() int {
+	return len(q.messages)
+}
+
+// notify queues the message for each of the API clients. done, if any, is
+// called once the message has been written to, or dropped for, all of them.
+func (o *Onion) notify(clients []net.Conn, message msg.Message, done func()) {
+
+	var queues []*clientQueue
+	var remaining atomic.Int32
+	var finish func()
+
+	o.lock.Lock()
+	for _, client := range clients {
+		if queue, present := o.clients[client]; present {
+			queues = append(queues, queue)
+		}
+	}
+	o.lock.Unlock()
+
+	if done == nil {
+		done = func() {}
+	}
+	remaining.Store(int32(len(queues) + 1))
+	finish = func() {
+		if remaining.Add(-1) == 0 {
+			done()
+		}
+	}
+	for _, queue := range queues {
+		queue.push(message, finish)
+	}
+	finish()
+}
@@ -0,0 +1,643 @@
+package onion
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/limoges/p2pnet/msg"
+)
+
+// The time we wait for a peer to answer a request sent on a link.
+const ResponseTimeout = 10 * time.Second
+
+var (
+	ErrResponseTimeout = errors.New("The peer did not respond in time")
+	ErrUnknownCircuit  = errors.New("No circuit is known for this tunnel")
+	ErrCircuitInUse    = errors.New("The tunnel id is already in use on this link")
+)
+
+// Circuit is the state kept by a peer for a tunnel passing through it.
+// Traffic received from the previous hop with PreviousId loses a layer and is
+// forwarded to the next hop with NextId. Traffic coming back from the next hop
+// gains a layer on its way to the previous hop. A circuit without a next hop
+// terminates here.
+type Circuit struct {
+	Previous   *Link
+	PreviousId uint32
+	Next       *Link
+	NextId     uint32
+	SessionId  uint32
+
+	// The tunnel the circuit belongs to, if it starts or ends here.
+	tunnel *Tunnel
+	// The hostkey of the initiator, when the circuit ends here.
+	hostkey []byte
+	// The circuit ending here this one is joined to at a rendezvous.
+	joined *Circuit
+}
+
+// circuitKey identifies a circuit on one of our links.
+type circuitKey struct {
+	link     *Link
+	tunnelId uint32
+}
+
+// The messages a tunnel carries towards its last hop, and back to its
+// initiator. Anything else is rejected before it is decoded.
+var (
+	forwardMessages = []uint16{
+		msg.ONION_EXTEND, msg.ONION_BEGIN, msg.ONION_DATA, msg.ONION_SENDME,
+		msg.ONION_OPEN, msg.ONION_SEGMENT, msg.ONION_CLOSE, msg.ONION_KEEPALIVE,
+		msg.ONION_ESTABLISH_INTRO, msg.ONION_INTRODUCE, msg.ONION_ESTABLISH_RENDEZVOUS,
+		msg.ONION_RENDEZVOUS, msg.ONION_SEALED, msg.ONION_REPLYABLE_DATA, msg.ONION_PADDING,
+	}
+	backwardMessages = []uint16{
+		msg.ONION_EXTENDED, msg.ONION_INTRO_ESTABLISHED, msg.ONION_INTRODUCE_ACK,
+		msg.ONION_RENDEZVOUS_ESTABLISHED, msg.ONION_RENDEZVOUS_JOINED, msg.ONION_INTRODUCED,
+		msg.ONION_DATA, msg.ONION_REPLYABLE_DATA, msg.ONION_SENDME, msg.ONION_OPEN,
+		msg.ONION_SEGMENT, msg.ONION_CLOSE, msg.ONION_KEEPALIVE, msg.ONION_SEALED,
+	}
+)
+
+func (c *Circuit) isForward(source *Link, tunnelId uint32) bool {
+	return c.Previous == source && c.PreviousId == tunnelId
+}
+
+func (o *Onion) handleCreate(source *Link, m *msg.OnionCreate) error {
+
+	var message msg.Message
+	var handshake1 msg.AuthSessionIncomingHS1
+	var valid bool
+	var response *msg.AuthSessionHS2
+	var err error
+
+	if message, err = msg.ReadExpected(bytes.NewReader(m.Payload), msg.AUTH_SESSION_INCOMING_HS1); err != nil {
+		return err
+	}
+	if handshake1, valid = message.(msg.AuthSessionIncomingHS1); !valid {
+		return errors.New("Invalid handshake in Onion Create")
+	}
+
+	if response, err = o.requestHandshake2(&handshake1); err != nil {
+		return err
+	}
+	o.storeSession(response.SessionId, handshake1.Hostkey)
+
+	err = o.storeCircuit(&Circuit{
+		Previous:   source,
+		PreviousId: m.TunnelId,
+		SessionId:  response.SessionId,
+		hostkey:    handshake1.Hostkey,
+	})
+	if err != nil {
+		return err
+	}
+
+	return source.Send(msg.OnionCreated{
+		TunnelId: m.TunnelId,
+		Payload:  response.HandshakePayload,
+	})
+}
+
+func (o *Onion) handleCreated(source *Link, m *msg.OnionCreated) error {
+	return o.respond(circuitKey{source, m.TunnelId}, *m)
+}
+
+func (o *Onion) handleRelay(source *Link, m *msg.OnionRelay) error {
+
+	var circuit *Circuit
+	var err error
+
+	if circuit, err = o.circuit(source, m.TunnelId); err != nil {
+		return err
+	}
+
+	if err = o.relay(circuit, source, m); err != nil {
+		o.relayFailed(circuit)
+	}
+	return err
+}
+
+// relayFailed reports a failure to handle the traffic of the circuit. The
+// clients of a tunnel starting or ending here are told about it. Any other
+// circuit is torn down, so that both ends learn about the failure.
+func (o *Onion) relayFailed(circuit *Circuit) {
+
+	if circuit.tunnel != nil {
+		o.notifyError(circuit.tunnel, msg.ONION_TUNNEL_DATA)
+	} else {
+		o.abortCircuit(circuit)
+	}
+}
+
+func (o *Onion) relay(circuit *Circuit, source *Link, m *msg.OnionRelay) error {
+
+	var payload []byte
+	var err error
+
+	// Traffic coming back to the initiator of the tunnel.
+	if circuit.Previous == nil {
+		return o.receiveFromTunnel(circuit.tunnel, m.Payload)
+	}
+
+	if !circuit.isForward(source, m.TunnelId) {
+		if payload, err = o.encryptLayers([]uint32{circuit.SessionId}, m.Payload); err != nil {
+			return err
+		}
+		return circuit.Previous.Send(msg.OnionRelay{
+			TunnelId: circuit.PreviousId,
+			Payload:  payload,
+		})
+	}
+
+	if payload, err = o.decryptLayers([]uint32{circuit.SessionId}, m.Payload); err != nil {
+		return err
+	}
+
+	if circuit.Next == nil {
+		return o.receiveFromCircuit(circuit, payload)
+	}
+	return circuit.Next.Send(msg.OnionRelay{
+		TunnelId: circuit.NextId,
+		Payload:  payload,
+	})
+}
+
+// receiveFromCircuit handles the traffic of a tunnel terminating here, once
+// all the layers have been removed.
+func (o *Onion) receiveFromCircuit(circuit *Circuit, payload []byte) error {
+
+	var message msg.Message
+	var err error
+
+	if message, err = msg.ReadExpected(bytes.NewReader(payload), forwardMessages...); err != nil {
+		return err
+	}
+	if circuit.tunnel != nil {
+		o.heard(circuit.tunnel)
+	}
+
+	switch message.(type) {
+	case msg.OnionExtend:
+		m := message.(msg.OnionExtend)
+		return o.extendCircuit(circuit, &m)
+	case msg.OnionBegin:
+		m := message.(msg.OnionBegin)
+		return o.beginTunnel(circuit, &m)
+	case msg.OnionData:
+		m := message.(msg.OnionData)
+		return o.receiveData(circuit, &m)
+	case msg.OnionSendme, msg.OnionOpen, msg.OnionSegment, msg.OnionClose:
+		if circuit.tunnel == nil {
+			return errors.New("Stream message received before the tunnel has begun")
+		}
+		return o.receiveStream(circuit.tunnel, message)
+	case msg.OnionKeepalive:
+		if circuit.tunnel == nil {
+			return errors.New("Keepalive received before the tunnel has begun")
+		}
+		return o.receiveKeepalive(circuit.tunnel)
+	case msg.OnionEstablishIntro:
+		m := message.(msg.OnionEstablishIntro)
+		return o.establishIntro(circuit, &m)
+	case msg.OnionIntroduce:
+		m := message.(msg.OnionIntroduce)
+		return o.introduce(circuit, &m)
+	case msg.OnionEstablishRendezvous:
+		m := message.(msg.OnionEstablishRendezvous)
+		return o.establishRendezvous(circuit, &m)
+	case msg.OnionRendezvous:
+		m := message.(msg.OnionRendezvous)
+		return o.meet(circuit, &m)
+	case msg.OnionSealed:
+		m := message.(msg.OnionSealed)
+		return o.relaySealed(circuit, &m)
+	case msg.OnionReplyableData:
+		if circuit.tunnel == nil {
+			return errors.New("Data received before the tunnel has begun")
+		}
+		m := message.(msg.OnionReplyableData)
+		return o.acceptReplyable(circuit.tunnel, &m)
+	case msg.OnionPadding:
+		return o.beginCover(circuit)
+	default:
+		return o.handleUnknown(nil, message)
+	}
+}
+
+// receiveFromTunnel handles the traffic coming back through a tunnel we
+// initiated.
+func (o *Onion) receiveFromTunnel(tunnel *Tunnel, payload []byte) error {
+
+	var message msg.Message
+	var err error
+
+	if payload, err = o.decryptLayers(tunnel.sessionIds(), payload); err != nil {
+		return err
+	}
+	if message, err = msg.ReadExpected(bytes.NewReader(payload), backwardMessages...); err != nil {
+		return err
+	}
+	o.heard(tunnel)
+
+	// Past a rendezvous point, only the other end of the tunnel is heard.
+	if joined := tunnel.joined.Load(); joined != nil {
+		if message, err = joined.open(message); err != nil {
+			return err
+		}
+	}
+
+	switch message.(type) {
+	case msg.OnionExtended, msg.OnionIntroEstablished, msg.OnionIntroduceAck,
+		msg.OnionRendezvousEstablished:
+		return o.respond(circuitKey{tunnel.link, tunnel.Hops[0].TunnelId}, message)
+	case msg.OnionRendezvousJoined:
+		m := message.(msg.OnionRendezvousJoined)
+		return o.joinTunnel(tunnel, &m)
+	case msg.OnionIntroduced:
+		m := message.(msg.OnionIntroduced)
+		return o.receiveIntroduction(tunnel, &m)
+	case msg.OnionData:
+		m := message.(msg.OnionData)
+		return o.acceptData(tunnel, m.Data)
+	case msg.OnionReplyableData:
+		m := message.(msg.OnionReplyableData)
+		return o.acceptReplyable(tunnel, &m)
+	case msg.OnionSendme, msg.OnionOpen, msg.OnionSegment, msg.OnionClose:
+		return o.receiveStream(tunnel, message)
+	case msg.OnionKeepalive:
+		return o.receiveKeepalive(tunnel)
+	default:
+		return o.handleUnknown(nil, message)
+	}
+}
+
+// extendCircuit makes the next hop of the circuit the peer named by the
+// initiator. We relay the initiator's handshake to it, and its answer back
+// through the circuit.
+func (o *Onion) extendCircuit(circuit *Circuit, m *msg.OnionExtend) error {
+
+	var hostport string
+	var link *Link
+	var tunnelId uint32
+	var handshake2 []byte
+	var err error
+
+	if circuit.Next != nil {
+		return errors.New("The circuit has already been extended")
+	}
+
+	hostport = net.JoinHostPort(net.IP(m.IPAddr[:]).String(), strconv.Itoa(int(m.Port)))
+	if link, err = o.link(hostport); err != nil {
+		return err
+	}
+
+	if tunnelId, err = o.unusedCircuitId(link); err != nil {
+		return err
+	}
+
+	if handshake2, err = o.create(link, tunnelId, m.Payload); err != nil {
+		return err
+	}
+
+	if err = o.attachNext(circuit, link, tunnelId); err != nil {
+		return err
+	}
+
+	return o.sendBackward(circuit, msg.OnionExtended{Payload: handshake2})
+}
+
+// create sends the handshake to the peer at the other end of the link and
+// waits for its answer.
+func (o *Onion) create(link *Link, tunnelId uint32, handshake1 []byte) ([]byte, error) {
+
+	var key circuitKey
+	var responses chan msg.Message
+	var response msg.Message
+	var created msg.OnionCreated
+	var valid bool
+	var err error
+
+	key = circuitKey{link, tunnelId}
+	responses = o.await(key)
+
+	err = link.Send(msg.OnionCreate{
+		TunnelId: tunnelId,
+		Payload:  handshake1,
+	})
+	if err != nil {
+		o.cancel(key)
+		return nil, err
+	}
+
+	if response, err = o.wait(key, responses); err != nil {
+		return nil, err
+	}
+	if created, valid = response.(msg.OnionCreated); !valid {
+		return nil, errors.New("Invalid response expected OnionCreated")
+	}
+	return created.Payload, nil
+}
+
+// sendBackward sends a message to the initiator of a circuit terminating
+// here, under our layer.
+func (o *Onion) sendBackward(circuit *Circuit, message msg.Message) error {
+
+	var buf *bytes.Buffer
+	var payload []byte
+	var err error
+
+	buf = new(bytes.Buffer)
+	if err = msg.Write(buf, message); err != nil {
+		return err
+	}
+
+	if payload, err = o.encryptLayers([]uint32{circuit.SessionId}, buf.Bytes()); err != nil {
+		return err
+	}
+
+	return circuit.Previous.Send(msg.OnionRelay{
+		TunnelId: circuit.PreviousId,
+		Payload:  payload,
+	})
+}
+
+// encryptLayers asks the Auth module to add a layer for each session. The
+// first session's layer is the innermost.
+func (o *Onion) encryptLayers(sessionIds []uint32, payload []byte) ([]byte, error) {
+
+	var request msg.AuthLayerEncrypt
+	var response msg.Message
+	var validResponse msg.AuthLayerEncryptResp
+	var valid bool
+	var err error
+
+	request = msg.AuthLayerEncrypt{
+		Layers:     uint8(len(sessionIds)),
+		RequestId:  o.nextRequestId(),
+		SessionIds: sessionIds,
+		Payload:    payload,
+	}
+
+	if response, err = requestFrom(o.AuthAddr, request); err != nil {
+		return nil, err
+	}
+
+	if validResponse, valid = response.(msg.AuthLayerEncryptResp); !valid {
+		return nil, errors.New("Invalid response to Auth Layer Encrypt")
+	}
+	return validResponse.EncryptedPayload, nil
+}
+
+// decryptLayers asks the Auth module to remove a layer for each session. The
+// last session's layer is the outermost.
+func (o *Onion) decryptLayers(sessionIds []uint32, payload []byte) ([]byte, error) {
+
+	var request msg.AuthLayerDecrypt
+	var response msg.Message
+	var validResponse msg.AuthLayerDecryptResp
+	var valid bool
+	var err error
+
+	request = msg.AuthLayerDecrypt{
+		Layers:           uint8(len(sessionIds)),
+		RequestId:        o.nextRequestId(),
+		SessionIds:       sessionIds,
+		EncryptedPayload: payload,
+	}
+
+	if response, err = requestFrom(o.AuthAddr, request); err != nil {
+		return nil, err
+	}
+
+	if validResponse, valid = response.(msg.AuthLayerDecryptResp); !valid {
+		return nil, errors.New("Invalid response to Auth Layer Decrypt")
+	}
+	return validResponse.DecryptedPayload, nil
+}
+
+func (o *Onion) nextRequestId() uint16 {
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.requestId = o.requestId + 1
+	return o.requestId
+}
+
+// link returns our link to the peer, opening it if needed. The messages the
+// peer sends on it are handled like those of any other link.
+func (o *Onion) link(hostport string) (*Link, error) {
+
+	var link *Link
+	var existing *Link
+	var present bool
+	var err error
+
+	o.lock.Lock()
+	link, present = o.links[hostport]
+	o.lock.Unlock()
+
+	if present {
+		return link, nil
+	}
+
+	if link, err = o.dialLink(hostport); err != nil {
+		return nil, err
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	// Another circuit may have dialed the peer in the meantime.
+	if existing, present = o.links[hostport]; present {
+		link.Close()
+		return existing, nil
+	}
+	o.links[hostport] = link
+	go o.serveDialedLink(hostport, link)
+
+	return link, nil
+}
+
+func (o *Onion) serveDialedLink(hostport string, link *Link) {
+
+	o.serveLink(link)
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.links[hostport] == link {
+		delete(o.links, hostport)
+	}
+	link.Close()
+}
+
+// circuit finds the circuit a relayed message belongs to.
+func (o *Onion) circuit(source *Link, tunnelId uint32) (*Circuit, error) {
+
+	var circuit *Circuit
+	var present bool
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if circuit, present = o.circuits[circuitKey{source, tunnelId}]; !present {
+		fmt.Printf("No circuit for tunnel %v from %v\n", tunnelId, source.RemoteAddr())
+		return nil, ErrUnknownCircuit
+	}
+	return circuit, nil
+}
+
+func (o *Onion) storeCircuit(circuit *Circuit) error {
+
+	var previous, next circuitKey
+	var present bool
+
+	previous = circuitKey{circuit.Previous, circuit.PreviousId}
+	next = circuitKey{circuit.Next, circuit.NextId}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if circuit.Previous != nil {
+		if _, present = o.circuits[previous]; present {
+			return ErrCircuitInUse
+		}
+	}
+	if circuit.Next != nil {
+		if _, present = o.circuits[next]; present {
+			return ErrCircuitInUse
+		}
+	}
+
+	if circuit.Previous != nil {
+		o.circuits[previous] = circuit
+	}
+	if circuit.Next != nil {
+		o.circuits[next] = circuit
+	}
+	return nil
+}
+
+// attachNext records the next hop of a circuit.
+func (o *Onion) attachNext(circuit *Circuit, link *Link, tunnelId uint32) error {
+
+	var key circuitKey
+	var present bool
+
+	key = circuitKey{link, tunnelId}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if _, present = o.circuits[key]; present {
+		return ErrCircuitInUse
+	}
+	circuit.Next = link
+	circuit.NextId = tunnelId
+	o.circuits[key] = circuit
+	return nil
+}
+
+// unusedCircuitId returns a tunnel id which no circuit uses on the link yet.
+func (o *Onion) unusedCircuitId(link *Link) (uint32, error) {
+
+	const MaximumTunnelIdAttempts = 100
+	var id uint32
+	var inUse bool
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for count := 0; count < MaximumTunnelIdAttempts; count++ {
+		if err := binary.Read(o.random, binary.BigEndian, &id); err != nil {
+			return 0, err
+		}
+		_, inUse = o.circuits[circuitKey{link, id}]
+		if _, awaited := o.pending[circuitKey{link, id}]; !inUse && !awaited {
+			return id, nil
+		}
+	}
+	return 0, errors.New("Could not generate a new tunnel id")
+}
+
+// await registers our interest in the response to a request sent on a link.
+func (o *Onion) await(key circuitKey) chan msg.Message {
+
+	var responses chan msg.Message
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	responses = make(chan msg.Message, 1)
+	o.pending[key] = responses
+	return responses
+}
+
+func (o *Onion) cancel(key circuitKey) {
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	delete(o.pending, key)
+}
+
+// wait returns the response registered with await, unless it does not arrive
+// in time.
+func (o *Onion) wait(key circuitKey, responses chan msg.Message) (msg.Message, error) {
+
+	select {
+	case response := <-responses:
+		return response, nil
+	case <-o.clock.After(ResponseTimeout):
+		o.cancel(key)
+		return nil, ErrResponseTimeout
+	}
+}
+
+// respond hands a response over to the request awaiting it.
+func (o *Onion) respond(key circuitKey, response msg.Message) error {
+
+	var responses chan msg.Message
+	var present bool
+
+	o.lock.Lock()
+	responses, present = o.pending[key]
+	delete(o.pending, key)
+	o.lock.Unlock()
+
+	if !present {
+		return errors.New("Unexpected " + msg.Identifier(response.TypeId()))
+	}
+	responses <- response
+	return nil
+}
+
+// splitHostport converts a hostport into the address fields of our
+// messages.
+func splitHostport(hostport string) ([msg.IPLength]byte, uint16, error) {
+
+	var ipAddr [msg.IPLength]byte
+	var host, portString string
+	var port int
+	var ip net.IP
+	var err error
+
+	if host, portString, err = net.SplitHostPort(hostport); err != nil {
+		return ipAddr, 0, err
+	}
+	if port, err = strconv.Atoi(portString); err != nil {
+		return ipAddr, 0, err
+	}
+	if ip = net.ParseIP(host).To16(); ip == nil {
+		return ipAddr, 0, errors.New("Invalid IP address " + host)
+	}
+	copy(ipAddr[:], ip)
+	return ipAddr, uint16(port), nil
+}
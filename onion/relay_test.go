@@ -0,0 +1,104 @@
+package onion
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/limoges/p2pnet"
+	"github.com/limoges/p2pnet/auth"
+	"github.com/limoges/p2pnet/msg"
+)
+
+// decrypted tells whether the session decrypted some traffic.
+func decrypted(a *auth.Auth, sessionId uint32) bool {
+
+	var info auth.SessionInfo
+	var present bool
+
+	info, present = a.SessionInfo(sessionId)
+	return present && info.BytesDecrypted > 0
+}
+
+// terminal returns the circuit terminating at the module, once it is bound
+// to a link.
+func terminal(o *Onion) *Circuit {
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for _, circuit := range o.circuits {
+		if circuit.Next == nil && circuit.Previous != nil {
+			return circuit
+		}
+	}
+	return nil
+}
+
+// Each hop removes its layer on the way to the destination, and adds one on
+// the way back to the initiator.
+func TestRelay(t *testing.T) {
+
+	var peers []*testPeer
+	var ready *msg.OnionTunnelReady
+	var tunnel *Tunnel
+	var circuit *Circuit
+	var buf *bytes.Buffer
+	var payload []byte
+	var err error
+
+	peers = startNetwork(t, 5, "")
+	source, destination := peers[0], peers[4]
+	if ready, err = source.Onion.BuildTunnel(2, destination.Onion.ListenAddr, destination.Onion.Hostkey); err != nil {
+		t.Fatal(err)
+	}
+	tunnel = source.Onion.Tunnels[ready.TunnelId]
+
+	if err = tunnel.Send(msg.RPSQuery{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the destination's circuit", func() bool {
+		circuit = terminal(destination.Onion)
+		return circuit != nil
+	})
+	for _, peer := range peers[1:] {
+		for _, session := range peer.Auth.ListSessions() {
+			waitFor(t, "a hop to remove its layer", func() bool {
+				return decrypted(peer.Auth, session.Id)
+			})
+		}
+	}
+
+	// The destination answers through its circuit.
+	buf = new(bytes.Buffer)
+	if err = msg.Write(buf, msg.RPSQuery{}); err != nil {
+		t.Fatal(err)
+	}
+	if payload, err = destination.Onion.encryptLayers([]uint32{circuit.SessionId}, buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err = circuit.Previous.Send(msg.OnionRelay{TunnelId: circuit.PreviousId, Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	for _, hop := range tunnel.Hops {
+		waitFor(t, "the initiator to remove the layer of "+hop.Hostport, func() bool {
+			return decrypted(source.Auth, hop.SessionId)
+		})
+	}
+}
+
+// A request gives up on its response once the clock says so.
+func TestResponseTimeout(t *testing.T) {
+
+	var o *Onion
+	var key circuitKey
+	var err error
+
+	o = newSphinxOnion(t, p2pnet.FixedClock{Time: time.Unix(1700000000, 0)})
+	if _, err = o.wait(key, o.await(key)); err != ErrResponseTimeout {
+		t.Fatalf("expected %v, got %v", ErrResponseTimeout, err)
+	}
+	if len(o.pending) != 0 {
+		t.Fatal("the request is still pending")
+	}
+}
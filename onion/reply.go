@@ -0,0 +1,254 @@
+package onion
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/limoges/p2pnet/auth"
+	"github.com/limoges/p2pnet/msg"
+)
+
+// How long a reply block may be used. It must be shorter than half of
+// SphinxKeyLifetime, so that our key outlives the reply blocks built with it.
+const ReplyBlockLifetime = 10 * time.Minute
+
+var (
+	ErrUnknownReply  = errors.New("The reply block is unknown, expired or already used")
+	ErrReplayedReply = errors.New("The reply block has already been received")
+)
+
+// replyBlock is a reply block we created: what opens the reply, and the
+// client waiting for it.
+type replyBlock struct {
+	secret  *auth.SphinxReplySecret
+	client  net.Conn
+	replyId uint32
+}
+
+// receivedReply is a reply block attached to data we received. The clients
+// the data went to may use it once.
+type receivedReply struct {
+	block    msg.OnionReplyableData
+	clients  map[net.Conn]bool
+	received time.Time
+}
+
+// handleTunnelReplyable sends the data through the tunnel with a reply block
+// leading back to the client.
+func (o *Onion) handleTunnelReplyable(source net.Conn, m *msg.OnionTunnelReplyable) error {
+
+	var tunnel *Tunnel
+	var replyable msg.OnionReplyableData
+	var err error
+
+	if tunnel, err = o.owned(m.TunnelID, source); err != nil {
+		return err
+	}
+	if replyable, err = o.createReplyBlock(source, m.ReplyId); err != nil {
+		return err
+	}
+	replyable.Data = m.Data
+
+	o.markDataSent(len(m.Data))
+	return tunnel.sendWindowed(DataStreamId, replyable)
+}
+
+// createReplyBlock builds the header of a Sphinx packet leading back to us
+// through peers picked like the hops of a tunnel. Whoever holds it learns the
+// first hop only, and each hop the next one. Nothing is kept on the path.
+func (o *Onion) createReplyBlock(client net.Conn, replyId uint32) (msg.OnionReplyableData, error) {
+
+	var replyable msg.OnionReplyableData
+	var until time.Time
+	var epoch *sphinxEpoch
+	var first string
+	var hops []auth.SphinxHop
+	var route auth.SphinxRoute
+	var block *auth.SphinxReplyBlock
+	var secret *auth.SphinxReplySecret
+	var err error
+
+	// The keys of the path must outlive the reply block.
+	until = o.clock.Now().Add(ReplyBlockLifetime)
+	if epoch, err = o.rotateSphinxKey(); err != nil {
+		return replyable, err
+	}
+	if first, hops, err = o.sphinxPath(o.ListenAddr, o.Hostkey, until); err != nil {
+		return replyable, err
+	}
+	route = auth.SphinxRoute{Deliver: true, Reply: true}
+	if _, err = io.ReadFull(lockedRandom{o}, route.Id[:]); err != nil {
+		return replyable, err
+	}
+	hops = append(hops, auth.SphinxHop{Key: epoch.key.PublicKey(), Route: route})
+
+	if block, secret, err = auth.NewSphinxReplyBlock(lockedRandom{o}, hops); err != nil {
+		return replyable, err
+	}
+	if replyable.IPAddr, replyable.Port, err = splitHostport(first); err != nil {
+		return replyable, err
+	}
+	replyable.Key = block.Key
+	replyable.Header = block.Header
+	replyable.HeaderLength = uint16(len(block.Header))
+
+	o.lock.Lock()
+	o.replyBlocks[route.Id] = &replyBlock{
+		secret:  secret,
+		client:  client,
+		replyId: replyId,
+	}
+	o.lock.Unlock()
+
+	go func() {
+		<-o.clock.After(ReplyBlockLifetime)
+		o.lock.Lock()
+		delete(o.replyBlocks, route.Id)
+		o.lock.Unlock()
+	}()
+	return replyable, nil
+}
+
+// receiveReply hands the reply delivered to us by Sphinx to the client of
+// its reply block, which is forgotten.
+func (o *Onion) receiveReply(result *auth.SphinxResult) error {
+
+	var block *replyBlock
+	var present bool
+	var data []byte
+	var err error
+
+	o.lock.Lock()
+	if block, present = o.replyBlocks[result.Route.Id]; present {
+		delete(o.replyBlocks, result.Route.Id)
+	}
+	o.lock.Unlock()
+
+	if !present {
+		return ErrUnknownReply
+	}
+	if data, err = auth.OpenSphinxReply(block.secret, result.Payload); err != nil {
+		return err
+	}
+	o.notify([]net.Conn{block.client}, msg.OnionTunnelReply{
+		ReplyId: block.replyId,
+		Data:    data,
+	}, nil)
+	return nil
+}
+
+// acceptReplyable hands the data received through the tunnel to its clients
+// along with a handle on its reply block.
+func (o *Onion) acceptReplyable(tunnel *Tunnel, m *msg.OnionReplyableData) error {
+	return o.acceptWindowed(tunnel, DataStreamId, func(done func()) error {
+		return o.deliverReplyable(tunnel, m, done)
+	})
+}
+
+// deliverReplyable keeps the reply block for the clients owning the tunnel.
+// A reply block is only received once. done is called once the clients have
+// the data.
+func (o *Onion) deliverReplyable(tunnel *Tunnel, m *msg.OnionReplyableData, done func()) error {
+
+	var now time.Time
+	var received *receivedReply
+	var message msg.OnionTunnelReplyable
+
+	now = o.clock.Now()
+	received = &receivedReply{
+		block:    *m,
+		clients:  make(map[net.Conn]bool),
+		received: now,
+	}
+	received.block.Data = nil
+
+	o.lock.Lock()
+	o.pruneReplies(now)
+	if _, seen := o.seenReplies[sha256.Sum256(m.Header)]; seen {
+		o.lock.Unlock()
+		return ErrReplayedReply
+	}
+	o.seenReplies[sha256.Sum256(m.Header)] = now
+
+	o.replyCount++
+	o.receivedReplies[o.replyCount] = received
+	message = msg.OnionTunnelReplyable{
+		TunnelID: tunnel.Id,
+		ReplyId:  o.replyCount,
+		Data:     m.Data,
+	}
+	o.lock.Unlock()
+
+	o.handOver(tunnel, func() {
+
+		var clients []net.Conn
+
+		clients = o.owners(tunnel)
+		o.lock.Lock()
+		for _, client := range clients {
+			received.clients[client] = true
+		}
+		o.lock.Unlock()
+
+		o.notify(clients, message, done)
+	})
+	return nil
+}
+
+// pruneReplies forgets the reply blocks received before they could have
+// expired. The lock must be held.
+func (o *Onion) pruneReplies(now time.Time) {
+
+	for id, seen := range o.seenReplies {
+		if now.Sub(seen) > ReplyBlockLifetime {
+			delete(o.seenReplies, id)
+		}
+	}
+	for replyId, received := range o.receivedReplies {
+		if now.Sub(received.received) > ReplyBlockLifetime {
+			delete(o.receivedReplies, replyId)
+		}
+	}
+}
+
+// handleTunnelReply sends the data as a Sphinx packet with the header of the
+// reply block, to its first hop. The reply block cannot be used again.
+func (o *Onion) handleTunnelReply(source net.Conn, m *msg.OnionTunnelReply) error {
+
+	var received *receivedReply
+	var present bool
+	var hostport string
+	var packet []byte
+	var link *Link
+	var err error
+
+	o.lock.Lock()
+	o.pruneReplies(o.clock.Now())
+	if received, present = o.receivedReplies[m.ReplyId]; present && received.clients[source] {
+		delete(o.receivedReplies, m.ReplyId)
+	}
+	o.lock.Unlock()
+
+	if !present || !received.clients[source] {
+		return ErrUnknownReply
+	}
+
+	packet, err = auth.NewSphinxReply(&auth.SphinxReplyBlock{
+		Header: received.block.Header,
+		Key:    received.block.Key,
+	}, m.Data)
+	if err != nil {
+		return err
+	}
+	hostport = net.JoinHostPort(net.IP(received.block.IPAddr[:]).String(), strconv.Itoa(int(received.block.Port)))
+	if link, err = o.link(hostport); err != nil {
+		return err
+	}
+
+	o.markDataSent(len(m.Data))
+	return link.Send(msg.OnionSphinx{Packet: packet})
+}
@@ -0,0 +1,59 @@
+package onion
+
+import (
+	"net"
+	"testing"
+
+	"github.com/limoges/p2pnet/msg"
+)
+
+// A reply block comes back to its sender as a Sphinx packet, once, and no
+// tunnel is kept for it.
+func TestReplyBlock(t *testing.T) {
+
+	var peers []*testPeer
+	var source, destination net.Conn
+	var tunnelId uint32
+	var replyable msg.OnionTunnelReplyable
+	var reply msg.OnionTunnelReply
+	var response msg.Message
+	var err error
+
+	peers = startNetwork(t, 5, startGossip(t))
+	spreadSphinxKeys(t, peers)
+	source = dialAPI(t, peers[0])
+	destination = dialAPI(t, peers[4])
+	tunnelId, _ = openTestTunnel(t, source, peers, destination)
+
+	if err = msg.Send(source, msg.OnionTunnelReplyable{TunnelID: tunnelId, ReplyId: 77, Data: []byte("ping")}); err != nil {
+		t.Fatal(err)
+	}
+	replyable = expectMessage[msg.OnionTunnelReplyable](t, destination)
+	if string(replyable.Data) != "ping" {
+		t.Fatalf("received %q", replyable.Data)
+	}
+
+	if err = msg.Send(destination, msg.OnionTunnelReply{ReplyId: replyable.ReplyId, Data: []byte("pong")}); err != nil {
+		t.Fatal(err)
+	}
+	reply = expectMessage[msg.OnionTunnelReply](t, source)
+	if reply.ReplyId != 77 || string(reply.Data) != "pong" {
+		t.Fatalf("received reply %v with %q", reply.ReplyId, reply.Data)
+	}
+
+	// The reply block is used once.
+	if response, err = msg.SendReceive(destination, msg.OnionTunnelReply{ReplyId: replyable.ReplyId, Data: []byte("again")}); err != nil {
+		t.Fatal(err)
+	}
+	if failed, valid := response.(msg.OnionError); !valid || failed.RequestType != msg.ONION_TUNNEL_REPLY || failed.TunnelID != replyable.ReplyId {
+		t.Fatalf("expected ONION_ERROR, got %v", response)
+	}
+
+	// Only the tunnel of the data was built, and the sender forgot the
+	// reply block.
+	peers[0].Onion.lock.Lock()
+	defer peers[0].Onion.lock.Unlock()
+	if len(peers[0].Onion.Tunnels) != 1 || len(peers[0].Onion.replyBlocks) != 0 {
+		t.Fatalf("%v tunnels and %v reply blocks are left", len(peers[0].Onion.Tunnels), len(peers[0].Onion.replyBlocks))
+	}
+}
@@ -0,0 +1,140 @@
+package onion
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/limoges/p2pnet"
+	"github.com/limoges/p2pnet/msg"
+)
+
+// The time the circuits of a replaced tunnel are kept, so that the traffic
+// already on its way through them still arrives.
+const RoundGracePeriod = 10 * time.Second
+
+// runRounds rebuilds our tunnels over fresh hops every RoundDuration.
+func (o *Onion) runRounds() {
+
+	var ticks <-chan time.Time
+
+	ticks = o.clock.Tick(time.Duration(o.RoundDuration) * time.Second)
+	for start := range ticks {
+		o.rotate(start)
+	}
+}
+
+// rotate replaces every tunnel we initiated before the round started. The
+// cover tunnel is simply dropped, the next cover traffic builds a new one.
+// The tunnels joined at a rendezvous point are kept.
+func (o *Onion) rotate(start time.Time) {
+
+	var tunnels []*Tunnel
+	var cover *Tunnel
+
+	o.lock.Lock()
+	for _, tunnel := range o.Tunnels {
+		if tunnel.origin != nil && tunnel.joined.Load() == nil && !tunnel.Created.After(start) {
+			tunnels = append(tunnels, tunnel)
+		}
+	}
+	cover = o.coverTunnel
+	o.coverTunnel = nil
+	o.lock.Unlock()
+
+	for _, tunnel := range tunnels {
+		if err := o.replaceTunnel(tunnel); err != nil {
+			fmt.Printf("Could not rebuild tunnel %v: %v\n", tunnel.Id, err)
+		}
+	}
+	if cover != nil {
+		o.retire(cover)
+	}
+}
+
+// replaceTunnel builds a new tunnel to the same destination over fresh hops
+// and moves the API clients over to it. The new tunnel keeps the id of the
+// one it replaces.
+func (o *Onion) replaceTunnel(tunnel *Tunnel) error {
+
+	var destination *Hop
+	var replacement *Tunnel
+	var current bool
+	var err error
+
+	if destination = tunnel.Destination(); destination == nil {
+		return nil
+	}
+
+	replacement, err = o.buildTunnel(len(tunnel.Hops)-1, destination.Hostport,
+		destination.Hostkey, msg.OnionBegin{Token: tunnel.token})
+	if err != nil {
+		return err
+	}
+
+	o.lock.Lock()
+	// The clients may have destroyed the tunnel in the meantime.
+	if current = o.Tunnels[tunnel.Id] == tunnel; current {
+		o.swapTunnel(tunnel, replacement)
+	}
+	o.lock.Unlock()
+
+	if !current {
+		return o.DestroyTunnel(replacement)
+	}
+	o.retire(tunnel)
+	return nil
+}
+
+// swapTunnel makes the replacement answer to the id and the clients of the
+// tunnel. The lock must be held.
+func (o *Onion) swapTunnel(tunnel, replacement *Tunnel) {
+
+	replacement.Id = tunnel.Id
+	replacement.token = tunnel.token
+	replacement.owners = tunnel.owners
+	replacement.incoming = tunnel.incoming
+	replacement.held = tunnel.held
+	tunnel.held = nil
+	replacement.streams = tunnel.streams
+	replacement.streamCount = tunnel.streamCount
+	tunnel.retired = true
+	o.Tunnels[tunnel.Id] = replacement
+	o.windows.Broadcast()
+}
+
+// retire tears down the tunnel once the grace period is over.
+func (o *Onion) retire(tunnel *Tunnel) {
+
+	go func() {
+		<-o.clock.After(RoundGracePeriod)
+		if err := o.DestroyTunnel(tunnel); err != nil {
+			fmt.Println(err)
+		}
+	}()
+}
+
+// continueTunnel lets the tunnel ending here replace the tunnel it was
+// rebuilt from, if any. Only a tunnel from the same initiator may be
+// replaced.
+func (o *Onion) continueTunnel(tunnel *Tunnel) bool {
+
+	var zero [msg.TunnelTokenLength]byte
+	var initiator p2pnet.Identity
+
+	if tunnel.token == zero {
+		return false
+	}
+	initiator = p2pnet.GetIdentity(tunnel.circuit.hostkey)
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for _, previous := range o.Tunnels {
+		if previous.circuit != nil && previous.token == tunnel.token &&
+			p2pnet.GetIdentity(previous.circuit.hostkey) == initiator {
+			o.swapTunnel(previous, tunnel)
+			return true
+		}
+	}
+	return false
+}
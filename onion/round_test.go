@@ -0,0 +1,74 @@
+package onion
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/limoges/p2pnet/msg"
+)
+
+// A new round rebuilds the tunnel over fresh circuits. The clients at both
+// ends keep their tunnel ids, and tearing down the old circuits disturbs
+// none of them.
+func TestRoundSwap(t *testing.T) {
+
+	var peers []*testPeer
+	var previous, current *Tunnel
+	var data msg.OnionTunnelData
+	var err error
+
+	peers = startNetwork(t, 5, "")
+	source := dialAPI(t, peers[0])
+	destination, other := dialAPI(t, peers[4]), dialAPI(t, peers[4])
+	connected(t, peers[4], 2)
+
+	// Both clients of the destination share the tunnel.
+	sourceId, destinationId := openTestTunnel(t, source, peers, destination, other)
+
+	o := peers[0].Onion
+	previous, _ = o.tunnel(sourceId)
+	o.rotate(time.Now())
+	current, _ = o.tunnel(sourceId)
+	if current == previous || !previous.retired || current.origin == previous.origin {
+		t.Fatal("the tunnel was not rebuilt")
+	}
+
+	if err = msg.Send(source, msg.OnionTunnelData{TunnelID: sourceId, Data: []byte("again")}); err != nil {
+		t.Fatal(err)
+	}
+	for _, client := range []net.Conn{destination, other} {
+		if data = expectMessage[msg.OnionTunnelData](t, client); string(data.Data) != "again" || data.TunnelID != destinationId {
+			t.Fatalf("the destination received %q on %v instead of %v", data.Data, data.TunnelID, destinationId)
+		}
+	}
+	if err = msg.Send(other, msg.OnionTunnelData{TunnelID: destinationId, Data: []byte("back")}); err != nil {
+		t.Fatal(err)
+	}
+	if data = expectMessage[msg.OnionTunnelData](t, source); string(data.Data) != "back" || data.TunnelID != sourceId {
+		t.Fatalf("the source received %q on %v instead of %v", data.Data, data.TunnelID, sourceId)
+	}
+
+	// The old circuits go away quietly.
+	if err = o.DestroyTunnel(previous); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the old circuits to be torn down", func() bool {
+		peers[4].Onion.lock.Lock()
+		defer peers[4].Onion.lock.Unlock()
+		return len(peers[4].Onion.Tunnels) == 1 && len(peers[4].Onion.circuits) == 1
+	})
+	for _, client := range []net.Conn{source, destination, other} {
+		client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if m, err := msg.Read(client); err == nil {
+			t.Fatalf("a client received %v", msg.Identifier(m.TypeId()))
+		}
+	}
+
+	if err = msg.Send(source, msg.OnionTunnelData{TunnelID: sourceId, Data: []byte("still")}); err != nil {
+		t.Fatal(err)
+	}
+	if data = expectMessage[msg.OnionTunnelData](t, destination); string(data.Data) != "still" {
+		t.Fatalf("the destination received %q", data.Data)
+	}
+}
@@ -0,0 +1,158 @@
+package onion
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/limoges/p2pnet"
+)
+
+// The parts of SOCKS5 (RFC 1928) we support: CONNECT to a domain name,
+// without authentication.
+const (
+	socksVersion            = 5
+	socksNoAuthentication   = 0
+	socksNoAcceptableMethod = 0xff
+	socksConnect            = 1
+	socksIPv4               = 1
+	socksDomainName         = 3
+)
+
+// The replies to a SOCKS request.
+const (
+	socksSucceeded           = 0
+	socksGeneralFailure      = 1
+	socksHostUnreachable     = 4
+	socksCommandNotSupported = 7
+	socksAddressNotSupported = 8
+)
+
+// listenSocks accepts the connections of SOCKS clients.
+func (f *frontend) listenSocks(ln net.Listener) {
+
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			fmt.Println(err)
+		} else {
+			go f.serveSocks(conn)
+		}
+	}
+}
+
+// serveSocks carries the connection to the peer named by the pseudo-hostname
+// of its CONNECT request. The port requested is not used: the peer forwards
+// the stream to its own service.
+func (f *frontend) serveSocks(conn net.Conn) {
+
+	var identity p2pnet.Identity
+	var reply byte
+	var stream net.Conn
+	var err error
+
+	if err = socksHandshake(conn); err != nil {
+		fmt.Println(err)
+		conn.Close()
+		return
+	}
+
+	if identity, reply, err = readSocksConnect(conn); err == nil {
+		if stream, err = f.open(identity, ""); err != nil {
+			reply = socksHostUnreachable
+		}
+	}
+	if err != nil {
+		fmt.Println(err)
+		writeSocksReply(conn, reply)
+		conn.Close()
+		return
+	}
+
+	if err = writeSocksReply(conn, socksSucceeded); err != nil {
+		fmt.Println(err)
+		conn.Close()
+		stream.Close()
+		return
+	}
+	splice(conn, stream)
+}
+
+// socksHandshake agrees on using no authentication with the client.
+func socksHandshake(conn net.Conn) error {
+
+	var header [2]byte
+	var methods []byte
+
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	if header[0] != socksVersion {
+		return errors.New(fmt.Sprintf("Unsupported SOCKS version %v", header[0]))
+	}
+	methods = make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+
+	for _, method := range methods {
+		if method == socksNoAuthentication {
+			_, err := conn.Write([]byte{socksVersion, socksNoAuthentication})
+			return err
+		}
+	}
+	conn.Write([]byte{socksVersion, socksNoAcceptableMethod})
+	return errors.New("The SOCKS client requires authentication")
+}
+
+// readSocksConnect reads the request of the client, and returns the identity
+// it names. The reply to send is returned with any error.
+func readSocksConnect(conn net.Conn) (p2pnet.Identity, byte, error) {
+
+	var header [4]byte
+	var length [1]byte
+	var hostname []byte
+	var port [2]byte
+	var identity p2pnet.Identity
+	var err error
+
+	if _, err = io.ReadFull(conn, header[:]); err != nil {
+		return identity, socksGeneralFailure, err
+	}
+	if header[0] != socksVersion {
+		return identity, socksGeneralFailure, errors.New("Invalid SOCKS request")
+	}
+	if header[1] != socksConnect {
+		return identity, socksCommandNotSupported, errors.New("Only SOCKS CONNECT is supported")
+	}
+	// Peers are only named by their pseudo-hostnames.
+	if header[3] != socksDomainName {
+		return identity, socksAddressNotSupported, errors.New("Only SOCKS domain names are supported")
+	}
+
+	if _, err = io.ReadFull(conn, length[:]); err != nil {
+		return identity, socksGeneralFailure, err
+	}
+	hostname = make([]byte, length[0])
+	if _, err = io.ReadFull(conn, hostname); err != nil {
+		return identity, socksGeneralFailure, err
+	}
+	if _, err = io.ReadFull(conn, port[:]); err != nil {
+		return identity, socksGeneralFailure, err
+	}
+
+	if identity, err = p2pnet.IdentityFromHostname(string(hostname)); err != nil {
+		return identity, socksHostUnreachable, err
+	}
+	return identity, socksSucceeded, nil
+}
+
+// writeSocksReply answers the request. No bound address is given.
+func writeSocksReply(conn net.Conn, reply byte) error {
+
+	_, err := conn.Write([]byte{socksVersion, reply, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
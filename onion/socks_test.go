@@ -0,0 +1,126 @@
+package onion
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/limoges/p2pnet"
+)
+
+// echoServer runs a service sending back whatever it receives, and returns
+// its address.
+func echoServer(t *testing.T) string {
+
+	var listener net.Listener
+	var err error
+
+	if listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// dialSocks asks the proxy to connect to the peer, and returns the
+// connection with the reply of the proxy.
+func dialSocks(t *testing.T, proxy string, identity p2pnet.Identity) (net.Conn, byte) {
+
+	var conn net.Conn
+	var hostname string
+	var request []byte
+	var response [2]byte
+	var reply [10]byte
+	var err error
+
+	if hostname, err = identity.Hostname(); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err = net.Dial("tcp", proxy); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	if _, err = conn.Write([]byte{socksVersion, 1, socksNoAuthentication}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(conn, response[:]); err != nil {
+		t.Fatal(err)
+	}
+	if response != [2]byte{socksVersion, socksNoAuthentication} {
+		t.Fatalf("unexpected method selection %v", response)
+	}
+
+	request = []byte{socksVersion, socksConnect, 0, socksDomainName, byte(len(hostname))}
+	request = append(request, hostname...)
+	request = append(request, 0, 80)
+	if _, err = conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(conn, reply[:]); err != nil {
+		t.Fatal(err)
+	}
+	return conn, reply[1]
+}
+
+// A SOCKS client reaches the service of a peer the RPS module named, through
+// a tunnel, and is refused a peer nobody knows of.
+func TestSocks(t *testing.T) {
+
+	var service, proxy string
+	var peers []*testPeer
+	var conn net.Conn
+	var reply byte
+	var echoed []byte
+	var err error
+
+	service = echoServer(t)
+	proxy = port()
+	peers = startNetworkEach(t, 5, func(i int) string {
+		switch i {
+		case 0:
+			return "socks_address = " + proxy
+		case 4:
+			return "service_address = " + service
+		}
+		return ""
+	})
+
+	if _, reply = dialSocks(t, proxy, p2pnet.GetIdentity([]byte("unknown"))); reply != socksHostUnreachable {
+		t.Fatalf("expected host unreachable, got reply %v", reply)
+	}
+
+	peers[0].Onion.storeKnownPeer(peers[4].peer())
+	if conn, reply = dialSocks(t, proxy, p2pnet.GetIdentity(peers[4].Onion.Hostkey)); reply != socksSucceeded {
+		t.Fatalf("expected success, got reply %v", reply)
+	}
+	for i := 0; i < 3; i++ {
+		data := numbered(i, 10000)
+		if _, err = conn.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		echoed = make([]byte, len(data))
+		if _, err = io.ReadFull(conn, echoed); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, echoed) {
+			t.Fatalf("the service echoed other data")
+		}
+	}
+}
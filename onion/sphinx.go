@@ -0,0 +1,359 @@
+package onion
+
+import (
+	"crypto/ecdh"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/limoges/p2pnet"
+	"github.com/limoges/p2pnet/auth"
+	"github.com/limoges/p2pnet/msg"
+)
+
+const (
+	// How long each of our Sphinx keys is used. A new key is announced once
+	// the newest is halfway through its lifetime.
+	SphinxKeyLifetime = time.Hour
+	// How often we announce our Sphinx key.
+	SphinxKeyRefresh = 10 * time.Minute
+)
+
+var (
+	ErrUnknownSphinxKey = errors.New("No Sphinx key is known for the peer")
+	ErrExpiredSphinxKey = errors.New("The Sphinx key of the peer has expired")
+	ErrReplayedSphinx   = errors.New("The Sphinx packet has already been processed")
+)
+
+// sphinxEpoch is one of our Sphinx keys, and the tags of the packets it
+// processed. Once the key expires, no packet is processed with it anymore and
+// its tags are dropped with it.
+type sphinxEpoch struct {
+	key     *ecdh.PrivateKey
+	expires time.Time
+	tags    map[[sha256.Size]byte]bool
+}
+
+// runSphinx rotates our Sphinx key and announces it through gossip every
+// SphinxKeyRefresh.
+func (o *Onion) runSphinx() {
+
+	var wait time.Duration
+
+	for {
+		wait = SphinxKeyRefresh
+		if err := o.publishSphinxKey(); err != nil {
+			fmt.Printf("Could not announce our Sphinx key: %v\n", err)
+			wait = DescriptorRetry
+		}
+		<-o.clock.After(wait)
+	}
+}
+
+// rotateSphinxKey forgets our Sphinx keys which expired, and picks a new key
+// once the newest is halfway through its lifetime. It returns the newest key.
+func (o *Onion) rotateSphinxKey() (*sphinxEpoch, error) {
+
+	var now time.Time
+	var live []*sphinxEpoch
+	var epoch *sphinxEpoch
+	var key *ecdh.PrivateKey
+	var err error
+
+	now = o.clock.Now()
+
+	o.lock.Lock()
+	for _, existing := range o.sphinxEpochs {
+		if existing.expires.After(now) {
+			live = append(live, existing)
+		}
+	}
+	o.sphinxEpochs = live
+	if len(live) > 0 && live[len(live)-1].expires.Sub(now) > SphinxKeyLifetime/2 {
+		epoch = live[len(live)-1]
+	}
+	o.lock.Unlock()
+
+	if epoch != nil {
+		return epoch, nil
+	}
+
+	if key, err = ecdh.X25519().GenerateKey(lockedRandom{o}); err != nil {
+		return nil, err
+	}
+	epoch = &sphinxEpoch{
+		key:     key,
+		expires: now.Add(SphinxKeyLifetime),
+		tags:    make(map[[sha256.Size]byte]bool),
+	}
+
+	o.lock.Lock()
+	o.sphinxEpochs = append(o.sphinxEpochs, epoch)
+	o.lock.Unlock()
+	return epoch, nil
+}
+
+// publishSphinxKey announces our newest Sphinx key through gossip. Peers use
+// the newest key they know, so the older ones only process the packets
+// already on their way.
+func (o *Onion) publishSphinxKey() error {
+
+	var key msg.SphinxKey
+	var err error
+
+	if key, err = o.sphinxAnnouncement(); err != nil {
+		return err
+	}
+	if err = o.storeSphinxKey(key.Bytes()); err != nil {
+		return err
+	}
+
+	return forwardTo(o.GossipAddr, msg.GossipAnnounce{
+		DataType: msg.ONION_SPHINX_KEY,
+		Data:     key.Bytes(),
+	})
+}
+
+// sphinxAnnouncement signs our newest Sphinx key, rotating it first if
+// needed.
+func (o *Onion) sphinxAnnouncement() (msg.SphinxKey, error) {
+
+	var epoch *sphinxEpoch
+	var key msg.SphinxKey
+	var err error
+
+	if epoch, err = o.rotateSphinxKey(); err != nil {
+		return key, err
+	}
+
+	key = msg.SphinxKey{
+		Expires: uint64(epoch.expires.Unix()),
+		Hostkey: o.Hostkey,
+	}
+	copy(key.Key[:], epoch.key.PublicKey().Bytes())
+	key.Signature, err = o.sign(key.SignedContent())
+	return key, err
+}
+
+// storeSphinxKey keeps the Sphinx key if it is signed by its peer and newer
+// than the one we know.
+func (o *Onion) storeSphinxKey(data []byte) error {
+
+	var key msg.SphinxKey
+	var identity p2pnet.Identity
+	var err error
+
+	if key, err = msg.NewSphinxKey(data); err != nil {
+		return err
+	}
+	if err = verify(key.Hostkey, key.SignedContent(), key.Signature); err != nil {
+		return err
+	}
+	if time.Unix(int64(key.Expires), 0).Before(o.clock.Now()) {
+		return ErrExpiredSphinxKey
+	}
+	if _, err = ecdh.X25519().NewPublicKey(key.Key[:]); err != nil {
+		return err
+	}
+
+	identity = p2pnet.GetIdentity(key.Hostkey)
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if known, present := o.sphinxKeys[identity]; !present || known.Expires < key.Expires {
+		o.sphinxKeys[identity] = key
+	}
+	return nil
+}
+
+// sphinxKeyOf returns the Sphinx key of the peer with the hostkey, unless it
+// expires before until.
+func (o *Onion) sphinxKeyOf(hostkey []byte, until time.Time) (*ecdh.PublicKey, error) {
+
+	var identity p2pnet.Identity
+	var key msg.SphinxKey
+	var present bool
+
+	identity = p2pnet.GetIdentity(hostkey)
+
+	o.lock.Lock()
+	key, present = o.sphinxKeys[identity]
+	if present && time.Unix(int64(key.Expires), 0).Before(o.clock.Now()) {
+		delete(o.sphinxKeys, identity)
+		o.lock.Unlock()
+		return nil, ErrExpiredSphinxKey
+	}
+	o.lock.Unlock()
+
+	if !present {
+		return nil, ErrUnknownSphinxKey
+	}
+	if time.Unix(int64(key.Expires), 0).Before(until) {
+		return nil, ErrExpiredSphinxKey
+	}
+	return ecdh.X25519().NewPublicKey(key.Key[:])
+}
+
+// sphinxPath picks HopCount peers to the peer at the hostport with the
+// hostkey like the hops of a tunnel, and returns the address of the first
+// one with their hops, each relaying to the next and the last to the peer.
+// Their keys must last until the given time.
+func (o *Onion) sphinxPath(hostport string, hostkey []byte, until time.Time) (string, []auth.SphinxHop, error) {
+
+	var hopCount int
+	var peers []p2pnet.Peer
+	var hops []auth.SphinxHop
+	var next string
+	var err error
+
+	hopCount = o.HopCount
+	if hopCount < o.MinimalHopCount {
+		hopCount = o.MinimalHopCount
+	}
+	if hopCount >= auth.SphinxMaxHops {
+		hopCount = auth.SphinxMaxHops - 1
+	}
+	if peers, err = o.selectPath(hopCount, hostport, hostkey); err != nil {
+		return "", nil, err
+	}
+	if len(peers) == 0 {
+		return hostport, nil, nil
+	}
+
+	hops = make([]auth.SphinxHop, len(peers))
+	for i, peer := range peers {
+		if hops[i].Key, err = o.sphinxKeyOf(peer.Hostkey, until); err != nil {
+			return "", nil, err
+		}
+		next = hostport
+		if i < len(peers)-1 {
+			next = peerHostport(peers[i+1])
+		}
+		if hops[i].Route.IPAddr, hops[i].Route.Port, err = splitHostport(next); err != nil {
+			return "", nil, err
+		}
+	}
+	return peerHostport(peers[0]), hops, nil
+}
+
+// handleSphinxSend sends the data as a Sphinx packet to the peer, through
+// HopCount peers picked like the hops of a tunnel.
+func (o *Onion) handleSphinxSend(source net.Conn, m *msg.OnionSphinxSend) error {
+
+	var hostport, first string
+	var hops []auth.SphinxHop
+	var key *ecdh.PublicKey
+	var packet []byte
+	var link *Link
+	var err error
+
+	hostport = net.JoinHostPort(net.IP(m.IPAddr[:]).String(), strconv.Itoa(int(m.Port)))
+	if key, err = o.sphinxKeyOf(m.Hostkey, o.clock.Now()); err != nil {
+		return err
+	}
+	if first, hops, err = o.sphinxPath(hostport, m.Hostkey, o.clock.Now()); err != nil {
+		return err
+	}
+	hops = append(hops, auth.SphinxHop{Key: key, Route: auth.SphinxRoute{Deliver: true}})
+
+	if packet, err = auth.NewSphinxPacket(lockedRandom{o}, hops, m.Data); err != nil {
+		return err
+	}
+	if link, err = o.link(first); err != nil {
+		return err
+	}
+
+	o.markDataSent(len(m.Data))
+	return link.Send(msg.OnionSphinx{Packet: packet})
+}
+
+// handleSphinxSubscribe hands the client the Sphinx packets delivered to us
+// from now on.
+func (o *Onion) handleSphinxSubscribe(source net.Conn) error {
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.sphinxClients[source] = true
+	return nil
+}
+
+// handleSphinx removes our layer of the Sphinx packet, and relays it to the
+// next hop, delivers it to the subscribed API clients, or hands the reply to
+// the client of its reply block.
+func (o *Onion) handleSphinx(source *Link, m *msg.OnionSphinx) error {
+
+	var result *auth.SphinxResult
+	var clients []net.Conn
+	var hostport string
+	var link *Link
+	var err error
+
+	if result, err = o.processSphinx(m.Packet); err != nil {
+		return err
+	}
+
+	if result.Route.Reply {
+		return o.receiveReply(result)
+	}
+	if result.Route.Deliver {
+		o.lock.Lock()
+		for client := range o.sphinxClients {
+			clients = append(clients, client)
+		}
+		o.lock.Unlock()
+
+		o.notify(clients, msg.OnionSphinxReceived{Data: result.Data}, nil)
+		return nil
+	}
+
+	hostport = net.JoinHostPort(net.IP(result.Route.IPAddr[:]).String(), strconv.Itoa(int(result.Route.Port)))
+	if link, err = o.link(hostport); err != nil {
+		return err
+	}
+	return link.Send(msg.OnionSphinx{Packet: result.Packet})
+}
+
+// processSphinx removes our layer of the packet with the key it was built
+// for, unless that key has expired or already processed the packet.
+func (o *Onion) processSphinx(packet []byte) (*auth.SphinxResult, error) {
+
+	var now time.Time
+	var epochs []*sphinxEpoch
+	var result *auth.SphinxResult
+	var err error
+
+	now = o.clock.Now()
+
+	o.lock.Lock()
+	epochs = append(epochs, o.sphinxEpochs...)
+	o.lock.Unlock()
+
+	// The header only checks with the right key.
+	err = auth.ErrSphinxTampered
+	for i := len(epochs) - 1; i >= 0; i-- {
+		if !epochs[i].expires.After(now) {
+			continue
+		}
+		if result, err = auth.ProcessSphinxPacket(epochs[i].key, packet); err == auth.ErrSphinxTampered {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		o.lock.Lock()
+		defer o.lock.Unlock()
+
+		if epochs[i].tags[result.Tag] {
+			return nil, ErrReplayedSphinx
+		}
+		epochs[i].tags[result.Tag] = true
+		return result, nil
+	}
+	return nil, err
+}
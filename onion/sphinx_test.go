@@ -0,0 +1,203 @@
+package onion
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/limoges/p2pnet"
+	"github.com/limoges/p2pnet/auth"
+	"github.com/limoges/p2pnet/cfg"
+	"github.com/limoges/p2pnet/msg"
+)
+
+// newSphinxOnion creates a module which is not run.
+func newSphinxOnion(t *testing.T, clock p2pnet.Clock) *Onion {
+
+	var dir, hostkey, path string
+	var conf *cfg.Configurations
+	var o *Onion
+	var err error
+
+	dir = t.TempDir()
+	if hostkey, err = filepath.Abs(filepath.Join("..", "main", "keys", "peer0.pem")); err != nil {
+		t.Fatal(err)
+	}
+	path = filepath.Join(dir, "peer.ini")
+	if err = os.WriteFile(path, []byte("HOSTKEY = "+hostkey+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if conf, err = cfg.New(path); err != nil {
+		t.Fatal(err)
+	}
+	if o, err = NewWithSources(conf, p2pnet.Sources{Random: rand.Reader, Clock: clock}); err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+// sphinxPacketFor builds a packet delivered by the single hop with the key.
+func sphinxPacketFor(t *testing.T, epoch *sphinxEpoch) []byte {
+
+	var packet []byte
+	var err error
+
+	packet, err = auth.NewSphinxPacket(rand.Reader, []auth.SphinxHop{{
+		Key:   epoch.key.PublicKey(),
+		Route: auth.SphinxRoute{Deliver: true},
+	}}, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packet
+}
+
+// Our Sphinx key is replaced halfway through its lifetime, and the packets
+// still on their way for the previous one are processed until it expires.
+// The tags of a key's packets go with it.
+func TestSphinxKeyRotation(t *testing.T) {
+
+	var clock *p2pnet.FixedClock
+	var o *Onion
+	var first, second *sphinxEpoch
+	var announced msg.SphinxKey
+	var replayed, late []byte
+	var err error
+
+	clock = &p2pnet.FixedClock{Time: time.Unix(1700000000, 0)}
+	o = newSphinxOnion(t, clock)
+
+	if announced, err = o.sphinxAnnouncement(); err != nil {
+		t.Fatal(err)
+	}
+	if len(o.sphinxEpochs) != 1 {
+		t.Fatalf("%v keys instead of 1", len(o.sphinxEpochs))
+	}
+	first = o.sphinxEpochs[0]
+	if announced.Expires != uint64(clock.Time.Add(SphinxKeyLifetime).Unix()) {
+		t.Fatalf("the key is announced until %v", time.Unix(int64(announced.Expires), 0))
+	}
+
+	replayed = sphinxPacketFor(t, first)
+	late = sphinxPacketFor(t, first)
+	if _, err = o.processSphinx(replayed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = o.processSphinx(replayed); err != ErrReplayedSphinx {
+		t.Fatalf("expected %v, got %v", ErrReplayedSphinx, err)
+	}
+
+	// Until halfway through its lifetime, the key is kept.
+	clock.Time = clock.Time.Add(SphinxKeyLifetime/2 - time.Second)
+	if announced, err = o.sphinxAnnouncement(); err != nil {
+		t.Fatal(err)
+	}
+	if len(o.sphinxEpochs) != 1 {
+		t.Fatalf("the key was replaced early")
+	}
+
+	clock.Time = clock.Time.Add(2 * time.Second)
+	if announced, err = o.sphinxAnnouncement(); err != nil {
+		t.Fatal(err)
+	}
+	if len(o.sphinxEpochs) != 2 {
+		t.Fatalf("%v keys instead of 2", len(o.sphinxEpochs))
+	}
+	second = o.sphinxEpochs[1]
+	if string(announced.Key[:]) != string(second.key.PublicKey().Bytes()) {
+		t.Fatal("the new key is not announced")
+	}
+
+	// Both keys process packets, and the replays are still refused.
+	if _, err = o.processSphinx(sphinxPacketFor(t, second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = o.processSphinx(replayed); err != ErrReplayedSphinx {
+		t.Fatalf("expected %v, got %v", ErrReplayedSphinx, err)
+	}
+
+	// Once the first key has expired, it and its tags are gone.
+	clock.Time = first.expires
+	if _, err = o.processSphinx(late); err != auth.ErrSphinxTampered {
+		t.Fatalf("expected %v, got %v", auth.ErrSphinxTampered, err)
+	}
+	if _, err = o.rotateSphinxKey(); err != nil {
+		t.Fatal(err)
+	}
+	if len(o.sphinxEpochs) != 1 || o.sphinxEpochs[0] != second {
+		t.Fatalf("the expired key was kept")
+	}
+
+	// However long we run, at most two keys are kept.
+	for i := 0; i < 10; i++ {
+		clock.Time = clock.Time.Add(SphinxKeyRefresh)
+		if _, err = o.sphinxAnnouncement(); err != nil {
+			t.Fatal(err)
+		}
+		if len(o.sphinxEpochs) > 2 {
+			t.Fatalf("%v keys are kept", len(o.sphinxEpochs))
+		}
+	}
+}
+
+// spreadSphinxKeys waits until every peer knows the Sphinx keys of all the
+// others, which they announce through the gossip module when they start.
+func spreadSphinxKeys(t *testing.T, peers []*testPeer) {
+
+	for _, peer := range peers {
+		waitFor(t, "the Sphinx keys to spread to "+peer.Onion.ListenAddr, func() bool {
+			peer.Onion.lock.Lock()
+			defer peer.Onion.lock.Unlock()
+			return len(peer.Onion.sphinxKeys) >= len(peers)-1
+		})
+	}
+}
+
+// A Sphinx packet crosses the network to the clients of the destination
+// which subscribed, and to no other.
+func TestSphinxSubscribers(t *testing.T) {
+
+	var peers []*testPeer
+	var source, subscriber, bystander net.Conn
+	var build *msg.OnionTunnelBuild
+	var send msg.OnionSphinxSend
+	var received msg.OnionSphinxReceived
+	var err error
+
+	peers = startNetwork(t, 5, startGossip(t))
+	spreadSphinxKeys(t, peers)
+	source = dialAPI(t, peers[0])
+	subscriber = dialAPI(t, peers[4])
+	bystander = dialAPI(t, peers[4])
+
+	if err = msg.Send(subscriber, msg.OnionSphinxSubscribe{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	build = buildMsg(peers[4])
+	send = msg.OnionSphinxSend{
+		Port:          build.Port,
+		HostkeyLength: uint16(len(build.DstHostkey)),
+		Hostkey:       build.DstHostkey,
+		Data:          []byte("hello"),
+	}
+	copy(send.IPAddr[:], build.IPAddr)
+	if err = msg.Send(source, send); err != nil {
+		t.Fatal(err)
+	}
+
+	received = expectMessage[msg.OnionSphinxReceived](t, subscriber)
+	if string(received.Data) != "hello" {
+		t.Fatalf("received %q", received.Data)
+	}
+
+	bystander.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if message, err := msg.Read(bystander); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("the client which did not subscribe got %v, %v", message, err)
+	}
+}
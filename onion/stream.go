@@ -0,0 +1,245 @@
+package onion
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+
+	"github.com/limoges/p2pnet/msg"
+)
+
+// Stream is one of the conversations multiplexed inside a tunnel. Streams
+// opened by the initiator of the tunnel have odd ids, those opened by the
+// other end even ones. DataStreamId is never used for them.
+type Stream struct {
+	Id uint16
+
+	// The API clients the data of the stream is delivered to.
+	clients map[net.Conn]bool
+	window  window
+}
+
+func newStream(id uint16) *Stream {
+	return &Stream{
+		Id:      id,
+		clients: make(map[net.Conn]bool),
+		window:  newWindow(StreamWindowStart, StreamWindowIncrement),
+	}
+}
+
+// handleStreamOpen opens a stream in the tunnel for the client.
+func (o *Onion) handleStreamOpen(source net.Conn, m *msg.OnionStreamOpen) error {
+
+	var tunnel *Tunnel
+	var stream *Stream
+	var err error
+
+	if tunnel, err = o.owned(m.TunnelID, source); err != nil {
+		return err
+	}
+
+	if stream, err = o.openStream(tunnel, source); err != nil {
+		return err
+	}
+	if err = tunnel.Send(msg.OnionOpen{StreamId: stream.Id, Service: m.Service}); err != nil {
+		o.removeStream(tunnel, stream.Id)
+		return err
+	}
+
+	return msg.Send(source, msg.OnionStreamReady{
+		TunnelID: m.TunnelID,
+		StreamID: stream.Id,
+	})
+}
+
+func (o *Onion) handleStreamData(source net.Conn, m *msg.OnionStreamData) error {
+
+	var tunnel *Tunnel
+	var err error
+
+	if tunnel, err = o.owned(m.TunnelID, source); err != nil {
+		return err
+	}
+	o.markDataSent(len(m.Data))
+	return tunnel.sendWindowed(m.StreamID, msg.OnionSegment{
+		StreamId: m.StreamID,
+		Data:     m.Data,
+	})
+}
+
+func (o *Onion) handleStreamClose(source net.Conn, m *msg.OnionStreamClose) error {
+
+	var tunnel *Tunnel
+	var err error
+
+	if tunnel, err = o.owned(m.TunnelID, source); err != nil {
+		return err
+	}
+	if o.removeStream(tunnel, m.StreamID) == nil {
+		return ErrUnknownStream
+	}
+	return tunnel.Send(msg.OnionClose{StreamId: m.StreamID})
+}
+
+// receiveStream handles the stream messages the other end of the tunnel
+// sent.
+func (o *Onion) receiveStream(tunnel *Tunnel, message msg.Message) error {
+
+	switch message.(type) {
+	case msg.OnionOpen:
+		m := message.(msg.OnionOpen)
+		return o.acceptStream(tunnel, m.StreamId, m.Service)
+	case msg.OnionSegment:
+		m := message.(msg.OnionSegment)
+		return o.acceptWindowed(tunnel, m.StreamId, func(done func()) error {
+			return o.deliverSegment(tunnel, &m, done)
+		})
+	case msg.OnionClose:
+		m := message.(msg.OnionClose)
+		return o.closeStream(tunnel, m.StreamId)
+	case msg.OnionSendme:
+		m := message.(msg.OnionSendme)
+		return o.receiveSendme(tunnel, &m)
+	default:
+		return o.handleUnknown(nil, message)
+	}
+}
+
+// openStream gives the client a new stream in the tunnel.
+func (o *Onion) openStream(tunnel *Tunnel, client net.Conn) (*Stream, error) {
+
+	var id uint16
+	var inUse bool
+	var stream *Stream
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for count := 0; count < math.MaxUint16/2; count++ {
+		tunnel.streamCount = tunnel.streamCount + 1
+		id = 2 * tunnel.streamCount
+		if tunnel.initiated() {
+			id = id + 1
+		}
+		if _, inUse = tunnel.streams[id]; !inUse && id != DataStreamId {
+			stream = newStream(id)
+			stream.clients[client] = true
+			tunnel.streams[id] = stream
+			return stream, nil
+		}
+	}
+	return nil, errors.New("No stream id is left in the tunnel")
+}
+
+// acceptStream opens the stream the other end asked for, and lets the
+// clients of the tunnel know about it and the service it is for.
+func (o *Onion) acceptStream(tunnel *Tunnel, id uint16, service []byte) error {
+
+	var stream *Stream
+	var present bool
+
+	// The ids of the other end have the other parity.
+	if (id%2 == 1) == tunnel.initiated() || id == DataStreamId {
+		return errors.New(fmt.Sprintf("Invalid stream id %v", id))
+	}
+
+	o.lock.Lock()
+	if _, present = tunnel.streams[id]; present {
+		o.lock.Unlock()
+		return errors.New(fmt.Sprintf("Stream %v is already open", id))
+	}
+	stream = newStream(id)
+	tunnel.streams[id] = stream
+	o.lock.Unlock()
+
+	o.handOver(tunnel, func() {
+
+		var clients []net.Conn
+
+		clients = o.owners(tunnel)
+		o.lock.Lock()
+		for _, client := range clients {
+			stream.clients[client] = true
+		}
+		o.lock.Unlock()
+
+		o.notify(clients, msg.OnionStreamIncoming{
+			TunnelID: tunnel.Id,
+			StreamID: id,
+			Service:  service,
+		}, nil)
+	})
+	return nil
+}
+
+// deliverSegment queues the data of the stream for its clients. done is
+// called once they all have it.
+func (o *Onion) deliverSegment(tunnel *Tunnel, m *msg.OnionSegment, done func()) error {
+
+	var stream *Stream
+
+	o.lock.Lock()
+	stream = tunnel.streams[m.StreamId]
+	o.lock.Unlock()
+
+	o.handOver(tunnel, func() {
+		o.notify(o.streamClients(stream), msg.OnionStreamData{
+			TunnelID: tunnel.Id,
+			StreamID: m.StreamId,
+			Data:     m.Data,
+		}, done)
+	})
+	return nil
+}
+
+// streamClients returns the API clients of the stream, if any.
+func (o *Onion) streamClients(stream *Stream) []net.Conn {
+
+	var clients []net.Conn
+
+	if stream == nil {
+		return nil
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for client := range stream.clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// closeStream forgets the stream the other end closed and tells its clients.
+func (o *Onion) closeStream(tunnel *Tunnel, id uint16) error {
+
+	var stream *Stream
+
+	if stream = o.removeStream(tunnel, id); stream == nil {
+		return ErrUnknownStream
+	}
+
+	// The data already queued for the clients comes first.
+	o.handOver(tunnel, func() {
+		o.notify(o.streamClients(stream), msg.OnionStreamClose{
+			TunnelID: tunnel.Id,
+			StreamID: id,
+		}, nil)
+	})
+	return nil
+}
+
+// removeStream forgets the stream and returns it, if it was open.
+func (o *Onion) removeStream(tunnel *Tunnel, id uint16) *Stream {
+
+	var stream *Stream
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	stream = tunnel.streams[id]
+	delete(tunnel.streams, id)
+	o.windows.Broadcast()
+	return stream
+}
@@ -0,0 +1,149 @@
+package onion
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/limoges/p2pnet/sdk"
+)
+
+func dialSDK(t *testing.T, peer *testPeer) *sdk.Client {
+
+	var client *sdk.Client
+	var err error
+
+	if client, err = sdk.Dial(peer.Onion.APIAddr); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// Several streams share a tunnel, each with its own data, and either end
+// may open them.
+func TestStreams(t *testing.T) {
+
+	var peers []*testPeer
+	var source, destination *sdk.Client
+	var tunnelId uint32
+	var done chan error
+	var err error
+
+	peers = startNetwork(t, 5, "")
+	source = dialSDK(t, peers[0])
+	destination = dialSDK(t, peers[4])
+	connected(t, peers[4], 1)
+
+	if tunnelId, err = source.Build(peers[4].Onion.ListenAddr, peers[4].Onion.Hostkey); err != nil {
+		t.Fatal(err)
+	}
+
+	// The destination echoes the streams it accepts.
+	go func() {
+		for {
+			stream, err := destination.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(stream, stream)
+				stream.Close()
+			}()
+		}
+	}()
+
+	done = make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			done <- echo(source, tunnelId, bytes.Repeat([]byte{byte('a' + i)}, 20000))
+		}(i)
+	}
+	for i := 0; i < 3; i++ {
+		if err = <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err = source.Open(tunnelId + 1); err == nil {
+		t.Fatal("opened a stream on an unknown tunnel")
+	}
+}
+
+// echo sends the payload on a new stream, and checks it comes back.
+func echo(client *sdk.Client, tunnelId uint32, payload []byte) error {
+
+	var stream *sdk.Stream
+	var received []byte
+	var err error
+
+	if stream, err = client.Open(tunnelId); err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	go stream.Write(payload)
+	received = make([]byte, len(payload))
+	stream.SetReadDeadline(time.Now().Add(30 * time.Second))
+	if _, err = io.ReadFull(stream, received); err != nil {
+		return err
+	}
+	if !bytes.Equal(received, payload) {
+		return fmt.Errorf("stream %v echoed other data", stream.RemoteAddr())
+	}
+	return nil
+}
+
+// The destination opens a stream back to the initiator, whose data ends when
+// the destination closes it.
+func TestStreamFromDestination(t *testing.T) {
+
+	var peers []*testPeer
+	var source, destination *sdk.Client
+	var tunnelId, remoteId uint32
+	var outgoing, incoming *sdk.Stream
+	var data []byte
+	var err error
+
+	peers = startNetwork(t, 5, "")
+	source = dialSDK(t, peers[0])
+	destination = dialSDK(t, peers[4])
+	connected(t, peers[4], 1)
+
+	if tunnelId, err = source.Build(peers[4].Onion.ListenAddr, peers[4].Onion.Hostkey); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the tunnel at the destination", func() bool {
+		peers[4].Onion.lock.Lock()
+		defer peers[4].Onion.lock.Unlock()
+		for id := range peers[4].Onion.Tunnels {
+			remoteId = id
+		}
+		return remoteId != 0
+	})
+
+	if outgoing, err = destination.Open(remoteId); err != nil {
+		t.Fatal(err)
+	}
+	if incoming, err = source.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	if incoming.TunnelId() != tunnelId {
+		t.Fatalf("the stream arrived on %v instead of %v", incoming.TunnelId(), tunnelId)
+	}
+
+	if _, err = outgoing.Write([]byte("back")); err != nil {
+		t.Fatal(err)
+	}
+	outgoing.Close()
+	incoming.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if data, err = io.ReadAll(incoming); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "back" {
+		t.Fatalf("read %q", data)
+	}
+}
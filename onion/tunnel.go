@@ -2,19 +2,74 @@ package onion
 
 import (
 	"bytes"
+	"crypto/ecdh"
+	"encoding/binary"
 	"errors"
 	"fmt"
-	"math/rand"
+	"io"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/limoges/p2pnet"
 	"github.com/limoges/p2pnet/msg"
 )
 
+// Hop is a peer of the tunnel with which a session has been established.
+// TunnelId identifies the tunnel on the link leading to the hop.
+type Hop struct {
+	Hostport  string
+	Hostkey   []byte
+	SessionId uint32
+	TunnelId  uint32
+}
+
 type Tunnel struct {
-	Id    uint32
-	onion *Onion
+	Id      uint32
+	Hops    []*Hop
+	Created time.Time
+	State   TunnelState
+	onion   *Onion
+
+	// The link to the first hop.
+	link *Link
+	// The circuit of a tunnel initiated by us.
+	origin *Circuit
+	// The circuit of a tunnel initiated by another peer and ending here.
+	circuit *Circuit
+	// The API connections owning the tunnel. The tunnel is torn down once
+	// the last of them destroys it or disconnects.
+	owners map[net.Conn]bool
+	// Whether the tunnel was brought to us. API clients own it by
+	// subscribing to it, and what it delivers until the first of them does
+	// is held back for it.
+	incoming bool
+	held     []func()
+	// Whether the deliveries held back are being handed over.
+	flushing bool
+	// Identifies the tunnel to its last hop across rounds.
+	token [msg.TunnelTokenLength]byte
+	// Whether the tunnel has been replaced in a new round.
+	retired bool
+	// Whether the tunnel has been torn down.
+	closed bool
+	// When traffic last came through the tunnel.
+	heard time.Time
+	// The end-to-end layer of a tunnel joined to a hidden service's, or to a
+	// client's, at a rendezvous point.
+	joined atomic.Pointer[rendezvous]
+	// Our half of the key exchange and the cookie of a rendezvous in
+	// progress.
+	joining *ecdh.PrivateKey
+	cookie  [msg.RendezvousCookieLength]byte
+
+	circuitWindow window
+	streamWindow  window
+
+	// The streams multiplexed in the tunnel, and the number of streams we
+	// opened.
+	streams     map[uint16]*Stream
+	streamCount uint16
 }
 
 func NewTunnel(o *Onion) (*Tunnel, error) {
@@ -27,29 +82,194 @@ func NewTunnel(o *Onion) (*Tunnel, error) {
 		return nil, err
 	}
 	tunnel.onion = o
+	tunnel.Created = o.clock.Now()
+	tunnel.heard = tunnel.Created
+	tunnel.owners = make(map[net.Conn]bool)
+	tunnel.circuitWindow = newWindow(CircuitWindowStart, CircuitWindowIncrement)
+	tunnel.streamWindow = newWindow(StreamWindowStart, StreamWindowIncrement)
+	tunnel.streams = make(map[uint16]*Stream)
 
 	return tunnel, nil
 }
 
+// AddLink extends the tunnel to the peer. The first hop is reached directly.
+// The following ones are reached by the current last hop, so that only the
+// first hop learns who initiated the tunnel.
 func (t *Tunnel) AddLink(hostport string, hostkey []byte) error {
 
+	var hop *Hop
+	var exchange handshakeExchange
 	var err error
 
 	t.onion.storeIdentity(hostport, hostkey)
 
-	if err = t.onion.buildSession(hostport, hostkey); err != nil {
+	hop = &Hop{
+		Hostport: hostport,
+		Hostkey:  hostkey,
+	}
+
+	if len(t.Hops) == 0 {
+		if err = t.connect(hop); err != nil {
+			return err
+		}
+		exchange = func(handshake1 []byte) ([]byte, error) {
+			return t.onion.create(t.link, hop.TunnelId, handshake1)
+		}
+	} else {
+		exchange = func(handshake1 []byte) ([]byte, error) {
+			return t.extend(hop, handshake1)
+		}
+	}
+
+	if hop.SessionId, err = t.onion.buildSession(hop.Hostkey, exchange); err != nil {
 		return err
 	}
 
+	t.Hops = append(t.Hops, hop)
 	return nil
 }
 
+// connect opens the link to the first hop, on which the tunnel's traffic
+// comes back to us.
+func (t *Tunnel) connect(first *Hop) error {
+
+	var err error
+
+	if t.link, err = t.onion.link(first.Hostport); err != nil {
+		return err
+	}
+	if first.TunnelId, err = t.onion.unusedCircuitId(t.link); err != nil {
+		return err
+	}
+
+	t.origin = &Circuit{
+		Next:   t.link,
+		NextId: first.TunnelId,
+		tunnel: t,
+	}
+	return t.onion.storeCircuit(t.origin)
+}
+
+// extend asks the last hop of the tunnel to relay the handshake to the new
+// hop, and waits for the new hop's answer.
+func (t *Tunnel) extend(hop *Hop, handshake1 []byte) ([]byte, error) {
+
+	var extend msg.OnionExtend
+	var key circuitKey
+	var responses chan msg.Message
+	var response msg.Message
+	var extended msg.OnionExtended
+	var valid bool
+	var err error
+
+	extend = msg.OnionExtend{Payload: handshake1}
+	if extend.IPAddr, extend.Port, err = splitHostport(hop.Hostport); err != nil {
+		return nil, err
+	}
+
+	key = circuitKey{t.link, t.Hops[0].TunnelId}
+	responses = t.onion.await(key)
+
+	if err = t.Send(extend); err != nil {
+		t.onion.cancel(key)
+		return nil, err
+	}
+
+	if response, err = t.onion.wait(key, responses); err != nil {
+		return nil, err
+	}
+	if extended, valid = response.(msg.OnionExtended); !valid {
+		return nil, errors.New("Invalid response expected OnionExtended")
+	}
+	return extended.Payload, nil
+}
+
+// Send wraps the message in a layer for each hop and sends it through the
+// tunnel. When the tunnel ends here, the message goes back to its initiator.
+// Past a rendezvous point, the message is sealed for the other end.
+func (t *Tunnel) Send(message msg.Message) error {
+
+	var joined *rendezvous
+	var err error
+
+	if joined = t.joined.Load(); joined != nil {
+		if message, err = joined.seal(lockedRandom{t.onion}, message); err != nil {
+			return err
+		}
+	}
+	return t.sendPlain(message)
+}
+
+// sendPlain sends the message through the tunnel without sealing it.
+func (t *Tunnel) sendPlain(message msg.Message) error {
+
+	var buf *bytes.Buffer
+	var payload []byte
+	var err error
+
+	if t.circuit != nil {
+		return t.onion.sendBackward(t.circuit, message)
+	}
+
+	buf = new(bytes.Buffer)
+	if err = msg.Write(buf, message); err != nil {
+		return err
+	}
+
+	if payload, err = t.onion.encryptLayers(t.sessionIds(), buf.Bytes()); err != nil {
+		return err
+	}
+
+	return t.link.Send(msg.OnionRelay{
+		TunnelId: t.Hops[0].TunnelId,
+		Payload:  payload,
+	})
+}
+
+// initiated reports whether we initiated the tunnel. A hidden service
+// answers the tunnels it joins to its clients like a destination would.
+func (t *Tunnel) initiated() bool {
+
+	var joined *rendezvous
+
+	joined = t.joined.Load()
+	return t.circuit == nil && (joined == nil || !joined.service)
+}
+
+// sessionIds lists the sessions of the hops from the destination to the
+// first hop, whose layer is the outermost.
+func (t *Tunnel) sessionIds() []uint32 {
+
+	var ids []uint32
+
+	ids = make([]uint32, len(t.Hops))
+	for i, hop := range t.Hops {
+		ids[len(t.Hops)-1-i] = hop.SessionId
+	}
+	return ids
+}
+
+// Destination returns the last hop of the tunnel.
+func (t *Tunnel) Destination() *Hop {
+
+	if len(t.Hops) == 0 {
+		return nil
+	}
+	return t.Hops[len(t.Hops)-1]
+}
+
 func (t *Tunnel) CreateTunnelReady() (*msg.OnionTunnelReady, error) {
 
 	var tunnelReady *msg.OnionTunnelReady
+	var destination *Hop
+
+	if destination = t.Destination(); destination == nil {
+		return nil, errors.New("The tunnel has no destination")
+	}
 
 	tunnelReady = &msg.OnionTunnelReady{
-		TunnelId: t.Id,
+		TunnelId:   t.Id,
+		DstHostkey: destination.Hostkey,
 	}
 	return tunnelReady, nil
 }
@@ -61,20 +281,20 @@ func (o *Onion) localUnusedTunnelId() (uint32, error) {
 	var alreadyInUse bool
 	var count int
 
-	seed := time.Now().UnixNano()
-	source := rand.NewSource(seed)
-	rng := rand.New(source)
+	o.lock.Lock()
+	defer o.lock.Unlock()
 
-	id = rng.Uint32()
-	count = 1
+	count = 0
 	for {
 		if count == MaximumTunnelIdAttempts {
 			return 0, errors.New("Could not generate a new tunnel id")
 		}
+		if err := binary.Read(o.random, binary.BigEndian, &id); err != nil {
+			return 0, err
+		}
 		if _, alreadyInUse = o.Tunnels[id]; !alreadyInUse {
 			break
 		}
-		id = rng.Uint32()
 		count = count + 1
 	}
 	return id, nil
@@ -94,7 +314,7 @@ func (o *Onion) repackageHandshake1(m *msg.AuthSessionHS1) *msg.AuthSessionIncom
 	return repackaged
 }
 
-func (o *Onion) repackageHandshake2(sessionId uint32, m *msg.AuthHandshake2) (*msg.AuthSessionIncomingHS2, error) {
+func (o *Onion) repackageHandshake2(sessionId uint32, m msg.Message) (*msg.AuthSessionIncomingHS2, error) {
 
 	var buf *bytes.Buffer
 	var repackaged msg.AuthSessionIncomingHS2
@@ -132,34 +352,90 @@ func (o *Onion) packageIncomingHandshake2(sessionId uint32, m msg.Message) (*msg
 
 	return incoming, nil
 }
+
+// BuildTunnel builds a tunnel to the destination through hopCount
+// intermediate hops sampled from the RPS module. When hopCount is zero, the
+// configured hop count is used. It is never lower than the minimal hop count.
 func (o *Onion) BuildTunnel(hopCount int, hostport string, hostkey []byte) (*msg.OnionTunnelReady, error) {
 
 	var tunnelReady *msg.OnionTunnelReady
+	var tunnel *Tunnel
+	var begin msg.OnionBegin
 	var err error
+
+	o.lock.Lock()
+	_, err = io.ReadFull(o.random, begin.Token[:])
+	o.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if tunnel, err = o.buildTunnel(hopCount, hostport, hostkey, begin); err != nil {
+		return nil, err
+	}
+	tunnel.token = begin.Token
+
+	if tunnelReady, err = tunnel.CreateTunnelReady(); err != nil {
+		return nil, err
+	}
+
+	o.storeTunnel(tunnel)
+	return tunnelReady, nil
+}
+
+// buildTunnel builds the tunnel and sends the first message through it, if
+// any.
+func (o *Onion) buildTunnel(hopCount int, hostport string, hostkey []byte, first msg.Message) (*Tunnel, error) {
+
 	var tunnel *Tunnel
+	var peers []p2pnet.Peer
+	var err error
+
+	if hopCount <= 0 {
+		hopCount = o.HopCount
+	}
+	if hopCount < o.MinimalHopCount {
+		hopCount = o.MinimalHopCount
+	}
 
 	if tunnel, err = NewTunnel(o); err != nil {
 		return nil, err
 	}
 
-	// for _, i := range hopCount {
-	// 		Building minim hops
-	//		if err = tunnel.AddLink(randomHostport, randomHostkey); err != nil {
-	//			return err
-	//		}
-	// }
+	if peers, err = o.selectPath(hopCount, hostport, hostkey); err != nil {
+		return nil, err
+	}
 
-	// Add the final link
-	if err = tunnel.AddLink(hostport, hostkey); err != nil {
+	// Tear down whatever part of the tunnel was built if it fails.
+	if err = tunnel.build(peers, hostport, hostkey, first); err != nil {
 		fmt.Println(err)
+		o.DestroyTunnel(tunnel)
 		return nil, err
 	}
+	return tunnel, nil
+}
 
-	if tunnelReady, err = tunnel.CreateTunnelReady(); err != nil {
-		return nil, err
+// build extends the tunnel through the peers to the destination.
+func (t *Tunnel) build(peers []p2pnet.Peer, hostport string, hostkey []byte, first msg.Message) error {
+
+	var err error
+
+	for _, peer := range peers {
+		if err = t.AddLink(peerHostport(peer), peer.Hostkey); err != nil {
+			return err
+		}
 	}
 
-	return tunnelReady, nil
+	// Add the final link
+	if err = t.AddLink(hostport, hostkey); err != nil {
+		return err
+	}
+
+	// The first message tells the destination the tunnel ends there.
+	if first == nil {
+		return nil
+	}
+	return t.Send(first)
 }
 
 func (o *Onion) requestHandshake1(hostkey []byte) (*msg.AuthSessionHS1, error) {
@@ -208,29 +484,47 @@ func (o *Onion) requestHandshake2(request *msg.AuthSessionIncomingHS1) (*msg.Aut
 	return &validResponse, nil
 }
 
-func (o *Onion) finalHandshake(hostport string, handshake1 *msg.AuthSessionIncomingHS1) (*msg.AuthHandshake2, error) {
+// handshakeExchange delivers our handshake to a hop and returns the hop's
+// answer.
+type handshakeExchange func(handshake1 []byte) ([]byte, error)
 
-	var response msg.Message
-	var validResponse msg.AuthHandshake2
-	var valid bool
+func (o *Onion) finalHandshake(exchange handshakeExchange, handshake1 *msg.AuthSessionIncomingHS1) (msg.Message, error) {
+
+	var buf *bytes.Buffer
+	var payload []byte
+	var handshake2 msg.Message
 	var err error
 
-	if response, err = requestFrom(hostport, handshake1); err != nil {
+	buf = new(bytes.Buffer)
+	if err = msg.Write(buf, handshake1); err != nil {
 		return nil, err
 	}
 
-	if validResponse, valid = response.(msg.AuthHandshake2); !valid {
-		return nil, errors.New("Invalid response expected AuthHandshake2")
+	if payload, err = exchange(buf.Bytes()); err != nil {
+		return nil, err
 	}
 
-	return &validResponse, nil
+	handshake2, err = msg.ReadExpected(bytes.NewReader(payload),
+		msg.AUTH_HANDSHAKE2, msg.AUTH_HANDSHAKE2_HYBRID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The remote answers with the handshake matching the negotiated
+	// key exchange.
+	switch handshake2.(type) {
+	case msg.AuthHandshake2, msg.AuthHandshake2Hybrid:
+		return handshake2, nil
+	default:
+		return nil, errors.New("Invalid response expected AuthHandshake2")
+	}
 }
 
-func (o *Onion) buildSession(hostport string, hostkey []byte) error {
+func (o *Onion) buildSession(hostkey []byte, exchange handshakeExchange) (uint32, error) {
 
 	var handshake1 *msg.AuthSessionHS1
 	var repackaged1 *msg.AuthSessionIncomingHS1
-	var handshake2 *msg.AuthHandshake2
+	var handshake2 msg.Message
 	var repackaged2 *msg.AuthSessionIncomingHS2
 	var response msg.Message
 	var sessionId uint32
@@ -238,38 +532,45 @@ func (o *Onion) buildSession(hostport string, hostkey []byte) error {
 
 	// Start the session with our Auth module
 	if handshake1, err = o.requestHandshake1(hostkey); err != nil {
-		return err
+		return 0, err
 	}
 
-	// Save the session Id and hostport.
+	// Save the session Id.
 	sessionId = handshake1.SessionId
 	o.storeSession(sessionId, hostkey)
-	o.storeIdentity(hostport, hostkey)
+
+	// A session whose handshake failed is of no use to either module.
+	defer func() {
+		if err != nil {
+			o.closeSession(sessionId)
+		}
+	}()
 
 	// Repackage the handshake to send it.
 	repackaged1 = o.repackageHandshake1(handshake1)
 
 	// Request the handshake2 from the remote.
-	if handshake2, err = o.finalHandshake(hostport, repackaged1); err != nil {
-		return err
+	if handshake2, err = o.finalHandshake(exchange, repackaged1); err != nil {
+		return 0, err
 	}
 
 	// Repackage the response and send it to auth.
 	if repackaged2, err = o.repackageHandshake2(sessionId, handshake2); err != nil {
-		return err
+		return 0, err
 	}
 
 	// Send the final handshake to the Auth module.
 	if response, err = requestFrom(o.AuthAddr, repackaged2); err != nil {
-		return err
+		return 0, err
 	}
 
 	// Check the message type session confirmed.
 	if response.TypeId() != msg.AUTH_SESSION_CONFIRMED {
-		return errors.New("Session has been denied.")
+		err = errors.New("Session has been denied.")
+		return 0, err
 	}
 
-	return nil
+	return sessionId, nil
 }
 
 // Send a message and waits for the response.
@@ -310,6 +611,10 @@ func (o *Onion) storeIdentity(hostport string, hostkey []byte) {
 
 	var identity p2pnet.Identity
 	identity = p2pnet.GetIdentity(hostkey)
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
 	o.Peers[identity] = hostport
 }
 
@@ -317,5 +622,29 @@ func (o *Onion) storeSession(id uint32, hostkey []byte) {
 
 	var identity p2pnet.Identity
 	identity = p2pnet.GetIdentity(hostkey)
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
 	o.Sessions[id] = identity
 }
+
+func (o *Onion) storeTunnel(tunnel *Tunnel) {
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.Tunnels[tunnel.Id] = tunnel
+}
+
+func (o *Onion) tunnel(id uint32) (*Tunnel, bool) {
+
+	var tunnel *Tunnel
+	var present bool
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	tunnel, present = o.Tunnels[id]
+	return tunnel, present
+}
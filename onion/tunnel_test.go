@@ -0,0 +1,94 @@
+package onion
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/limoges/p2pnet"
+	"github.com/limoges/p2pnet/msg"
+)
+
+// A tunnel goes through distinct intermediate hops sampled from the RPS
+// module, none of which is the source or the destination.
+func TestBuildTunnel(t *testing.T) {
+
+	var peers []*testPeer
+	var response msg.Message
+	var ready msg.OnionTunnelReady
+	var tunnel *Tunnel
+	var valid bool
+	var err error
+
+	peers = startNetwork(t, 5, "")
+	conn := dialAPI(t, peers[0])
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if response, err = msg.SendReceive(conn, buildMsg(peers[4])); err != nil {
+		t.Fatal(err)
+	}
+	if ready, valid = response.(msg.OnionTunnelReady); !valid {
+		t.Fatalf("unexpected response %v", msg.Identifier(response.TypeId()))
+	}
+	if !bytes.Equal(ready.DstHostkey, peers[4].Onion.Hostkey) {
+		t.Fatal("the tunnel does not lead to the destination")
+	}
+
+	peers[0].Onion.lock.Lock()
+	tunnel = peers[0].Onion.Tunnels[ready.TunnelId]
+	peers[0].Onion.lock.Unlock()
+	if tunnel == nil || len(tunnel.Hops) != 3 {
+		t.Fatalf("expected 2 intermediate hops and the destination, got %v", tunnel)
+	}
+
+	seen := map[p2pnet.Identity]bool{
+		p2pnet.GetIdentity(peers[0].Onion.Hostkey): true,
+		p2pnet.GetIdentity(peers[4].Onion.Hostkey): true,
+	}
+	for _, hop := range tunnel.Hops[:2] {
+		if identity := p2pnet.GetIdentity(hop.Hostkey); seen[identity] {
+			t.Fatalf("the hop %v appears twice in the tunnel", hop.Hostport)
+		} else {
+			seen[identity] = true
+		}
+	}
+}
+
+// A tunnel cannot be built when the RPS module knows too few peers.
+func TestBuildTunnelNotEnoughPeers(t *testing.T) {
+
+	var peers []*testPeer
+	var err error
+
+	peers = startNetwork(t, 2, "")
+	if _, err = peers[0].Onion.BuildTunnel(2, peers[1].Onion.ListenAddr, peers[1].Onion.Hostkey); err != ErrNotEnoughPeers {
+		t.Fatalf("expected %v, got %v", ErrNotEnoughPeers, err)
+	}
+}
+
+// When a hop declines the handshake, the tunnel is not built and neither our
+// module nor our Auth module keeps the session.
+func TestBuildTunnelDeclined(t *testing.T) {
+
+	var peers []*testPeer
+	var err error
+
+	peers = startNetworkEach(t, 3, func(i int) string {
+		if i == 0 {
+			return "\n[ONION_AUTHENTICATION]\nkey_exchange = hybrid-only\n"
+		}
+		return ""
+	})
+	if _, err = peers[0].Onion.BuildTunnel(1, peers[2].Onion.ListenAddr, peers[2].Onion.Hostkey); err == nil {
+		t.Fatal("the tunnel was built with a peer without the hybrid exchange")
+	}
+
+	peers[0].Onion.lock.Lock()
+	sessions := len(peers[0].Onion.Sessions)
+	peers[0].Onion.lock.Unlock()
+	if sessions != 0 {
+		t.Fatalf("%v sessions are left", sessions)
+	}
+	waitFor(t, "the Auth module to forget the session", func() bool {
+		return len(peers[0].Auth.ListSessions()) == 0
+	})
+}
@@ -2,12 +2,22 @@ package p2pnet
 
 import (
 	"crypto/sha256"
+	"encoding/base32"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"strings"
 )
 
+// The domain of the pseudo-hostnames naming peers by their identity.
+const HostnameDomain = "p2pnet"
+
+// Pseudo-hostnames use lowercase base32, which fits a digest in a single DNS
+// label unlike hexadecimal.
+var hostnameEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
 // Represents the identity of a peer. It corresponds to the SHA256 checksum of
 // the peer's hostkey.
 type Identity string
@@ -20,6 +30,64 @@ func GetIdentity(hostkey []byte) Identity {
 	return Identity(hex.EncodeToString(sum[:]))
 }
 
+// IdentityFromDigest converts a raw SHA256 checksum, as transmitted in
+// messages, into an Identity.
+func IdentityFromDigest(sum [sha256.Size]byte) Identity {
+	return Identity(hex.EncodeToString(sum[:]))
+}
+
+// Digest returns the raw SHA256 checksum represented by the identity.
+func (i Identity) Digest() ([sha256.Size]byte, error) {
+
+	var sum [sha256.Size]byte
+	var decoded []byte
+	var err error
+
+	if decoded, err = hex.DecodeString(string(i)); err != nil {
+		return sum, err
+	}
+	if len(decoded) != sha256.Size {
+		return sum, errors.New("Identity is not a SHA256 checksum")
+	}
+	copy(sum[:], decoded)
+	return sum, nil
+}
+
+// Hostname returns the pseudo-hostname naming the peer with the identity.
+func (i Identity) Hostname() (string, error) {
+
+	var sum [sha256.Size]byte
+	var err error
+
+	if sum, err = i.Digest(); err != nil {
+		return "", err
+	}
+	return hostnameEncoding.EncodeToString(sum[:]) + "." + HostnameDomain, nil
+}
+
+// IdentityFromHostname returns the identity named by the pseudo-hostname.
+func IdentityFromHostname(hostname string) (Identity, error) {
+
+	var label string
+	var found bool
+	var decoded []byte
+	var sum [sha256.Size]byte
+	var err error
+
+	hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+	if label, found = strings.CutSuffix(hostname, "."+HostnameDomain); !found {
+		return "", errors.New("Not a peer hostname: " + hostname)
+	}
+	if decoded, err = hostnameEncoding.DecodeString(label); err != nil {
+		return "", err
+	}
+	if len(decoded) != sha256.Size {
+		return "", errors.New("Not a peer hostname: " + hostname)
+	}
+	copy(sum[:], decoded)
+	return IdentityFromDigest(sum), nil
+}
+
 type SessionId uint32
 
 type Session struct {
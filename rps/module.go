@@ -1,6 +1,7 @@
 package rps
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
@@ -72,12 +73,17 @@ func (r *RPS) getRandomPeer() (p2pnet.Peer, error) {
 	source := rand.NewSource(seed)
 	rng := rand.New(source)
 
+	if len(r.PeersByIP) == 0 {
+		return p2pnet.Peer{}, errors.New("No peer is known")
+	}
+
 	peerNo := rng.Intn(len(r.PeersByIP))
 	i := 0
 	for key := range r.PeersByIP {
 		if i == peerNo {
 			return r.PeersByIP[key], nil
 		}
+		i = i + 1
 	}
 	return p2pnet.Peer{}, nil
 }
@@ -98,5 +104,5 @@ func (r *RPS) ReplyWithRandomPeer(source net.Conn) error {
 	}
 	copy(response.IPAddr[:], peer.IPAddr)
 
-	return msg.WriteMessage(source, response)
+	return msg.Send(source, response)
 }
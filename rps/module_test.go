@@ -0,0 +1,85 @@
+package rps
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/limoges/p2pnet"
+	"github.com/limoges/p2pnet/msg"
+)
+
+func newTestRPS(count int) *RPS {
+
+	var r *RPS
+
+	r = &RPS{
+		PeersByIP:      make(map[string]p2pnet.Peer),
+		PeersByHostkey: make(map[string]p2pnet.Peer),
+	}
+	for i := 0; i < count; i++ {
+		peer := p2pnet.Peer{
+			Port:    uint16(7000 + i),
+			IPAddr:  net.IPv4(10, 0, 0, byte(i)).To16(),
+			Hostkey: []byte{byte(i), 1, 2, 3},
+		}
+		r.PeersByIP[net.IP(peer.IPAddr).String()] = peer
+		r.PeersByHostkey[string(peer.Hostkey)] = peer
+	}
+	return r
+}
+
+// Every known peer may be drawn, and none is drawn when no peer is known.
+func TestGetRandomPeer(t *testing.T) {
+
+	var drawn map[uint16]bool
+	var peer p2pnet.Peer
+	var err error
+
+	if _, err = newTestRPS(0).getRandomPeer(); err == nil {
+		t.Fatal("drew a peer out of none")
+	}
+
+	r := newTestRPS(3)
+	drawn = make(map[uint16]bool)
+	for i := 0; i < 300 && len(drawn) < 3; i++ {
+		if peer, err = r.getRandomPeer(); err != nil {
+			t.Fatal(err)
+		}
+		if peer.Hostkey == nil {
+			t.Fatal("drew an empty peer")
+		}
+		drawn[peer.Port] = true
+	}
+	if len(drawn) != 3 {
+		t.Fatalf("drew %v of the 3 peers", len(drawn))
+	}
+}
+
+// The answer to a query decodes into the peer that was drawn.
+func TestReplyWithRandomPeer(t *testing.T) {
+
+	var client, server net.Conn
+	var response msg.Message
+	var peer msg.RPSPeer
+	var valid bool
+	var err error
+
+	client, server = net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	r := newTestRPS(1)
+	go r.Handle(server, msg.RPSQuery{})
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if response, err = msg.Read(client); err != nil {
+		t.Fatal(err)
+	}
+	if peer, valid = response.(msg.RPSPeer); !valid {
+		t.Fatalf("unexpected response %v", msg.Identifier(response.TypeId()))
+	}
+	if peer.Port != 7000 || !net.IP(peer.IPAddr[:]).Equal(net.IPv4(10, 0, 0, 0)) || !bytes.Equal(peer.Hostkey, []byte{0, 1, 2, 3}) {
+		t.Fatalf("unexpected peer %#v", peer)
+	}
+}
@@ -0,0 +1,402 @@
+// Package sdk lets applications use the onion API of a peer. Tunnels are
+// built through the API connection, and the streams multiplexed inside them
+// are exposed as net.Conn.
+package sdk
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/limoges/p2pnet/msg"
+)
+
+// The largest amount of data sent in a single ONION_STREAM_DATA.
+const MaximumSegmentSize = 4096
+
+// The number of incoming streams kept until they are accepted. The streams
+// arriving while the backlog is full are refused.
+const IncomingBacklog = 16
+
+var (
+	ErrClientClosed  = errors.New("The client has been closed")
+	ErrRequestFailed = errors.New("The onion module could not fulfill the request")
+)
+
+// Client is a connection to the onion API of a peer.
+type Client struct {
+	conn net.Conn
+
+	// Requests are answered in order, one at a time.
+	requests  sync.Mutex
+	request   uint16
+	responses chan msg.Message
+
+	streams  map[streamKey]*Stream
+	incoming chan *Stream
+	closed   chan struct{}
+	lock     sync.Mutex
+
+	// Whether the client only uses the tunnels it builds.
+	outgoing bool
+}
+
+type streamKey struct {
+	tunnelId uint32
+	streamId uint16
+}
+
+// Dial connects to the onion API at the address.
+func Dial(apiAddr string) (*Client, error) {
+
+	var conn net.Conn
+	var err error
+
+	if conn, err = net.Dial("tcp", apiAddr); err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// DialOutgoing connects to the onion API at the address, for a client which
+// only uses the tunnels it builds.
+func DialOutgoing(apiAddr string) (*Client, error) {
+
+	var conn net.Conn
+	var err error
+
+	if conn, err = net.Dial("tcp", apiAddr); err != nil {
+		return nil, err
+	}
+	return NewOutgoingClient(conn), nil
+}
+
+// NewClient uses the connection to an onion API.
+func NewClient(conn net.Conn) *Client {
+	return newClient(conn, false)
+}
+
+// NewOutgoingClient uses the connection to an onion API, without subscribing
+// to the tunnels other peers build to us. Accept never returns a stream.
+func NewOutgoingClient(conn net.Conn) *Client {
+	return newClient(conn, true)
+}
+
+func newClient(conn net.Conn, outgoing bool) *Client {
+
+	var c *Client
+
+	c = &Client{
+		conn:      conn,
+		responses: make(chan msg.Message, 1),
+		streams:   make(map[streamKey]*Stream),
+		incoming:  make(chan *Stream, IncomingBacklog),
+		closed:    make(chan struct{}),
+		outgoing:  outgoing,
+	}
+	go c.receive()
+	return c
+}
+
+// Build builds a tunnel to the peer at hostport with the hostkey, and returns
+// the tunnel's id.
+func (c *Client) Build(hostport string, hostkey []byte) (uint32, error) {
+
+	var host, portString string
+	var port int
+	var ip net.IP
+	var err error
+
+	if host, portString, err = net.SplitHostPort(hostport); err != nil {
+		return 0, err
+	}
+	if port, err = strconv.Atoi(portString); err != nil {
+		return 0, err
+	}
+	if ip = net.ParseIP(host).To16(); ip == nil {
+		return 0, errors.New("Invalid IP address " + host)
+	}
+
+	return c.build(msg.OnionTunnelBuild{
+		Port:       uint16(port),
+		IPAddr:     ip,
+		DstHostkey: hostkey,
+	})
+}
+
+// BuildHidden builds a tunnel to the hidden service with the hostkey, and
+// returns the tunnel's id.
+func (c *Client) BuildHidden(hostkey []byte) (uint32, error) {
+	return c.build(msg.OnionTunnelBuild{
+		IPAddr:     net.IPv6unspecified,
+		DstHostkey: hostkey,
+	})
+}
+
+func (c *Client) build(request msg.OnionTunnelBuild) (uint32, error) {
+
+	var response msg.Message
+	var ready msg.OnionTunnelReady
+	var valid bool
+	var err error
+
+	if response, err = c.send(request); err != nil {
+		return 0, err
+	}
+	if ready, valid = response.(msg.OnionTunnelReady); !valid {
+		return 0, ErrRequestFailed
+	}
+	return ready.TunnelId, nil
+}
+
+// Open opens a new stream in the tunnel, to the default service of the other
+// end.
+func (c *Client) Open(tunnelId uint32) (*Stream, error) {
+	return c.OpenService(tunnelId, "")
+}
+
+// OpenService opens a new stream in the tunnel, to the named service of the
+// other end.
+func (c *Client) OpenService(tunnelId uint32, service string) (*Stream, error) {
+
+	var response msg.Message
+	var ready msg.OnionStreamReady
+	var stream *Stream
+	var valid bool
+	var err error
+
+	response, err = c.send(msg.OnionStreamOpen{
+		TunnelID: tunnelId,
+		Service:  []byte(service),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ready, valid = response.(msg.OnionStreamReady); !valid {
+		return nil, ErrRequestFailed
+	}
+	if stream = c.stream(ready.TunnelID, ready.StreamID); stream == nil {
+		return nil, ErrRequestFailed
+	}
+	return stream, nil
+}
+
+// Accept waits for the other end of one of our tunnels to open a stream.
+func (c *Client) Accept() (*Stream, error) {
+
+	select {
+	case stream := <-c.incoming:
+		return stream, nil
+	case <-c.closed:
+		return nil, ErrClientClosed
+	}
+}
+
+// Destroy releases our interest in the tunnel.
+func (c *Client) Destroy(tunnelId uint32) error {
+	return c.write(msg.OnionTunnelDestroy{TunnelID: tunnelId})
+}
+
+// subscribe asks for the streams of the tunnel another peer built to us.
+func (c *Client) subscribe(tunnelId uint32) error {
+	return c.write(msg.OnionTunnelSubscribe{TunnelID: tunnelId})
+}
+
+// Close closes the connection to the API, and all the streams with it.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// send sends a request and waits for its answer. The module answers a
+// failed request with ONION_ERROR.
+func (c *Client) send(request msg.Message) (msg.Message, error) {
+
+	var response msg.Message
+
+	c.requests.Lock()
+	defer c.requests.Unlock()
+
+	c.lock.Lock()
+	c.request = request.TypeId()
+	c.lock.Unlock()
+
+	if err := c.write(request); err != nil {
+		return nil, err
+	}
+
+	select {
+	case response = <-c.responses:
+	case <-c.closed:
+		return nil, ErrClientClosed
+	}
+
+	if failure, failed := response.(msg.OnionError); failed {
+		return nil, fmt.Errorf("%w: %v", ErrRequestFailed, msg.Identifier(failure.RequestType))
+	}
+	return response, nil
+}
+
+func (c *Client) write(message msg.Message) error {
+	return msg.Send(c.conn, message)
+}
+
+// receive dispatches the messages of the module until the connection closes.
+func (c *Client) receive() {
+
+	var message msg.Message
+	var err error
+
+	defer c.shutdown()
+
+	for {
+		if message, err = msg.Receive(c.conn); err != nil {
+			return
+		}
+
+		switch message.(type) {
+		case msg.OnionTunnelReady:
+			c.respond(message)
+		case msg.OnionStreamReady:
+			// The stream must be known before its first data arrives.
+			m := message.(msg.OnionStreamReady)
+			c.storeStream(m.TunnelID, m.StreamID, "")
+			c.respond(message)
+		case msg.OnionError:
+			m := message.(msg.OnionError)
+			c.receiveError(&m)
+		case msg.OnionTunnelIncoming:
+			m := message.(msg.OnionTunnelIncoming)
+			// Writing may wait for the module, which may wait for us.
+			if !c.outgoing {
+				go c.subscribe(m.TunnelID)
+			}
+		case msg.OnionStreamIncoming:
+			m := message.(msg.OnionStreamIncoming)
+			if !c.outgoing {
+				c.acceptIncoming(c.storeStream(m.TunnelID, m.StreamID, string(m.Service)))
+			}
+		case msg.OnionStreamData:
+			m := message.(msg.OnionStreamData)
+			if stream := c.stream(m.TunnelID, m.StreamID); stream != nil && !stream.receive(m.Data) {
+				fmt.Printf("Stream %v overflowed\n", stream.LocalAddr())
+				c.refuse(stream)
+			}
+		case msg.OnionStreamClose:
+			m := message.(msg.OnionStreamClose)
+			if stream := c.removeStream(m.TunnelID, m.StreamID); stream != nil {
+				stream.remoteClose()
+			}
+		}
+	}
+}
+
+// acceptIncoming queues the stream for Accept, or refuses it if the backlog
+// is full.
+func (c *Client) acceptIncoming(stream *Stream) {
+
+	select {
+	case c.incoming <- stream:
+	default:
+		fmt.Printf("Refusing stream %v: the backlog is full\n", stream.LocalAddr())
+		c.refuse(stream)
+	}
+}
+
+// refuse forgets the stream and closes it at the other end. The receiving
+// goroutine must not wait for the module, which may be waiting for it.
+func (c *Client) refuse(stream *Stream) {
+
+	if c.removeStream(stream.tunnelId, stream.id) == nil {
+		// The stream has been closed in the meantime.
+		return
+	}
+	go c.write(msg.OnionStreamClose{
+		TunnelID: stream.tunnelId,
+		StreamID: stream.id,
+	})
+}
+
+func (c *Client) respond(response msg.Message) {
+
+	c.lock.Lock()
+	c.request = 0
+	c.lock.Unlock()
+
+	c.responses <- response
+}
+
+// receiveError answers the request in progress, or closes the streams of a
+// tunnel which has been torn down.
+func (c *Client) receiveError(m *msg.OnionError) {
+
+	var pending bool
+
+	c.lock.Lock()
+	pending = c.request != 0 && c.request == m.RequestType
+	c.lock.Unlock()
+
+	if pending {
+		c.respond(*m)
+		return
+	}
+
+	if m.RequestType != msg.ONION_TUNNEL_DESTROY {
+		return
+	}
+	c.lock.Lock()
+	for key, stream := range c.streams {
+		if key.tunnelId == m.TunnelID {
+			delete(c.streams, key)
+			stream.remoteClose()
+		}
+	}
+	c.lock.Unlock()
+}
+
+func (c *Client) shutdown() {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	close(c.closed)
+	for key, stream := range c.streams {
+		delete(c.streams, key)
+		stream.remoteClose()
+	}
+}
+
+func (c *Client) storeStream(tunnelId uint32, streamId uint16, service string) *Stream {
+
+	var stream *Stream
+
+	stream = newStream(c, tunnelId, streamId)
+	stream.service = service
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.streams[streamKey{tunnelId, streamId}] = stream
+	return stream
+}
+
+func (c *Client) stream(tunnelId uint32, streamId uint16) *Stream {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.streams[streamKey{tunnelId, streamId}]
+}
+
+func (c *Client) removeStream(tunnelId uint32, streamId uint16) *Stream {
+
+	var stream *Stream
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stream = c.streams[streamKey{tunnelId, streamId}]
+	delete(c.streams, streamKey{tunnelId, streamId})
+	return stream
+}
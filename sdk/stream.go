@@ -0,0 +1,303 @@
+package sdk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/limoges/p2pnet/msg"
+)
+
+// The number of segments kept for a stream until they are read. The client
+// keeps reading from the API connection for the other streams, so a stream
+// whose buffer overflows is closed instead.
+const StreamBuffer = 64
+
+var (
+	ErrStreamOverflow = errors.New("The stream was not read fast enough and has been closed")
+)
+
+// Stream is a stream multiplexed inside a tunnel. It implements net.Conn.
+type Stream struct {
+	client   *Client
+	tunnelId uint32
+	id       uint16
+	service  string
+
+	// Filled by the client, and closed when the other end closes the stream
+	// or it overflows.
+	data     chan []byte
+	pending  []byte
+	overflow bool
+
+	// The result of a write which missed its deadline, while it is still in
+	// progress.
+	writing chan error
+	writer  sync.Mutex
+
+	done          chan struct{}
+	closeOnce     sync.Once
+	readDeadline  time.Time
+	writeDeadline time.Time
+	lock          sync.Mutex
+}
+
+// Addr identifies a stream. Both ends of a stream see the same address.
+type Addr struct {
+	TunnelId uint32
+	StreamId uint16
+}
+
+func (a Addr) Network() string {
+	return "onion"
+}
+
+func (a Addr) String() string {
+	return fmt.Sprintf("%v/%v", a.TunnelId, a.StreamId)
+}
+
+func newStream(client *Client, tunnelId uint32, id uint16) *Stream {
+	return &Stream{
+		client:   client,
+		tunnelId: tunnelId,
+		id:       id,
+		data:     make(chan []byte, StreamBuffer),
+		done:     make(chan struct{}),
+	}
+}
+
+// TunnelId returns the id of the tunnel the stream belongs to.
+func (s *Stream) TunnelId() uint32 {
+	return s.tunnelId
+}
+
+// Service returns the name of the service the other end opened the stream
+// for. It is empty for the default service and for the streams we opened.
+func (s *Stream) Service() string {
+	return s.service
+}
+
+// Read reads the data the other end wrote. It returns io.EOF once the other
+// end closed the stream, and ErrStreamOverflow once the data buffered before
+// an overflow has been read.
+func (s *Stream) Read(p []byte) (int, error) {
+
+	var timeout <-chan time.Time
+	var segment []byte
+	var open bool
+	var n int
+
+	if len(s.pending) == 0 {
+		s.lock.Lock()
+		if !s.readDeadline.IsZero() {
+			timer := time.NewTimer(time.Until(s.readDeadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		s.lock.Unlock()
+
+		select {
+		case segment, open = <-s.data:
+			if !open {
+				return 0, s.closedError()
+			}
+			s.pending = segment
+		case <-s.done:
+			return 0, net.ErrClosed
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+
+	n = copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// Write sends the data to the other end. It blocks while the onion module
+// holds the stream back, until the write deadline.
+func (s *Stream) Write(p []byte) (int, error) {
+
+	var chunk []byte
+	var written int
+
+	s.writer.Lock()
+	defer s.writer.Unlock()
+
+	for len(p) > 0 {
+		select {
+		case <-s.done:
+			return written, net.ErrClosed
+		default:
+		}
+
+		chunk = p
+		if len(chunk) > MaximumSegmentSize {
+			chunk = chunk[:MaximumSegmentSize]
+		}
+		err := s.write(msg.OnionStreamData{
+			TunnelID: s.tunnelId,
+			StreamID: s.id,
+			Data:     chunk,
+		})
+		if err != nil {
+			return written, err
+		}
+		written = written + len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// write sends the message to the module before the write deadline. The
+// connection to the API is shared with the other streams, so a message which
+// missed the deadline is still sent whole once the module takes it, and the
+// following writes wait for it. The writer lock must be held.
+func (s *Stream) write(message msg.Message) error {
+
+	var deadline time.Time
+	var timeout <-chan time.Time
+	var err error
+
+	s.lock.Lock()
+	deadline = s.writeDeadline
+	s.lock.Unlock()
+
+	if !deadline.IsZero() {
+		if !time.Now().Before(deadline) {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	if s.writing != nil {
+		select {
+		case err = <-s.writing:
+			s.writing = nil
+			if err != nil {
+				return err
+			}
+		case <-timeout:
+			return os.ErrDeadlineExceeded
+		}
+	}
+
+	if timeout == nil {
+		return s.client.write(message)
+	}
+
+	s.writing = make(chan error, 1)
+	go func(writing chan<- error) {
+		writing <- s.client.write(message)
+	}(s.writing)
+
+	select {
+	case err = <-s.writing:
+		s.writing = nil
+		return err
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// Close closes the stream at both ends.
+func (s *Stream) Close() error {
+
+	var err error
+
+	s.closeOnce.Do(func() {
+		close(s.done)
+		if s.client.removeStream(s.tunnelId, s.id) != nil {
+			err = s.client.write(msg.OnionStreamClose{
+				TunnelID: s.tunnelId,
+				StreamID: s.id,
+			})
+		}
+	})
+	return err
+}
+
+// remoteClose ends the data of the stream. Only the client's receiving
+// goroutine calls it.
+func (s *Stream) remoteClose() {
+	close(s.data)
+}
+
+// receive buffers data of the stream. Only the client's receiving goroutine
+// calls it. It reports whether the data fit in the buffer; the data ends
+// there otherwise.
+func (s *Stream) receive(data []byte) bool {
+
+	select {
+	case s.data <- data:
+		return true
+	case <-s.done:
+		return true
+	default:
+	}
+
+	s.lock.Lock()
+	s.overflow = true
+	s.lock.Unlock()
+
+	close(s.data)
+	return false
+}
+
+// closedError returns the error reads return once the data has ended.
+func (s *Stream) closedError() error {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.overflow {
+		return ErrStreamOverflow
+	}
+	return io.EOF
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+	return Addr{s.tunnelId, s.id}
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	return Addr{s.tunnelId, s.id}
+}
+
+// SetDeadline sets the deadline of the following reads and writes.
+func (s *Stream) SetDeadline(t time.Time) error {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.readDeadline = t
+	s.writeDeadline = t
+	return nil
+}
+
+// SetReadDeadline sets the deadline of the following reads.
+func (s *Stream) SetReadDeadline(t time.Time) error {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.readDeadline = t
+	return nil
+}
+
+// SetWriteDeadline sets the deadline of the following writes. A write which
+// misses it may still reach the other end.
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.writeDeadline = t
+	return nil
+}
@@ -0,0 +1,246 @@
+package sdk
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/limoges/p2pnet/msg"
+)
+
+// The tests stand in for the onion module at the other end of a pipe.
+
+func newTestClient(t *testing.T) (*Client, net.Conn) {
+
+	var module, conn net.Conn
+
+	module, conn = net.Pipe()
+	t.Cleanup(func() {
+		module.Close()
+		conn.Close()
+	})
+	return NewClient(conn), module
+}
+
+// send sends the message to the client, as the module.
+func send(t *testing.T, module net.Conn, message msg.Message) {
+
+	module.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err := msg.Write(module, message); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expectClose reads the message the client sent, which closes the stream.
+func expectClose(t *testing.T, module net.Conn, streamId uint16) {
+
+	var message msg.Message
+	var err error
+
+	module.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if message, err = msg.Read(module); err != nil {
+		t.Fatal(err)
+	}
+	if m, valid := message.(msg.OnionStreamClose); !valid || m.StreamID != streamId {
+		t.Fatalf("expected ONION_STREAM_CLOSE for stream %v, got %v", streamId, message)
+	}
+}
+
+func acceptTestStream(t *testing.T, c *Client, module net.Conn, streamId uint16) *Stream {
+
+	var stream *Stream
+	var err error
+
+	send(t, module, msg.OnionStreamIncoming{TunnelID: 1, StreamID: streamId})
+	if stream, err = c.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	if stream.id != streamId {
+		t.Fatalf("accepted stream %v instead of %v", stream.id, streamId)
+	}
+	return stream
+}
+
+// A stream which is not read overflows and is closed, and the other streams
+// keep being served.
+func TestStreamOverflow(t *testing.T) {
+
+	var c *Client
+	var module net.Conn
+	var stream *Stream
+	var buffer []byte
+	var err error
+
+	c, module = newTestClient(t)
+	stream = acceptTestStream(t, c, module, 2)
+
+	for i := 0; i <= StreamBuffer; i++ {
+		send(t, module, msg.OnionStreamData{TunnelID: 1, StreamID: 2, Data: []byte{byte(i)}})
+	}
+	expectClose(t, module, 2)
+
+	// More data for the stream is ignored.
+	send(t, module, msg.OnionStreamData{TunnelID: 1, StreamID: 2, Data: []byte{0}})
+	acceptTestStream(t, c, module, 4)
+
+	buffer = make([]byte, 1)
+	for i := 0; i < StreamBuffer; i++ {
+		if _, err = stream.Read(buffer); err != nil {
+			t.Fatal(err)
+		}
+		if buffer[0] != byte(i) {
+			t.Fatalf("read %v instead of %v", buffer[0], i)
+		}
+	}
+	if _, err = stream.Read(buffer); err != ErrStreamOverflow {
+		t.Fatalf("expected %v, got %v", ErrStreamOverflow, err)
+	}
+
+	// The stream is only closed once.
+	if err = stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The streams arriving while the backlog is full are refused.
+func TestIncomingBacklog(t *testing.T) {
+
+	var c *Client
+	var module net.Conn
+	var stream *Stream
+	var err error
+
+	c, module = newTestClient(t)
+	for i := 1; i <= IncomingBacklog+1; i++ {
+		send(t, module, msg.OnionStreamIncoming{TunnelID: 1, StreamID: uint16(2 * i)})
+	}
+	expectClose(t, module, 2*(IncomingBacklog+1))
+
+	for i := 1; i <= IncomingBacklog; i++ {
+		if stream, err = c.Accept(); err != nil {
+			t.Fatal(err)
+		}
+		if stream.id != uint16(2*i) {
+			t.Fatalf("accepted stream %v instead of %v", stream.id, 2*i)
+		}
+	}
+}
+
+// A write the module does not take in time fails, and is sent before the
+// following writes once it does.
+func TestWriteDeadline(t *testing.T) {
+
+	var c *Client
+	var module net.Conn
+	var stream *Stream
+	var start time.Time
+	var written chan error
+	var err error
+
+	c, module = newTestClient(t)
+	stream = acceptTestStream(t, c, module, 2)
+
+	start = time.Now()
+	stream.SetWriteDeadline(start.Add(50 * time.Millisecond))
+	if _, err = stream.Write([]byte("first")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", os.ErrDeadlineExceeded, err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("the write took %v", time.Since(start))
+	}
+
+	// The deadline has passed.
+	if _, err = stream.Write([]byte("second")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", os.ErrDeadlineExceeded, err)
+	}
+
+	stream.SetDeadline(time.Time{})
+	written = make(chan error, 1)
+	go func() {
+		_, err := stream.Write([]byte("third"))
+		written <- err
+	}()
+
+	for _, expected := range []string{"first", "third"} {
+		module.SetReadDeadline(time.Now().Add(5 * time.Second))
+		message, err := msg.Read(module)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, valid := message.(msg.OnionStreamData)
+		if !valid || !bytes.Equal(data.Data, []byte(expected)) {
+			t.Fatalf("expected %q, got %v", expected, message)
+		}
+	}
+	if err = <-written; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The data ends with io.EOF once the other end closes the stream.
+func TestStreamRemoteClose(t *testing.T) {
+
+	var c *Client
+	var module net.Conn
+	var stream *Stream
+	var data []byte
+	var err error
+
+	c, module = newTestClient(t)
+	stream = acceptTestStream(t, c, module, 2)
+
+	send(t, module, msg.OnionStreamData{TunnelID: 1, StreamID: 2, Data: []byte("data")})
+	send(t, module, msg.OnionStreamClose{TunnelID: 1, StreamID: 2})
+	if data, err = io.ReadAll(stream); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "data" {
+		t.Fatalf("read %q", data)
+	}
+}
+
+// Opening a stream asks the module, and the stream writes its data to the
+// tunnel.
+func TestStreamOpen(t *testing.T) {
+
+	var c *Client
+	var module net.Conn
+	var opened chan *Stream
+	var stream *Stream
+	var message msg.Message
+	var err error
+
+	c, module = newTestClient(t)
+	opened = make(chan *Stream, 1)
+	go func() {
+		stream, err := c.Open(1)
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- stream
+	}()
+
+	module.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if message, err = msg.Read(module); err != nil {
+		t.Fatal(err)
+	}
+	if open, valid := message.(msg.OnionStreamOpen); !valid || open.TunnelID != 1 {
+		t.Fatalf("expected ONION_STREAM_OPEN for tunnel 1, got %v", message)
+	}
+	send(t, module, msg.OnionStreamReady{TunnelID: 1, StreamID: 3})
+	if stream = <-opened; stream == nil || stream.id != 3 {
+		t.Fatal("the stream was not opened")
+	}
+
+	go stream.Write([]byte("data"))
+	if message, err = msg.Read(module); err != nil {
+		t.Fatal(err)
+	}
+	if data, valid := message.(msg.OnionStreamData); !valid || data.StreamID != 3 || string(data.Data) != "data" {
+		t.Fatalf("expected the data of stream 3, got %v", message)
+	}
+}
@@ -0,0 +1,101 @@
+package p2pnet
+
+import (
+	"crypto/rand"
+	"io"
+	mrand "math/rand"
+	"sync"
+	"time"
+)
+
+// Clock provides the time to the modules. It is injected through the
+// module constructors so that time dependent behaviour can be reproduced.
+type Clock interface {
+	Now() time.Time
+	// Tick delivers the time every d.
+	Tick(d time.Duration) <-chan time.Time
+	// After delivers the time once, after d.
+	After(d time.Duration) <-chan time.Time
+}
+
+// SystemClock is the Clock backed by the time package.
+type SystemClock struct{}
+
+func (c SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c SystemClock) Tick(d time.Duration) <-chan time.Time {
+	return time.Tick(d)
+}
+
+func (c SystemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// FixedClock always reports the same time and never ticks. Its timers expire
+// at once, so that nothing waits forever for a time which never comes.
+type FixedClock struct {
+	Time time.Time
+}
+
+func (c FixedClock) Now() time.Time {
+	return c.Time
+}
+
+func (c FixedClock) Tick(d time.Duration) <-chan time.Time {
+	return nil
+}
+
+func (c FixedClock) After(d time.Duration) <-chan time.Time {
+
+	var expired chan time.Time
+
+	expired = make(chan time.Time, 1)
+	expired <- c.Time
+	return expired
+}
+
+// Sources holds the randomness and clock used by a module.
+type Sources struct {
+	Random io.Reader
+	Clock  Clock
+	// Seeded is set when Random is deterministic. The modules then draw from
+	// it even where they would otherwise use the system's randomness.
+	Seeded bool
+}
+
+// DefaultSources returns the sources used in production: the
+// cryptographically secure random number generator and the system clock.
+func DefaultSources() Sources {
+	return Sources{
+		Random: rand.Reader,
+		Clock:  SystemClock{},
+	}
+}
+
+// SeededSources returns deterministic sources. The same seed and time will
+// always produce the same random bytes and the same clock readings.
+// They must never be used outside of tests.
+func SeededSources(seed int64, now time.Time) Sources {
+	return Sources{
+		Random: &lockedReader{reader: mrand.New(mrand.NewSource(seed))},
+		Clock:  FixedClock{Time: now},
+		Seeded: true,
+	}
+}
+
+// lockedReader serializes the reads of a reader which is not safe for
+// concurrent use, such as the readers of math/rand.
+type lockedReader struct {
+	lock   sync.Mutex
+	reader io.Reader
+}
+
+func (r *lockedReader) Read(p []byte) (int, error) {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.reader.Read(p)
+}
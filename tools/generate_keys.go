@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/rand"
 	"crypto/rsa"
 	"fmt"
 	"io/ioutil"
@@ -20,7 +21,7 @@ func main() {
 	var err error
 
 	fmt.Println("Generating new public-private key pair...")
-	if priv, err = auth.GenerateKey(); err != nil {
+	if priv, err = auth.GenerateKey(rand.Reader); err != nil {
 		fmt.Println(err)
 		return
 	}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/rand"
 	"crypto/rsa"
 	"encoding/hex"
 	"fmt"
@@ -21,7 +22,7 @@ func main() {
 	secret = asymmetric()
 	hmac = generateHMAC()
 
-	if encrypted, err = auth.EncryptAESWithHMAC(plaintext, secret, hmac); err != nil {
+	if encrypted, err = auth.EncryptAESWithHMAC(rand.Reader, plaintext, secret, hmac); err != nil {
 		fmt.Println(err)
 		return
 	}
@@ -43,7 +44,7 @@ func generateHMAC() []byte {
 	var hmac []byte
 	var err error
 
-	if hmac, err = auth.GenerateNewSymmetricKey(); err != nil {
+	if hmac, err = auth.GenerateNewSymmetricKey(rand.Reader); err != nil {
 		panic(err)
 	}
 
@@ -58,16 +59,16 @@ func asymmetric() []byte {
 	var err error
 
 	fmt.Println("Generating RSA private key.")
-	if private, err = auth.GenerateKey(); err != nil {
+	if private, err = auth.GenerateKey(rand.Reader); err != nil {
 		panic(err)
 	}
 
-	if key, err = auth.GenerateNewSymmetricKey(); err != nil {
+	if key, err = auth.GenerateNewSymmetricKey(rand.Reader); err != nil {
 		panic(err)
 	}
 	fmt.Printf("Generated %v-bytes symmetric key.\n", len(key))
 
-	if encrypted, err = auth.EncryptPKCS(&private.PublicKey, key); err != nil {
+	if encrypted, err = auth.EncryptPKCS(rand.Reader, &private.PublicKey, key); err != nil {
 		panic(err)
 	}
 	fmt.Printf("Encrypted symmetric key. Encrypted length %v.\n", len(encrypted))
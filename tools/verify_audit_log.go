@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/rsa"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/limoges/p2pnet/auth"
+)
+
+func main() {
+
+	var filepath string
+	var keypath string
+	var pub *rsa.PublicKey
+	var count int
+	var err error
+
+	flag.Parse()
+
+	filepath = flag.Arg(0)
+	keypath = flag.Arg(1)
+	if len(filepath) == 0 || len(keypath) == 0 {
+		fmt.Println("Usage: verify_audit_log <audit log> <hostkey pem>")
+		os.Exit(2)
+	}
+
+	fmt.Printf("Reading hostkey from %v\n", keypath)
+	if pub, err = auth.ReadPEMPublicKey(keypath); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Verifying audit log %v\n", filepath)
+	if count, err = auth.VerifyAuditLog(filepath, pub); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("%v records verified.\n", count)
+}